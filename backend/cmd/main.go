@@ -7,18 +7,39 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
 	"airshare-backend/internal/config"
 	"airshare-backend/internal/discovery"
+	"airshare-backend/internal/room"
+	"airshare-backend/internal/security"
 	"airshare-backend/internal/server"
 	"airshare-backend/internal/transfer"
 )
 
+// 静态加密口令的环境变量，避免口令出现在配置文件或命令行中
+const (
+	storagePassphraseEnv    = "AIRSHARE_STORAGE_PASSPHRASE"
+	newStoragePassphraseEnv = "AIRSHARE_NEW_STORAGE_PASSPHRASE"
+)
+
 func main() {
 	var configPath string
+	var issueCert string
+	var issueToken, tokenScopes, revokeToken string
+	var tokenTTL time.Duration
+	var listTokens bool
+	var rekeyStorage bool
 	flag.StringVar(&configPath, "config", "config.yaml", "path to config file")
+	flag.StringVar(&issueCert, "issue-cert", "", "issue a client certificate signed by the AirShare CA for the given device ID and exit")
+	flag.StringVar(&issueToken, "issue-token", "", "issue an API token for the given device ID and exit")
+	flag.StringVar(&tokenScopes, "token-scopes", string(security.ScopeAdmin), "comma separated scopes for -issue-token (devices:read, transfer:send, transfer:receive, admin)")
+	flag.DurationVar(&tokenTTL, "token-ttl", 0, "lifetime of the token issued by -issue-token, 0 means no expiry")
+	flag.StringVar(&revokeToken, "revoke-token", "", "revoke the API token with the given ID and exit")
+	flag.BoolVar(&listTokens, "list-tokens", false, "list issued API tokens and exit")
+	flag.BoolVar(&rekeyStorage, "rekey-storage", false, "re-wrap encrypted files with the passphrase in "+newStoragePassphraseEnv+" and exit")
 	flag.Parse()
 
 	// 加载配置
@@ -27,16 +48,66 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	if issueCert != "" {
+		if err := issueClientCertificate(&cfg.Security, issueCert); err != nil {
+			log.Fatalf("Failed to issue certificate: %v", err)
+		}
+		return
+	}
+
+	if issueToken != "" || revokeToken != "" || listTokens {
+		if err := manageTokens(&cfg.Security, issueToken, tokenScopes, tokenTTL, revokeToken, listTokens); err != nil {
+			log.Fatalf("Failed to manage tokens: %v", err)
+		}
+		return
+	}
+
+	if rekeyStorage {
+		count, err := security.RekeyStorage(cfg.Transfer.StoragePath, os.Getenv(storagePassphraseEnv), os.Getenv(newStoragePassphraseEnv))
+		if err != nil {
+			log.Fatalf("Failed to rekey storage: %v", err)
+		}
+		fmt.Printf("Re-wrapped %d files, use the new passphrase in %s from now on\n", count, storagePassphraseEnv)
+		return
+	}
+
+	var storageVault *security.StorageVault
+	if cfg.Transfer.EncryptAtRest {
+		storageVault, err = security.OpenStorageVault(cfg.Transfer.StoragePath, os.Getenv(storagePassphraseEnv))
+		if err != nil {
+			log.Fatalf("Failed to open storage vault (set %s): %v", storagePassphraseEnv, err)
+		}
+	}
+
 	// 创建上下文（暂时未使用）
 
 	// 初始化服务
 	// 使用默认参数创建discoveryManager
 	discoveryManager := discovery.NewDiscoveryManager(5*time.Second, 30*time.Second, 100)
-	transferService, err := transfer.NewService(&cfg.Transfer)
+	transferService, err := transfer.NewService(&cfg.Transfer, storageVault)
 	if err != nil {
 		log.Fatalf("Failed to create transfer service: %v", err)
 	}
-	server := server.New(&cfg.Server, discoveryManager, transferService)
+	keyAlgorithm, err := security.ParseKeyAlgorithm(cfg.Security.KeyAlgorithm)
+	if err != nil {
+		log.Fatalf("Invalid key algorithm: %v", err)
+	}
+	encryptionService, err := security.NewEncryptionService(cfg.Security.KeyDir, keyAlgorithm)
+	if err != nil {
+		log.Fatalf("Failed to create encryption service: %v", err)
+	}
+	// 自动接收规则中的“已信任设备”以已固定公钥的设备为准
+	transferService.SetTrustCheck(encryptionService.IsTrusted)
+	tokenStore, err := security.LoadTokenStore(filepath.Join(cfg.Security.KeyDir, "tokens.json"))
+	if err != nil {
+		log.Fatalf("Failed to load token store: %v", err)
+	}
+	pairingService, err := security.NewPairingService(encryptionService, tokenStore)
+	if err != nil {
+		log.Fatalf("Failed to create pairing service: %v", err)
+	}
+	roomService := room.NewService(time.Duration(cfg.Server.RoomTTL) * time.Minute)
+	server := server.New(&cfg.Server, &cfg.Security, discoveryManager, transferService, encryptionService, pairingService, tokenStore, roomService)
 
 	// 启动服务
 	errCh := make(chan error, 3)
@@ -86,4 +157,87 @@ func main() {
 	discoveryManager.Stop()
 
 	log.Println("AirShare server stopped successfully")
-}
\ No newline at end of file
+}
+
+// issueClientCertificate 为设备签发客户端证书，用于双向TLS认证
+func issueClientCertificate(cfg *config.SecurityConfig, deviceID string) error {
+	if cfg.CADir == "" {
+		return fmt.Errorf("ca_dir is not configured")
+	}
+
+	algorithm, err := security.ParseKeyAlgorithm(cfg.KeyAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	certService, err := security.NewPersistentCertificateService(cfg.CADir, algorithm)
+	if err != nil {
+		return err
+	}
+
+	certPEM, keyPEM, err := certService.GenerateDeviceCertificate(deviceID)
+	if err != nil {
+		return err
+	}
+
+	certFile := filepath.Join(cfg.CADir, deviceID+".crt")
+	keyFile := filepath.Join(cfg.CADir, deviceID+".key")
+
+	if err := os.WriteFile(certFile, []byte(certPEM), 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, []byte(keyPEM), 0600); err != nil {
+		return err
+	}
+
+	log.Printf("Issued client certificate for %s: %s, %s", deviceID, certFile, keyFile)
+	return nil
+}
+
+// manageTokens 管理API令牌：签发、吊销或列出
+func manageTokens(cfg *config.SecurityConfig, deviceID, scopes string, ttl time.Duration, revokeID string, list bool) error {
+	if err := os.MkdirAll(cfg.KeyDir, 0700); err != nil {
+		return err
+	}
+
+	store, err := security.LoadTokenStore(filepath.Join(cfg.KeyDir, "tokens.json"))
+	if err != nil {
+		return err
+	}
+
+	if deviceID != "" {
+		parsedScopes, err := security.ParseScopes(scopes)
+		if err != nil {
+			return err
+		}
+
+		token, info, err := store.Issue(deviceID, parsedScopes, ttl)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Token ID: %s\nToken: %s\n", info.ID, token)
+	}
+
+	if revokeID != "" {
+		if err := store.Revoke(revokeID); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked token %s\n", revokeID)
+	}
+
+	if list {
+		for _, token := range store.List() {
+			status := "active"
+			switch {
+			case token.Revoked:
+				status = "revoked"
+			case token.ExpiresAt != nil && time.Now().After(*token.ExpiresAt):
+				status = "expired"
+			}
+			fmt.Printf("%s\t%s\t%v\t%s\n", token.ID, token.DeviceID, token.Scopes, status)
+		}
+	}
+
+	return nil
+}
@@ -20,6 +20,8 @@ type ServerConfig struct {
 	Port    int    "yaml:\"port\""
 	Host    string "yaml:\"host\""
 	WebRoot string "yaml:\"web_root\""
+	// RoomTTL 房间的最长有效期（分钟）
+	RoomTTL int    "yaml:\"room_ttl\""
 }
 
 // DiscoveryConfig 设备发现配置
@@ -37,6 +39,39 @@ type TransferConfig struct {
 	ChunkSize     int    "yaml:\"chunk_size\""
 	EnableResume  bool   "yaml:\"enable_resume\""
 	CleanupPeriod int    "yaml:\"cleanup_period\""
+	// EncryptAtRest 静态加密接收的文件，口令通过 AIRSHARE_STORAGE_PASSPHRASE 环境变量提供
+	EncryptAtRest bool   "yaml:\"encrypt_at_rest\""
+	// ConsentTimeout 等待接收方确认的时间（秒），超时视为拒绝
+	ConsentTimeout int   "yaml:\"consent_timeout\""
+	// AutoAccept 自动接收规则
+	AutoAccept AutoAcceptConfig "yaml:\"auto_accept\""
+	// ConflictPolicy 接收的文件与已有文件同名时的处理方式：rename、overwrite、skip、version
+	ConflictPolicy string "yaml:\"conflict_policy\""
+	// Bandwidth 带宽限制，可以通过API在运行时调整
+	Bandwidth BandwidthConfig "yaml:\"bandwidth\""
+	// MaxConcurrent 同时进行的传输数，其余已接收的传输排队等待，0表示不限制
+	MaxConcurrent int "yaml:\"max_concurrent\""
+	// ProgressInterval 进行中的传输发送进度事件的间隔（毫秒），0表示不发送
+	ProgressInterval int "yaml:\"progress_interval\""
+}
+
+// BandwidthConfig 带宽限制，单位为字节/秒，0表示不限制
+type BandwidthConfig struct {
+	GlobalLimit int64            "yaml:\"global_limit\""
+	// PeerLimit 每个设备的限制，未在 PeerLimits 中单独设置的设备使用该值
+	PeerLimit   int64            "yaml:\"peer_limit\""
+	PeerLimits  map[string]int64 "yaml:\"peer_limits\""
+}
+
+// AutoAcceptConfig 自动接收规则，满足所有已设置的条件时无需接收方确认
+type AutoAcceptConfig struct {
+	Enabled     bool     "yaml:\"enabled\""
+	// TrustedOnly 只自动接收已信任设备发送的文件
+	TrustedOnly bool     "yaml:\"trusted_only\""
+	// MaxSize 总大小上限（字节），0表示不限制
+	MaxSize     int64    "yaml:\"max_size\""
+	// MIMETypes 允许的MIME类型，支持 image/* 形式的通配，为空表示不限制
+	MIMETypes   []string "yaml:\"mime_types\""
 }
 
 // SecurityConfig 安全配置
@@ -44,6 +79,16 @@ type SecurityConfig struct {
 	EnableTLS     bool   "yaml:\"enable_tls\""
 	CertFile      string "yaml:\"cert_file\""
 	KeyFile       string "yaml:\"key_file\""
+	// RequireClientCert 启用双向认证，要求客户端出示由AirShare CA签发的证书
+	RequireClientCert bool   "yaml:\"require_client_cert\""
+	// CADir CA证书和私钥的存放目录，未设置时每次启动生成临时CA
+	CADir         string "yaml:\"ca_dir\""
+	// KeyDir 设备身份密钥和配对信息的存放目录
+	KeyDir        string "yaml:\"key_dir\""
+	// KeyAlgorithm 新生成的身份密钥和证书使用的算法：ecdsa-p256（默认）、ed25519 或 rsa
+	KeyAlgorithm  string "yaml:\"key_algorithm\""
+	// EnableAuth 启用设备令牌认证，令牌在配对后签发或通过管理命令签发
+	EnableAuth    bool   "yaml:\"enable_auth\""
 	EnableCORS    bool   "yaml:\"enable_cors\""
 	AllowedOrigins []string "yaml:\"allowed_origins\""
 }
@@ -58,6 +103,7 @@ func DefaultConfig() *Config {
 			Port:    8080,
 			Host:    "0.0.0.0",
 			WebRoot: filepath.Join(cwd, "../frontend/build/web"),
+			RoomTTL: 60,
 		},
 		Discovery: DiscoveryConfig{
 			ServiceName: "_airshare._tcp",
@@ -71,11 +117,24 @@ func DefaultConfig() *Config {
 			ChunkSize:     64 * 1024,          // 64KB
 			EnableResume:  true,
 			CleanupPeriod: 24, // 小时
+			ConsentTimeout: 120,
+			AutoAccept: AutoAcceptConfig{
+				Enabled:     false,
+				TrustedOnly: true,
+				MaxSize:     100 * 1024 * 1024, // 100MB
+			},
+			ConflictPolicy: "rename",
+			MaxConcurrent:  3,
+			ProgressInterval: 500,
 		},
 		Security: SecurityConfig{
 			EnableTLS:      false,
+			CADir:          filepath.Join(cwd, "certs"),
+			KeyDir:         filepath.Join(cwd, "keys"),
+			KeyAlgorithm:   "ecdsa-p256",
+			EnableAuth:     true,
 			EnableCORS:     true,
-			AllowedOrigins: []string{"*"},
+			AllowedOrigins: []string{"http://localhost:8081", "http://127.0.0.1:8081"},
 		},
 	}
 }
@@ -0,0 +1,305 @@
+package room
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"airshare-backend/pkg/models"
+)
+
+const (
+	// codeAlphabet 房间短码字符集，去掉了容易混淆的0/O、1/I/L
+	codeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+	codeLength   = 6
+
+	// DefaultRoomTTL 默认房间有效期
+	DefaultRoomTTL = time.Hour
+
+	maxRoomMembers = 32 // 包括等待批准的设备
+)
+
+var (
+	ErrRoomNotFound = errors.New("房间不存在或已过期")
+	ErrNotHost      = errors.New("只有房主可以执行该操作")
+	ErrNotMember    = errors.New("设备不是房间成员")
+	ErrRoomFull     = errors.New("房间人数已满")
+	ErrNoDeviceID   = errors.New("缺少设备ID")
+)
+
+// JoinStatus 加入房间的结果
+type JoinStatus string
+
+const (
+	JoinPending  JoinStatus = "pending"  // 等待房主批准
+	JoinApproved JoinStatus = "approved" // 已是房间成员
+)
+
+// room 房间状态
+type room struct {
+	info    models.RoomInfo
+	members map[string]models.DeviceInfo // 已批准的成员，包括房主
+	pending map[string]models.DeviceInfo // 等待批准的设备
+}
+
+// Service 房间服务，不同网络中的设备通过房间短码在同一个服务器上会合
+type Service struct {
+	mu    sync.Mutex
+	rooms map[string]*room
+	ttl   time.Duration
+}
+
+// NewService 创建房间服务，ttl 为房间的最长有效期
+func NewService(ttl time.Duration) *Service {
+	if ttl <= 0 {
+		ttl = DefaultRoomTTL
+	}
+
+	return &Service{
+		rooms: make(map[string]*room),
+		ttl:   ttl,
+	}
+}
+
+// Create 创建房间，host 成为房主和第一个成员
+// ttl 小于等于0或超过服务端上限时使用上限
+func (s *Service) Create(host models.DeviceInfo, ttl time.Duration) (*models.RoomInfo, error) {
+	if host.ID == "" {
+		return nil, ErrNoDeviceID
+	}
+	if ttl <= 0 || ttl > s.ttl {
+		ttl = s.ttl
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purgeExpired()
+
+	code, err := s.newCode()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	r := &room{
+		info: models.RoomInfo{
+			ID:        code,
+			HostID:    host.ID,
+			CreatedAt: now,
+			ExpiresAt: now.Add(ttl),
+		},
+		members: map[string]models.DeviceInfo{host.ID: host},
+		pending: make(map[string]models.DeviceInfo),
+	}
+	s.rooms[code] = r
+
+	return r.snapshot(), nil
+}
+
+// Join 通过短码申请加入房间，已是成员的设备（如重连）直接返回
+func (s *Service) Join(code string, device models.DeviceInfo) (*models.RoomInfo, JoinStatus, error) {
+	if device.ID == "" {
+		return nil, "", ErrNoDeviceID
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.get(code)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if _, ok := r.members[device.ID]; ok {
+		r.members[device.ID] = device
+		return r.snapshot(), JoinApproved, nil
+	}
+
+	if _, ok := r.pending[device.ID]; !ok && len(r.members)+len(r.pending) >= maxRoomMembers {
+		return nil, "", ErrRoomFull
+	}
+	r.pending[device.ID] = device
+
+	return r.snapshot(), JoinPending, nil
+}
+
+// Approve 房主批准等待中的设备
+func (s *Service) Approve(code, hostID, deviceID string) (*models.RoomInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.getAsHost(code, hostID)
+	if err != nil {
+		return nil, err
+	}
+
+	device, ok := r.pending[deviceID]
+	if !ok {
+		return nil, fmt.Errorf("设备未申请加入房间: %s", deviceID)
+	}
+	delete(r.pending, deviceID)
+	r.members[deviceID] = device
+
+	return r.snapshot(), nil
+}
+
+// Kick 房主移出成员或拒绝等待中的设备
+func (s *Service) Kick(code, hostID, deviceID string) (*models.RoomInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.getAsHost(code, hostID)
+	if err != nil {
+		return nil, err
+	}
+	if deviceID == hostID {
+		return nil, errors.New("房主不能移出自己")
+	}
+
+	_, member := r.members[deviceID]
+	_, pending := r.pending[deviceID]
+	if !member && !pending {
+		return nil, ErrNotMember
+	}
+	delete(r.members, deviceID)
+	delete(r.pending, deviceID)
+
+	return r.snapshot(), nil
+}
+
+// Leave 设备离开房间，房主离开时关闭房间并返回 closed 为true
+func (s *Service) Leave(code, deviceID string) (info *models.RoomInfo, closed bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.get(code)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if deviceID == r.info.HostID {
+		delete(s.rooms, r.info.ID)
+		return r.snapshot(), true, nil
+	}
+
+	delete(r.members, deviceID)
+	delete(r.pending, deviceID)
+	return r.snapshot(), false, nil
+}
+
+// Get 获取房间信息
+func (s *Service) Get(code string) (*models.RoomInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.get(code)
+	if err != nil {
+		return nil, err
+	}
+	return r.snapshot(), nil
+}
+
+// IsMember 检查设备是否为房间的已批准成员
+func (s *Service) IsMember(code, deviceID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.get(code)
+	if err != nil {
+		return false
+	}
+	_, ok := r.members[deviceID]
+	return ok
+}
+
+// get 获取未过期的房间，调用者需持有锁
+func (s *Service) get(code string) (*room, error) {
+	code = NormalizeCode(code)
+	r, ok := s.rooms[code]
+	if !ok {
+		return nil, ErrRoomNotFound
+	}
+	if time.Now().After(r.info.ExpiresAt) {
+		delete(s.rooms, code)
+		return nil, ErrRoomNotFound
+	}
+	return r, nil
+}
+
+// getAsHost 获取房间并检查操作者是否为房主，调用者需持有锁
+func (s *Service) getAsHost(code, hostID string) (*room, error) {
+	r, err := s.get(code)
+	if err != nil {
+		return nil, err
+	}
+	if r.info.HostID != hostID {
+		return nil, ErrNotHost
+	}
+	return r, nil
+}
+
+// purgeExpired 删除所有过期房间，调用者需持有锁
+func (s *Service) purgeExpired() {
+	now := time.Now()
+	for code, r := range s.rooms {
+		if now.After(r.info.ExpiresAt) {
+			delete(s.rooms, code)
+		}
+	}
+}
+
+// newCode 生成未被占用的房间短码，调用者需持有锁
+func (s *Service) newCode() (string, error) {
+	max := big.NewInt(int64(len(codeAlphabet)))
+	for attempt := 0; attempt < 10; attempt++ {
+		var b strings.Builder
+		for i := 0; i < codeLength; i++ {
+			n, err := rand.Int(rand.Reader, max)
+			if err != nil {
+				return "", fmt.Errorf("生成房间短码失败: %v", err)
+			}
+			b.WriteByte(codeAlphabet[n.Int64()])
+		}
+
+		if _, exists := s.rooms[b.String()]; !exists {
+			return b.String(), nil
+		}
+	}
+	return "", errors.New("生成房间短码失败: 重试次数过多")
+}
+
+// snapshot 复制房间信息，设备按ID排序
+func (r *room) snapshot() *models.RoomInfo {
+	info := r.info
+	info.Devices = sortedDevices(r.members)
+	if len(r.pending) > 0 {
+		info.Pending = sortedDevices(r.pending)
+	}
+	return &info
+}
+
+// sortedDevices 将设备表转换为按ID排序的列表
+func sortedDevices(devices map[string]models.DeviceInfo) []models.DeviceInfo {
+	list := make([]models.DeviceInfo, 0, len(devices))
+	for _, device := range devices {
+		list = append(list, device)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// NormalizeCode 规范化用户输入的短码，忽略大小写、空格和连字符
+func NormalizeCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, code)
+}
@@ -1,29 +1,36 @@
 package security
 
 import (
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"log"
 	"math/big"
+	"net"
+	"os"
+	"path/filepath"
 	"time"
 )
 
 // CertificateService 证书管理服务
 type CertificateService struct {
 	caCert     *x509.Certificate
-	caKey      *rsa.PrivateKey
+	caKey      crypto.Signer
+	algorithm  KeyAlgorithm // 新生成的CA和设备证书使用的算法
 	certificates map[string]*x509.Certificate
-	privateKeys  map[string]*rsa.PrivateKey
+	privateKeys  map[string]crypto.Signer
 }
 
 // NewCertificateService 创建新的证书服务
-func NewCertificateService() (*CertificateService, error) {
+func NewCertificateService(algorithm KeyAlgorithm) (*CertificateService, error) {
 	service := &CertificateService{
+		algorithm:    algorithm,
 		certificates: make(map[string]*x509.Certificate),
-		privateKeys:  make(map[string]*rsa.PrivateKey),
+		privateKeys:  make(map[string]crypto.Signer),
 	}
 
 	// 生成CA证书
@@ -34,10 +41,32 @@ func NewCertificateService() (*CertificateService, error) {
 	return service, nil
 }
 
+// NewPersistentCertificateService 创建使用持久化CA的证书服务
+// CA证书和私钥保存在caDir中，重启后签发的设备证书仍然有效
+// algorithm 只用于新生成的密钥，已有的CA（包括旧版本的RSA CA）继续使用
+func NewPersistentCertificateService(caDir string, algorithm KeyAlgorithm) (*CertificateService, error) {
+	service := &CertificateService{
+		algorithm:    algorithm,
+		certificates: make(map[string]*x509.Certificate),
+		privateKeys:  make(map[string]crypto.Signer),
+	}
+
+	if err := os.MkdirAll(caDir, 0700); err != nil {
+		return nil, fmt.Errorf("创建CA目录失败: %v", err)
+	}
+
+	if err := service.loadOrGenerateCA(caDir); err != nil {
+		return nil, err
+	}
+
+	return service, nil
+}
+
 // GenerateDeviceCertificate 生成设备证书
-func (s *CertificateService) GenerateDeviceCertificate(deviceID string) (string, string, error) {
+// hosts 为证书的主题备用名称，可以是域名或IP地址
+func (s *CertificateService) GenerateDeviceCertificate(deviceID string, hosts ...string) (string, string, error) {
 	// 生成设备密钥对
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	privateKey, err := GenerateKey(s.algorithm)
 	if err != nil {
 		return "", "", fmt.Errorf("生成设备密钥对失败: %v", err)
 	}
@@ -52,14 +81,22 @@ func (s *CertificateService) GenerateDeviceCertificate(deviceID string) (string,
 		},
 		NotBefore:             time.Now(),
 		NotAfter:              time.Now().AddDate(1, 0, 0), // 1年有效期
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		KeyUsage:              certificateKeyUsage(privateKey.Public()),
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 		IsCA:                  false,
 	}
 
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
 	// 使用CA证书签名
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, s.caCert, &privateKey.PublicKey, s.caKey)
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, s.caCert, privateKey.Public(), s.caKey)
 	if err != nil {
 		return "", "", fmt.Errorf("创建设备证书失败: %v", err)
 	}
@@ -70,10 +107,10 @@ func (s *CertificateService) GenerateDeviceCertificate(deviceID string) (string,
 		Bytes: certDER,
 	})
 
-	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
-	})
+	privateKeyPEM, err := MarshalPrivateKeyPEM(privateKey)
+	if err != nil {
+		return "", "", err
+	}
 
 	// 保存证书和密钥
 	cert, err := x509.ParseCertificate(certDER)
@@ -125,8 +162,8 @@ func (s *CertificateService) GetCACertificate() string {
 
 // 生成CA证书
 func (s *CertificateService) generateCACertificate() error {
-	// 生成CA密钥对
-	caKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	// 生成CA密钥对，默认使用P-256，避免4096位RSA拖慢启动
+	caKey, err := GenerateKey(s.algorithm)
 	if err != nil {
 		return fmt.Errorf("生成CA密钥对失败: %v", err)
 	}
@@ -142,14 +179,14 @@ func (s *CertificateService) generateCACertificate() error {
 		},
 		NotBefore:             time.Now(),
 		NotAfter:              time.Now().AddDate(10, 0, 0), // 10年有效期
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		KeyUsage:              certificateKeyUsage(caKey.Public()) | x509.KeyUsageCertSign,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 		IsCA:                  true,
 	}
 
 	// 自签名CA证书
-	caCertDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &caKey.PublicKey, caKey)
+	caCertDER, err := x509.CreateCertificate(rand.Reader, &template, &template, caKey.Public(), caKey)
 	if err != nil {
 		return fmt.Errorf("创建CA证书失败: %v", err)
 	}
@@ -165,6 +202,66 @@ func (s *CertificateService) generateCACertificate() error {
 	return nil
 }
 
+// 加载或生成CA证书
+func (s *CertificateService) loadOrGenerateCA(caDir string) error {
+	certFile := filepath.Join(caDir, "ca.pem")
+	keyFile := filepath.Join(caDir, "ca-key.pem")
+
+	certPEM, certErr := os.ReadFile(certFile)
+	keyPEM, keyErr := os.ReadFile(keyFile)
+	if certErr == nil && keyErr == nil {
+		certBlock, _ := pem.Decode(certPEM)
+		if certBlock == nil {
+			return errors.New("无效的CA证书PEM格式")
+		}
+
+		caCert, err := x509.ParseCertificate(certBlock.Bytes)
+		if err != nil {
+			return fmt.Errorf("解析CA证书失败: %v", err)
+		}
+
+		caKey, err := ParsePrivateKeyPEM(keyPEM)
+		if err != nil {
+			return fmt.Errorf("解析CA私钥失败: %v", err)
+		}
+
+		if !PublicKeysEqual(caCert.PublicKey, caKey.Public()) {
+			return errors.New("CA证书和私钥不匹配")
+		}
+
+		s.caCert = caCert
+		s.caKey = caKey
+
+		log.Printf("已加载CA证书: %s", certFile)
+		return nil
+	}
+
+	log.Println("未找到CA证书，正在生成新的CA...")
+	if err := s.generateCACertificate(); err != nil {
+		return fmt.Errorf("生成CA证书失败: %v", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: s.caCert.Raw,
+	})
+
+	keyPEM, err := MarshalPrivateKeyPEM(s.caKey)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return fmt.Errorf("写入CA证书失败: %v", err)
+	}
+
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return fmt.Errorf("写入CA私钥失败: %v", err)
+	}
+
+	return nil
+}
+
 // GetCertificate 获取设备证书
 func (s *CertificateService) GetCertificate(deviceID string) (*x509.Certificate, bool) {
 	cert, exists := s.certificates[deviceID]
@@ -172,7 +269,7 @@ func (s *CertificateService) GetCertificate(deviceID string) (*x509.Certificate,
 }
 
 // GetPrivateKey 获取设备私钥
-func (s *CertificateService) GetPrivateKey(deviceID string) (*rsa.PrivateKey, bool) {
+func (s *CertificateService) GetPrivateKey(deviceID string) (crypto.Signer, bool) {
 	key, exists := s.privateKeys[deviceID]
 	return key, exists
 }
@@ -180,7 +277,7 @@ func (s *CertificateService) GetPrivateKey(deviceID string) (*rsa.PrivateKey, bo
 // GenerateTemporaryCertificate 生成临时证书（用于测试）
 func (s *CertificateService) GenerateTemporaryCertificate(deviceID string) (string, string, error) {
 	// 生成临时密钥对
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	privateKey, err := GenerateKey(s.algorithm)
 	if err != nil {
 		return "", "", fmt.Errorf("生成临时密钥对失败: %v", err)
 	}
@@ -193,11 +290,11 @@ func (s *CertificateService) GenerateTemporaryCertificate(deviceID string) (stri
 		},
 		NotBefore: time.Now(),
 		NotAfter:  time.Now().Add(24 * time.Hour), // 24小时有效期
-		KeyUsage:   x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		KeyUsage:   certificateKeyUsage(privateKey.Public()),
 	}
 
 	// 自签名临时证书
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, privateKey.Public(), privateKey)
 	if err != nil {
 		return "", "", fmt.Errorf("创建临时证书失败: %v", err)
 	}
@@ -207,10 +304,10 @@ func (s *CertificateService) GenerateTemporaryCertificate(deviceID string) (stri
 		Bytes: certDER,
 	})
 
-	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
-	})
+	privateKeyPEM, err := MarshalPrivateKeyPEM(privateKey)
+	if err != nil {
+		return "", "", err
+	}
 
 	return string(certPEM), string(privateKeyPEM), nil
 }
@@ -239,10 +336,10 @@ func (s *CertificateService) ExportCertificate(deviceID string) (string, string,
 		Bytes: cert.Raw,
 	})
 
-	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
-	})
+	privateKeyPEM, err := MarshalPrivateKeyPEM(key)
+	if err != nil {
+		return "", "", err
+	}
 
 	return string(certPEM), string(privateKeyPEM), nil
 }
@@ -260,19 +357,14 @@ func (s *CertificateService) ImportCertificate(deviceID, certPEM, privateKeyPEM
 		return fmt.Errorf("解析证书失败: %v", err)
 	}
 
-	// 解析私钥
-	keyBlock, _ := pem.Decode([]byte(privateKeyPEM))
-	if keyBlock == nil {
-		return fmt.Errorf("无效的私钥PEM格式")
-	}
-
-	privateKey, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	// 解析私钥，支持RSA、ECDSA P-256和Ed25519
+	privateKey, err := ParsePrivateKeyPEM([]byte(privateKeyPEM))
 	if err != nil {
-		return fmt.Errorf("解析私钥失败: %v", err)
+		return err
 	}
 
 	// 验证证书和私钥匹配
-	if !cert.PublicKey.(*rsa.PublicKey).Equal(&privateKey.PublicKey) {
+	if !PublicKeysEqual(cert.PublicKey, privateKey.Public()) {
 		return fmt.Errorf("证书和私钥不匹配")
 	}
 
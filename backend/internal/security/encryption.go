@@ -1,10 +1,10 @@
 package security
 
 import (
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
@@ -12,7 +12,6 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -23,10 +22,14 @@ import (
 // EncryptionService 提供端到端加密功能
 type EncryptionService struct {
 	mu            sync.RWMutex
-	privateKey    *rsa.PrivateKey
-	publicKey     *rsa.PublicKey
+	privateKey    crypto.Signer
+	publicKey     crypto.PublicKey
+	algorithm     KeyAlgorithm // 生成新身份密钥时使用的算法
 	certificates  map[string]*x509.Certificate
 	sharedSecrets map[string][]byte // 与对等端的共享密钥
+	knownDevices  *KnownDevices     // 按设备ID固定的公钥
+	replayGuard   *ReplayGuard      // 接收消息的重放检测
+	sequences     map[string]uint64 // 发往各接收者的最后序列号
 	keyDir        string
 }
 
@@ -38,16 +41,18 @@ type EncryptedMessage struct {
 	Key         string `json:"key"`          // 加密的AES密钥（base64编码）
 	Signature   string `json:"signature"`    // 数字签名（base64编码）
 	Timestamp   int64  `json:"timestamp"`    // 时间戳
+	Sequence    uint64 `json:"sequence"`     // 发往该接收者的序列号
 	SenderID    string `json:"sender_id"`    // 发送者ID
 	RecipientID string `json:"recipient_id"` // 接收者ID
 }
 
 // KeyPair 密钥对
 type KeyPair struct {
-	PrivateKeyPEM string `json:"private_key"` // PEM格式的私钥
-	PublicKeyPEM  string `json:"public_key"`  // PEM格式的公钥
-	Fingerprint   string `json:"fingerprint"` // 密钥指纹
-	CreatedAt     int64  `json:"created_at"`  // 创建时间
+	PrivateKeyPEM string       `json:"private_key"`         // PEM格式的私钥
+	PublicKeyPEM  string       `json:"public_key"`          // PEM格式的公钥
+	Algorithm     KeyAlgorithm `json:"algorithm,omitempty"` // 密钥算法
+	Fingerprint   string       `json:"fingerprint"`         // 密钥指纹
+	CreatedAt     int64        `json:"created_at"`          // 创建时间
 }
 
 // EncryptData 加密数据请求
@@ -57,10 +62,14 @@ type EncryptData struct {
 }
 
 // NewEncryptionService 创建新的加密服务
-func NewEncryptionService(keyDir string) (*EncryptionService, error) {
+// algorithm 只用于生成新的身份密钥，已有的密钥（包括旧版本的RSA密钥）继续使用
+func NewEncryptionService(keyDir string, algorithm KeyAlgorithm) (*EncryptionService, error) {
 	service := &EncryptionService{
+		algorithm:     algorithm,
 		certificates:  make(map[string]*x509.Certificate),
 		sharedSecrets: make(map[string][]byte),
+		replayGuard:   NewReplayGuard(DefaultReplaySkew, DefaultNonceCacheSize),
+		sequences:     make(map[string]uint64),
 		keyDir:        keyDir,
 	}
 
@@ -74,6 +83,17 @@ func NewEncryptionService(keyDir string) (*EncryptionService, error) {
 		return nil, err
 	}
 
+	// 加载已知设备并恢复固定的公钥
+	knownDevices, err := LoadKnownDevices(filepath.Join(keyDir, "known_devices.json"))
+	if err != nil {
+		return nil, err
+	}
+	service.knownDevices = knownDevices
+
+	for _, device := range knownDevices.List() {
+		service.pinCertificate("", device.PublicKey)
+	}
+
 	return service, nil
 }
 
@@ -105,25 +125,19 @@ func (s *EncryptionService) Encrypt(data *EncryptData) (*EncryptedMessage, error
 	// 使用接收者的公钥加密AES密钥
 	s.mu.RLock()
 	cert, exists := s.certificates[data.RecipientID]
+	ownKey := s.publicKey
 	s.mu.RUnlock()
 
 	if !exists {
 		// 如果没有证书，使用自己的公钥（用于测试）
 		cert = &x509.Certificate{
-			PublicKey: s.publicKey,
+			PublicKey: ownKey,
 		}
 	}
 
-	publicKey := cert.PublicKey.(*rsa.PublicKey)
-	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, aesKey, nil)
+	encryptedKey, err := wrapKeyFor(cert.PublicKey, aesKey)
 	if err != nil {
-		return nil, fmt.Errorf("RSA加密失败: %v", err)
-	}
-
-	// 使用私钥签名
-	signature, err := s.sign(ciphertext)
-	if err != nil {
-		return nil, fmt.Errorf("签名失败: %v", err)
+		return nil, fmt.Errorf("加密AES密钥失败: %v", err)
 	}
 
 	// 构建加密消息
@@ -132,15 +146,45 @@ func (s *EncryptionService) Encrypt(data *EncryptData) (*EncryptedMessage, error
 		Data:        base64.StdEncoding.EncodeToString(ciphertext),
 		IV:          base64.StdEncoding.EncodeToString(iv),
 		Key:         base64.StdEncoding.EncodeToString(encryptedKey),
-		Signature:   base64.StdEncoding.EncodeToString(signature),
 		Timestamp:   time.Now().Unix(),
+		Sequence:    s.nextSequence(data.RecipientID),
 		SenderID:    s.getFingerprint(),
 		RecipientID: data.RecipientID,
 	}
 
+	// 使用私钥签名，签名覆盖时间戳和序列号，防止被篡改后重放
+	signature, err := s.sign(msg.signedPayload())
+	if err != nil {
+		return nil, fmt.Errorf("签名失败: %v", err)
+	}
+	msg.Signature = base64.StdEncoding.EncodeToString(signature)
+
 	return msg, nil
 }
 
+// EncryptForDevice 使用已固定的设备公钥加密，只允许发给已信任且公钥未变化的设备
+func (s *EncryptionService) EncryptForDevice(deviceID string, plaintext []byte) (*EncryptedMessage, error) {
+	device, exists := s.knownDevices.Get(deviceID)
+	if !exists || !device.Trusted {
+		return nil, fmt.Errorf("设备未信任，无法加密: %s", deviceID)
+	}
+	if device.PendingFingerprint != "" {
+		return nil, fmt.Errorf("设备公钥已变化，请先核对: %s", deviceID)
+	}
+
+	s.mu.RLock()
+	_, pinned := s.certificates[device.Fingerprint]
+	s.mu.RUnlock()
+	if !pinned {
+		return nil, fmt.Errorf("设备公钥未固定: %s", deviceID)
+	}
+
+	return s.Encrypt(&EncryptData{
+		Plaintext:   plaintext,
+		RecipientID: device.Fingerprint,
+	})
+}
+
 // Decrypt 解密数据
 func (s *EncryptionService) Decrypt(msg *EncryptedMessage) ([]byte, error) {
 	// 解码密文
@@ -168,14 +212,24 @@ func (s *EncryptionService) Decrypt(msg *EncryptedMessage) ([]byte, error) {
 	}
 
 	// 验证签名
-	if err := s.verifySignature(ciphertext, signature, msg.SenderID); err != nil {
+	if err := s.verifySignature(msg.signedPayload(), signature, msg.SenderID); err != nil {
 		return nil, fmt.Errorf("签名验证失败: %v", err)
 	}
 
+	// 签名通过后再做重放检测，避免伪造的消息污染检测状态
+	// IV对每条消息随机生成，作为随机数使用
+	if err := s.replayGuard.Check(msg.SenderID, msg.Sequence, time.Unix(msg.Timestamp, 0), msg.IV); err != nil {
+		return nil, err
+	}
+
 	// 解密AES密钥
-	aesKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, s.privateKey, encryptedKey, nil)
+	s.mu.RLock()
+	privateKey := s.privateKey
+	s.mu.RUnlock()
+
+	aesKey, err := unwrapKeyWith(privateKey, encryptedKey)
 	if err != nil {
-		return nil, fmt.Errorf("RSA解密失败: %v", err)
+		return nil, fmt.Errorf("解密AES密钥失败: %v", err)
 	}
 
 	// 检查是否有共享密钥
@@ -209,15 +263,36 @@ func (s *EncryptionService) Decrypt(msg *EncryptedMessage) ([]byte, error) {
 	return plaintext, nil
 }
 
-// GenerateKeyPair 生成新的RSA密钥对
+// signedPayload 构造需要签名的数据，包含消息头和密文
+func (msg *EncryptedMessage) signedPayload() []byte {
+	header := fmt.Sprintf("%s\n%d\n%d\n%s\n%s\n%s\n%s\n", msg.Type, msg.Timestamp, msg.Sequence,
+		msg.SenderID, msg.RecipientID, msg.IV, msg.Key)
+	return append([]byte(header), msg.Data...)
+}
+
+// nextSequence 获取发往接收者的下一个序列号
+// 序列号以纳秒时间戳为起点，进程重启后仍然大于之前发送的序列号
+func (s *EncryptionService) nextSequence(recipientID string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sequence := s.sequences[recipientID] + 1
+	if seed := uint64(time.Now().UnixNano()); sequence < seed {
+		sequence = seed
+	}
+	s.sequences[recipientID] = sequence
+	return sequence
+}
+
+// GenerateKeyPair 使用配置的算法生成新的身份密钥对
 func (s *EncryptionService) GenerateKeyPair() (*KeyPair, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	privateKey, err := GenerateKey(s.algorithm)
 	if err != nil {
-		return nil, fmt.Errorf("生成RSA密钥对失败: %v", err)
+		return nil, fmt.Errorf("生成密钥对失败: %v", err)
 	}
 
 	// 生成公钥PEM
-	publicKeyDER, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(privateKey.Public())
 	if err != nil {
 		return nil, fmt.Errorf("序列化公钥失败: %v", err)
 	}
@@ -228,10 +303,10 @@ func (s *EncryptionService) GenerateKeyPair() (*KeyPair, error) {
 	})
 
 	// 生成私钥PEM
-	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
-	})
+	privateKeyPEM, err := MarshalPrivateKeyPEM(privateKey)
+	if err != nil {
+		return nil, err
+	}
 
 	// 计算密钥指纹
 	fingerprint := s.calculateFingerprint(publicKeyDER)
@@ -239,6 +314,7 @@ func (s *EncryptionService) GenerateKeyPair() (*KeyPair, error) {
 	keyPair := &KeyPair{
 		PrivateKeyPEM: string(privateKeyPEM),
 		PublicKeyPEM:  string(publicKeyPEM),
+		Algorithm:     s.algorithm,
 		Fingerprint:   fingerprint,
 		CreatedAt:     time.Now().Unix(),
 	}
@@ -251,7 +327,7 @@ func (s *EncryptionService) GenerateKeyPair() (*KeyPair, error) {
 	// 更新服务密钥
 	s.mu.Lock()
 	s.privateKey = privateKey
-	s.publicKey = &privateKey.PublicKey
+	s.publicKey = privateKey.Public()
 	s.mu.Unlock()
 
 	return keyPair, nil
@@ -275,6 +351,18 @@ func (s *EncryptionService) GetPublicKey() string {
 	return string(publicKeyPEM)
 }
 
+// KeyAlgorithm 获取本设备身份密钥的算法
+func (s *EncryptionService) KeyAlgorithm() KeyAlgorithm {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	algorithm, err := KeyAlgorithmOf(s.publicKey)
+	if err != nil {
+		return s.algorithm
+	}
+	return algorithm
+}
+
 // GetFingerprint 获取密钥指纹
 func (s *EncryptionService) GetFingerprint() string {
 	return s.getFingerprint()
@@ -297,20 +385,15 @@ func (s *EncryptionService) loadOrGenerateKeys() error {
 			return fmt.Errorf("解析密钥文件失败: %v", err)
 		}
 
-		// 解析私钥
-		block, _ := pem.Decode([]byte(keyPair.PrivateKeyPEM))
-		if block == nil {
-			return errors.New("无效的私钥PEM格式")
-		}
-
-		privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		// 解析私钥，兼容旧版本的PKCS#1 RSA私钥
+		privateKey, err := ParsePrivateKeyPEM([]byte(keyPair.PrivateKeyPEM))
 		if err != nil {
-			return fmt.Errorf("解析私钥失败: %v", err)
+			return err
 		}
 
 		s.mu.Lock()
 		s.privateKey = privateKey
-		s.publicKey = &privateKey.PublicKey
+		s.publicKey = privateKey.Public()
 		s.mu.Unlock()
 
 		log.Printf("已加载现有密钥对，指纹: %s", keyPair.Fingerprint)
@@ -344,10 +427,10 @@ func (s *EncryptionService) saveKeyPair(keyPair *KeyPair) error {
 	return nil
 }
 
-// 计算密钥指纹
+// 计算密钥指纹（完整的SHA-256）
 func (s *EncryptionService) calculateFingerprint(publicKeyDER []byte) string {
 	hash := sha256.Sum256(publicKeyDER)
-	return fmt.Sprintf("%x", hash[:8]) // 使用前8字节作为指纹
+	return fmt.Sprintf("%x", hash[:])
 }
 
 // 获取指纹
@@ -368,19 +451,11 @@ func (s *EncryptionService) sign(data []byte) ([]byte, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	hash := sha256.Sum256(data)
-	signature, err := rsa.SignPKCS1v15(rand.Reader, s.privateKey, crypto.SHA256, hash[:])
-	if err != nil {
-		return nil, err
-	}
-
-	return signature, nil
+	return signMessage(s.privateKey, data)
 }
 
 // 验证签名
 func (s *EncryptionService) verifySignature(data, signature []byte, senderID string) error {
-	hash := sha256.Sum256(data)
-
 	s.mu.RLock()
 	cert, exists := s.certificates[senderID]
 	s.mu.RUnlock()
@@ -389,8 +464,7 @@ func (s *EncryptionService) verifySignature(data, signature []byte, senderID str
 		return fmt.Errorf("发送者证书不存在: %s", senderID)
 	}
 
-	publicKey := cert.PublicKey.(*rsa.PublicKey)
-	return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], signature)
+	return verifyMessage(cert.PublicKey, data, signature)
 }
 
 // AddCertificate 添加证书
@@ -400,6 +474,131 @@ func (s *EncryptionService) AddCertificate(cert *x509.Certificate, fingerprint s
 	s.certificates[fingerprint] = cert
 }
 
+// TrustDevice 固定设备公钥并将设备标记为可信，返回公钥指纹
+func (s *EncryptionService) TrustDevice(deviceID, name, publicKeyPEM string) (string, error) {
+	previous, _ := s.knownDevices.Get(deviceID)
+
+	device, err := s.knownDevices.Pin(deviceID, name, publicKeyPEM, true)
+	if err != nil {
+		return "", err
+	}
+
+	if previous != nil {
+		s.pinCertificate(previous.Fingerprint, "")
+	}
+	s.pinCertificate("", device.PublicKey)
+
+	return device.Fingerprint, nil
+}
+
+// ObserveDevice 记录设备出示的公钥，首次见到时固定，之后比对是否一致
+func (s *EncryptionService) ObserveDevice(deviceID, name, publicKeyPEM string) (KeyStatus, *KnownDevice, error) {
+	status, device, err := s.knownDevices.Observe(deviceID, name, publicKeyPEM)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if status == KeyStatusNew {
+		s.pinCertificate("", device.PublicKey)
+	}
+
+	return status, device, nil
+}
+
+// AcceptKeyChange 接受设备变化后的新公钥
+func (s *EncryptionService) AcceptKeyChange(deviceID string) (*KnownDevice, error) {
+	previous, exists := s.knownDevices.Get(deviceID)
+	if !exists {
+		return nil, fmt.Errorf("设备不存在: %s", deviceID)
+	}
+
+	device, err := s.knownDevices.AcceptKeyChange(deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.pinCertificate(previous.Fingerprint, device.PublicKey)
+	return device, nil
+}
+
+// VerifyDevice 在人工核对短认证字符串后将设备标记为可信
+func (s *EncryptionService) VerifyDevice(deviceID string) error {
+	return s.knownDevices.MarkVerified(deviceID)
+}
+
+// VerificationCode 获取本设备与指定设备之间的短认证字符串
+// 设备公钥发生变化时使用待确认的新公钥计算
+func (s *EncryptionService) VerificationCode(deviceID string) (*ShortAuthString, error) {
+	device, exists := s.knownDevices.Get(deviceID)
+	if !exists {
+		return nil, fmt.Errorf("设备不存在: %s", deviceID)
+	}
+
+	fingerprint := device.Fingerprint
+	if device.PendingFingerprint != "" {
+		fingerprint = device.PendingFingerprint
+	}
+
+	return NewShortAuthString(s.getFingerprint(), fingerprint), nil
+}
+
+// IsTrusted 检查设备是否已配对可信
+func (s *EncryptionService) IsTrusted(deviceID string) bool {
+	device, exists := s.knownDevices.Get(deviceID)
+	return exists && device.Trusted
+}
+
+// GetTrustedDevices 获取已信任设备及其密钥指纹
+func (s *EncryptionService) GetTrustedDevices() map[string]string {
+	devices := make(map[string]string)
+	for _, device := range s.knownDevices.List() {
+		if device.Trusted {
+			devices[device.DeviceID] = device.Fingerprint
+		}
+	}
+	return devices
+}
+
+// GetKnownDevices 获取所有已知设备
+func (s *EncryptionService) GetKnownDevices() []KnownDevice {
+	return s.knownDevices.List()
+}
+
+// OnKeyChanged 注册设备公钥变化回调
+func (s *EncryptionService) OnKeyChanged(callback KeyChangeCallback) {
+	s.knownDevices.OnKeyChanged(callback)
+}
+
+// UntrustDevice 删除设备记录并移除固定的公钥
+func (s *EncryptionService) UntrustDevice(deviceID string) error {
+	device, err := s.knownDevices.Remove(deviceID)
+	if device != nil {
+		s.pinCertificate(device.Fingerprint, "")
+	}
+	return err
+}
+
+// pinCertificate 更新用于签名验证的公钥，移除旧指纹并添加新公钥
+func (s *EncryptionService) pinCertificate(oldFingerprint, publicKeyPEM string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if oldFingerprint != "" {
+		delete(s.certificates, oldFingerprint)
+	}
+
+	if publicKeyPEM == "" {
+		return
+	}
+
+	fingerprint, publicKey, err := publicKeyFingerprint(publicKeyPEM)
+	if err != nil {
+		log.Printf("固定公钥失败: %v", err)
+		return
+	}
+	s.certificates[fingerprint] = &x509.Certificate{PublicKey: publicKey}
+}
+
 // GenerateSharedSecret 生成共享密钥
 func (s *EncryptionService) GenerateSharedSecret(peerPublicKeyPEM string) (string, error) {
 	block, _ := pem.Decode([]byte(peerPublicKeyPEM))
@@ -412,7 +611,9 @@ func (s *EncryptionService) GenerateSharedSecret(peerPublicKeyPEM string) (strin
 		return "", fmt.Errorf("解析公钥失败: %v", err)
 	}
 
-	peerPublicKey := publicKey.(*rsa.PublicKey)
+	if _, err := KeyAlgorithmOf(publicKey); err != nil {
+		return "", err
+	}
 
 	// 使用ECDH或其他密钥交换协议建立共享密钥
 	// 这里简化实现，实际应该使用更安全的密钥交换协议
@@ -0,0 +1,135 @@
+package security
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JoinKind 加入二维码的用途
+type JoinKind string
+
+const (
+	JoinKindRoom    JoinKind = "room"    // 加入房间，Code为房间短码
+	JoinKindPairing JoinKind = "pairing" // 设备配对，Code为配对码
+)
+
+const (
+	joinURIScheme  = "airshare"
+	joinURIHost    = "join"
+	joinURIVersion = "2"
+	joinSignDomain = "airshare join uri v2"
+)
+
+var (
+	ErrJoinURIInvalid = errors.New("无效的加入链接")
+	ErrJoinURIExpired = errors.New("加入链接已过期")
+	ErrJoinURIForeign = errors.New("加入链接不是本节点签发的")
+)
+
+// JoinPayload 二维码中编码的加入信息
+type JoinPayload struct {
+	Kind        JoinKind  `json:"kind"`
+	Server      string    `json:"server"` // 服务器地址，如 https://192.168.1.2:8081
+	Code        string    `json:"code"`   // 房间短码或配对码
+	ExpiresAt   time.Time `json:"expires_at"`
+	Fingerprint string    `json:"fingerprint"` // 签发节点的公钥指纹，用于校验签名和固定服务器公钥
+	// HostFingerprint 房主设备已固定的公钥指纹，扫码方可用于固定房主公钥；房主公钥未知时为空
+	HostFingerprint string `json:"host_fingerprint,omitempty"`
+}
+
+// signedBytes 签名覆盖的内容
+func (p *JoinPayload) signedBytes() []byte {
+	return []byte(strings.Join([]string{
+		joinSignDomain,
+		string(p.Kind),
+		p.Server,
+		p.Code,
+		strconv.FormatInt(p.ExpiresAt.Unix(), 10),
+		p.Fingerprint,
+		p.HostFingerprint,
+	}, "\n"))
+}
+
+// SignJoinURI 使用本节点身份密钥签名，生成 airshare://join 链接
+// Fingerprint 由本节点填写
+func (s *EncryptionService) SignJoinURI(payload JoinPayload) (string, error) {
+	payload.Fingerprint = s.getFingerprint()
+
+	signature, err := s.sign(payload.signedBytes())
+	if err != nil {
+		return "", fmt.Errorf("签名加入链接失败: %v", err)
+	}
+
+	query := url.Values{}
+	query.Set("v", joinURIVersion)
+	query.Set("kind", string(payload.Kind))
+	query.Set("server", payload.Server)
+	query.Set("code", payload.Code)
+	query.Set("exp", strconv.FormatInt(payload.ExpiresAt.Unix(), 10))
+	query.Set("fp", payload.Fingerprint)
+	if payload.HostFingerprint != "" {
+		query.Set("hfp", payload.HostFingerprint)
+	}
+	query.Set("sig", base64.RawURLEncoding.EncodeToString(signature))
+
+	uri := url.URL{Scheme: joinURIScheme, Host: joinURIHost, RawQuery: query.Encode()}
+	return uri.String(), nil
+}
+
+// VerifyJoinURI 校验扫描到的加入链接：格式、有效期、签发节点和签名
+func (s *EncryptionService) VerifyJoinURI(raw string) (*JoinPayload, error) {
+	uri, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || uri.Scheme != joinURIScheme || uri.Host != joinURIHost {
+		return nil, ErrJoinURIInvalid
+	}
+
+	query := uri.Query()
+	if query.Get("v") != joinURIVersion {
+		return nil, fmt.Errorf("%w: 不支持的版本", ErrJoinURIInvalid)
+	}
+
+	exp, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: 过期时间无效", ErrJoinURIInvalid)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(query.Get("sig"))
+	if err != nil || len(signature) == 0 {
+		return nil, fmt.Errorf("%w: 签名无效", ErrJoinURIInvalid)
+	}
+
+	payload := &JoinPayload{
+		Kind:            JoinKind(query.Get("kind")),
+		Server:          query.Get("server"),
+		Code:            query.Get("code"),
+		ExpiresAt:       time.Unix(exp, 0),
+		Fingerprint:     query.Get("fp"),
+		HostFingerprint: query.Get("hfp"),
+	}
+	if payload.Kind != JoinKindRoom && payload.Kind != JoinKindPairing || payload.Code == "" {
+		return nil, ErrJoinURIInvalid
+	}
+
+	if payload.Fingerprint != s.getFingerprint() {
+		return nil, ErrJoinURIForeign
+	}
+
+	s.mu.RLock()
+	publicKey := s.publicKey
+	s.mu.RUnlock()
+
+	if err := verifyMessage(publicKey, payload.signedBytes(), signature); err != nil {
+		return nil, fmt.Errorf("%w: 签名验证失败", ErrJoinURIInvalid)
+	}
+
+	// 签名有效后再检查有效期，避免向伪造的链接透露过期信息
+	if time.Now().After(payload.ExpiresAt) {
+		return nil, ErrJoinURIExpired
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,368 @@
+package security
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// KeyAlgorithm 身份密钥和证书使用的公钥算法
+type KeyAlgorithm string
+
+const (
+	KeyAlgorithmEd25519   KeyAlgorithm = "ed25519"
+	KeyAlgorithmECDSAP256 KeyAlgorithm = "ecdsa-p256"
+	KeyAlgorithmRSA       KeyAlgorithm = "rsa" // 兼容旧版本生成的RSA密钥
+)
+
+// DefaultKeyAlgorithm 默认算法，P-256证书被所有浏览器支持，生成速度也远快于RSA
+const DefaultKeyAlgorithm = KeyAlgorithmECDSAP256
+
+// SupportedKeyAlgorithms 本节点支持的算法，按优先级排列
+var SupportedKeyAlgorithms = []KeyAlgorithm{KeyAlgorithmEd25519, KeyAlgorithmECDSAP256, KeyAlgorithmRSA}
+
+// ErrUnsupportedKey 公钥或私钥类型不受支持
+var ErrUnsupportedKey = errors.New("不支持的密钥类型")
+
+// ecdhInfo 密钥封装时HKDF的上下文信息
+const ecdhInfo = "airshare key wrap v1"
+
+// ParseKeyAlgorithm 解析算法名称，空字符串返回默认算法
+func ParseKeyAlgorithm(name string) (KeyAlgorithm, error) {
+	if name == "" {
+		return DefaultKeyAlgorithm, nil
+	}
+
+	for _, algorithm := range SupportedKeyAlgorithms {
+		if KeyAlgorithm(name) == algorithm {
+			return algorithm, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnsupportedKey, name)
+}
+
+// NegotiateKeyAlgorithm 在对方提供的算法中选择本节点最优先的一个
+// 对方未提供列表时（旧版本客户端）使用本节点的首选算法
+func NegotiateKeyAlgorithm(preferred KeyAlgorithm, offered []KeyAlgorithm) (KeyAlgorithm, error) {
+	if len(offered) == 0 {
+		return preferred, nil
+	}
+
+	candidates := append([]KeyAlgorithm{preferred}, SupportedKeyAlgorithms...)
+	for _, candidate := range candidates {
+		for _, algorithm := range offered {
+			if algorithm == candidate {
+				return candidate, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w: 没有双方都支持的算法 %v", ErrUnsupportedKey, offered)
+}
+
+// GenerateKey 生成指定算法的私钥
+func GenerateKey(algorithm KeyAlgorithm) (crypto.Signer, error) {
+	switch algorithm {
+	case KeyAlgorithmEd25519:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	case KeyAlgorithmECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyAlgorithmRSA:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedKey, algorithm)
+	}
+}
+
+// KeyAlgorithmOf 获取公钥的算法，不支持的类型（如P-384）返回错误
+func KeyAlgorithmOf(publicKey crypto.PublicKey) (KeyAlgorithm, error) {
+	switch key := publicKey.(type) {
+	case ed25519.PublicKey:
+		return KeyAlgorithmEd25519, nil
+	case *ecdsa.PublicKey:
+		if key.Curve == elliptic.P256() {
+			return KeyAlgorithmECDSAP256, nil
+		}
+		return "", fmt.Errorf("%w: ECDSA %s", ErrUnsupportedKey, key.Curve.Params().Name)
+	case *rsa.PublicKey:
+		return KeyAlgorithmRSA, nil
+	default:
+		return "", fmt.Errorf("%w: %T", ErrUnsupportedKey, publicKey)
+	}
+}
+
+// MarshalPrivateKeyPEM 将私钥编码为PKCS#8格式的PEM
+func MarshalPrivateKeyPEM(privateKey crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("序列化私钥失败: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	}), nil
+}
+
+// ParsePrivateKeyPEM 解析PEM格式私钥，支持PKCS#8、PKCS#1（RSA）和SEC 1（EC）
+func ParsePrivateKeyPEM(privateKeyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil {
+		return nil, errors.New("无效的私钥PEM格式")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("解析私钥失败: %v", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, key)
+	}
+
+	if _, err := KeyAlgorithmOf(signer.Public()); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// PublicKeysEqual 比较两个公钥是否相同
+func PublicKeysEqual(a, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
+
+// certificateKeyUsage 根据密钥类型返回证书的密钥用途，只有RSA支持密钥加密
+func certificateKeyUsage(publicKey crypto.PublicKey) x509.KeyUsage {
+	if _, ok := publicKey.(*rsa.PublicKey); ok {
+		return x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	}
+	return x509.KeyUsageDigitalSignature
+}
+
+// signMessage 使用私钥签名，RSA和ECDSA先计算SHA-256，Ed25519直接签名原文
+func signMessage(privateKey crypto.Signer, data []byte) ([]byte, error) {
+	switch key := privateKey.(type) {
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, data), nil
+	case *ecdsa.PrivateKey:
+		hash := sha256.Sum256(data)
+		return ecdsa.SignASN1(rand.Reader, key, hash[:])
+	case *rsa.PrivateKey:
+		hash := sha256.Sum256(data)
+		return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, privateKey)
+	}
+}
+
+// verifyMessage 验证签名
+func verifyMessage(publicKey crypto.PublicKey, data, signature []byte) error {
+	switch key := publicKey.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, data, signature) {
+			return errors.New("签名无效")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(data)
+		if !ecdsa.VerifyASN1(key, hash[:], signature) {
+			return errors.New("签名无效")
+		}
+		return nil
+	case *rsa.PublicKey:
+		hash := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature)
+	default:
+		return fmt.Errorf("%w: %T", ErrUnsupportedKey, publicKey)
+	}
+}
+
+// wrapKeyFor 使用接收者公钥封装对称密钥
+// RSA使用OAEP；ECDSA和Ed25519使用临时密钥做ECDH，经HKDF派生AES-GCM密钥后封装，
+// 结果为 临时公钥 | nonce | 密文
+func wrapKeyFor(publicKey crypto.PublicKey, key []byte) ([]byte, error) {
+	if rsaKey, ok := publicKey.(*rsa.PublicKey); ok {
+		return rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaKey, key, nil)
+	}
+
+	recipient, err := ecdhPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeral, err := recipient.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("生成临时密钥失败: %v", err)
+	}
+
+	aead, err := ecdhAEAD(ephemeral, recipient, ephemeral.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("生成nonce失败: %v", err)
+	}
+
+	wrapped := append([]byte(nil), ephemeral.PublicKey().Bytes()...)
+	wrapped = append(wrapped, nonce...)
+	return aead.Seal(wrapped, nonce, key, nil), nil
+}
+
+// unwrapKeyWith 使用本地私钥解开 wrapKeyFor 封装的对称密钥
+func unwrapKeyWith(privateKey crypto.Signer, wrapped []byte) ([]byte, error) {
+	if rsaKey, ok := privateKey.(*rsa.PrivateKey); ok {
+		return rsa.DecryptOAEP(sha256.New(), rand.Reader, rsaKey, wrapped, nil)
+	}
+
+	local, err := ecdhPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// P-256为65字节的非压缩点，X25519为32字节
+	ephemeralSize := 65
+	if local.Curve() == ecdh.X25519() {
+		ephemeralSize = 32
+	}
+	if len(wrapped) < ephemeralSize+12 {
+		return nil, errors.New("封装的密钥长度无效")
+	}
+
+	ephemeral, err := local.Curve().NewPublicKey(wrapped[:ephemeralSize])
+	if err != nil {
+		return nil, fmt.Errorf("解析临时公钥失败: %v", err)
+	}
+
+	aead, err := ecdhAEAD(local, ephemeral, wrapped[:ephemeralSize])
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := wrapped[ephemeralSize : ephemeralSize+aead.NonceSize()]
+	return aead.Open(nil, nonce, wrapped[ephemeralSize+aead.NonceSize():], nil)
+}
+
+// ecdhAEAD 计算ECDH共享密钥并派生AES-256-GCM
+func ecdhAEAD(privateKey *ecdh.PrivateKey, publicKey *ecdh.PublicKey, ephemeral []byte) (cipher.AEAD, error) {
+	shared, err := privateKey.ECDH(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("密钥协商失败: %v", err)
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, ephemeral, []byte(ecdhInfo)), key); err != nil {
+		return nil, fmt.Errorf("派生密钥失败: %v", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("创建AES加密器失败: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// ecdhPublicKey 将签名公钥转换为ECDH公钥，Ed25519转换为对应的X25519公钥
+func ecdhPublicKey(publicKey crypto.PublicKey) (*ecdh.PublicKey, error) {
+	if _, err := KeyAlgorithmOf(publicKey); err != nil {
+		return nil, err
+	}
+
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		return key.ECDH()
+	case ed25519.PublicKey:
+		u, err := edwardsToMontgomery(key)
+		if err != nil {
+			return nil, err
+		}
+		return ecdh.X25519().NewPublicKey(u)
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, publicKey)
+	}
+}
+
+// ecdhPrivateKey 将签名私钥转换为ECDH私钥
+// Ed25519私钥对应的X25519标量为种子的SHA-512前32字节（RFC 8032）
+func ecdhPrivateKey(privateKey crypto.Signer) (*ecdh.PrivateKey, error) {
+	if _, err := KeyAlgorithmOf(privateKey.Public()); err != nil {
+		return nil, err
+	}
+
+	switch key := privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		return key.ECDH()
+	case ed25519.PrivateKey:
+		hash := sha512.Sum512(key.Seed())
+		return ecdh.X25519().NewPrivateKey(hash[:32])
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, privateKey)
+	}
+}
+
+// curve25519P 曲线25519的素数 2^255 - 19
+var curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// edwardsToMontgomery 将Ed25519公钥转换为X25519公钥：u = (1 + y) / (1 - y) mod p
+func edwardsToMontgomery(publicKey ed25519.PublicKey) ([]byte, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("无效的Ed25519公钥")
+	}
+
+	// 小端编码，最高位为x的符号位
+	encoded := make([]byte, 32)
+	for i := range encoded {
+		encoded[i] = publicKey[31-i]
+	}
+	encoded[0] &= 0x7f
+	y := new(big.Int).SetBytes(encoded)
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, errors.New("无效的Ed25519公钥")
+	}
+
+	one := big.NewInt(1)
+	denominator := new(big.Int).Sub(one, y)
+	denominator.Mod(denominator, curve25519P)
+	if denominator.Sign() == 0 {
+		return nil, errors.New("无效的Ed25519公钥")
+	}
+
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, new(big.Int).ModInverse(denominator, curve25519P))
+	u.Mod(u, curve25519P)
+
+	out := make([]byte, 32)
+	u.FillBytes(out)
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
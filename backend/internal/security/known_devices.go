@@ -0,0 +1,330 @@
+package security
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// KeyStatus 设备公钥与已固定公钥的比对结果
+type KeyStatus string
+
+const (
+	KeyStatusNew     KeyStatus = "new"     // 首次见到该设备，已固定公钥
+	KeyStatusMatch   KeyStatus = "match"   // 与已固定公钥一致
+	KeyStatusChanged KeyStatus = "changed" // 与已固定公钥不一致
+)
+
+// KnownDevice 已知设备记录
+type KnownDevice struct {
+	DeviceID    string    `json:"device_id"`
+	Name        string    `json:"name"`
+	Fingerprint string    `json:"fingerprint"` // 完整的SHA-256公钥指纹
+	PublicKey   string    `json:"public_key"`  // PEM格式公钥
+	Trusted     bool      `json:"trusted"`     // 是否经过配对或人工核对
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+
+	// 检测到公钥变化后待确认的新公钥
+	PendingFingerprint string `json:"pending_fingerprint,omitempty"`
+	PendingPublicKey   string `json:"pending_public_key,omitempty"`
+}
+
+// KeyChangeEvent 公钥变化事件
+type KeyChangeEvent struct {
+	DeviceID       string    `json:"device_id"`
+	Name           string    `json:"name"`
+	OldFingerprint string    `json:"old_fingerprint"`
+	NewFingerprint string    `json:"new_fingerprint"`
+	WasTrusted     bool      `json:"was_trusted"`
+	DetectedAt     time.Time `json:"detected_at"`
+}
+
+// KeyChangeCallback 公钥变化回调函数
+type KeyChangeCallback func(event KeyChangeEvent)
+
+// KnownDevices 持久化的已知设备存储，按设备ID固定公钥（首次使用即信任）
+type KnownDevices struct {
+	mu        sync.RWMutex
+	path      string
+	devices   map[string]*KnownDevice
+	callbacks []KeyChangeCallback
+}
+
+// LoadKnownDevices 从文件加载已知设备，文件不存在时返回空存储
+func LoadKnownDevices(path string) (*KnownDevices, error) {
+	store := &KnownDevices{
+		path:    path,
+		devices: make(map[string]*KnownDevice),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, fmt.Errorf("读取已知设备文件失败: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &store.devices); err != nil {
+		return nil, fmt.Errorf("解析已知设备文件失败: %v", err)
+	}
+
+	return store, nil
+}
+
+// Observe 记录设备出示的公钥
+// 首次见到的设备直接固定公钥；公钥变化时保留原公钥并触发key_changed事件
+func (k *KnownDevices) Observe(deviceID, name, publicKeyPEM string) (KeyStatus, *KnownDevice, error) {
+	fingerprint, _, err := publicKeyFingerprint(publicKeyPEM)
+	if err != nil {
+		return "", nil, err
+	}
+
+	k.mu.Lock()
+
+	now := time.Now()
+	device, exists := k.devices[deviceID]
+	if !exists {
+		device = &KnownDevice{
+			DeviceID:    deviceID,
+			Name:        name,
+			Fingerprint: fingerprint,
+			PublicKey:   publicKeyPEM,
+			FirstSeen:   now,
+			LastSeen:    now,
+		}
+		k.devices[deviceID] = device
+		err := k.save()
+		snapshot := *device
+		k.mu.Unlock()
+
+		log.Printf("首次见到设备 %s，已固定公钥指纹: %s", deviceID, fingerprint)
+		return KeyStatusNew, &snapshot, err
+	}
+
+	if device.Fingerprint == fingerprint {
+		device.LastSeen = now
+		if name != "" {
+			device.Name = name
+		}
+		snapshot := *device
+		k.mu.Unlock()
+		return KeyStatusMatch, &snapshot, nil
+	}
+
+	device.PendingFingerprint = fingerprint
+	device.PendingPublicKey = publicKeyPEM
+	err = k.save()
+	snapshot := *device
+
+	event := KeyChangeEvent{
+		DeviceID:       deviceID,
+		Name:           device.Name,
+		OldFingerprint: device.Fingerprint,
+		NewFingerprint: fingerprint,
+		WasTrusted:     device.Trusted,
+		DetectedAt:     now,
+	}
+	callbacks := append([]KeyChangeCallback(nil), k.callbacks...)
+	k.mu.Unlock()
+
+	log.Printf("警告: 设备 %s 的公钥已变化: %s -> %s", deviceID, event.OldFingerprint, event.NewFingerprint)
+	k.notifyCallbacks(callbacks, event)
+
+	return KeyStatusChanged, &snapshot, err
+}
+
+// Pin 固定设备公钥，覆盖原有记录（用于经过认证的配对流程）
+func (k *KnownDevices) Pin(deviceID, name, publicKeyPEM string, trusted bool) (*KnownDevice, error) {
+	fingerprint, _, err := publicKeyFingerprint(publicKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now()
+	device, exists := k.devices[deviceID]
+	if !exists {
+		device = &KnownDevice{
+			DeviceID:  deviceID,
+			FirstSeen: now,
+		}
+		k.devices[deviceID] = device
+	}
+
+	if name != "" {
+		device.Name = name
+	}
+	device.Fingerprint = fingerprint
+	device.PublicKey = publicKeyPEM
+	device.Trusted = trusted
+	device.LastSeen = now
+	device.PendingFingerprint = ""
+	device.PendingPublicKey = ""
+
+	snapshot := *device
+	return &snapshot, k.save()
+}
+
+// AcceptKeyChange 接受设备的新公钥，新公钥需要重新核对才会被信任
+func (k *KnownDevices) AcceptKeyChange(deviceID string) (*KnownDevice, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	device, exists := k.devices[deviceID]
+	if !exists {
+		return nil, fmt.Errorf("设备不存在: %s", deviceID)
+	}
+
+	if device.PendingFingerprint == "" {
+		return nil, fmt.Errorf("设备 %s 没有待确认的公钥", deviceID)
+	}
+
+	device.Fingerprint = device.PendingFingerprint
+	device.PublicKey = device.PendingPublicKey
+	device.PendingFingerprint = ""
+	device.PendingPublicKey = ""
+	device.Trusted = false
+
+	snapshot := *device
+	return &snapshot, k.save()
+}
+
+// MarkVerified 在人工核对短认证字符串后将设备标记为可信
+func (k *KnownDevices) MarkVerified(deviceID string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	device, exists := k.devices[deviceID]
+	if !exists {
+		return fmt.Errorf("设备不存在: %s", deviceID)
+	}
+
+	if device.PendingFingerprint != "" {
+		return fmt.Errorf("设备 %s 的公钥已变化，请先确认新公钥", deviceID)
+	}
+
+	device.Trusted = true
+	return k.save()
+}
+
+// Remove 删除设备记录
+func (k *KnownDevices) Remove(deviceID string) (*KnownDevice, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	device, exists := k.devices[deviceID]
+	if !exists {
+		return nil, nil
+	}
+
+	delete(k.devices, deviceID)
+	return device, k.save()
+}
+
+// Get 获取设备记录
+func (k *KnownDevices) Get(deviceID string) (*KnownDevice, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	device, exists := k.devices[deviceID]
+	if !exists {
+		return nil, false
+	}
+
+	snapshot := *device
+	return &snapshot, true
+}
+
+// List 获取所有已知设备，按设备ID排序
+func (k *KnownDevices) List() []KnownDevice {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	devices := make([]KnownDevice, 0, len(k.devices))
+	for _, device := range k.devices {
+		devices = append(devices, *device)
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].DeviceID < devices[j].DeviceID
+	})
+
+	return devices
+}
+
+// OnKeyChanged 注册公钥变化回调
+func (k *KnownDevices) OnKeyChanged(callback KeyChangeCallback) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.callbacks = append(k.callbacks, callback)
+}
+
+// notifyCallbacks 通知所有注册的回调函数
+func (k *KnownDevices) notifyCallbacks(callbacks []KeyChangeCallback, event KeyChangeEvent) {
+	for _, callback := range callbacks {
+		go func(cb KeyChangeCallback) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Key change callback panic: %v", r)
+				}
+			}()
+
+			cb(event)
+		}(callback)
+	}
+}
+
+// save 将设备记录写入文件，调用方需持有锁
+func (k *KnownDevices) save() error {
+	data, err := json.MarshalIndent(k.devices, "", "  ")
+	if err != nil {
+		return fmt.Errorf("序列化已知设备失败: %v", err)
+	}
+
+	// 先写临时文件再重命名，避免写入中断导致文件损坏
+	tempPath := k.path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0600); err != nil {
+		return fmt.Errorf("写入已知设备文件失败: %v", err)
+	}
+
+	if err := os.Rename(tempPath, k.path); err != nil {
+		return fmt.Errorf("写入已知设备文件失败: %v", err)
+	}
+
+	return nil
+}
+
+// publicKeyFingerprint 解析PEM格式公钥并计算完整的SHA-256指纹
+func publicKeyFingerprint(publicKeyPEM string) (string, crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return "", nil, errors.New("无效的公钥PEM格式")
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", nil, fmt.Errorf("解析公钥失败: %v", err)
+	}
+
+	// 只接受可以用于签名验证和密钥封装的类型
+	if _, err := KeyAlgorithmOf(publicKey); err != nil {
+		return "", nil, err
+	}
+
+	hash := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(hash[:]), publicKey, nil
+}
@@ -0,0 +1,135 @@
+package security
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OriginPolicy 跨域来源策略，CORS和WebSocket握手共用同一份白名单
+//
+// 白名单条目支持以下格式：
+//   - "*"                        允许所有来源
+//   - "https://app.example.com"  精确匹配协议、主机和端口
+//   - "https://*.example.com"    匹配example.com的所有子域名
+//
+// 同源判断只对本节点自身的主机名生效（见AllowHosts），
+// 防止DNS重绑定：攻击者域名解析到本节点后，Origin与Host一致但主机名不属于本节点
+type OriginPolicy struct {
+	allowAll bool
+	origins  map[string]bool
+	suffixes []originSuffix
+	hosts    map[string]bool // 本节点的主机名和IP地址，不含端口
+}
+
+// originSuffix 子域名通配规则
+type originSuffix struct {
+	scheme string
+	suffix string // 以"."开头的域名后缀，可带端口
+}
+
+// NewOriginPolicy 根据白名单创建来源策略
+func NewOriginPolicy(allowedOrigins []string) *OriginPolicy {
+	policy := &OriginPolicy{
+		origins: make(map[string]bool),
+		hosts:   make(map[string]bool),
+	}
+
+	for _, origin := range allowedOrigins {
+		origin = normalizeOrigin(origin)
+		switch {
+		case origin == "":
+			continue
+		case origin == "*":
+			policy.allowAll = true
+		case strings.Contains(origin, "://*."):
+			parts := strings.SplitN(origin, "://*", 2)
+			policy.suffixes = append(policy.suffixes, originSuffix{
+				scheme: parts[0],
+				suffix: parts[1],
+			})
+		default:
+			policy.origins[origin] = true
+		}
+	}
+
+	return policy
+}
+
+// AllowHosts 登记本节点的主机名和IP地址，只有这些主机上的页面被视为同源
+// 需要在开始处理请求前调用
+func (p *OriginPolicy) AllowHosts(hosts ...string) {
+	for _, host := range hosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" {
+			p.hosts[strings.Trim(host, "[]")] = true
+		}
+	}
+}
+
+// AllowsAll 是否允许所有来源
+func (p *OriginPolicy) AllowsAll() bool {
+	return p.allowAll
+}
+
+// Allowed 检查来源是否在白名单中
+func (p *OriginPolicy) Allowed(origin string) bool {
+	origin = normalizeOrigin(origin)
+	if origin == "" {
+		return false
+	}
+
+	if p.allowAll || p.origins[origin] {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	for _, suffix := range p.suffixes {
+		if u.Scheme == suffix.scheme && strings.HasSuffix(u.Host, suffix.suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckRequest 检查请求来源，可直接用作websocket.Upgrader.CheckOrigin
+// 没有Origin头的请求来自非浏览器客户端，同源请求始终允许
+func (p *OriginPolicy) CheckRequest(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if p.IsSameOrigin(r) {
+		return true
+	}
+
+	return p.Allowed(origin)
+}
+
+// IsSameOrigin 检查请求的Origin与Host一致，且Host是本节点登记的主机名
+func (p *OriginPolicy) IsSameOrigin(r *http.Request) bool {
+	u, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil || !strings.EqualFold(u.Host, r.Host) {
+		return false
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return p.hosts[strings.ToLower(strings.Trim(host, "[]"))]
+}
+
+// normalizeOrigin 统一来源格式：去除空白和末尾斜杠并转为小写
+func normalizeOrigin(origin string) string {
+	origin = strings.TrimSpace(origin)
+	origin = strings.TrimSuffix(origin, "/")
+	return strings.ToLower(origin)
+}
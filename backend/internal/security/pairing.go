@@ -0,0 +1,469 @@
+package security
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// SPAKE2（RFC 9382）在P-256曲线上使用的固定点M和N（压缩格式）
+const (
+	spake2PointM = "02886e2f97ace46e55ba9dd7242579f2993b64e16ef3dcab95afd497333d8fa12f"
+	spake2PointN = "03d8bbd6c639c62937b04d997f38c3770719c629d7014d49a24b4f98baa1292b49"
+)
+
+const (
+	pairingCodeTTL     = 2 * time.Minute // 配对码有效期
+	pairingMaxAttempts = 3               // 每个配对码允许的最大尝试次数
+	pairingKeyLabel    = "airshare-pairing-key"
+)
+
+// PairingCode 配对码，由本设备显示给用户
+type PairingCode struct {
+	ID        string    `json:"pairing_id"`
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// PairingRequest 配对请求（SPAKE2第一条消息，由输入配对码的设备发送）
+type PairingRequest struct {
+	DeviceID   string         `json:"device_id"`            // 发起配对的设备ID
+	DeviceName string         `json:"device_name"`          // 发起配对的设备名称
+	PA         string         `json:"pa"`                   // SPAKE2公开值pA（base64编码）
+	Algorithms []KeyAlgorithm `json:"algorithms,omitempty"` // 发起方支持的身份密钥算法
+}
+
+// PairingResponse 配对响应（SPAKE2第二条消息）
+type PairingResponse struct {
+	PairingID string       `json:"pairing_id"`
+	PB        string       `json:"pb"`                  // SPAKE2公开值pB（base64编码）
+	Confirm   string       `json:"confirm"`             // 本设备的密钥确认值（base64编码）
+	Algorithm KeyAlgorithm `json:"algorithm,omitempty"` // 协商的身份密钥算法，发起方应使用该算法的公钥确认
+}
+
+// PairingConfirm 配对确认，携带发起方的密钥确认值和公钥
+type PairingConfirm struct {
+	PairingID string `json:"pairing_id"`
+	Confirm   string `json:"confirm"`    // 发起方的密钥确认值（base64编码）
+	PublicKey string `json:"public_key"` // 发起方的PEM格式公钥
+	KeyMAC    string `json:"key_mac"`    // 使用会话密钥对公钥计算的MAC（base64编码）
+}
+
+// PairingResult 配对结果，携带本设备的公钥供对方固定
+type PairingResult struct {
+	DeviceID          string `json:"device_id"`          // 已配对设备ID
+	DeviceName        string `json:"device_name"`        // 已配对设备名称
+	DeviceFingerprint string `json:"device_fingerprint"` // 已配对设备的公钥指纹
+	NodeID            string `json:"node_id"`            // 本设备标识（公钥指纹）
+	PublicKey         string `json:"public_key"`         // 本设备的PEM格式公钥
+	KeyMAC            string `json:"key_mac"`            // 使用会话密钥对本设备公钥计算的MAC
+	Token             string `json:"token,omitempty"`    // 使用会话密钥AES-GCM加密的访问令牌（base64(nonce||密文)）
+}
+
+// PairingService 基于PIN码和SPAKE2的设备配对服务
+type PairingService struct {
+	mu         sync.Mutex
+	encryption *EncryptionService
+	tokens     *TokenStore
+	curve      elliptic.Curve
+	mx, my     *big.Int
+	nx, ny     *big.Int
+	offer      *pairingOffer
+}
+
+// pairingOffer 当前有效的配对码
+type pairingOffer struct {
+	code     PairingCode
+	attempts int
+	session  *pairingSession
+}
+
+// pairingSession 进行中的SPAKE2握手
+type pairingSession struct {
+	deviceID   string
+	deviceName string
+	algorithm  KeyAlgorithm // 协商的身份密钥算法，发起方未提供列表时为空
+	sessionKey []byte       // Ke
+	confirmA   []byte       // 期望的发起方确认值
+}
+
+// NewPairingService 创建新的配对服务
+// tokens不为nil时，配对成功后为设备签发访问令牌
+func NewPairingService(encryption *EncryptionService, tokens *TokenStore) (*PairingService, error) {
+	curve := elliptic.P256()
+
+	mx, my, err := decodeCompressedPoint(curve, spake2PointM)
+	if err != nil {
+		return nil, fmt.Errorf("解析SPAKE2常量M失败: %v", err)
+	}
+
+	nx, ny, err := decodeCompressedPoint(curve, spake2PointN)
+	if err != nil {
+		return nil, fmt.Errorf("解析SPAKE2常量N失败: %v", err)
+	}
+
+	return &PairingService{
+		encryption: encryption,
+		tokens:     tokens,
+		curve:      curve,
+		mx:         mx,
+		my:         my,
+		nx:         nx,
+		ny:         ny,
+	}, nil
+}
+
+// StartPairing 生成新的6位配对码，之前的配对码立即失效
+func (s *PairingService) StartPairing() (*PairingCode, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return nil, fmt.Errorf("生成配对码失败: %v", err)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("生成配对ID失败: %v", err)
+	}
+
+	code := PairingCode{
+		ID:        hex.EncodeToString(id),
+		Code:      fmt.Sprintf("%06d", n.Int64()),
+		ExpiresAt: time.Now().Add(pairingCodeTTL),
+	}
+
+	s.mu.Lock()
+	s.offer = &pairingOffer{code: code}
+	s.mu.Unlock()
+
+	log.Printf("已生成配对码，有效期至 %s", code.ExpiresAt.Format(time.RFC3339))
+	return &code, nil
+}
+
+// CurrentCode 获取当前有效的配对码，用于生成配对二维码
+func (s *PairingService) CurrentCode() (*PairingCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	offer, err := s.activeOffer()
+	if err != nil {
+		return nil, err
+	}
+	code := offer.code
+	return &code, nil
+}
+
+// CancelPairing 取消当前的配对码
+func (s *PairingService) CancelPairing() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offer = nil
+}
+
+// TrustedDevices 获取已配对的设备及其公钥指纹
+func (s *PairingService) TrustedDevices() map[string]string {
+	return s.encryption.GetTrustedDevices()
+}
+
+// Unpair 解除设备配对并吊销设备的访问令牌
+func (s *PairingService) Unpair(deviceID string) error {
+	if err := s.encryption.UntrustDevice(deviceID); err != nil {
+		return err
+	}
+	if s.tokens != nil {
+		if err := s.tokens.RevokeDevice(deviceID); err != nil {
+			return err
+		}
+	}
+	log.Printf("已解除设备 %s 的配对", deviceID)
+	return nil
+}
+
+// HandleRequest 处理配对请求，计算本方SPAKE2公开值和密钥确认值
+func (s *PairingService) HandleRequest(req *PairingRequest) (*PairingResponse, error) {
+	if req.DeviceID == "" {
+		return nil, errors.New("缺少设备ID")
+	}
+
+	pA, err := base64.StdEncoding.DecodeString(req.PA)
+	if err != nil {
+		return nil, fmt.Errorf("解码pA失败: %v", err)
+	}
+
+	xx, xy := elliptic.Unmarshal(s.curve, pA)
+	if xx == nil {
+		return nil, errors.New("无效的pA")
+	}
+
+	// 在消耗尝试次数之前协商算法，不兼容的设备不会占用配对码
+	algorithm, err := NegotiateKeyAlgorithm(s.encryption.KeyAlgorithm(), req.Algorithms)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Algorithms) == 0 {
+		algorithm = ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	offer, err := s.activeOffer()
+	if err != nil {
+		return nil, err
+	}
+
+	// 每次握手都消耗一次尝试机会，限制在线猜测
+	offer.attempts++
+	offer.session = nil
+	if offer.attempts > pairingMaxAttempts {
+		s.offer = nil
+		return nil, errors.New("配对尝试次数过多，请重新生成配对码")
+	}
+
+	w := s.passwordScalar(offer.code.Code)
+
+	y, err := rand.Int(rand.Reader, new(big.Int).Sub(s.curve.Params().N, big.NewInt(1)))
+	if err != nil {
+		return nil, fmt.Errorf("生成随机数失败: %v", err)
+	}
+	y.Add(y, big.NewInt(1))
+
+	// pB = y*G + w*N
+	gx, gy := s.curve.ScalarBaseMult(y.Bytes())
+	wnx, wny := s.curve.ScalarMult(s.nx, s.ny, w.Bytes())
+	yx, yy := s.curve.Add(gx, gy, wnx, wny)
+	pB := elliptic.Marshal(s.curve, yx, yy)
+
+	// K = y*(pA - w*M)
+	wmx, wmy := s.curve.ScalarMult(s.mx, s.my, w.Bytes())
+	tx, ty := s.curve.Add(xx, xy, wmx, new(big.Int).Sub(s.curve.Params().P, wmy))
+	kx, ky := s.curve.ScalarMult(tx, ty, y.Bytes())
+	if kx.Sign() == 0 && ky.Sign() == 0 {
+		return nil, errors.New("无效的共享点")
+	}
+	k := elliptic.Marshal(s.curve, kx, ky)
+
+	nodeID := s.encryption.GetFingerprint()
+	transcript := spake2Transcript([]byte(req.DeviceID), []byte(nodeID), pA, pB, k, w.Bytes())
+
+	sessionKey, confirmA, confirmB, err := spake2Keys(transcript)
+	if err != nil {
+		return nil, err
+	}
+
+	offer.session = &pairingSession{
+		deviceID:   req.DeviceID,
+		deviceName: req.DeviceName,
+		algorithm:  algorithm,
+		sessionKey: sessionKey,
+		confirmA:   confirmA,
+	}
+
+	return &PairingResponse{
+		PairingID: offer.code.ID,
+		PB:        base64.StdEncoding.EncodeToString(pB),
+		Confirm:   base64.StdEncoding.EncodeToString(confirmB),
+		Algorithm: algorithm,
+	}, nil
+}
+
+// HandleConfirm 校验发起方的确认值，固定双方公钥并将设备标记为可信
+func (s *PairingService) HandleConfirm(confirm *PairingConfirm) (*PairingResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	offer, err := s.activeOffer()
+	if err != nil {
+		return nil, err
+	}
+
+	session := offer.session
+	if session == nil || offer.code.ID != confirm.PairingID {
+		return nil, errors.New("配对会话不存在")
+	}
+	offer.session = nil
+
+	confirmA, err := base64.StdEncoding.DecodeString(confirm.Confirm)
+	if err != nil || !hmac.Equal(confirmA, session.confirmA) {
+		if offer.attempts >= pairingMaxAttempts {
+			s.offer = nil
+		}
+		return nil, errors.New("配对码错误")
+	}
+
+	keyMAC, err := base64.StdEncoding.DecodeString(confirm.KeyMAC)
+	if err != nil || !hmac.Equal(keyMAC, pairingKeyMAC(session.sessionKey, session.deviceID, confirm.PublicKey)) {
+		s.offer = nil
+		return nil, errors.New("公钥校验失败")
+	}
+
+	if err := checkKeyAlgorithm(confirm.PublicKey, session.algorithm); err != nil {
+		s.offer = nil
+		return nil, err
+	}
+
+	fingerprint, err := s.encryption.TrustDevice(session.deviceID, session.deviceName, confirm.PublicKey)
+	if err != nil {
+		s.offer = nil
+		return nil, err
+	}
+
+	// 配对码只能成功使用一次
+	s.offer = nil
+
+	nodeID := s.encryption.GetFingerprint()
+	nodeKey := s.encryption.GetPublicKey()
+
+	log.Printf("设备 %s 配对成功，指纹: %s", session.deviceID, fingerprint)
+
+	result := &PairingResult{
+		DeviceID:          session.deviceID,
+		DeviceName:        session.deviceName,
+		DeviceFingerprint: fingerprint,
+		NodeID:            nodeID,
+		PublicKey:         nodeKey,
+		KeyMAC:            base64.StdEncoding.EncodeToString(pairingKeyMAC(session.sessionKey, nodeID, nodeKey)),
+	}
+
+	if s.tokens != nil {
+		token, _, err := s.tokens.Issue(session.deviceID, DefaultDeviceScopes, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		// 令牌使用握手的会话密钥加密，避免在未加密的连接上泄露
+		sealed, err := sealWithSessionKey(session.sessionKey, []byte(token))
+		if err != nil {
+			return nil, err
+		}
+		result.Token = base64.StdEncoding.EncodeToString(sealed)
+	}
+
+	return result, nil
+}
+
+// activeOffer 获取当前有效的配对码，调用方需持有锁
+func (s *PairingService) activeOffer() (*pairingOffer, error) {
+	if s.offer == nil {
+		return nil, errors.New("没有进行中的配对")
+	}
+
+	if time.Now().After(s.offer.code.ExpiresAt) {
+		s.offer = nil
+		return nil, errors.New("配对码已过期")
+	}
+
+	return s.offer, nil
+}
+
+// passwordScalar 由配对码派生SPAKE2的口令标量w
+func (s *PairingService) passwordScalar(code string) *big.Int {
+	hash := sha256.Sum256([]byte("airshare-pairing:" + code))
+	w := new(big.Int).SetBytes(hash[:])
+	return w.Mod(w, s.curve.Params().N)
+}
+
+// checkKeyAlgorithm 检查公钥类型受支持，并且与协商的算法一致
+func checkKeyAlgorithm(publicKeyPEM string, negotiated KeyAlgorithm) error {
+	_, publicKey, err := publicKeyFingerprint(publicKeyPEM)
+	if err != nil {
+		return err
+	}
+
+	algorithm, err := KeyAlgorithmOf(publicKey)
+	if err != nil {
+		return err
+	}
+
+	if negotiated != "" && algorithm != negotiated {
+		return fmt.Errorf("%w: 协商的算法为 %s，收到 %s", ErrUnsupportedKey, negotiated, algorithm)
+	}
+	return nil
+}
+
+// spake2Transcript 按RFC 9382构造握手记录，每个字段前附加8字节小端长度
+func spake2Transcript(fields ...[]byte) []byte {
+	var transcript []byte
+	for _, field := range fields {
+		var length [8]byte
+		binary.LittleEndian.PutUint64(length[:], uint64(len(field)))
+		transcript = append(transcript, length[:]...)
+		transcript = append(transcript, field...)
+	}
+	return transcript
+}
+
+// spake2Keys 由握手记录派生会话密钥和双方的确认值
+func spake2Keys(transcript []byte) (sessionKey, confirmA, confirmB []byte, err error) {
+	hash := sha256.Sum256(transcript)
+	sessionKey = hash[:16]
+	authKey := hash[16:]
+
+	confirmKeys := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, authKey, nil, []byte("ConfirmationKeys")), confirmKeys); err != nil {
+		return nil, nil, nil, fmt.Errorf("派生确认密钥失败: %v", err)
+	}
+
+	macA := hmac.New(sha256.New, confirmKeys[:16])
+	macA.Write(transcript)
+	macB := hmac.New(sha256.New, confirmKeys[16:])
+	macB.Write(transcript)
+
+	return sessionKey, macA.Sum(nil), macB.Sum(nil), nil
+}
+
+// pairingKeyMAC 使用会话密钥认证交换的公钥
+func pairingKeyMAC(sessionKey []byte, deviceID, publicKeyPEM string) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(pairingKeyLabel))
+	mac.Write(spake2Transcript([]byte(deviceID), []byte(publicKeyPEM)))
+	return mac.Sum(nil)
+}
+
+// sealWithSessionKey 使用会话密钥进行AES-GCM加密，输出nonce||密文
+func sealWithSessionKey(sessionKey, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return nil, fmt.Errorf("创建AES加密器失败: %v", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("创建GCM失败: %v", err)
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("生成nonce失败: %v", err)
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decodeCompressedPoint 解析十六进制编码的压缩曲线点
+func decodeCompressedPoint(curve elliptic.Curve, encoded string) (*big.Int, *big.Int, error) {
+	data, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	x, y := elliptic.UnmarshalCompressed(curve, data)
+	if x == nil {
+		return nil, nil, errors.New("无效的曲线点")
+	}
+	return x, y, nil
+}
@@ -0,0 +1,225 @@
+package security
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// pairingInitiator 测试中扮演输入配对码的设备，按RFC 9382计算发起方的SPAKE2消息
+type pairingInitiator struct {
+	responder *PairingService // 只借用曲线和常量M、N
+	deviceID  string
+	w         *big.Int
+	x         *big.Int
+	pA        []byte
+}
+
+// newPairingInitiator 用 pin 生成发起方的公开值 pA = x*G + w*M
+func newPairingInitiator(t *testing.T, responder *PairingService, deviceID, pin string) *pairingInitiator {
+	t.Helper()
+
+	curve := responder.curve
+	x, err := rand.Int(rand.Reader, new(big.Int).Sub(curve.Params().N, big.NewInt(1)))
+	if err != nil {
+		t.Fatalf("生成随机数失败: %v", err)
+	}
+	x.Add(x, big.NewInt(1))
+
+	w := responder.passwordScalar(pin)
+	gx, gy := curve.ScalarBaseMult(x.Bytes())
+	wmx, wmy := curve.ScalarMult(responder.mx, responder.my, w.Bytes())
+	ax, ay := curve.Add(gx, gy, wmx, wmy)
+
+	return &pairingInitiator{
+		responder: responder,
+		deviceID:  deviceID,
+		w:         w,
+		x:         x,
+		pA:        elliptic.Marshal(curve, ax, ay),
+	}
+}
+
+// request 配对请求
+func (p *pairingInitiator) request() *PairingRequest {
+	return &PairingRequest{
+		DeviceID:   p.deviceID,
+		DeviceName: "test device",
+		PA:         base64.StdEncoding.EncodeToString(p.pA),
+	}
+}
+
+// finish 由响应计算 K = x*(pB - w*N)，返回会话密钥、发起方确认值以及响应方确认值是否匹配
+func (p *pairingInitiator) finish(t *testing.T, resp *PairingResponse, nodeID string) ([]byte, []byte, bool) {
+	t.Helper()
+
+	curve := p.responder.curve
+	pB, err := base64.StdEncoding.DecodeString(resp.PB)
+	if err != nil {
+		t.Fatalf("解码pB失败: %v", err)
+	}
+	bx, by := elliptic.Unmarshal(curve, pB)
+	if bx == nil {
+		t.Fatal("无效的pB")
+	}
+
+	wnx, wny := curve.ScalarMult(p.responder.nx, p.responder.ny, p.w.Bytes())
+	tx, ty := curve.Add(bx, by, wnx, new(big.Int).Sub(curve.Params().P, wny))
+	kx, ky := curve.ScalarMult(tx, ty, p.x.Bytes())
+	k := elliptic.Marshal(curve, kx, ky)
+
+	transcript := spake2Transcript([]byte(p.deviceID), []byte(nodeID), p.pA, pB, k, p.w.Bytes())
+	sessionKey, confirmA, confirmB, err := spake2Keys(transcript)
+	if err != nil {
+		t.Fatalf("派生会话密钥失败: %v", err)
+	}
+
+	received, err := base64.StdEncoding.DecodeString(resp.Confirm)
+	if err != nil {
+		t.Fatalf("解码确认值失败: %v", err)
+	}
+	return sessionKey, confirmA, hmac.Equal(received, confirmB)
+}
+
+// newTestPairingService 创建使用临时目录的配对服务
+func newTestPairingService(t *testing.T) (*PairingService, *TokenStore) {
+	t.Helper()
+
+	dir := t.TempDir()
+	encryption, err := NewEncryptionService(filepath.Join(dir, "keys"), KeyAlgorithmECDSAP256)
+	if err != nil {
+		t.Fatalf("创建加密服务失败: %v", err)
+	}
+	tokens, err := LoadTokenStore(filepath.Join(dir, "tokens.json"))
+	if err != nil {
+		t.Fatalf("创建令牌存储失败: %v", err)
+	}
+	service, err := NewPairingService(encryption, tokens)
+	if err != nil {
+		t.Fatalf("创建配对服务失败: %v", err)
+	}
+	return service, tokens
+}
+
+// wrongPIN 与 code 不同的6位配对码
+func wrongPIN(code string, i int) string {
+	n, _ := strconv.Atoi(code)
+	return fmt.Sprintf("%06d", (n+1+i)%1000000)
+}
+
+func TestPairingSPAKE2(t *testing.T) {
+	initiatorKeys, err := NewEncryptionService(t.TempDir(), KeyAlgorithmECDSAP256)
+	if err != nil {
+		t.Fatalf("创建发起方密钥失败: %v", err)
+	}
+	publicKey := initiatorKeys.GetPublicKey()
+
+	tests := []struct {
+		name       string
+		wrongPINs  int  // 使用正确的配对码之前输错的次数
+		wantPaired bool // 最后使用正确的配对码能否配对
+	}{
+		{name: "correct pin", wrongPINs: 0, wantPaired: true},
+		{name: "wrong pin then correct", wrongPINs: pairingMaxAttempts - 1, wantPaired: true},
+		{name: "attempts exhausted", wrongPINs: pairingMaxAttempts, wantPaired: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responder, tokens := newTestPairingService(t)
+			code, err := responder.StartPairing()
+			if err != nil {
+				t.Fatalf("生成配对码失败: %v", err)
+			}
+			nodeID := responder.encryption.GetFingerprint()
+			const deviceID = "initiator"
+
+			// 错误的配对码双方都无法通过对方的确认
+			for i := 0; i < tt.wrongPINs; i++ {
+				initiator := newPairingInitiator(t, responder, deviceID, wrongPIN(code.Code, i))
+				resp, err := responder.HandleRequest(initiator.request())
+				if err != nil {
+					t.Fatalf("第 %d 次尝试被拒绝: %v", i+1, err)
+				}
+				sessionKey, confirmA, ok := initiator.finish(t, resp, nodeID)
+				if ok {
+					t.Fatal("错误的配对码通过了响应方的确认")
+				}
+				_, err = responder.HandleConfirm(&PairingConfirm{
+					PairingID: resp.PairingID,
+					Confirm:   base64.StdEncoding.EncodeToString(confirmA),
+					PublicKey: publicKey,
+					KeyMAC:    base64.StdEncoding.EncodeToString(pairingKeyMAC(sessionKey, deviceID, publicKey)),
+				})
+				if err == nil {
+					t.Fatal("错误的配对码完成了配对")
+				}
+			}
+
+			initiator := newPairingInitiator(t, responder, deviceID, code.Code)
+			resp, err := responder.HandleRequest(initiator.request())
+			if !tt.wantPaired {
+				if err == nil {
+					t.Fatal("尝试次数用尽后仍然接受配对请求")
+				}
+				if responder.encryption.IsTrusted(deviceID) {
+					t.Fatal("尝试次数用尽后设备被标记为可信")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("处理配对请求失败: %v", err)
+			}
+
+			sessionKey, confirmA, ok := initiator.finish(t, resp, nodeID)
+			if !ok {
+				t.Fatal("正确的配对码未通过响应方的确认")
+			}
+			result, err := responder.HandleConfirm(&PairingConfirm{
+				PairingID: resp.PairingID,
+				Confirm:   base64.StdEncoding.EncodeToString(confirmA),
+				PublicKey: publicKey,
+				KeyMAC:    base64.StdEncoding.EncodeToString(pairingKeyMAC(sessionKey, deviceID, publicKey)),
+			})
+			if err != nil {
+				t.Fatalf("确认配对失败: %v", err)
+			}
+
+			if !responder.encryption.IsTrusted(deviceID) {
+				t.Fatal("配对成功后设备未被标记为可信")
+			}
+			keyMAC, _ := base64.StdEncoding.DecodeString(result.KeyMAC)
+			if !hmac.Equal(keyMAC, pairingKeyMAC(sessionKey, result.NodeID, result.PublicKey)) {
+				t.Fatal("响应方公钥的MAC校验失败")
+			}
+
+			// 令牌使用会话密钥加密
+			sealed, err := base64.StdEncoding.DecodeString(result.Token)
+			if err != nil {
+				t.Fatalf("解码令牌失败: %v", err)
+			}
+			block, _ := aes.NewCipher(sessionKey)
+			gcm, _ := cipher.NewGCM(block)
+			token, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+			if err != nil {
+				t.Fatalf("解密令牌失败: %v", err)
+			}
+			if _, err := tokens.Validate(string(token)); err != nil {
+				t.Fatalf("签发的令牌无效: %v", err)
+			}
+
+			// 配对码只能成功使用一次
+			if _, err := responder.HandleRequest(newPairingInitiator(t, responder, deviceID, code.Code).request()); err == nil {
+				t.Fatal("配对码被重复使用")
+			}
+		})
+	}
+}
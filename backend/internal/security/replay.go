@@ -0,0 +1,203 @@
+package security
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultReplaySkew     = 2 * time.Minute // 允许的最大时钟偏差
+	DefaultNonceCacheSize = 4096            // 随机数缓存的最大条目数
+	replayWindowSize      = 64              // 序列号滑动窗口大小，允许窗口内的乱序到达
+	maxTrackedReplayPeers = 1024            // 最多跟踪的对等端数量
+)
+
+var (
+	ErrReplayTimestamp = errors.New("消息时间戳超出允许范围")
+	ErrReplaySequence  = errors.New("消息序列号重复或过旧")
+	ErrReplayNonce     = errors.New("消息随机数重复")
+	ErrReplayMissing   = errors.New("消息缺少防重放字段")
+)
+
+// ReplayError 重放检测拒绝消息时返回的错误
+// 可以使用 errors.Is 判断具体原因（ErrReplayTimestamp 等）
+type ReplayError struct {
+	PeerID   string
+	Sequence uint64
+	Err      error
+}
+
+func (e *ReplayError) Error() string {
+	return fmt.Sprintf("拒绝来自 %s 的消息（序列号 %d）: %v", e.PeerID, e.Sequence, e.Err)
+}
+
+func (e *ReplayError) Unwrap() error {
+	return e.Err
+}
+
+// IsReplayError 检查错误是否由重放检测产生
+func IsReplayError(err error) bool {
+	var replayErr *ReplayError
+	return errors.As(err, &replayErr)
+}
+
+// ReplayGuard 重放检测器
+// 按对等端跟踪单调递增的序列号，检查时间戳偏差，并缓存最近见过的随机数
+type ReplayGuard struct {
+	mu        sync.Mutex
+	maxSkew   time.Duration
+	cacheSize int
+	peers     map[string]*sequenceWindow
+	nonces    map[string]*list.Element
+	order     *list.List // 随机数按插入顺序排列，用于淘汰最旧的条目
+	now       func() time.Time
+}
+
+// sequenceWindow 单个对等端的序列号滑动窗口
+type sequenceWindow struct {
+	highest  uint64 // 已接受的最大序列号
+	bitmap   uint64 // 第i位表示 highest-i 是否已接受
+	lastSeen time.Time
+}
+
+// nonceEntry 随机数缓存条目
+type nonceEntry struct {
+	key    string
+	seenAt time.Time
+}
+
+// NewReplayGuard 创建重放检测器
+// maxSkew 为允许的时间戳偏差，nonceCacheSize 为随机数缓存上限，传0使用默认值
+func NewReplayGuard(maxSkew time.Duration, nonceCacheSize int) *ReplayGuard {
+	if maxSkew <= 0 {
+		maxSkew = DefaultReplaySkew
+	}
+	if nonceCacheSize <= 0 {
+		nonceCacheSize = DefaultNonceCacheSize
+	}
+
+	return &ReplayGuard{
+		maxSkew:   maxSkew,
+		cacheSize: nonceCacheSize,
+		peers:     make(map[string]*sequenceWindow),
+		nonces:    make(map[string]*list.Element),
+		order:     list.New(),
+		now:       time.Now,
+	}
+}
+
+// Check 检查消息是否为重放，通过检查时记录序列号和随机数
+// sequence 为0表示消息不带序列号，此时只依赖时间戳和随机数
+func (g *ReplayGuard) Check(peerID string, sequence uint64, timestamp time.Time, nonce string) error {
+	reject := func(err error) error {
+		return &ReplayError{PeerID: peerID, Sequence: sequence, Err: err}
+	}
+
+	if peerID == "" || nonce == "" || timestamp.IsZero() {
+		return reject(ErrReplayMissing)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	if timestamp.Before(now.Add(-g.maxSkew)) || timestamp.After(now.Add(g.maxSkew)) {
+		return reject(ErrReplayTimestamp)
+	}
+
+	g.expireNonces(now)
+
+	nonceKey := peerID + "\x00" + nonce
+	if _, seen := g.nonces[nonceKey]; seen {
+		return reject(ErrReplayNonce)
+	}
+
+	if sequence != 0 {
+		window := g.peers[peerID]
+		if window == nil {
+			window = &sequenceWindow{}
+		}
+		if !window.accept(sequence) {
+			return reject(ErrReplaySequence)
+		}
+		window.lastSeen = now
+		if g.peers[peerID] == nil {
+			g.trackPeer(peerID, window)
+		}
+	}
+
+	g.nonces[nonceKey] = g.order.PushBack(&nonceEntry{key: nonceKey, seenAt: now})
+	for g.order.Len() > g.cacheSize {
+		g.removeNonce(g.order.Front())
+	}
+
+	return nil
+}
+
+// Forget 清除对等端的序列号状态，例如对方重新配对或更换密钥后
+func (g *ReplayGuard) Forget(peerID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.peers, peerID)
+}
+
+// accept 检查序列号并更新窗口，重复或落在窗口之外的旧序列号返回false
+func (w *sequenceWindow) accept(sequence uint64) bool {
+	if sequence > w.highest {
+		shift := sequence - w.highest
+		if shift >= replayWindowSize {
+			w.bitmap = 1
+		} else {
+			w.bitmap = w.bitmap<<shift | 1
+		}
+		w.highest = sequence
+		return true
+	}
+
+	offset := w.highest - sequence
+	if offset >= replayWindowSize {
+		return false
+	}
+
+	mask := uint64(1) << offset
+	if w.bitmap&mask != 0 {
+		return false
+	}
+	w.bitmap |= mask
+	return true
+}
+
+// trackPeer 记录新的对等端，超过上限时淘汰最久未活动的对等端，调用方需持有锁
+func (g *ReplayGuard) trackPeer(peerID string, window *sequenceWindow) {
+	if len(g.peers) >= maxTrackedReplayPeers {
+		var oldestID string
+		var oldest time.Time
+		for id, w := range g.peers {
+			if oldestID == "" || w.lastSeen.Before(oldest) {
+				oldestID, oldest = id, w.lastSeen
+			}
+		}
+		delete(g.peers, oldestID)
+	}
+	g.peers[peerID] = window
+}
+
+// expireNonces 移除超出时间窗口的随机数，这些消息会被时间戳检查拒绝，调用方需持有锁
+func (g *ReplayGuard) expireNonces(now time.Time) {
+	cutoff := now.Add(-2 * g.maxSkew)
+	for element := g.order.Front(); element != nil; element = g.order.Front() {
+		if !element.Value.(*nonceEntry).seenAt.Before(cutoff) {
+			return
+		}
+		g.removeNonce(element)
+	}
+}
+
+// removeNonce 删除随机数缓存条目，调用方需持有锁
+func (g *ReplayGuard) removeNonce(element *list.Element) {
+	entry := g.order.Remove(element).(*nonceEntry)
+	delete(g.nonces, entry.key)
+}
@@ -0,0 +1,149 @@
+package security
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReplayGuardCheck(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	type message struct {
+		peer     string
+		sequence uint64
+		skew     time.Duration // 时间戳相对当前时间的偏差
+		nonce    string
+		wantErr  error
+	}
+
+	tests := []struct {
+		name     string
+		messages []message
+	}{
+		{
+			name: "in order",
+			messages: []message{
+				{peer: "a", sequence: 1, nonce: "n1"},
+				{peer: "a", sequence: 2, nonce: "n2"},
+			},
+		},
+		{
+			name: "duplicate sequence",
+			messages: []message{
+				{peer: "a", sequence: 5, nonce: "n1"},
+				{peer: "a", sequence: 5, nonce: "n2", wantErr: ErrReplaySequence},
+			},
+		},
+		{
+			name: "duplicate nonce",
+			messages: []message{
+				{peer: "a", sequence: 1, nonce: "n1"},
+				{peer: "a", sequence: 2, nonce: "n1", wantErr: ErrReplayNonce},
+				{peer: "b", sequence: 1, nonce: "n1"}, // 随机数按对等端区分
+			},
+		},
+		{
+			name: "reordered within window",
+			messages: []message{
+				{peer: "a", sequence: 10, nonce: "n1"},
+				{peer: "a", sequence: 8, nonce: "n2"},
+				{peer: "a", sequence: 9, nonce: "n3"},
+				{peer: "a", sequence: 8, nonce: "n4", wantErr: ErrReplaySequence},
+			},
+		},
+		{
+			name: "out of window",
+			messages: []message{
+				{peer: "a", sequence: replayWindowSize + 10, nonce: "n1"},
+				{peer: "a", sequence: 11, nonce: "n2"},
+				{peer: "a", sequence: 10, nonce: "n3", wantErr: ErrReplaySequence},
+			},
+		},
+		{
+			name: "jump past window",
+			messages: []message{
+				{peer: "a", sequence: 1, nonce: "n1"},
+				{peer: "a", sequence: 1 + 2*replayWindowSize, nonce: "n2"},
+				{peer: "a", sequence: 1 + replayWindowSize, nonce: "n3", wantErr: ErrReplaySequence},
+				{peer: "a", sequence: 2 + replayWindowSize, nonce: "n4"},
+			},
+		},
+		{
+			name: "skewed timestamps",
+			messages: []message{
+				{peer: "a", sequence: 1, skew: DefaultReplaySkew, nonce: "n1"},
+				{peer: "a", sequence: 2, skew: -DefaultReplaySkew, nonce: "n2"},
+				{peer: "a", sequence: 3, skew: DefaultReplaySkew + time.Second, nonce: "n3", wantErr: ErrReplayTimestamp},
+				{peer: "a", sequence: 4, skew: -DefaultReplaySkew - time.Second, nonce: "n4", wantErr: ErrReplayTimestamp},
+				{peer: "a", sequence: 3, nonce: "n3"}, // 被拒绝的消息不记录序列号和随机数
+			},
+		},
+		{
+			name: "without sequence",
+			messages: []message{
+				{peer: "a", nonce: "n1"},
+				{peer: "a", nonce: "n2"},
+				{peer: "a", nonce: "n1", wantErr: ErrReplayNonce},
+			},
+		},
+		{
+			name: "missing fields",
+			messages: []message{
+				{peer: "", sequence: 1, nonce: "n1", wantErr: ErrReplayMissing},
+				{peer: "a", sequence: 1, nonce: "", wantErr: ErrReplayMissing},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guard := NewReplayGuard(0, 0)
+			guard.now = func() time.Time { return now }
+
+			for i, msg := range tt.messages {
+				err := guard.Check(msg.peer, msg.sequence, now.Add(msg.skew), msg.nonce)
+				if msg.wantErr == nil {
+					if err != nil {
+						t.Fatalf("第 %d 条消息被拒绝: %v", i+1, err)
+					}
+					continue
+				}
+				if !errors.Is(err, msg.wantErr) || !IsReplayError(err) {
+					t.Fatalf("第 %d 条消息的错误 = %v，期望 %v", i+1, err, msg.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayGuardZeroTimestamp(t *testing.T) {
+	guard := NewReplayGuard(0, 0)
+	if err := guard.Check("a", 1, time.Time{}, "n1"); !errors.Is(err, ErrReplayMissing) {
+		t.Fatalf("缺少时间戳的错误 = %v，期望 ErrReplayMissing", err)
+	}
+}
+
+func TestReplayGuardNonceExpiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	guard := NewReplayGuard(time.Minute, 0)
+	guard.now = func() time.Time { return now }
+
+	if err := guard.Check("a", 0, now, "n1"); err != nil {
+		t.Fatalf("检查消息失败: %v", err)
+	}
+
+	// 超出时间窗口的随机数被淘汰，使用旧时间戳的重放仍会被时间戳检查拒绝
+	now = now.Add(3 * time.Minute)
+	if err := guard.Check("a", 0, now.Add(-3*time.Minute), "n1"); !errors.Is(err, ErrReplayTimestamp) {
+		t.Fatalf("过期消息的错误 = %v，期望 ErrReplayTimestamp", err)
+	}
+
+	// 淘汰在时间戳检查之后进行，下一条通过检查的消息触发
+	if err := guard.Check("a", 0, now, "n2"); err != nil {
+		t.Fatalf("检查消息失败: %v", err)
+	}
+	if _, ok := guard.nonces["a\x00n1"]; ok {
+		t.Fatal("超出时间窗口的随机数未被淘汰")
+	}
+}
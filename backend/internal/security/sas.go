@@ -0,0 +1,62 @@
+package security
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// sasLength 短认证字符串包含的符号数量，每个符号6位，共42位
+const sasLength = 7
+
+// sasSymbols 短认证字符串使用的64个符号，每个符号同时有表情和单词两种表示
+var sasSymbols = [64]struct {
+	emoji string
+	word  string
+}{
+	{"🐶", "dog"}, {"🐱", "cat"}, {"🦁", "lion"}, {"🐎", "horse"},
+	{"🦄", "unicorn"}, {"🐷", "pig"}, {"🐘", "elephant"}, {"🐰", "rabbit"},
+	{"🐼", "panda"}, {"🐓", "rooster"}, {"🐧", "penguin"}, {"🐢", "turtle"},
+	{"🐟", "fish"}, {"🐙", "octopus"}, {"🦋", "butterfly"}, {"🌷", "flower"},
+	{"🌳", "tree"}, {"🌵", "cactus"}, {"🍄", "mushroom"}, {"🌏", "globe"},
+	{"🌙", "moon"}, {"☁️", "cloud"}, {"🔥", "fire"}, {"🍌", "banana"},
+	{"🍎", "apple"}, {"🍓", "strawberry"}, {"🌽", "corn"}, {"🍕", "pizza"},
+	{"🎂", "cake"}, {"❤️", "heart"}, {"😀", "smiley"}, {"🤖", "robot"},
+	{"🎩", "hat"}, {"👓", "glasses"}, {"🔧", "spanner"}, {"🎅", "santa"},
+	{"👍", "thumbs up"}, {"☂️", "umbrella"}, {"⌛", "hourglass"}, {"⏰", "clock"},
+	{"🎁", "gift"}, {"💡", "light bulb"}, {"📕", "book"}, {"✏️", "pencil"},
+	{"📎", "paperclip"}, {"✂️", "scissors"}, {"🔒", "lock"}, {"🔑", "key"},
+	{"🔨", "hammer"}, {"☎️", "telephone"}, {"🏁", "flag"}, {"🚂", "train"},
+	{"🚲", "bicycle"}, {"✈️", "aeroplane"}, {"🚀", "rocket"}, {"🏆", "trophy"},
+	{"⚽", "ball"}, {"🎸", "guitar"}, {"🎺", "trumpet"}, {"🔔", "bell"},
+	{"⚓", "anchor"}, {"🎧", "headphones"}, {"📁", "folder"}, {"📌", "pin"},
+}
+
+// ShortAuthString 供用户人工比对的短认证字符串
+type ShortAuthString struct {
+	Emoji []string `json:"emoji"`
+	Words []string `json:"words"`
+}
+
+// NewShortAuthString 根据双方公钥指纹生成短认证字符串
+// 指纹顺序不影响结果，双方设备计算出的字符串相同
+func NewShortAuthString(fingerprintA, fingerprintB string) *ShortAuthString {
+	if fingerprintA > fingerprintB {
+		fingerprintA, fingerprintB = fingerprintB, fingerprintA
+	}
+
+	hash := sha256.Sum256([]byte("AIRSHARE_SAS|" + fingerprintA + "|" + fingerprintB))
+	bits := binary.BigEndian.Uint64(hash[:8])
+
+	sas := &ShortAuthString{
+		Emoji: make([]string, sasLength),
+		Words: make([]string, sasLength),
+	}
+
+	for i := 0; i < sasLength; i++ {
+		index := (bits >> (58 - 6*i)) & 0x3f
+		sas.Emoji[i] = sasSymbols[index].emoji
+		sas.Words[i] = sasSymbols[index].word
+	}
+
+	return sas
+}
@@ -0,0 +1,540 @@
+package security
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// 静态加密文件格式：
+//
+//	magic(4) | 包装后的数据密钥(60) | nonce前缀(7) | 分段密文...
+//
+// 每个文件使用随机生成的数据密钥，数据密钥由主密钥通过AES-GCM包装。
+// 文件内容按64KB分段加密（STREAM结构），nonce由前缀、分段序号和末段标记组成，
+// 可以检测分段的重排和截断。更换口令时只需重新包装文件头中的数据密钥。
+const (
+	vaultMagic         = "ASE1"
+	vaultKeystoreFile  = ".keystore.json"
+	vaultSegmentSize   = 64 * 1024
+	vaultNoncePrefix   = 7
+	vaultWrappedKeyLen = 12 + 32 + 16 // nonce + 数据密钥 + GCM标签
+	vaultHeaderSize    = len(vaultMagic) + vaultWrappedKeyLen + vaultNoncePrefix
+	vaultCheckLabel    = "airshare storage key check"
+)
+
+// Argon2id 默认参数
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+)
+
+var (
+	ErrVaultPassphrase = errors.New("存储口令错误")
+	ErrVaultCorrupted  = errors.New("加密文件已损坏或被篡改")
+	ErrVaultLocked     = errors.New("文件已加密，需要配置存储口令")
+)
+
+// StorageVault 接收文件的静态加密
+type StorageVault struct {
+	masterKey []byte
+}
+
+// vaultKeystore 主密钥派生参数，保存在存储目录中，不包含任何密钥
+type vaultKeystore struct {
+	Salt    string `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+	Check   string `json:"check"` // 用于校验口令的HMAC
+}
+
+// OpenStorageVault 使用口令打开存储目录的密钥库，不存在时创建
+func OpenStorageVault(dir, passphrase string) (*StorageVault, error) {
+	if passphrase == "" {
+		return nil, errors.New("存储口令不能为空")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("创建存储目录失败: %v", err)
+	}
+
+	path := filepath.Join(dir, vaultKeystoreFile)
+	keystore, err := loadVaultKeystore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if keystore == nil {
+		keystore, err = newVaultKeystore()
+		if err != nil {
+			return nil, err
+		}
+		masterKey := keystore.deriveKey(passphrase)
+		keystore.Check = vaultCheck(masterKey)
+		if err := keystore.save(path); err != nil {
+			return nil, err
+		}
+		log.Printf("已创建存储密钥库: %s", path)
+		return &StorageVault{masterKey: masterKey}, nil
+	}
+
+	masterKey, err := keystore.unlock(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StorageVault{masterKey: masterKey}, nil
+}
+
+// IsVaultFile 判断文件名是否为密钥库自身，列出存储目录时应跳过
+func IsVaultFile(name string) bool {
+	return name == vaultKeystoreFile || name == vaultKeystoreFile+".new"
+}
+
+// IsEncryptedFile 检查文件是否为静态加密格式
+func IsEncryptedFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(vaultMagic))
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return false
+	}
+	return string(magic) == vaultMagic
+}
+
+// NewWriter 创建加密写入器，关闭写入器时写入最后一个分段
+// 写入器不会关闭底层的w
+func (v *StorageVault) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("生成数据密钥失败: %v", err)
+	}
+
+	noncePrefix := make([]byte, vaultNoncePrefix)
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return nil, fmt.Errorf("生成nonce失败: %v", err)
+	}
+
+	wrapped, err := wrapDataKey(v.masterKey, dataKey, noncePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, vaultHeaderSize)
+	header = append(header, vaultMagic...)
+	header = append(header, wrapped...)
+	header = append(header, noncePrefix...)
+	if _, err := w.Write(header); err != nil {
+		return nil, fmt.Errorf("写入文件头失败: %v", err)
+	}
+
+	return &vaultWriter{
+		w:           w,
+		aead:        aead,
+		noncePrefix: noncePrefix,
+		buf:         make([]byte, 0, vaultSegmentSize),
+	}, nil
+}
+
+// NewReader 创建解密读取器，r需要位于文件开头
+func (v *StorageVault) NewReader(r io.Reader) (io.Reader, error) {
+	header := make([]byte, vaultHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrVaultCorrupted
+	}
+
+	if string(header[:len(vaultMagic)]) != vaultMagic {
+		return nil, ErrVaultCorrupted
+	}
+
+	wrapped := header[len(vaultMagic) : len(vaultMagic)+vaultWrappedKeyLen]
+	noncePrefix := header[len(vaultMagic)+vaultWrappedKeyLen:]
+
+	dataKey, err := unwrapDataKey(v.masterKey, wrapped, noncePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &vaultReader{
+		r:           bufio.NewReaderSize(r, vaultSegmentSize+aead.Overhead()+1),
+		aead:        aead,
+		noncePrefix: append([]byte(nil), noncePrefix...),
+		segment:     make([]byte, vaultSegmentSize+aead.Overhead()),
+	}, nil
+}
+
+// RekeyStorage 使用新口令重新包装存储目录中所有加密文件的数据密钥
+// 文件内容不需要重新加密。中途失败时可以使用相同的口令重新执行，返回重新包装的文件数量
+func RekeyStorage(dir, oldPassphrase, newPassphrase string) (int, error) {
+	if newPassphrase == "" {
+		return 0, errors.New("新的存储口令不能为空")
+	}
+
+	path := filepath.Join(dir, vaultKeystoreFile)
+	pendingPath := path + ".new"
+
+	current, err := loadVaultKeystore(path)
+	if err != nil {
+		return 0, err
+	}
+	if current == nil {
+		return 0, errors.New("存储目录尚未启用静态加密")
+	}
+
+	oldKey, err := current.unlock(oldPassphrase)
+	if err != nil {
+		return 0, err
+	}
+
+	// 上次更换中断时沿用已生成的新密钥库
+	pending, err := loadVaultKeystore(pendingPath)
+	if err != nil {
+		return 0, err
+	}
+
+	var newKey []byte
+	if pending != nil {
+		if newKey, err = pending.unlock(newPassphrase); err != nil {
+			return 0, fmt.Errorf("存在未完成的口令更换，新口令与上次不一致: %v", err)
+		}
+	} else {
+		if pending, err = newVaultKeystore(); err != nil {
+			return 0, err
+		}
+		newKey = pending.deriveKey(newPassphrase)
+		pending.Check = vaultCheck(newKey)
+		if err := pending.save(pendingPath); err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+	err = filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || IsVaultFile(info.Name()) {
+			return nil
+		}
+
+		rekeyed, err := rewrapFile(filePath, oldKey, newKey)
+		if err != nil {
+			return fmt.Errorf("重新包装 %s 失败: %v", filePath, err)
+		}
+		if rekeyed {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+
+	if err := os.Rename(pendingPath, path); err != nil {
+		return count, fmt.Errorf("更新密钥库失败: %v", err)
+	}
+
+	log.Printf("存储口令已更换，重新包装了 %d 个文件", count)
+	return count, nil
+}
+
+// rewrapFile 原地替换文件头中的数据密钥包装，已使用新密钥的文件直接跳过
+func rewrapFile(path string, oldKey, newKey []byte) (bool, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header := make([]byte, vaultHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil || string(header[:len(vaultMagic)]) != vaultMagic {
+		// 不是加密文件
+		return false, nil
+	}
+
+	wrapped := header[len(vaultMagic) : len(vaultMagic)+vaultWrappedKeyLen]
+	noncePrefix := header[len(vaultMagic)+vaultWrappedKeyLen:]
+
+	dataKey, err := unwrapDataKey(oldKey, wrapped, noncePrefix)
+	if err != nil {
+		if _, newErr := unwrapDataKey(newKey, wrapped, noncePrefix); newErr == nil {
+			return false, nil
+		}
+		return false, err
+	}
+
+	rewrapped, err := wrapDataKey(newKey, dataKey, noncePrefix)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := file.WriteAt(rewrapped, int64(len(vaultMagic))); err != nil {
+		return false, err
+	}
+	return true, file.Sync()
+}
+
+// vaultWriter 分段加密写入器
+type vaultWriter struct {
+	w           io.Writer
+	aead        cipher.AEAD
+	noncePrefix []byte
+	counter     uint32
+	buf         []byte
+	closed      bool
+}
+
+func (w *vaultWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("写入器已关闭")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// 缓冲区已满且还有数据时才写出，保证最后一个分段在Close时写出
+		if len(w.buf) == vaultSegmentSize {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(w.buf[len(w.buf):vaultSegmentSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *vaultWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+func (w *vaultWriter) flush(last bool) error {
+	if w.counter == ^uint32(0) {
+		return errors.New("文件过大")
+	}
+
+	nonce := segmentNonce(w.noncePrefix, w.counter, last)
+	sealed := w.aead.Seal(nil, nonce, w.buf, nil)
+	if _, err := w.w.Write(sealed); err != nil {
+		return fmt.Errorf("写入加密数据失败: %v", err)
+	}
+
+	w.counter++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// vaultReader 分段解密读取器
+type vaultReader struct {
+	r           *bufio.Reader
+	aead        cipher.AEAD
+	noncePrefix []byte
+	counter     uint32
+	segment     []byte
+	plain       []byte
+	done        bool
+}
+
+func (r *vaultReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// next 读取并解密下一个分段
+func (r *vaultReader) next() error {
+	n, err := io.ReadFull(r.r, r.segment)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			// 缺少最后一个分段，文件被截断
+			return ErrVaultCorrupted
+		}
+		return err
+	}
+
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, peekErr := r.r.Peek(1); peekErr == io.EOF {
+			last = true
+		}
+	}
+
+	nonce := segmentNonce(r.noncePrefix, r.counter, last)
+	plain, err := r.aead.Open(r.segment[:0], nonce, r.segment[:n], nil)
+	if err != nil {
+		return ErrVaultCorrupted
+	}
+
+	r.counter++
+	r.plain = plain
+	r.done = last
+	return nil
+}
+
+// segmentNonce 构造分段nonce：前缀(7) | 分段序号(4) | 末段标记(1)
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[vaultNoncePrefix:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// wrapDataKey 使用主密钥包装数据密钥，nonce前缀作为附加数据绑定到文件
+func wrapDataKey(masterKey, dataKey, noncePrefix []byte) ([]byte, error) {
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("生成nonce失败: %v", err)
+	}
+
+	aad := append([]byte(vaultMagic), noncePrefix...)
+	return aead.Seal(nonce, nonce, dataKey, aad), nil
+}
+
+// unwrapDataKey 使用主密钥解开数据密钥
+func unwrapDataKey(masterKey, wrapped, noncePrefix []byte) ([]byte, error) {
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aad := append([]byte(vaultMagic), noncePrefix...)
+	nonceSize := aead.NonceSize()
+	dataKey, err := aead.Open(nil, wrapped[:nonceSize], wrapped[nonceSize:], aad)
+	if err != nil {
+		return nil, ErrVaultCorrupted
+	}
+	return dataKey, nil
+}
+
+// newGCM 创建AES-256-GCM
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("创建AES加密器失败: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// newVaultKeystore 使用随机盐和默认参数创建密钥库
+func newVaultKeystore() (*vaultKeystore, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("生成盐失败: %v", err)
+	}
+
+	return &vaultKeystore{
+		Salt:    base64.StdEncoding.EncodeToString(salt),
+		Time:    argon2Time,
+		Memory:  argon2Memory,
+		Threads: argon2Threads,
+	}, nil
+}
+
+// loadVaultKeystore 读取密钥库，文件不存在时返回nil
+func loadVaultKeystore(path string) (*vaultKeystore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("读取密钥库失败: %v", err)
+	}
+
+	var keystore vaultKeystore
+	if err := json.Unmarshal(data, &keystore); err != nil {
+		return nil, fmt.Errorf("解析密钥库失败: %v", err)
+	}
+	return &keystore, nil
+}
+
+// save 写入密钥库
+func (k *vaultKeystore) save(path string) error {
+	data, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return fmt.Errorf("序列化密钥库失败: %v", err)
+	}
+
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0600); err != nil {
+		return fmt.Errorf("写入密钥库失败: %v", err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("写入密钥库失败: %v", err)
+	}
+	return nil
+}
+
+// deriveKey 使用Argon2id从口令派生主密钥
+func (k *vaultKeystore) deriveKey(passphrase string) []byte {
+	salt, _ := base64.StdEncoding.DecodeString(k.Salt)
+	return argon2.IDKey([]byte(passphrase), salt, k.Time, k.Memory, k.Threads, 32)
+}
+
+// unlock 派生主密钥并校验口令
+func (k *vaultKeystore) unlock(passphrase string) ([]byte, error) {
+	masterKey := k.deriveKey(passphrase)
+	if !hmac.Equal([]byte(vaultCheck(masterKey)), []byte(k.Check)) {
+		return nil, ErrVaultPassphrase
+	}
+	return masterKey, nil
+}
+
+// vaultCheck 计算用于校验口令的HMAC，不会泄露主密钥
+func vaultCheck(masterKey []byte) string {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte(vaultCheckLabel))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
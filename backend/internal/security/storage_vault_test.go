@@ -0,0 +1,265 @@
+package security
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sealedSegmentSize 加密后完整分段的长度（分段 + GCM标签）
+const sealedSegmentSize = vaultSegmentSize + 16
+
+// encryptBytes 使用 vault 加密 plaintext
+func encryptBytes(t *testing.T, vault *StorageVault, plaintext []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := vault.NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("创建加密写入器失败: %v", err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatalf("写入失败: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("关闭写入器失败: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// decryptBytes 使用 vault 解密 ciphertext
+func decryptBytes(vault *StorageVault, ciphertext []byte) ([]byte, error) {
+	r, err := vault.NewReader(bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// randomBytes 生成 n 字节随机数据
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("生成随机数据失败: %v", err)
+	}
+	return data
+}
+
+func TestStorageVaultSegmentBoundaries(t *testing.T) {
+	vault, err := OpenStorageVault(t.TempDir(), "passphrase")
+	if err != nil {
+		t.Fatalf("打开密钥库失败: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		size     int
+		segments int // 加密后的分段数，包括最后一个分段
+	}{
+		{name: "empty", size: 0, segments: 1},
+		{name: "one byte", size: 1, segments: 1},
+		{name: "segment minus one", size: vaultSegmentSize - 1, segments: 1},
+		{name: "exact segment", size: vaultSegmentSize, segments: 1},
+		{name: "segment plus one", size: vaultSegmentSize + 1, segments: 2},
+		{name: "two segments", size: 2 * vaultSegmentSize, segments: 2},
+		{name: "two segments and tail", size: 2*vaultSegmentSize + 17, segments: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext := randomBytes(t, tt.size)
+			ciphertext := encryptBytes(t, vault, plaintext)
+
+			if want := vaultHeaderSize + tt.size + 16*tt.segments; len(ciphertext) != want {
+				t.Fatalf("密文长度 = %d，期望 %d", len(ciphertext), want)
+			}
+
+			decrypted, err := decryptBytes(vault, ciphertext)
+			if err != nil {
+				t.Fatalf("解密失败: %v", err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Fatal("解密结果与原文不一致")
+			}
+		})
+	}
+}
+
+func TestStorageVaultDetectsTampering(t *testing.T) {
+	vault, err := OpenStorageVault(t.TempDir(), "passphrase")
+	if err != nil {
+		t.Fatalf("打开密钥库失败: %v", err)
+	}
+
+	// 两个完整分段和一个末段
+	plaintext := randomBytes(t, 2*vaultSegmentSize+17)
+	segment := func(i int) int { return vaultHeaderSize + i*sealedSegmentSize }
+
+	tests := []struct {
+		name   string
+		mutate func(ciphertext []byte) []byte
+	}{
+		{
+			name: "truncated header",
+			mutate: func(c []byte) []byte {
+				return c[:vaultHeaderSize-1]
+			},
+		},
+		{
+			name: "tampered wrapped key",
+			mutate: func(c []byte) []byte {
+				c[len(vaultMagic)] ^= 1
+				return c
+			},
+		},
+		{
+			name: "tampered nonce prefix",
+			mutate: func(c []byte) []byte {
+				c[vaultHeaderSize-1] ^= 1
+				return c
+			},
+		},
+		{
+			name: "tampered middle segment",
+			mutate: func(c []byte) []byte {
+				c[segment(1)+100] ^= 1
+				return c
+			},
+		},
+		{
+			name: "tampered last segment",
+			mutate: func(c []byte) []byte {
+				c[len(c)-1] ^= 1
+				return c
+			},
+		},
+		{
+			name: "dropped last segment",
+			mutate: func(c []byte) []byte {
+				return c[:segment(2)]
+			},
+		},
+		{
+			name: "truncated inside segment",
+			mutate: func(c []byte) []byte {
+				return c[:segment(1)+1000]
+			},
+		},
+		{
+			name: "header only",
+			mutate: func(c []byte) []byte {
+				return c[:vaultHeaderSize]
+			},
+		},
+		{
+			name: "swapped segments",
+			mutate: func(c []byte) []byte {
+				swapped := append([]byte(nil), c[:segment(0)]...)
+				swapped = append(swapped, c[segment(1):segment(2)]...)
+				swapped = append(swapped, c[segment(0):segment(1)]...)
+				return append(swapped, c[segment(2):]...)
+			},
+		},
+		{
+			name: "appended data",
+			mutate: func(c []byte) []byte {
+				return append(c, make([]byte, sealedSegmentSize)...)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ciphertext := tt.mutate(encryptBytes(t, vault, plaintext))
+			if _, err := decryptBytes(vault, ciphertext); !errors.Is(err, ErrVaultCorrupted) {
+				t.Fatalf("错误 = %v，期望 ErrVaultCorrupted", err)
+			}
+		})
+	}
+}
+
+func TestRekeyStorageResume(t *testing.T) {
+	tests := []struct {
+		name          string
+		resumeWith    string // 中断后重新执行时使用的新口令
+		wantResumeErr bool
+	}{
+		{name: "same new passphrase", resumeWith: "new", wantResumeErr: false},
+		{name: "different new passphrase", resumeWith: "other", wantResumeErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			vault, err := OpenStorageVault(dir, "old")
+			if err != nil {
+				t.Fatalf("打开密钥库失败: %v", err)
+			}
+
+			files := map[string][]byte{
+				"a.bin": randomBytes(t, vaultSegmentSize+1),
+				"b.bin": randomBytes(t, 10),
+				"d.bin": randomBytes(t, 0),
+			}
+			for name, plaintext := range files {
+				if err := os.WriteFile(filepath.Join(dir, name), encryptBytes(t, vault, plaintext), 0600); err != nil {
+					t.Fatalf("写入文件失败: %v", err)
+				}
+			}
+			os.WriteFile(filepath.Join(dir, "plain.txt"), []byte("not encrypted"), 0600)
+
+			// 数据密钥无法解开的文件使更换在 a、b 之后中断
+			broken := append([]byte(vaultMagic), make([]byte, vaultWrappedKeyLen+vaultNoncePrefix)...)
+			brokenPath := filepath.Join(dir, "c.bin")
+			os.WriteFile(brokenPath, broken, 0600)
+
+			count, err := RekeyStorage(dir, "old", "new")
+			if err == nil || count != 2 {
+				t.Fatalf("更换口令 = (%d, %v)，期望在第3个文件中断", count, err)
+			}
+			if _, err := OpenStorageVault(dir, "old"); err != nil {
+				t.Fatalf("中断后原口令失效: %v", err)
+			}
+
+			os.Remove(brokenPath)
+			count, err = RekeyStorage(dir, "old", tt.resumeWith)
+			if tt.wantResumeErr {
+				if err == nil {
+					t.Fatal("使用不同的新口令继续更换成功")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("继续更换口令失败: %v", err)
+			}
+			// 已重新包装的文件被跳过
+			if count != 1 {
+				t.Fatalf("继续更换时重新包装了 %d 个文件，期望 1", count)
+			}
+
+			if _, err := OpenStorageVault(dir, "old"); !errors.Is(err, ErrVaultPassphrase) {
+				t.Fatalf("更换后原口令的错误 = %v，期望 ErrVaultPassphrase", err)
+			}
+			rekeyed, err := OpenStorageVault(dir, "new")
+			if err != nil {
+				t.Fatalf("使用新口令打开密钥库失败: %v", err)
+			}
+			for name, plaintext := range files {
+				ciphertext, _ := os.ReadFile(filepath.Join(dir, name))
+				decrypted, err := decryptBytes(rekeyed, ciphertext)
+				if err != nil || !bytes.Equal(decrypted, plaintext) {
+					t.Fatalf("更换后解密 %s 失败: %v", name, err)
+				}
+			}
+			if data, _ := os.ReadFile(filepath.Join(dir, "plain.txt")); string(data) != "not encrypted" {
+				t.Fatal("未加密的文件被修改")
+			}
+		})
+	}
+}
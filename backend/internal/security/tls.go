@@ -61,7 +61,11 @@ func (s *TLSService) GetTLSConfig(deviceID string) (*tls.Config, error) {
 	config = &tls.Config{
 		Certificates: []tls.Certificate{tlsCert},
 		MinVersion:   tls.VersionTLS12,
+		// TLS 1.2的套件需要与证书密钥类型匹配，同时列出ECDSA和RSA套件；Ed25519证书由TLS 1.3处理
 		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
 			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
 			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
 			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
@@ -93,6 +97,8 @@ func (s *TLSService) GetClientTLSConfig() *tls.Config {
 		InsecureSkipVerify: false, // 严格验证证书
 		MinVersion:         tls.VersionTLS12,
 		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
 			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
 			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
 		},
@@ -253,7 +259,8 @@ func (s *SecureDataTransfer) ReceiveAndDecrypt(conn io.Reader) ([]byte, string,
 	// 解密数据
 	plaintext, err := s.encryptionService.Decrypt(&encryptedMsg)
 	if err != nil {
-		return nil, "", fmt.Errorf("解密数据失败: %v", err)
+		// 保留原始错误，调用方可以用 IsReplayError 区分重放
+		return nil, "", fmt.Errorf("解密数据失败: %w", err)
 	}
 
 	return plaintext, encryptedMsg.SenderID, nil
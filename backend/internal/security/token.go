@@ -0,0 +1,353 @@
+package security
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scope 访问令牌权限范围
+type Scope string
+
+const (
+	ScopeReadDevices Scope = "devices:read"     // 查看设备列表
+	ScopeSend        Scope = "transfer:send"    // 发起和管理发送
+	ScopeReceive     Scope = "transfer:receive" // 接收、下载和删除文件
+	ScopeAdmin       Scope = "admin"            // 管理配对、已知设备和令牌，包含所有权限
+)
+
+// DefaultDeviceScopes 配对成功后签发给设备的默认权限
+var DefaultDeviceScopes = []Scope{ScopeReadDevices, ScopeSend, ScopeReceive}
+
+// tokenPrefix 令牌前缀，便于在日志和配置中识别
+const tokenPrefix = "ast_"
+
+var (
+	ErrTokenInvalid = errors.New("无效的访问令牌")
+	ErrTokenRevoked = errors.New("访问令牌已吊销")
+	ErrTokenExpired = errors.New("访问令牌已过期")
+)
+
+// DeviceToken 绑定到设备的访问令牌，只保存令牌的哈希值
+type DeviceToken struct {
+	ID        string     `json:"id"`
+	DeviceID  string     `json:"device_id"`
+	Scopes    []Scope    `json:"scopes"`
+	Hash      string     `json:"hash"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Revoked   bool       `json:"revoked"`
+}
+
+// HasScope 检查令牌是否拥有指定权限，admin拥有所有权限
+func (t *DeviceToken) HasScope(scope Scope) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenStore 持久化的设备令牌存储
+type TokenStore struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	tokens  map[string]*DeviceToken // 以令牌ID为键
+}
+
+// LoadTokenStore 从文件加载令牌存储，文件不存在时返回空存储
+func LoadTokenStore(path string) (*TokenStore, error) {
+	store := &TokenStore{
+		path:   path,
+		tokens: make(map[string]*DeviceToken),
+	}
+
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// ParseScopes 解析逗号分隔的权限列表
+func ParseScopes(value string) ([]Scope, error) {
+	var scopes []Scope
+	for _, part := range strings.Split(value, ",") {
+		scope := Scope(strings.TrimSpace(part))
+		switch scope {
+		case "":
+			continue
+		case ScopeReadDevices, ScopeSend, ScopeReceive, ScopeAdmin:
+			scopes = append(scopes, scope)
+		default:
+			return nil, fmt.Errorf("未知的权限: %s", scope)
+		}
+	}
+
+	if len(scopes) == 0 {
+		return nil, errors.New("至少需要一个权限")
+	}
+	return scopes, nil
+}
+
+// Issue 为设备签发新令牌，返回明文令牌（只在签发时可见）
+// ttl为0表示永不过期
+func (s *TokenStore) Issue(deviceID string, scopes []Scope, ttl time.Duration) (string, *DeviceToken, error) {
+	if deviceID == "" {
+		return "", nil, errors.New("缺少设备ID")
+	}
+
+	idBytes := make([]byte, 6)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", nil, fmt.Errorf("生成令牌失败: %v", err)
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, fmt.Errorf("生成令牌失败: %v", err)
+	}
+
+	id := hex.EncodeToString(idBytes)
+	plaintext := tokenPrefix + id + "_" + base64.RawURLEncoding.EncodeToString(secret)
+
+	token := &DeviceToken{
+		ID:        id,
+		DeviceID:  deviceID,
+		Scopes:    append([]Scope(nil), scopes...),
+		Hash:      hashToken(plaintext),
+		CreatedAt: time.Now(),
+	}
+	if ttl > 0 {
+		expiresAt := token.CreatedAt.Add(ttl)
+		token.ExpiresAt = &expiresAt
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reloadIfChanged(); err != nil {
+		return "", nil, err
+	}
+
+	s.tokens[id] = token
+	if err := s.save(); err != nil {
+		delete(s.tokens, id)
+		return "", nil, err
+	}
+
+	log.Printf("已为设备 %s 签发令牌 %s，权限: %v", deviceID, id, scopes)
+
+	snapshot := *token
+	return plaintext, &snapshot, nil
+}
+
+// Validate 校验明文令牌，返回对应的令牌记录
+func (s *TokenStore) Validate(plaintext string) (*DeviceToken, error) {
+	id, ok := tokenID(plaintext)
+	if !ok {
+		return nil, ErrTokenInvalid
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 令牌可能被管理命令在其他进程中吊销
+	if err := s.reloadIfChanged(); err != nil {
+		log.Printf("重新加载令牌文件失败: %v", err)
+	}
+
+	token, exists := s.tokens[id]
+	if !exists || token.Hash != hashToken(plaintext) {
+		return nil, ErrTokenInvalid
+	}
+
+	if token.Revoked {
+		return nil, ErrTokenRevoked
+	}
+
+	if token.ExpiresAt != nil && time.Now().After(*token.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+
+	snapshot := *token
+	return &snapshot, nil
+}
+
+// Check 检查已认证的令牌当前是否仍然有效，用于长连接的周期性复核
+func (s *TokenStore) Check(tokenID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 令牌可能被管理命令在其他进程中吊销
+	if err := s.reloadIfChanged(); err != nil {
+		log.Printf("重新加载令牌文件失败: %v", err)
+	}
+
+	token, exists := s.tokens[tokenID]
+	if !exists {
+		return ErrTokenInvalid
+	}
+
+	if token.Revoked {
+		return ErrTokenRevoked
+	}
+
+	if token.ExpiresAt != nil && time.Now().After(*token.ExpiresAt) {
+		return ErrTokenExpired
+	}
+
+	return nil
+}
+
+// Revoke 吊销令牌
+func (s *TokenStore) Revoke(tokenID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reloadIfChanged(); err != nil {
+		return err
+	}
+
+	token, exists := s.tokens[tokenID]
+	if !exists {
+		return fmt.Errorf("令牌不存在: %s", tokenID)
+	}
+
+	token.Revoked = true
+	log.Printf("已吊销令牌 %s", tokenID)
+	return s.save()
+}
+
+// RevokeDevice 吊销设备的所有令牌
+func (s *TokenStore) RevokeDevice(deviceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reloadIfChanged(); err != nil {
+		return err
+	}
+
+	count := 0
+	for _, token := range s.tokens {
+		if token.DeviceID == deviceID && !token.Revoked {
+			token.Revoked = true
+			count++
+		}
+	}
+
+	if count == 0 {
+		return nil
+	}
+
+	log.Printf("已吊销设备 %s 的 %d 个令牌", deviceID, count)
+	return s.save()
+}
+
+// List 获取所有令牌记录，按创建时间排序
+func (s *TokenStore) List() []DeviceToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reloadIfChanged(); err != nil {
+		log.Printf("重新加载令牌文件失败: %v", err)
+	}
+
+	tokens := make([]DeviceToken, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		snapshot := *token
+		snapshot.Hash = ""
+		tokens = append(tokens, snapshot)
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+
+	return tokens
+}
+
+// load 从文件读取令牌
+func (s *TokenStore) load() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("读取令牌文件失败: %v", err)
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("读取令牌文件失败: %v", err)
+	}
+
+	tokens := make(map[string]*DeviceToken)
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("解析令牌文件失败: %v", err)
+	}
+
+	s.tokens = tokens
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// reloadIfChanged 文件被其他进程修改时重新加载，调用方需持有锁
+func (s *TokenStore) reloadIfChanged() error {
+	info, err := os.Stat(s.path)
+	if err != nil || info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	return s.load()
+}
+
+// save 将令牌写入文件，调用方需持有锁
+func (s *TokenStore) save() error {
+	data, err := json.MarshalIndent(s.tokens, "", "  ")
+	if err != nil {
+		return fmt.Errorf("序列化令牌失败: %v", err)
+	}
+
+	tempPath := s.path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0600); err != nil {
+		return fmt.Errorf("写入令牌文件失败: %v", err)
+	}
+
+	if err := os.Rename(tempPath, s.path); err != nil {
+		return fmt.Errorf("写入令牌文件失败: %v", err)
+	}
+
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// tokenID 从明文令牌中解析令牌ID
+func tokenID(plaintext string) (string, bool) {
+	if !strings.HasPrefix(plaintext, tokenPrefix) {
+		return "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(plaintext, tokenPrefix), "_", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", false
+	}
+	return parts[0], true
+}
+
+// hashToken 计算令牌的SHA-256哈希
+func hashToken(plaintext string) string {
+	hash := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"airshare-backend/internal/security"
+	"airshare-backend/pkg/models"
+	"github.com/gorilla/websocket"
+)
+
+// contextKey 请求上下文键类型
+type contextKey string
+
+// tokenContextKey 请求上下文中保存已认证令牌的键
+const tokenContextKey contextKey = "device_token"
+
+// wsMessageScopes WebSocket消息需要的权限，未列出的消息无需认证
+// 配对消息必须允许未认证的设备发送，否则新设备无法完成配对；
+// 身份声明会修改已知设备的公钥记录，只接受已认证的设备
+var wsMessageScopes = map[string][]security.Scope{
+	models.MessageTypeDeviceList:     {security.ScopeReadDevices},
+	models.MessageTypeDeviceIdentity: {security.ScopeReadDevices, security.ScopeSend, security.ScopeReceive},
+	models.MessageTypeTransfer:       {security.ScopeSend},
+	models.MessageTypeSignal:         {security.ScopeSend, security.ScopeReceive},
+
+	// 房间
+	models.MessageTypeRoomCreate:  {security.ScopeSend, security.ScopeReceive},
+	models.MessageTypeRoomJoin:    {security.ScopeSend, security.ScopeReceive},
+	models.MessageTypeRoomApprove: {security.ScopeSend, security.ScopeReceive},
+	models.MessageTypeRoomKick:    {security.ScopeSend, security.ScopeReceive},
+	models.MessageTypeRoomLeave:   {security.ScopeSend, security.ScopeReceive},
+
+	// 文本和剪贴板
+	models.MessageTypeText:        {security.ScopeSend},
+	models.MessageTypeClipboard:   {security.ScopeSend},
+	models.MessageTypeTextHistory: {security.ScopeReceive},
+
+	// 传输确认
+	models.MessageTypeTransferDecision: {security.ScopeReceive},
+
+	// 传输队列
+	models.MessageTypeTransferControl: {security.ScopeSend, security.ScopeReceive},
+	models.MessageTypeTransferQueue:   {security.ScopeSend, security.ScopeReceive},
+}
+
+// authEnabled 是否启用令牌认证
+func (s *Server) authEnabled() bool {
+	return s.tokens != nil && s.securityConfig.EnableAuth
+}
+
+// requireScope 认证中间件，令牌拥有任一指定权限即可访问
+func (s *Server) requireScope(handler http.HandlerFunc, scopes ...security.Scope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.authEnabled() {
+			handler(w, r)
+			return
+		}
+
+		plaintext := tokenFromRequest(r)
+		if plaintext == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="airshare"`)
+			respondError(w, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+
+		token, err := s.tokens.Validate(plaintext)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="airshare", error="invalid_token"`)
+			respondError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		if !hasAnyScope(token, scopes) {
+			respondError(w, http.StatusForbidden, "Insufficient scope")
+			return
+		}
+
+		handler(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey, token)))
+	}
+}
+
+// authenticateWebSocket 校验WebSocket握手中的令牌
+// 未携带令牌的连接允许建立，但只能发送无需认证的消息（如配对）
+func (s *Server) authenticateWebSocket(r *http.Request) (*security.DeviceToken, error) {
+	plaintext := tokenFromRequest(r)
+	if !s.authEnabled() || plaintext == "" {
+		return nil, nil
+	}
+	return s.tokens.Validate(plaintext)
+}
+
+// wsMessageAllowed 检查WebSocket连接是否有权限发送该类型的消息
+func (s *Server) wsMessageAllowed(conn *websocket.Conn, msgType string) bool {
+	if !s.authEnabled() {
+		return true
+	}
+
+	scopes, required := wsMessageScopes[msgType]
+	if !required {
+		return true
+	}
+
+	s.clientMutex.RLock()
+	token := s.clients[conn]
+	s.clientMutex.RUnlock()
+
+	return token != nil && hasAnyScope(token, scopes)
+}
+
+// connTokenValid 检查连接认证时使用的令牌是否仍然有效，未认证的连接始终有效
+func (s *Server) connTokenValid(conn *websocket.Conn) bool {
+	if s.tokens == nil {
+		return true
+	}
+
+	s.clientMutex.RLock()
+	token := s.clients[conn]
+	s.clientMutex.RUnlock()
+
+	return token == nil || s.tokens.Check(token.ID) == nil
+}
+
+// closeConns 关闭令牌满足条件的WebSocket连接，用于吊销令牌或解除配对后立即断开
+func (s *Server) closeConns(match func(token *security.DeviceToken) bool) {
+	s.clientMutex.Lock()
+	var conns []*websocket.Conn
+	for conn, token := range s.clients {
+		if token != nil && match(token) {
+			conns = append(conns, conn)
+			// 立即移除，断开前不再向该连接推送消息
+			delete(s.clients, conn)
+		}
+	}
+	s.clientMutex.Unlock()
+
+	for _, conn := range conns {
+		// 关闭后读循环退出，由其清理房间绑定和写锁
+		conn.Close()
+	}
+}
+
+// tokenFromRequest 从Authorization头或access_token查询参数中获取令牌
+// 浏览器的WebSocket和EventSource无法设置请求头，因此也支持查询参数
+func tokenFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+			return strings.TrimSpace(auth[7:])
+		}
+		return ""
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// tokenFromContext 获取请求上下文中已认证的令牌，未启用认证时返回nil
+func tokenFromContext(ctx context.Context) *security.DeviceToken {
+	token, _ := ctx.Value(tokenContextKey).(*security.DeviceToken)
+	return token
+}
+
+// hasAnyScope 检查令牌是否拥有任一指定权限
+func hasAnyScope(token *security.DeviceToken, scopes []security.Scope) bool {
+	for _, scope := range scopes {
+		if token.HasScope(scope) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// bandwidthUpdate 带宽限制的调整请求，未提供的字段保持不变
+type bandwidthUpdate struct {
+	GlobalLimit *int64 `json:"global_limit"`
+	PeerLimit   *int64 `json:"peer_limit"`
+	// PeerLimits 按设备ID单独设置，值为负数时取消该设备的单独设置
+	PeerLimits map[string]int64 `json:"peer_limits"`
+}
+
+// handleGetBandwidth 获取当前的带宽限制
+func (s *Server) handleGetBandwidth(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, s.transferService.Bandwidth().Limits())
+}
+
+// handleUpdateBandwidth 运行时调整带宽限制，立即对进行中的传输生效
+func (s *Server) handleUpdateBandwidth(w http.ResponseWriter, r *http.Request) {
+	var update bandwidthUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if (update.GlobalLimit != nil && *update.GlobalLimit < 0) || (update.PeerLimit != nil && *update.PeerLimit < 0) {
+		respondError(w, http.StatusBadRequest, "Limits must not be negative")
+		return
+	}
+
+	limiter := s.transferService.Bandwidth()
+	if update.GlobalLimit != nil {
+		limiter.SetGlobalLimit(*update.GlobalLimit)
+	}
+	if update.PeerLimit != nil {
+		limiter.SetPeerLimit(*update.PeerLimit)
+	}
+	for peerID, limit := range update.PeerLimits {
+		limiter.SetPeerOverride(peerID, limit)
+	}
+
+	respondJSON(w, http.StatusOK, limiter.Limits())
+}
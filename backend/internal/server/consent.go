@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"airshare-backend/internal/transfer"
+	"airshare-backend/pkg/models"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// notifyTransferOffer 将传输请求推送给接收设备
+func (s *Server) notifyTransferOffer(offer models.TransferRequest) {
+	conns := s.peerConns(offer.ReceiverID)
+	if len(conns) == 0 {
+		log.Printf("接收设备 %s 不在线，传输 %s 等待其上线确认", offer.ReceiverID, offer.ID)
+		return
+	}
+
+	for _, conn := range conns {
+		if err := s.writeJSON(conn, models.WebSocketMessage{
+			Type:   models.MessageTypeTransferOffer,
+			Data:   offer,
+			Target: offer.ReceiverID,
+			Source: offer.SenderID,
+		}); err != nil {
+			log.Printf("推送传输请求失败: %v", err)
+		}
+	}
+}
+
+// sendPendingOffers 设备上线后补发离线期间收到的传输请求
+func (s *Server) sendPendingOffers(conn *websocket.Conn) {
+	deviceID := s.connDeviceID(conn)
+	if deviceID == "" {
+		return
+	}
+
+	for _, offer := range s.transferService.PendingOffers(deviceID) {
+		if err := s.writeJSON(conn, models.WebSocketMessage{
+			Type:   models.MessageTypeTransferOffer,
+			Data:   offer,
+			Target: offer.ReceiverID,
+			Source: offer.SenderID,
+		}); err != nil {
+			log.Printf("推送传输请求失败: %v", err)
+			return
+		}
+	}
+}
+
+// notifyTransferDecision 将接收方的决定通知发送设备和接收设备的其他连接
+func (s *Server) notifyTransferDecision(request models.TransferRequest, decision models.TransferDecision) {
+	msg := models.WebSocketMessage{
+		Type: models.MessageTypeTransferDecision,
+		Data: map[string]interface{}{
+			"decision": decision,
+			"transfer": request,
+		},
+		Source: request.ReceiverID,
+	}
+
+	conns := append(s.peerConns(request.SenderID), s.peerConns(request.ReceiverID)...)
+	for _, conn := range conns {
+		if err := s.writeJSON(conn, msg); err != nil {
+			log.Printf("通知传输决定失败: %v", err)
+		}
+	}
+
+	s.publishStatus(request)
+}
+
+// handleTransferDecision 接收设备通过WebSocket接收或拒绝传输
+func (s *Server) handleTransferDecision(conn *websocket.Conn, msg *models.WebSocketMessage) {
+	var decision models.TransferDecision
+	if err := decodeMessageData(msg, &decision); err != nil || decision.TransferID == "" {
+		s.sendError(conn, "无效的传输确认")
+		return
+	}
+
+	if _, err := s.transferService.Decide(decision.TransferID, s.connDeviceID(conn), decision); err != nil {
+		s.sendError(conn, err.Error())
+	}
+}
+
+// handleTransferDecisionHTTP 接收设备通过REST接口接收或拒绝传输
+func (s *Server) handleTransferDecisionHTTP(w http.ResponseWriter, r *http.Request) {
+	var decision models.TransferDecision
+	if err := json.NewDecoder(r.Body).Decode(&decision); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	// 启用认证时以令牌绑定的设备为准
+	deviceID := ""
+	if token := tokenFromContext(r.Context()); token != nil {
+		deviceID = token.DeviceID
+	}
+
+	result, err := s.transferService.Decide(mux.Vars(r)["transfer_id"], deviceID, decision)
+	if err != nil {
+		status := http.StatusNotFound
+		switch {
+		case errors.Is(err, transfer.ErrNotReceiver):
+			status = http.StatusForbidden
+		case errors.Is(err, transfer.ErrNotAwaiting):
+			status = http.StatusConflict
+		case errors.Is(err, transfer.ErrInvalidDecision):
+			status = http.StatusBadRequest
+		}
+		respondError(w, status, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, result)
+}
+
+// peerConns 获取代表指定设备的所有连接：令牌绑定到该设备的连接和以该设备加入房间并已获批准的连接
+func (s *Server) peerConns(deviceID string) []*websocket.Conn {
+	if deviceID == "" {
+		return nil
+	}
+
+	s.clientMutex.RLock()
+	var conns []*websocket.Conn
+	roomConns := make(map[*websocket.Conn]string)
+	for conn, token := range s.clients {
+		if token != nil && token.DeviceID == deviceID {
+			conns = append(conns, conn)
+		} else if binding := s.roomBindings[conn]; binding != nil && binding.deviceID == deviceID {
+			roomConns[conn] = binding.roomID
+		}
+	}
+	s.clientMutex.RUnlock()
+
+	for conn, roomID := range roomConns {
+		if s.rooms.IsMember(roomID, deviceID) {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"airshare-backend/internal/security"
+)
+
+const (
+	corsAllowedMethods = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsAllowedHeaders = "Accept, Authorization, Content-Type, X-Requested-With"
+	corsExposedHeaders = "Content-Disposition, Content-Length"
+	corsMaxAge         = 600 // 预检结果缓存时间（秒）
+)
+
+// corsMiddleware 根据SecurityConfig处理跨域请求和预检请求
+// 未启用CORS时不返回任何CORS头，浏览器只允许同源访问
+func corsMiddleware(enabled bool, policy *security.OriginPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || policy.IsSameOrigin(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+
+		isPreflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		allowed := enabled && policy.Allowed(origin)
+
+		if !allowed {
+			if isPreflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			// 不返回CORS头，由浏览器拦截响应
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if policy.AllowsAll() {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if isPreflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" && policy.AllowsAll() {
+				w.Header().Set("Access-Control-Allow-Headers", requested)
+			} else {
+				w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			}
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
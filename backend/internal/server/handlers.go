@@ -2,10 +2,18 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"mime"
 	"net/http"
 	"path/filepath"
+	"strconv"
+	"time"
 
+	"airshare-backend/internal/security"
+	"airshare-backend/internal/transfer"
 	"airshare-backend/pkg/models"
 	"github.com/gorilla/mux"
 )
@@ -27,6 +35,11 @@ func (s *Server) handleSendFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 发送者身份以令牌绑定的设备为准
+	if token := tokenFromContext(r.Context()); token != nil {
+		req.SenderID = token.DeviceID
+	}
+
 	// 暂时跳过目标设备验证，因为相关方法和字段未定义
 	// if !s.discoveryService.DeviceExists(req.TargetDeviceID) {
 	// 	respondError(w, http.StatusNotFound, "Target device not found")
@@ -35,6 +48,11 @@ func (s *Server) handleSendFile(w http.ResponseWriter, r *http.Request) {
 
 	// 开始传输
 	transferID, err := s.transferService.StartTransfer(&req)
+	if errors.Is(err, transfer.ErrInvalidManifest) || errors.Is(err, transfer.ErrInvalidFileName) ||
+		errors.Is(err, transfer.ErrInvalidChecksum) || errors.Is(err, transfer.ErrNoReceiver) {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to start transfer")
 		return
@@ -50,8 +68,18 @@ func (s *Server) handleGetTransferStatus(w http.ResponseWriter, r *http.Request)
 	vars := mux.Vars(r)
 	transferID := vars["transfer_id"]
 
-	status, err := s.transferService.GetTransferStatus(transferID)
+	// 启用认证时只有发送设备和接收设备可以查看
+	deviceID := ""
+	if token := tokenFromContext(r.Context()); token != nil {
+		deviceID = token.DeviceID
+	}
+
+	status, err := s.transferService.GetTransferStatus(transferID, deviceID)
 	if err != nil {
+		if errors.Is(err, transfer.ErrNotParticipant) {
+			respondError(w, http.StatusForbidden, "Not a participant of this transfer")
+			return
+		}
 		respondError(w, http.StatusNotFound, "Transfer not found")
 		return
 	}
@@ -63,8 +91,21 @@ func (s *Server) handleCancelTransfer(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	transferID := vars["transfer_id"]
 
-	if err := s.transferService.CancelTransfer(transferID); err != nil {
-		respondError(w, http.StatusNotFound, "Transfer not found")
+	// 启用认证时只有发送设备和接收设备可以取消
+	deviceID := ""
+	if token := tokenFromContext(r.Context()); token != nil {
+		deviceID = token.DeviceID
+	}
+
+	if err := s.transferService.CancelTransfer(transferID, deviceID); err != nil {
+		switch {
+		case errors.Is(err, transfer.ErrNotParticipant):
+			respondError(w, http.StatusForbidden, "Only the sending and receiving devices can cancel this transfer")
+		case errors.Is(err, transfer.ErrInvalidTransition):
+			respondError(w, http.StatusConflict, "Transfer can no longer be cancelled")
+		default:
+			respondError(w, http.StatusNotFound, "Transfer not found")
+		}
 		return
 	}
 
@@ -73,6 +114,33 @@ func (s *Server) handleCancelTransfer(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// maxContentQuery 一次查询的校验和数量上限
+const maxContentQuery = 10000
+
+// handleMissingContent 发送方查询接收方还没有的文件内容，已有的内容无需上传
+func (s *Server) handleMissingContent(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Checksums []string `json:"checksums"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if len(req.Checksums) > maxContentQuery {
+		respondError(w, http.StatusBadRequest, "Too many checksums")
+		return
+	}
+
+	deviceID := ""
+	if token := tokenFromContext(r.Context()); token != nil {
+		deviceID = token.DeviceID
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"missing": s.transferService.MissingContent(deviceID, req.Checksums),
+	})
+}
+
 func (s *Server) handleGetFiles(w http.ResponseWriter, r *http.Request) {
 	// 暂时返回空列表，因为transferService.ListFiles方法未定义
 	// files, err := s.transferService.ListFiles()
@@ -86,25 +154,42 @@ func (s *Server) handleGetFiles(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// handleDownloadFile 下载接收完成的文件，存储时加密的文件透明解密
 func (s *Server) handleDownloadFile(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	filename := vars["filename"]
 
-	// 暂时不使用s.config.Storage.Directory，因为配置可能未定义
-	// filePath := filepath.Join(s.config.Storage.Directory, filename)
+	// 启用认证时只有接收设备可以下载
+	deviceID := ""
+	if token := tokenFromContext(r.Context()); token != nil {
+		deviceID = token.DeviceID
+	}
 
-	// 暂时注释掉安全检查
-	// if !isSafePath(filePath, s.config.Storage.Directory) {
-	// 	respondError(w, http.StatusBadRequest, "Invalid filename")
-	// 	return
-	// }
+	file, info, err := s.transferService.DownloadFile(deviceID, vars["transfer_id"], vars["file_id"])
+	if err != nil {
+		switch {
+		case errors.Is(err, transfer.ErrNotParticipant):
+			respondError(w, http.StatusForbidden, "Only the receiving device can download this file")
+		case errors.Is(err, transfer.ErrFileIncomplete):
+			respondError(w, http.StatusConflict, "File has not been fully received")
+		case errors.Is(err, security.ErrVaultLocked):
+			respondError(w, http.StatusServiceUnavailable, "Storage is locked")
+		default:
+			respondError(w, http.StatusNotFound, "File not found")
+		}
+		return
+	}
+	defer file.Close()
 
-	// 设置下载头
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	// 文件名和类型由发送方声明，统一作为附件下载，不让浏览器按声明的类型渲染
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name}))
 	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.WriteHeader(http.StatusOK)
 
-	// 暂时不实现文件下载
-	respondError(w, http.StatusNotImplemented, "File download not implemented")
+	if _, err := io.Copy(w, file); err != nil {
+		log.Printf("下载文件 %s 失败: %v", info.ID, err)
+	}
 }
 
 func (s *Server) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
@@ -121,8 +206,152 @@ func (s *Server) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (s *Server) handleStartPairing(w http.ResponseWriter, r *http.Request) {
+	code, err := s.pairingService.StartPairing()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start pairing")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, code)
+}
+
+func (s *Server) handleCancelPairing(w http.ResponseWriter, r *http.Request) {
+	s.pairingService.CancelPairing()
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "cancelled",
+	})
+}
+
+func (s *Server) handleGetTrustedDevices(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"devices": s.pairingService.TrustedDevices(),
+	})
+}
+
+func (s *Server) handleUntrustDevice(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	deviceID := vars["device_id"]
+
+	if err := s.pairingService.Unpair(deviceID); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to unpair device")
+		return
+	}
+	// 解除配对会吊销设备的令牌，已建立的连接一并断开
+	s.closeConns(func(token *security.DeviceToken) bool { return token.DeviceID == deviceID })
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "unpaired",
+	})
+}
+
+func (s *Server) handleGetKnownDevices(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"node_id": s.encryption.GetFingerprint(),
+		"devices": s.encryption.GetKnownDevices(),
+	})
+}
+
+func (s *Server) handleGetVerificationCode(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	deviceID := vars["device_id"]
+
+	sas, err := s.encryption.VerificationCode(deviceID)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Device not found")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, sas)
+}
+
+func (s *Server) handleVerifyDevice(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	deviceID := vars["device_id"]
+
+	if err := s.encryption.VerifyDevice(deviceID); err != nil {
+		respondError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "verified",
+	})
+}
+
+func (s *Server) handleAcceptKeyChange(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	deviceID := vars["device_id"]
+
+	device, err := s.encryption.AcceptKeyChange(deviceID)
+	if err != nil {
+		respondError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, device)
+}
+
+func (s *Server) handleGetTokens(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"tokens": s.tokens.List(),
+	})
+}
+
+func (s *Server) handleIssueToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DeviceID   string           `json:"device_id"`
+		Scopes     []security.Scope `json:"scopes"`
+		TTLSeconds int64            `json:"ttl_seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.DeviceID == "" || len(req.Scopes) == 0 {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	// 令牌只能签发给已配对的设备
+	if !s.encryption.IsTrusted(req.DeviceID) {
+		respondError(w, http.StatusForbidden, "Device is not paired")
+		return
+	}
+
+	plaintext, token, err := s.tokens.Issue(req.DeviceID, req.Scopes, time.Duration(req.TTLSeconds)*time.Second)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to issue token")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"token": plaintext,
+		"id":    token.ID,
+	})
+}
+
+func (s *Server) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tokenID := vars["token_id"]
+
+	if err := s.tokens.Revoke(tokenID); err != nil {
+		respondError(w, http.StatusNotFound, "Token not found")
+		return
+	}
+	s.closeConns(func(token *security.DeviceToken) bool { return token.ID == tokenID })
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "revoked",
+	})
+}
+
 // WebSocket处理函数
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// 在握手阶段认证，携带无效令牌的连接直接拒绝
+	token, err := s.authenticateWebSocket(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
 	// 升级到WebSocket连接
 	// 使用s.upgrader而不是全局upgrader
 	conn, err := s.upgrader.Upgrade(w, r, nil)
@@ -131,8 +360,29 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 处理WebSocket消息
-	go s.handleWebSocketMessages(conn)
+	state := &wsConnState{conn: conn, done: make(chan struct{})}
+	// 慢客户端被断开后由读循环清理
+	state.outbox = transfer.NewWSOutbox(state.done, func() { conn.Close() })
+	state.touch()
+
+	// 创建或恢复会话并登记连接，会话信息和需要重发的消息先于其他消息发送
+	if err := s.openSession(state, token, r.URL.Query()); err != nil {
+		log.Printf("建立WebSocket会话失败: %v", err)
+		conn.Close()
+		return
+	}
+
+	s.clientMutex.Lock()
+	s.clients[conn] = token
+	s.clientMutex.Unlock()
+	transfer.RecordWSConnected(1)
+
+	s.sendPendingOffers(conn)
+
+	// 处理WebSocket消息，心跳和写协程在读循环退出后结束
+	go s.writeLoop(conn, state)
+	go s.keepAlive(conn, state)
+	go s.handleWebSocketMessages(conn, state)
 }
 
 // 辅助函数
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"airshare-backend/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// sseKeepAlive 没有事件时发送注释的间隔，防止代理断开空闲连接
+	sseKeepAlive = 15 * time.Second
+	// sseBufferSize 每个订阅缓存的事件数，客户端读取过慢时丢弃新事件
+	sseBufferSize = 32
+)
+
+// sseEvent 推送给SSE客户端的事件，name 为 progress 或 status
+type sseEvent struct {
+	name     string
+	transfer string
+	sender   string
+	receiver string
+	data     interface{}
+	final    bool // 传输已结束，不会再有新事件
+}
+
+// progressSubscription 一个SSE连接的订阅
+type progressSubscription struct {
+	transferID string // 为空时订阅 deviceID 参与的所有传输
+	deviceID   string // 未启用认证时为空
+	events     chan sseEvent
+}
+
+// notifyTransferProgress 将进度事件推送给发送设备和接收设备的WebSocket连接和SSE订阅
+// 消息只放入各连接的发送队列，不等待写入
+func (s *Server) notifyTransferProgress(event models.TransferProgressEvent) {
+	msg := models.WebSocketMessage{
+		Type: models.MessageTypeTransferProgress,
+		Data: event,
+	}
+
+	conns := append(s.peerConns(event.SenderID), s.peerConns(event.ReceiverID)...)
+	for _, conn := range conns {
+		if err := s.writeJSON(conn, msg); err != nil {
+			log.Printf("推送传输进度失败: %v", err)
+		}
+	}
+
+	s.publishEvent(sseEvent{
+		name:     "progress",
+		transfer: event.TransferID,
+		sender:   event.SenderID,
+		receiver: event.ReceiverID,
+		data:     event,
+	})
+}
+
+// publishStatus 将传输状态变化发送给SSE订阅
+func (s *Server) publishStatus(request models.TransferRequest) {
+	s.publishEvent(sseEvent{
+		name:     "status",
+		transfer: request.ID,
+		sender:   request.SenderID,
+		receiver: request.ReceiverID,
+		data:     request,
+		final:    transferFinished(request.Status),
+	})
+}
+
+// handleGetTransferProgress 获取传输当前的进度
+func (s *Server) handleGetTransferProgress(w http.ResponseWriter, r *http.Request) {
+	progress, err := s.transferService.Progress(mux.Vars(r)["transfer_id"])
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Transfer not found")
+		return
+	}
+
+	// 启用认证时只有发送设备和接收设备可以查看
+	if token := tokenFromContext(r.Context()); token != nil &&
+		token.DeviceID != progress.SenderID && token.DeviceID != progress.ReceiverID {
+		respondError(w, http.StatusForbidden, "Not a participant of this transfer")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, progress)
+}
+
+// publishEvent 将事件发送给匹配的SSE订阅，订阅的缓存已满时丢弃
+func (s *Server) publishEvent(event sseEvent) {
+	s.subscriptionMutex.Lock()
+	defer s.subscriptionMutex.Unlock()
+
+	for sub := range s.subscriptions {
+		if sub.transferID != "" && sub.transferID != event.transfer {
+			continue
+		}
+		if sub.deviceID != "" && sub.deviceID != event.sender && sub.deviceID != event.receiver {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+		}
+	}
+}
+
+// handleTransferEvents 通过Server-Sent Events推送传输的进度和状态变化
+// 指定 transfer_id 时只推送该传输，传输结束后关闭连接；否则推送令牌所属设备参与的所有传输
+func (s *Server) handleTransferEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondError(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+
+	deviceID := ""
+	if token := tokenFromContext(r.Context()); token != nil {
+		deviceID = token.DeviceID
+	}
+
+	// 单个传输的订阅先发送当前进度
+	transferID := mux.Vars(r)["transfer_id"]
+	var initial *models.TransferProgressEvent
+	if transferID != "" {
+		progress, err := s.transferService.Progress(transferID)
+		if err != nil {
+			respondError(w, http.StatusNotFound, "Transfer not found")
+			return
+		}
+		if deviceID != "" && deviceID != progress.SenderID && deviceID != progress.ReceiverID {
+			respondError(w, http.StatusForbidden, "Not a participant of this transfer")
+			return
+		}
+		initial = progress
+	}
+
+	sub := &progressSubscription{
+		transferID: transferID,
+		deviceID:   deviceID,
+		events:     make(chan sseEvent, sseBufferSize),
+	}
+	s.subscriptionMutex.Lock()
+	s.subscriptions[sub] = struct{}{}
+	s.subscriptionMutex.Unlock()
+	defer func() {
+		s.subscriptionMutex.Lock()
+		delete(s.subscriptions, sub)
+		s.subscriptionMutex.Unlock()
+	}()
+
+	// SSE连接长期保持，即使服务器设置了 WriteTimeout 也取消写超时
+	// 客户端断开由请求的 Context 和写入错误发现
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if initial != nil {
+		if err := writeSSE(w, "progress", initial); err != nil {
+			return
+		}
+		if transferFinished(initial.Status) {
+			flusher.Flush()
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event := <-sub.events:
+			if err := writeSSE(w, event.name, event.data); err != nil {
+				return
+			}
+			if transferID != "" && event.final {
+				flusher.Flush()
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// writeSSE 写入一个SSE事件，data 编码为单行JSON
+func writeSSE(w http.ResponseWriter, name string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, payload)
+	return err
+}
+
+// transferFinished 传输是否已经结束，失败和暂停的传输还可以重试或恢复
+func transferFinished(status models.TransferStatus) bool {
+	switch status {
+	case models.TransferCompleted, models.TransferCancelled, models.TransferRejected, models.TransferSkipped:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"airshare-backend/internal/security"
+	"github.com/gorilla/mux"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 1024
+)
+
+// handleRoomQR 生成加入房间的二维码，启用认证时只有房主可以生成
+// 二维码同时携带房主设备已固定的公钥指纹
+func (s *Server) handleRoomQR(w http.ResponseWriter, r *http.Request) {
+	info, err := s.rooms.Get(mux.Vars(r)["room_id"])
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Room not found")
+		return
+	}
+
+	if token := tokenFromContext(r.Context()); s.authEnabled() && (token == nil || token.DeviceID != info.HostID) {
+		respondError(w, http.StatusForbidden, "Only the room host can create a join QR code")
+		return
+	}
+
+	s.respondJoinQR(w, r, security.JoinPayload{
+		Kind:            security.JoinKindRoom,
+		Server:          serverURL(r),
+		Code:            info.ID,
+		ExpiresAt:       info.ExpiresAt,
+		HostFingerprint: s.encryption.GetTrustedDevices()[info.HostID],
+	})
+}
+
+// handlePairingQR 生成当前配对码的二维码
+func (s *Server) handlePairingQR(w http.ResponseWriter, r *http.Request) {
+	code, err := s.pairingService.CurrentCode()
+	if err != nil {
+		respondError(w, http.StatusNotFound, "No active pairing code")
+		return
+	}
+
+	s.respondJoinQR(w, r, security.JoinPayload{
+		Kind:      security.JoinKindPairing,
+		Server:    serverURL(r),
+		Code:      code.Code,
+		ExpiresAt: code.ExpiresAt,
+	})
+}
+
+// handleVerifyQR 校验扫描到的二维码内容，并确认房间或配对码仍然有效
+// 扫码的设备此时还没有令牌，因此该接口无需认证
+func (s *Server) handleVerifyQR(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	payload, err := s.encryption.VerifyJoinURI(req.Payload)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, security.ErrJoinURIExpired) {
+			status = http.StatusGone
+		}
+		respondError(w, status, err.Error())
+		return
+	}
+
+	switch payload.Kind {
+	case security.JoinKindRoom:
+		if _, err := s.rooms.Get(payload.Code); err != nil {
+			respondError(w, http.StatusGone, err.Error())
+			return
+		}
+	case security.JoinKindPairing:
+		code, err := s.pairingService.CurrentCode()
+		if err != nil || code.Code != payload.Code {
+			respondError(w, http.StatusGone, "配对码已失效")
+			return
+		}
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"valid":   true,
+		"payload": payload,
+	})
+}
+
+// respondJoinQR 签名加入链接并按 format 参数返回PNG、SVG或JSON
+func (s *Server) respondJoinQR(w http.ResponseWriter, r *http.Request, payload security.JoinPayload) {
+	uri, err := s.encryption.SignJoinURI(payload)
+	if err != nil {
+		log.Printf("生成加入链接失败: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to sign join URI")
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "json" {
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"uri":        uri,
+			"expires_at": payload.ExpiresAt,
+		})
+		return
+	}
+
+	size := defaultQRSize
+	if value := r.URL.Query().Get("size"); value != "" {
+		size, err = strconv.Atoi(value)
+		if err != nil || size < minQRSize || size > maxQRSize {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("size must be between %d and %d", minQRSize, maxQRSize))
+			return
+		}
+	}
+
+	code, err := qrcode.New(uri, qrcode.Medium)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to encode QR code")
+		return
+	}
+
+	// 二维码包含有时效的链接，不允许缓存
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch format {
+	case "", "png":
+		image, err := code.PNG(size)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to render QR code")
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	case "svg":
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte(renderQRSVG(code.Bitmap(), size)))
+	default:
+		respondError(w, http.StatusBadRequest, "format must be png, svg or json")
+	}
+}
+
+// renderQRSVG 将二维码矩阵渲染为SVG，同一行相邻的深色模块合并为一个矩形
+func renderQRSVG(bitmap [][]bool, size int) string {
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+			start := x
+			for x+1 < len(row) && row[x+1] {
+				x++
+			}
+			run := x - start + 1
+			fmt.Fprintf(&path, "M%d,%dh%dv1h-%dz", start, y, run, run)
+		}
+	}
+
+	n := len(bitmap)
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="%s"/></svg>`,
+		size, size, n, n, n, n, path.String())
+}
+
+// serverURL 根据请求推断客户端可访问的服务器地址
+func serverURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
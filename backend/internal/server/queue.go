@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"airshare-backend/internal/transfer"
+	"airshare-backend/pkg/models"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// notifyTransferStatus 将传输状态变化通知发送设备和接收设备
+func (s *Server) notifyTransferStatus(request models.TransferRequest) {
+	msg := models.WebSocketMessage{
+		Type: models.MessageTypeTransferStatus,
+		Data: request,
+	}
+
+	conns := append(s.peerConns(request.SenderID), s.peerConns(request.ReceiverID)...)
+	for _, conn := range conns {
+		if err := s.writeJSON(conn, msg); err != nil {
+			log.Printf("通知传输状态失败: %v", err)
+		}
+	}
+
+	s.publishStatus(request)
+}
+
+// handleTransferControl 通过WebSocket暂停、恢复、重试传输或调整队列位置
+func (s *Server) handleTransferControl(conn *websocket.Conn, msg *models.WebSocketMessage) {
+	var control models.TransferControl
+	if err := decodeMessageData(msg, &control); err != nil || control.TransferID == "" {
+		s.sendError(conn, "无效的传输操作")
+		return
+	}
+
+	// 操作结果通过 transfer_status 消息通知
+	if _, err := s.transferService.Control(s.connDeviceID(conn), control); err != nil {
+		s.sendError(conn, err.Error())
+	}
+}
+
+// sendTransferQueue 通过WebSocket发送传输队列
+func (s *Server) sendTransferQueue(conn *websocket.Conn) {
+	if err := s.writeJSON(conn, models.WebSocketMessage{
+		Type: models.MessageTypeTransferQueue,
+		Data: s.transferService.Queue(s.connDeviceID(conn)),
+	}); err != nil {
+		log.Printf("发送传输队列失败: %v", err)
+	}
+}
+
+// handleGetTransferQueue 获取当前设备参与的进行中、排队中和已暂停的传输
+func (s *Server) handleGetTransferQueue(w http.ResponseWriter, r *http.Request) {
+	deviceID := ""
+	if token := tokenFromContext(r.Context()); token != nil {
+		deviceID = token.DeviceID
+	}
+
+	respondJSON(w, http.StatusOK, s.transferService.Queue(deviceID))
+}
+
+// handleTransferControlHTTP 通过REST接口暂停、恢复、重试传输或调整队列位置
+// move 操作的请求体为 {"position": n}
+func (s *Server) handleTransferControlHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	control := models.TransferControl{
+		TransferID: vars["transfer_id"],
+		Action:     vars["action"],
+	}
+	if control.Action == models.QueueActionMove {
+		var req struct {
+			Position int `json:"position"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			respondError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		control.Position = req.Position
+	}
+
+	// 启用认证时以令牌绑定的设备为准
+	deviceID := ""
+	if token := tokenFromContext(r.Context()); token != nil {
+		deviceID = token.DeviceID
+	}
+
+	result, err := s.transferService.Control(deviceID, control)
+	if err != nil {
+		status := http.StatusNotFound
+		switch {
+		case errors.Is(err, transfer.ErrNotParticipant):
+			status = http.StatusForbidden
+		case errors.Is(err, transfer.ErrInvalidTransition):
+			status = http.StatusConflict
+		case errors.Is(err, transfer.ErrInvalidControl):
+			status = http.StatusBadRequest
+		}
+		respondError(w, status, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, result)
+}
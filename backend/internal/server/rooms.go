@@ -0,0 +1,354 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"airshare-backend/internal/room"
+	"airshare-backend/pkg/models"
+	"github.com/gorilla/websocket"
+)
+
+// roomBinding WebSocket连接所在的房间和代表的设备
+type roomBinding struct {
+	roomID   string
+	deviceID string
+}
+
+// handleRoomCreate 创建房间，当前连接成为房主
+func (s *Server) handleRoomCreate(conn *websocket.Conn, msg *models.WebSocketMessage) {
+	var req models.CreateRoomRequest
+	if err := decodeMessageData(msg, &req); err != nil {
+		s.sendError(conn, "无效的创建房间请求")
+		return
+	}
+
+	info, err := s.rooms.Create(s.roomDevice(conn, req.Device), time.Duration(req.TTLSeconds)*time.Second)
+	if err != nil {
+		s.sendError(conn, err.Error())
+		return
+	}
+
+	s.bindRoom(conn, info.ID, info.HostID)
+	log.Printf("设备 %s 创建了房间 %s", info.HostID, info.ID)
+
+	if err := s.writeJSON(conn, models.WebSocketMessage{
+		Type: models.MessageTypeRoomUpdate,
+		Data: info,
+	}); err != nil {
+		log.Printf("发送房间信息失败: %v", err)
+	}
+}
+
+// handleRoomJoin 通过短码申请加入房间，新设备需要等待房主批准
+func (s *Server) handleRoomJoin(conn *websocket.Conn, msg *models.WebSocketMessage) {
+	var req models.ConnectRequest
+	if err := decodeMessageData(msg, &req); err != nil || req.RoomID == "" {
+		s.sendError(conn, "无效的加入房间请求")
+		return
+	}
+
+	device := s.roomDevice(conn, req.Device)
+	if device.ID == "" {
+		s.sendError(conn, room.ErrNoDeviceID.Error())
+		return
+	}
+	// 已是成员的设备会被直接批准，同一设备ID不能由其他身份的连接接管
+	if s.roomIDInUse(conn, room.NormalizeCode(req.RoomID), device.ID) {
+		s.sendError(conn, "该设备已在其他连接上加入房间")
+		return
+	}
+
+	info, status, err := s.rooms.Join(req.RoomID, device)
+	if err != nil {
+		s.sendError(conn, err.Error())
+		return
+	}
+
+	s.bindRoom(conn, info.ID, device.ID)
+
+	// 重连的成员直接恢复，其他成员收到更新后的设备列表
+	if status == room.JoinApproved {
+		s.broadcastToRoom(info, models.WebSocketMessage{
+			Type: models.MessageTypeRoomUpdate,
+			Data: info,
+		})
+		return
+	}
+
+	// 批准前不向申请者透露成员信息
+	if err := s.writeJSON(conn, models.WebSocketMessage{
+		Type: models.MessageTypeRoomJoin,
+		Data: map[string]interface{}{
+			"room_id": info.ID,
+			"status":  status,
+		},
+	}); err != nil {
+		log.Printf("发送加入房间结果失败: %v", err)
+	}
+
+	for _, hostConn := range s.roomConns(info.ID, info.HostID) {
+		if err := s.writeJSON(hostConn, models.WebSocketMessage{
+			Type: models.MessageTypeRoomJoinRequest,
+			Data: map[string]interface{}{
+				"room_id": info.ID,
+				"device":  device,
+			},
+		}); err != nil {
+			log.Printf("通知房主失败: %v", err)
+		}
+	}
+}
+
+// handleRoomApprove 房主批准设备加入
+func (s *Server) handleRoomApprove(conn *websocket.Conn, msg *models.WebSocketMessage) {
+	var action models.RoomMemberAction
+	if err := decodeMessageData(msg, &action); err != nil {
+		s.sendError(conn, "无效的房间操作")
+		return
+	}
+
+	info, err := s.rooms.Approve(action.RoomID, s.roomDeviceID(conn, action.RoomID), action.DeviceID)
+	if err != nil {
+		s.sendError(conn, err.Error())
+		return
+	}
+
+	s.broadcastToRoom(info, models.WebSocketMessage{
+		Type: models.MessageTypeRoomUpdate,
+		Data: info,
+	})
+}
+
+// handleRoomKick 房主移出成员或拒绝申请
+func (s *Server) handleRoomKick(conn *websocket.Conn, msg *models.WebSocketMessage) {
+	var action models.RoomMemberAction
+	if err := decodeMessageData(msg, &action); err != nil {
+		s.sendError(conn, "无效的房间操作")
+		return
+	}
+
+	info, err := s.rooms.Kick(action.RoomID, s.roomDeviceID(conn, action.RoomID), action.DeviceID)
+	if err != nil {
+		s.sendError(conn, err.Error())
+		return
+	}
+
+	for _, kicked := range s.roomConns(info.ID, action.DeviceID) {
+		s.unbindRoom(kicked)
+		if err := s.writeJSON(kicked, models.WebSocketMessage{
+			Type: models.MessageTypeRoomKicked,
+			Data: map[string]interface{}{"room_id": info.ID},
+		}); err != nil {
+			log.Printf("通知被移出的设备失败: %v", err)
+		}
+	}
+
+	s.broadcastToRoom(info, models.WebSocketMessage{
+		Type: models.MessageTypeRoomUpdate,
+		Data: info,
+	})
+}
+
+// handleRoomLeave 离开房间，房主离开时关闭房间
+func (s *Server) handleRoomLeave(conn *websocket.Conn, msg *models.WebSocketMessage) {
+	binding := s.roomBindingOf(conn)
+	if binding == nil {
+		s.sendError(conn, "未加入房间")
+		return
+	}
+
+	info, closed, err := s.rooms.Leave(binding.roomID, binding.deviceID)
+	s.unbindRoom(conn)
+	if err != nil {
+		s.sendError(conn, err.Error())
+		return
+	}
+
+	if !closed {
+		s.broadcastToRoom(info, models.WebSocketMessage{
+			Type: models.MessageTypeRoomUpdate,
+			Data: info,
+		})
+		return
+	}
+
+	log.Printf("房间 %s 已关闭", info.ID)
+	for _, member := range s.roomConns(info.ID, "") {
+		s.unbindRoom(member)
+		if err := s.writeJSON(member, models.WebSocketMessage{
+			Type: models.MessageTypeRoomClosed,
+			Data: map[string]interface{}{"room_id": info.ID},
+		}); err != nil {
+			log.Printf("通知房间关闭失败: %v", err)
+		}
+	}
+}
+
+// forwardInRoom 将消息转发给同一房间内的目标设备
+func (s *Server) forwardInRoom(conn *websocket.Conn, msg *models.WebSocketMessage) {
+	binding := s.roomBindingOf(conn)
+	if binding == nil || !s.rooms.IsMember(binding.roomID, binding.deviceID) {
+		s.sendError(conn, room.ErrNotMember.Error())
+		return
+	}
+	if msg.Target == "" || !s.rooms.IsMember(binding.roomID, msg.Target) {
+		s.sendError(conn, "目标设备不在房间中")
+		return
+	}
+
+	targets := s.roomConns(binding.roomID, msg.Target)
+	if len(targets) == 0 {
+		s.sendError(conn, "目标设备不在线")
+		return
+	}
+
+	forward := models.WebSocketMessage{
+		Type:   msg.Type,
+		Data:   msg.Data,
+		Target: msg.Target,
+		Source: binding.deviceID,
+	}
+	for _, target := range targets {
+		if err := s.writeJSON(target, forward); err != nil {
+			log.Printf("转发房间消息失败: %v", err)
+		}
+	}
+}
+
+// sendRoomDeviceList 发送房间成员列表，标记当前在线的设备
+func (s *Server) sendRoomDeviceList(conn *websocket.Conn, binding *roomBinding) {
+	info, err := s.rooms.Get(binding.roomID)
+	if err != nil || !s.rooms.IsMember(binding.roomID, binding.deviceID) {
+		s.sendError(conn, room.ErrNotMember.Error())
+		return
+	}
+
+	for i := range info.Devices {
+		online := len(s.roomConns(info.ID, info.Devices[i].ID)) > 0
+		info.Devices[i].IsOnline = online
+		if online {
+			info.Devices[i].Status = models.DeviceStatusOnline
+		} else {
+			info.Devices[i].Status = models.DeviceStatusOffline
+		}
+	}
+
+	if err := s.writeJSON(conn, models.WebSocketMessage{
+		Type: models.MessageTypeDeviceList,
+		Data: info.Devices,
+	}); err != nil {
+		log.Printf("发送设备列表失败: %v", err)
+	}
+}
+
+// roomDevice 确定连接代表的设备，忽略客户端声明的设备ID
+// 已认证的连接使用令牌绑定的设备ID，未认证的连接使用由会话生成的访客ID，
+// 访客断线后通过恢复会话找回同一身份
+func (s *Server) roomDevice(conn *websocket.Conn, device models.DeviceInfo) models.DeviceInfo {
+	s.clientMutex.RLock()
+	token := s.clients[conn]
+	s.clientMutex.RUnlock()
+
+	session := s.connSession(conn)
+	switch {
+	case token != nil:
+		device.ID = token.DeviceID
+	case session != nil:
+		device.ID = guestDevicePrefix + session.ID()
+	default:
+		device.ID = ""
+	}
+	device.LastSeen = time.Now()
+	device.IsOnline = true
+	device.Status = models.DeviceStatusOnline
+	return device
+}
+
+// guestDevicePrefix 未认证连接在房间中的设备ID前缀
+const guestDevicePrefix = "guest-"
+
+// roomIDInUse 检查房间中的设备ID是否已绑定到其他身份的连接
+// 只有同一设备令牌认证的连接可以共用设备ID，例如同一设备的多个标签页
+func (s *Server) roomIDInUse(conn *websocket.Conn, roomID, deviceID string) bool {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	token := s.clients[conn]
+	for other, binding := range s.roomBindings {
+		if other == conn || binding.roomID != roomID || binding.deviceID != deviceID {
+			continue
+		}
+		if otherToken := s.clients[other]; token == nil || otherToken == nil || otherToken.DeviceID != token.DeviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// roomDeviceID 获取连接在指定房间中代表的设备ID，不在该房间时返回空字符串
+func (s *Server) roomDeviceID(conn *websocket.Conn, roomID string) string {
+	binding := s.roomBindingOf(conn)
+	if binding == nil || binding.roomID != room.NormalizeCode(roomID) {
+		return ""
+	}
+	return binding.deviceID
+}
+
+// roomBindingOf 获取连接所在的房间
+func (s *Server) roomBindingOf(conn *websocket.Conn) *roomBinding {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+	return s.roomBindings[conn]
+}
+
+// bindRoom 记录连接所在的房间，一个连接同时只在一个房间中
+func (s *Server) bindRoom(conn *websocket.Conn, roomID, deviceID string) {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+	s.roomBindings[conn] = &roomBinding{roomID: roomID, deviceID: deviceID}
+}
+
+// unbindRoom 解除连接与房间的关联
+func (s *Server) unbindRoom(conn *websocket.Conn) {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+	delete(s.roomBindings, conn)
+}
+
+// roomConns 获取房间中指定设备的连接，deviceID 为空时返回房间中的所有连接
+func (s *Server) roomConns(roomID, deviceID string) []*websocket.Conn {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	var conns []*websocket.Conn
+	for conn, binding := range s.roomBindings {
+		if binding.roomID == roomID && (deviceID == "" || binding.deviceID == deviceID) {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+// broadcastToRoom 发送消息给房间中已批准的成员
+func (s *Server) broadcastToRoom(info *models.RoomInfo, msg models.WebSocketMessage) {
+	members := make(map[string]bool, len(info.Devices))
+	for _, device := range info.Devices {
+		members[device.ID] = true
+	}
+
+	s.clientMutex.RLock()
+	var conns []*websocket.Conn
+	for conn, binding := range s.roomBindings {
+		if binding.roomID == info.ID && members[binding.deviceID] {
+			conns = append(conns, conn)
+		}
+	}
+	s.clientMutex.RUnlock()
+
+	for _, conn := range conns {
+		if err := s.writeJSON(conn, msg); err != nil {
+			log.Printf("发送房间消息失败: %v", err)
+		}
+	}
+}
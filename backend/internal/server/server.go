@@ -2,60 +2,180 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"sync"
+	"time"
 
 	"airshare-backend/internal/config"
 	"airshare-backend/internal/discovery"
+	"airshare-backend/internal/room"
+	"airshare-backend/internal/security"
 	"airshare-backend/internal/transfer"
 	"airshare-backend/pkg/models"
+	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Server HTTP服务器
 type Server struct {
 	config           *config.ServerConfig
+	securityConfig   *config.SecurityConfig
 	discoveryService *discovery.DiscoveryManager
 	transferService  *transfer.Service
+	encryption       *security.EncryptionService
+	pairingService   *security.PairingService
+	tokens           *security.TokenStore
+	rooms            *room.Service
+	originPolicy     *security.OriginPolicy
 	upgrader         websocket.Upgrader
-	clients         map[*websocket.Conn]bool
+	httpServer       *http.Server
+	clients         map[*websocket.Conn]*security.DeviceToken // 连接对应的令牌，未认证时为nil
+	roomBindings    map[*websocket.Conn]*roomBinding          // 连接所在的房间
+	textHistory     *textHistory
 	clientMutex     sync.RWMutex
+	conns           sync.Map // *websocket.Conn -> *wsConnState，连接的发送队列、心跳和会话状态
+	sessions        *transfer.WSSessionStore // 会话，包括断线宽限期内的
+	subscriptions     map[*progressSubscription]struct{} // 传输事件的SSE订阅
+	subscriptionMutex sync.Mutex
 }
 
 // New 创建新的服务器
-func New(serverConfig *config.ServerConfig, discoveryService *discovery.DiscoveryManager, transferService *transfer.Service) *Server {
-	return &Server{
+func New(serverConfig *config.ServerConfig, securityConfig *config.SecurityConfig, discoveryService *discovery.DiscoveryManager, transferService *transfer.Service, encryption *security.EncryptionService, pairingService *security.PairingService, tokens *security.TokenStore, rooms *room.Service) *Server {
+	originPolicy := security.NewOriginPolicy(securityConfig.AllowedOrigins)
+
+	s := &Server{
 		config:           serverConfig,
+		securityConfig:   securityConfig,
 		discoveryService: discoveryService,
 		transferService:  transferService,
+		encryption:       encryption,
+		pairingService:   pairingService,
+		tokens:           tokens,
+		rooms:            rooms,
+		originPolicy:     originPolicy,
 		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true // 允许所有来源，生产环境需要严格限制
-			},
+			// 与CORS使用同一份来源白名单，防止局域网内的恶意网页操控本节点
+			CheckOrigin: originPolicy.CheckRequest,
 		},
-		clients: make(map[*websocket.Conn]bool),
+		clients:      make(map[*websocket.Conn]*security.DeviceToken),
+		roomBindings: make(map[*websocket.Conn]*roomBinding),
+		sessions:     transfer.NewWSSessionStore(nil),
+		textHistory:  newTextHistory(),
+		subscriptions: make(map[*progressSubscription]struct{}),
 	}
+
+	// 只有通过本节点自身的主机名访问时才视为同源
+	originPolicy.AllowHosts(s.localHosts()...)
+
+	// 传输请求推送给接收设备，接收方的决定通知发送设备
+	transferService.OnOffer(s.notifyTransferOffer)
+	transferService.OnDecision(s.notifyTransferDecision)
+	// 传输开始、排队、暂停、失败或完成时通知双方
+	transferService.OnStatusChange(s.notifyTransferStatus)
+	transferService.OnProgress(s.notifyTransferProgress)
+
+	// 已知设备公钥变化时通知可以管理已知设备的客户端，未认证的连接看不到信任列表的变化
+	encryption.OnKeyChanged(func(event security.KeyChangeEvent) {
+		s.broadcastToClients(models.WebSocketMessage{
+			Type: models.MessageTypeKeyChanged,
+			Data: event,
+		}, security.ScopeAdmin)
+	})
+
+	return s
 }
 
 // Start 启动服务器
 func (s *Server) Start() error {
-	// 设置路由
-	http.HandleFunc("/", s.handleRoot)
-	http.HandleFunc("/api/devices", s.handleDevices)
-	http.HandleFunc("/api/transfer", s.handleTransfer)
-	http.HandleFunc("/ws", s.handleWebSocket)
+	addr := fmt.Sprintf("%s:%d", s.config.Host, s.config.Port)
+	handler := s.routes()
+
+	if s.securityConfig != nil && s.securityConfig.EnableTLS {
+		httpServer, err := s.newHTTPSServer(handler)
+		if err != nil {
+			return fmt.Errorf("初始化HTTPS失败: %v", err)
+		}
+		httpServer.Addr = addr
+		s.setHTTPServer(httpServer)
+
+		log.Printf("服务器启动在 https://%s", addr)
+		// 证书已经在TLSConfig中配置，这里不需要再指定证书文件
+		return httpServer.ListenAndServeTLS("", "")
+	}
+
+	httpServer := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+	s.setHTTPServer(httpServer)
+
+	log.Printf("服务器启动在 %s", addr)
+	return httpServer.ListenAndServe()
+}
+
+// routes 设置路由
+func (s *Server) routes() http.Handler {
+	router := mux.NewRouter()
+
+	// WebSocket握手在handleWebSocket中认证，未认证连接只能进行配对
+	router.HandleFunc("/ws", s.handleWebSocket)
+	router.HandleFunc("/api/devices", s.requireScope(s.handleDevices, security.ScopeReadDevices))
+	router.HandleFunc("/api/transfer", s.requireScope(s.handleTransfer, security.ScopeSend))
+	router.HandleFunc("/metrics", s.requireScope(promhttp.Handler().ServeHTTP, security.ScopeAdmin)).Methods("GET")
+
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/devices", s.requireScope(s.handleGetDevices, security.ScopeReadDevices)).Methods("GET")
+	api.HandleFunc("/transfer/send", s.requireScope(s.handleSendFile, security.ScopeSend)).Methods("POST")
+	api.HandleFunc("/transfer/{transfer_id}/status", s.requireScope(s.handleGetTransferStatus, security.ScopeSend, security.ScopeReceive)).Methods("GET")
+	api.HandleFunc("/transfer/{transfer_id}/cancel", s.requireScope(s.handleCancelTransfer, security.ScopeSend)).Methods("POST")
+	api.HandleFunc("/transfer/{transfer_id}/decision", s.requireScope(s.handleTransferDecisionHTTP, security.ScopeReceive)).Methods("POST")
+	api.HandleFunc("/transfer/queue", s.requireScope(s.handleGetTransferQueue, security.ScopeSend, security.ScopeReceive)).Methods("GET")
+	api.HandleFunc("/transfer/events", s.requireScope(s.handleTransferEvents, security.ScopeSend, security.ScopeReceive)).Methods("GET")
+	api.HandleFunc("/transfer/{transfer_id}/events", s.requireScope(s.handleTransferEvents, security.ScopeSend, security.ScopeReceive)).Methods("GET")
+	api.HandleFunc("/transfer/{transfer_id}/files/{file_id}/download", s.requireScope(s.handleDownloadFile, security.ScopeReceive)).Methods("GET")
+	api.HandleFunc("/transfer/{transfer_id}/progress", s.requireScope(s.handleGetTransferProgress, security.ScopeSend, security.ScopeReceive)).Methods("GET")
+	api.HandleFunc("/transfer/{transfer_id}/{action:pause|resume|retry|move}", s.requireScope(s.handleTransferControlHTTP, security.ScopeSend, security.ScopeReceive)).Methods("POST")
+	api.HandleFunc("/content/missing", s.requireScope(s.handleMissingContent, security.ScopeSend)).Methods("POST")
+	api.HandleFunc("/bandwidth", s.requireScope(s.handleGetBandwidth, security.ScopeAdmin)).Methods("GET")
+	api.HandleFunc("/bandwidth", s.requireScope(s.handleUpdateBandwidth, security.ScopeAdmin)).Methods("PUT")
+	api.HandleFunc("/files", s.requireScope(s.handleGetFiles, security.ScopeReceive)).Methods("GET")
+	api.HandleFunc("/files/{filename}", s.requireScope(s.handleDeleteFile, security.ScopeReceive)).Methods("DELETE")
+	api.HandleFunc("/pairing", s.requireScope(s.handleStartPairing, security.ScopeAdmin)).Methods("POST")
+	api.HandleFunc("/pairing", s.requireScope(s.handleCancelPairing, security.ScopeAdmin)).Methods("DELETE")
+	api.HandleFunc("/pairing/qr", s.requireScope(s.handlePairingQR, security.ScopeAdmin)).Methods("GET")
+	api.HandleFunc("/pairing/devices", s.requireScope(s.handleGetTrustedDevices, security.ScopeAdmin)).Methods("GET")
+	api.HandleFunc("/pairing/devices/{device_id}", s.requireScope(s.handleUntrustDevice, security.ScopeAdmin)).Methods("DELETE")
+	api.HandleFunc("/known-devices", s.requireScope(s.handleGetKnownDevices, security.ScopeAdmin)).Methods("GET")
+	api.HandleFunc("/known-devices/{device_id}/sas", s.requireScope(s.handleGetVerificationCode, security.ScopeAdmin)).Methods("GET")
+	api.HandleFunc("/known-devices/{device_id}/verify", s.requireScope(s.handleVerifyDevice, security.ScopeAdmin)).Methods("POST")
+	api.HandleFunc("/known-devices/{device_id}/accept-key", s.requireScope(s.handleAcceptKeyChange, security.ScopeAdmin)).Methods("POST")
+	api.HandleFunc("/rooms/{room_id}/qr", s.requireScope(s.handleRoomQR, security.ScopeSend, security.ScopeReceive)).Methods("GET")
+	// 扫码的设备还没有令牌，二维码校验无需认证
+	api.HandleFunc("/qr/verify", s.handleVerifyQR).Methods("POST")
+	api.HandleFunc("/tokens", s.requireScope(s.handleGetTokens, security.ScopeAdmin)).Methods("GET")
+	api.HandleFunc("/tokens", s.requireScope(s.handleIssueToken, security.ScopeAdmin)).Methods("POST")
+	api.HandleFunc("/tokens/{token_id}", s.requireScope(s.handleRevokeToken, security.ScopeAdmin)).Methods("DELETE")
 
 	// 启动文件服务
 	if s.config.WebRoot != "" {
-		http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(s.config.WebRoot))))
+		router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(s.config.WebRoot))))
 	}
 
-	addr := fmt.Sprintf("%s:%d", s.config.Host, s.config.Port)
-	log.Printf("服务器启动在 %s", addr)
-	
-	return http.ListenAndServe(addr, nil)
+	router.PathPrefix("/").HandlerFunc(s.handleRoot)
+
+	return corsMiddleware(s.securityConfig.EnableCORS, s.originPolicy, router)
+}
+
+// setHTTPServer 记录当前的http.Server，用于停止服务
+func (s *Server) setHTTPServer(httpServer *http.Server) {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+	s.httpServer = httpServer
 }
 
 // Stop 停止服务器
@@ -63,11 +183,17 @@ func (s *Server) Stop() {
 	s.clientMutex.Lock()
 	defer s.clientMutex.Unlock()
 
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+
 	// 关闭所有WebSocket连接
 	for client := range s.clients {
 		client.Close()
 	}
-	s.clients = make(map[*websocket.Conn]bool)
+	s.clients = make(map[*websocket.Conn]*security.DeviceToken)
+	s.roomBindings = make(map[*websocket.Conn]*roomBinding)
+	s.sessions.Close()
 }
 
 // handleRoot 处理根路径
@@ -112,26 +238,61 @@ func (s *Server) handleTransfer(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// handleWebSocketMessages 处理WebSocket消息
-func (s *Server) handleWebSocketMessages(conn *websocket.Conn) {
+// handleWebSocketMessages 处理WebSocket消息，读循环退出时负责清理连接
+func (s *Server) handleWebSocketMessages(conn *websocket.Conn, state *wsConnState) {
 	defer func() {
 		// 客户端断开连接
+		// 断开不会离开房间，会话在宽限期内保留所在的房间，设备也可以用同一设备ID重新加入
+		close(state.done)
 		s.clientMutex.Lock()
+		room := s.roomBindings[conn]
 		delete(s.clients, conn)
+		delete(s.roomBindings, conn)
 		s.clientMutex.Unlock()
+		s.conns.Delete(conn)
+		s.sessions.Detach(state.session, state, room)
+		transfer.RecordWSConnected(-1)
 		conn.Close()
 		log.Printf("WebSocket连接断开: %s", conn.RemoteAddr())
 	}()
 
+	// 任何数据（包括pong）都会延长读超时，超时未收到数据视为连接已失效
+	conn.SetReadDeadline(time.Now().Add(transfer.WSPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		if sent := state.lastPing.Load(); sent > 0 {
+			transfer.ObserveWSPingRTT(time.Since(time.Unix(0, sent)))
+		}
+		return conn.SetReadDeadline(time.Now().Add(transfer.WSPongTimeout))
+	})
+
 	for {
 		var msg models.WebSocketMessage
 		err := conn.ReadJSON(&msg)
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				transfer.RecordWSEviction(transfer.WSEvictPongTimeout)
+				log.Printf("连接 %s 心跳超时", conn.RemoteAddr())
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket读取错误: %v", err)
 			}
 			break
 		}
+		conn.SetReadDeadline(time.Now().Add(transfer.WSPongTimeout))
+
+		// 任何消息都可以携带确认，心跳和确认不算活跃
+		if msg.Ack > 0 {
+			state.session.Ack(msg.Ack)
+		}
+		if msg.Type != models.MessageTypeKeepAlive && msg.Type != models.MessageTypeAck {
+			state.touch()
+		}
+
+		// 令牌可能在连接期间被吊销或过期，每条消息都重新校验
+		if !s.connTokenValid(conn) {
+			s.sendError(conn, "访问令牌已失效")
+			break
+		}
 
 		s.handleWebSocketMessage(conn, &msg)
 	}
@@ -139,21 +300,59 @@ func (s *Server) handleWebSocketMessages(conn *websocket.Conn) {
 
 // handleWebSocketMessage 处理单个WebSocket消息
 func (s *Server) handleWebSocketMessage(conn *websocket.Conn, msg *models.WebSocketMessage) {
+	if !s.wsMessageAllowed(conn, msg.Type) {
+		s.sendError(conn, "权限不足")
+		return
+	}
+
 	switch msg.Type {
 	case models.MessageTypeDeviceList:
 		s.sendDeviceList(conn)
 	case models.MessageTypeTransfer:
 		s.handleTransferMessage(conn, msg)
-	case models.MessageTypeKeepAlive:
-		// 心跳包，不做任何处理
+	case models.MessageTypePairRequest:
+		s.handlePairRequest(conn, msg)
+	case models.MessageTypePairConfirm:
+		s.handlePairConfirm(conn, msg)
+	case models.MessageTypeDeviceIdentity:
+		s.handleDeviceIdentity(conn, msg)
+	case models.MessageTypeRoomCreate:
+		s.handleRoomCreate(conn, msg)
+	case models.MessageTypeRoomJoin:
+		s.handleRoomJoin(conn, msg)
+	case models.MessageTypeRoomApprove:
+		s.handleRoomApprove(conn, msg)
+	case models.MessageTypeRoomKick:
+		s.handleRoomKick(conn, msg)
+	case models.MessageTypeRoomLeave:
+		s.handleRoomLeave(conn, msg)
+	case models.MessageTypeSignal:
+		s.forwardInRoom(conn, msg)
+	case models.MessageTypeText, models.MessageTypeClipboard:
+		s.handleTextMessage(conn, msg)
+	case models.MessageTypeTextHistory:
+		s.sendTextHistory(conn)
+	case models.MessageTypeTransferDecision:
+		s.handleTransferDecision(conn, msg)
+	case models.MessageTypeTransferControl:
+		s.handleTransferControl(conn, msg)
+	case models.MessageTypeTransferQueue:
+		s.sendTransferQueue(conn)
+	case models.MessageTypeKeepAlive, models.MessageTypeAck:
+		// 心跳包，确认已在读循环中处理
 	default:
 		log.Printf("未知的消息类型: %s", msg.Type)
 		s.sendError(conn, "未知的消息类型")
 	}
 }
 
-// sendDeviceList 发送设备列表
+// sendDeviceList 发送设备列表，房间中的连接只能看到房间成员
 func (s *Server) sendDeviceList(conn *websocket.Conn) {
+	if binding := s.roomBindingOf(conn); binding != nil {
+		s.sendRoomDeviceList(conn, binding)
+		return
+	}
+
 	// 暂时返回空设备列表，因为s.discoveryService.GetDevices方法未定义
 	// devices := s.discoveryService.GetDevices()
 	msg := models.WebSocketMessage{
@@ -161,13 +360,19 @@ func (s *Server) sendDeviceList(conn *websocket.Conn) {
 		Data: []string{},
 	}
 	
-	if err := conn.WriteJSON(msg); err != nil {
+	if err := s.writeJSON(conn, msg); err != nil {
 		log.Printf("发送设备列表失败: %v", err)
 	}
 }
 
 // handleTransferMessage 处理传输消息
 func (s *Server) handleTransferMessage(conn *websocket.Conn, msg *models.WebSocketMessage) {
+	// 房间中的传输消息只在房间成员之间转发
+	if s.roomBindingOf(conn) != nil {
+		s.forwardInRoom(conn, msg)
+		return
+	}
+
 	// 这里需要根据消息内容处理文件传输
 	// 实际实现需要处理文件分片、进度更新等
 	responseMsg := models.WebSocketMessage{
@@ -176,12 +381,112 @@ func (s *Server) handleTransferMessage(conn *websocket.Conn, msg *models.WebSock
 			"message": "传输功能正在开发中",
 		},
 	}
-	// 直接使用websocket的WriteJSON方法
-	if err := conn.WriteJSON(responseMsg); err != nil {
+	// 通过writeJSON串行化同一连接的写入
+	if err := s.writeJSON(conn, responseMsg); err != nil {
 		log.Printf("发送传输消息失败: %v", err)
 	}
 }
 
+// handlePairRequest 处理配对请求
+func (s *Server) handlePairRequest(conn *websocket.Conn, msg *models.WebSocketMessage) {
+	var req security.PairingRequest
+	if err := decodeMessageData(msg, &req); err != nil {
+		s.sendError(conn, "无效的配对请求")
+		return
+	}
+
+	resp, err := s.pairingService.HandleRequest(&req)
+	if err != nil {
+		log.Printf("配对请求失败: %v", err)
+		s.sendError(conn, err.Error())
+		return
+	}
+
+	if err := s.writeJSON(conn, models.WebSocketMessage{
+		Type: models.MessageTypePairResponse,
+		Data: resp,
+	}); err != nil {
+		log.Printf("发送配对响应失败: %v", err)
+	}
+}
+
+// handlePairConfirm 处理配对确认
+func (s *Server) handlePairConfirm(conn *websocket.Conn, msg *models.WebSocketMessage) {
+	var confirm security.PairingConfirm
+	if err := decodeMessageData(msg, &confirm); err != nil {
+		s.sendError(conn, "无效的配对确认")
+		return
+	}
+
+	result, err := s.pairingService.HandleConfirm(&confirm)
+	if err != nil {
+		log.Printf("配对确认失败: %v", err)
+		s.sendError(conn, err.Error())
+		return
+	}
+
+	if err := s.writeJSON(conn, models.WebSocketMessage{
+		Type: models.MessageTypePairComplete,
+		Data: result,
+	}); err != nil {
+		log.Printf("发送配对结果失败: %v", err)
+	}
+}
+
+// handleDeviceIdentity 处理设备身份声明，比对设备公钥与已固定的公钥
+// 只接受已配对的设备；启用认证时声明的设备ID必须与连接的令牌一致，
+// 防止其他连接冒充设备覆盖待确认的公钥或制造大量 key_changed 通知
+func (s *Server) handleDeviceIdentity(conn *websocket.Conn, msg *models.WebSocketMessage) {
+	var identity models.DeviceIdentity
+	if err := decodeMessageData(msg, &identity); err != nil || identity.DeviceID == "" {
+		s.sendError(conn, "无效的设备身份")
+		return
+	}
+
+	if s.authEnabled() {
+		s.clientMutex.RLock()
+		token := s.clients[conn]
+		s.clientMutex.RUnlock()
+		if token == nil || token.DeviceID != identity.DeviceID {
+			s.sendError(conn, "设备身份与令牌不符")
+			return
+		}
+	}
+	if _, paired := s.encryption.GetTrustedDevices()[identity.DeviceID]; !paired {
+		s.sendError(conn, "设备尚未配对")
+		return
+	}
+
+	status, device, err := s.encryption.ObserveDevice(identity.DeviceID, identity.DeviceName, identity.PublicKey)
+	if err != nil {
+		log.Printf("记录设备身份失败: %v", err)
+		s.sendError(conn, err.Error())
+		return
+	}
+
+	if err := s.writeJSON(conn, models.WebSocketMessage{
+		Type: models.MessageTypeDeviceIdentity,
+		Data: map[string]interface{}{
+			"status":      status,
+			"trusted":     device.Trusted && status != security.KeyStatusChanged,
+			"fingerprint": device.Fingerprint,
+			"node_id":     s.encryption.GetFingerprint(),
+			"public_key":  s.encryption.GetPublicKey(),
+		},
+	}); err != nil {
+		log.Printf("发送设备身份响应失败: %v", err)
+	}
+}
+
+// decodeMessageData 将消息数据解析到指定结构体
+func decodeMessageData(msg *models.WebSocketMessage, target interface{}) error {
+	data, err := json.Marshal(msg.Data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
 // sendError 发送错误消息
 func (s *Server) sendError(conn *websocket.Conn, errorMsg string) {
 	msg := models.WebSocketMessage{
@@ -189,11 +494,53 @@ func (s *Server) sendError(conn *websocket.Conn, errorMsg string) {
 		Error: errorMsg,
 	}
 	
-	if err := conn.WriteJSON(msg); err != nil {
+	if err := s.writeJSON(conn, msg); err != nil {
 		log.Printf("发送错误消息失败: %v", err)
 	}
 }
 
+// writeJSON 将WebSocket消息放入连接的发送队列，不等待写入，写入慢的连接不影响调用者
+// 消息分配会话序列号并缓存，断线后恢复会话时重发；发送队列持续阻塞的连接被断开
+func (s *Server) writeJSON(conn *websocket.Conn, msg models.WebSocketMessage) error {
+	value, ok := s.conns.Load(conn)
+	if !ok {
+		return errConnClosed
+	}
+	state := value.(*wsConnState)
+
+	// 会话已被新连接接管时，旧连接上的消息不进入缓存
+	err := state.session.SendTo(state, func(seq uint64) ([]byte, error) {
+		msg.Seq = seq
+		return json.Marshal(msg)
+	})
+	if errors.Is(err, transfer.ErrWSSessionDetached) {
+		return errConnClosed
+	}
+	return err
+}
+
+// writeLoop 连接上唯一的消息写入者，按入队顺序写入，读循环退出时结束
+// 写入失败或超时的连接被关闭，由读循环清理
+func (s *Server) writeLoop(conn *websocket.Conn, state *wsConnState) {
+	for {
+		select {
+		case <-state.done:
+			return
+		case data := <-state.outbox.Messages():
+			conn.SetWriteDeadline(time.Now().Add(transfer.WSWriteTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					transfer.RecordWSEviction(transfer.WSEvictWriteTimeout)
+				}
+				log.Printf("连接 %s 写入消息失败: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
 // sendJSONResponse 发送JSON响应
 func (s *Server) sendJSONResponse(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
@@ -204,21 +551,24 @@ func (s *Server) sendJSONResponse(w http.ResponseWriter, status int, data interf
 	}
 }
 
-// broadcastToClients 广播消息给所有客户端
-func (s *Server) broadcastToClients(msg models.WebSocketMessage) {
+// broadcastToClients 广播消息给令牌拥有 scope 权限的客户端，未启用认证时发给所有客户端
+// 消息放入每个连接的发送队列，写入慢的连接不阻塞其他连接
+func (s *Server) broadcastToClients(msg models.WebSocketMessage, scope security.Scope) {
+	authEnabled := s.authEnabled()
+
 	s.clientMutex.RLock()
-	defer s.clientMutex.RUnlock()
+	clients := make([]*websocket.Conn, 0, len(s.clients))
+	for client, token := range s.clients {
+		if authEnabled && (token == nil || !token.HasScope(scope)) {
+			continue
+		}
+		clients = append(clients, client)
+	}
+	s.clientMutex.RUnlock()
 
-	for client := range s.clients {
-		if err := client.WriteJSON(msg); err != nil {
+	for _, client := range clients {
+		if err := s.writeJSON(client, msg); err != nil {
 			log.Printf("广播消息失败: %v", err)
-			// 移除失败的客户端
-			go func(c *websocket.Conn) {
-				s.clientMutex.Lock()
-				delete(s.clients, c)
-				s.clientMutex.Unlock()
-				c.Close()
-			}(client)
 		}
 	}
 }
\ No newline at end of file
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"airshare-backend/internal/security"
+	"airshare-backend/internal/transfer"
+	"airshare-backend/pkg/models"
+	"github.com/gorilla/websocket"
+)
+
+// errConnClosed 连接已经断开并清理
+var errConnClosed = errors.New("连接已关闭")
+
+// wsConnState 连接的发送队列、心跳和会话状态，实现 transfer.WSConn
+type wsConnState struct {
+	conn       *websocket.Conn
+	outbox     *transfer.WSOutbox  // 发送队列，由 writeLoop 写入连接
+	session    *transfer.WSSession // 握手时设置，之后不再改变
+	done       chan struct{}       // 读循环退出时关闭，通知心跳和写协程退出
+	lastActive atomic.Int64        // 最后一次收到业务消息的时间（UnixNano）
+	lastPing   atomic.Int64        // 最后一次发送ping的时间（UnixNano）
+}
+
+// touch 更新最后活跃时间
+func (c *wsConnState) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// Enqueue 将消息放入连接的发送队列
+func (c *wsConnState) Enqueue(data []byte) {
+	c.outbox.Enqueue(data)
+}
+
+// connSession 获取连接的会话，连接已断开时返回nil
+func (s *Server) connSession(conn *websocket.Conn) *transfer.WSSession {
+	value, ok := s.conns.Load(conn)
+	if !ok {
+		return nil
+	}
+	return value.(*wsConnState).session
+}
+
+// openSession 为新连接创建会话，提供有效的恢复令牌时恢复原会话和房间
+// 查询参数：session_id、resume_token、last_seq（客户端收到的最大序列号）
+// 会话信息和需要重发的消息在连接登记之前入队，先于其他消息发送
+func (s *Server) openSession(state *wsConnState, token *security.DeviceToken, query url.Values) error {
+	deviceID := ""
+	if token != nil {
+		deviceID = token.DeviceID
+	}
+
+	if id, resumeToken := query.Get("session_id"), query.Get("resume_token"); id != "" && resumeToken != "" {
+		lastSeq, _ := strconv.ParseUint(query.Get("last_seq"), 10, 64)
+
+		resumed, err := s.sessions.Resume(id, resumeToken, deviceID, lastSeq, state, sessionMessage)
+		if err == nil {
+			transfer.RecordWSResume("resumed")
+			log.Printf("连接 %s 已恢复会话 %s，重发 %d 条消息", state.conn.RemoteAddr(), id, resumed.Replayed)
+			state.session = resumed.Session
+			s.conns.Store(state.conn, state)
+
+			// 房间在断线期间关闭或设备被移出时不再恢复
+			if room, ok := resumed.State.(*roomBinding); ok && room != nil && s.rooms.IsMember(room.roomID, room.deviceID) {
+				s.clientMutex.Lock()
+				s.roomBindings[state.conn] = room
+				s.clientMutex.Unlock()
+			}
+
+			// 旧连接可能是尚未超时的半开连接
+			if old, ok := resumed.Previous.(*wsConnState); ok {
+				old.conn.Close()
+			}
+			return nil
+		}
+
+		transfer.RecordWSResume("rejected")
+		log.Printf("恢复会话 %s 失败: %v，创建新会话", id, err)
+	}
+
+	session, err := s.sessions.Open("", deviceID, state, sessionMessage)
+	if err != nil {
+		return err
+	}
+	state.session = session
+	s.conns.Store(state.conn, state)
+	return nil
+}
+
+// sessionMessage 会话信息消息，会话信息不分配序列号也不缓存
+func sessionMessage(info transfer.WSSessionInfo) ([]byte, error) {
+	return json.Marshal(models.WebSocketMessage{
+		Type: models.MessageTypeSession,
+		Data: models.WebSocketSession{
+			SessionID:   info.ID,
+			ResumeToken: info.Token,
+			Resumed:     info.Resumed,
+			LastSeq:     info.LastSeq,
+		},
+	})
+}
+
+// keepAlive 定期发送ping，断开长时间空闲的未认证连接
+// 读超时由读循环设置，收到pong时延长；WriteControl可以与其他写操作并发调用
+func (s *Server) keepAlive(conn *websocket.Conn, state *wsConnState) {
+	ticker := time.NewTicker(transfer.WSPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-state.done:
+			return
+		case now := <-ticker.C:
+			if s.idleEvictable(conn) {
+				if idle := now.Sub(time.Unix(0, state.lastActive.Load())); idle > transfer.WSIdleTimeout {
+					transfer.RecordWSEviction(transfer.WSEvictIdle)
+					log.Printf("连接 %s 空闲 %v，断开连接", conn.RemoteAddr(), idle.Round(time.Second))
+					conn.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseNormalClosure, "idle timeout"),
+						now.Add(transfer.WSWriteTimeout))
+					conn.Close()
+					return
+				}
+			}
+
+			state.lastPing.Store(now.UnixNano())
+			if err := conn.WriteControl(websocket.PingMessage, nil, now.Add(transfer.WSWriteTimeout)); err != nil {
+				log.Printf("连接 %s 发送心跳失败: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// idleEvictable 启用认证时未认证的连接只能配对，长时间空闲时断开
+// 已认证的连接需要一直在线等待传输请求，不因空闲断开
+func (s *Server) idleEvictable(conn *websocket.Conn) bool {
+	if !s.authEnabled() {
+		return false
+	}
+
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+	return s.clients[conn] == nil
+}
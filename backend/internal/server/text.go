@@ -0,0 +1,366 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"airshare-backend/internal/room"
+	"airshare-backend/internal/security"
+	"airshare-backend/pkg/models"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	maxTextSize        = 64 * 1024       // text/plain 和 text/uri-list 的最大字节数
+	maxImageSize       = 2 * 1024 * 1024 // image/png 解码后的最大字节数
+	textHistorySize    = 20              // 每台设备保留的最近消息数
+	textHistoryDevices = 256             // 最多保留历史的设备数
+)
+
+// pngSignature PNG文件头
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// textHistory 每台设备最近收发的文本消息，只保存在内存中
+type textHistory struct {
+	mu      sync.Mutex
+	entries map[string][]models.TextPayload
+}
+
+// newTextHistory 创建文本消息历史
+func newTextHistory() *textHistory {
+	return &textHistory{entries: make(map[string][]models.TextPayload)}
+}
+
+// add 记录设备的一条消息，超过上限时丢弃最早的
+// 设备数达到上限时丢弃最久没有新消息的设备的历史
+func (h *textHistory) add(deviceID string, payload models.TextPayload) {
+	if deviceID == "" {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, exists := h.entries[deviceID]; !exists && len(h.entries) >= textHistoryDevices {
+		h.evictOldest()
+	}
+
+	entries := append(h.entries[deviceID], payload)
+	if len(entries) > textHistorySize {
+		entries = entries[len(entries)-textHistorySize:]
+	}
+	h.entries[deviceID] = entries
+}
+
+// evictOldest 删除最后一条消息最早的设备历史，调用者需持有锁
+func (h *textHistory) evictOldest() {
+	oldest := ""
+	var oldestAt time.Time
+	for deviceID, entries := range h.entries {
+		last := entries[len(entries)-1].SentAt
+		if oldest == "" || last.Before(oldestAt) {
+			oldest, oldestAt = deviceID, last
+		}
+	}
+	delete(h.entries, oldest)
+}
+
+// list 获取设备的消息历史，按时间先后排列
+func (h *textHistory) list(deviceID string) []models.TextPayload {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]models.TextPayload{}, h.entries[deviceID]...)
+}
+
+// handleTextMessage 将文本或剪贴板内容转发给目标设备或房间成员
+func (s *Server) handleTextMessage(conn *websocket.Conn, msg *models.WebSocketMessage) {
+	var payload models.TextPayload
+	if err := decodeMessageData(msg, &payload); err != nil {
+		s.sendError(conn, "无效的文本消息")
+		return
+	}
+	if err := validateTextPayload(&payload); err != nil {
+		s.sendError(conn, err.Error())
+		return
+	}
+
+	sender := s.connDeviceID(conn)
+	binding := s.roomBindingOf(conn)
+	recipients, err := s.textRecipients(binding, sender, msg.Target)
+	if err != nil {
+		s.sendError(conn, err.Error())
+		return
+	}
+	if len(payload.Encrypted) > 0 && len(recipients) != 1 {
+		s.sendError(conn, "客户端加密的内容只能发给单个设备")
+		return
+	}
+
+	id, err := newTextID()
+	if err != nil {
+		s.sendError(conn, err.Error())
+		return
+	}
+
+	payload.ID = id
+	payload.Kind = msg.Type
+	payload.From = sender
+	payload.SentAt = time.Now()
+	if binding != nil {
+		payload.RoomID = binding.roomID
+	}
+
+	online := 0
+	for _, recipient := range recipients {
+		delivered, err := s.sealTextFor(payload, recipient)
+		if err != nil {
+			s.sendError(conn, err.Error())
+			return
+		}
+
+		s.textHistory.add(recipient, delivered)
+
+		var targets []*websocket.Conn
+		if binding != nil {
+			targets = s.roomConns(binding.roomID, recipient)
+		} else {
+			targets = s.deviceConns(recipient)
+		}
+		if len(targets) > 0 {
+			online++
+		}
+
+		for _, target := range targets {
+			if err := s.writeJSON(target, models.WebSocketMessage{
+				Type:   msg.Type,
+				Data:   delivered,
+				Target: recipient,
+				Source: sender,
+			}); err != nil {
+				log.Printf("转发文本消息失败: %v", err)
+			}
+		}
+	}
+
+	// 发送方的历史不保留加密前的明文
+	sent := payload
+	sent.ServerEncrypt = false
+	sent.To = msg.Target
+	if payload.ServerEncrypt || len(payload.Encrypted) > 0 {
+		sent.Content = ""
+		sent.Encrypted = nil
+	}
+	s.textHistory.add(sender, sent)
+
+	if err := s.writeJSON(conn, models.WebSocketMessage{
+		Type: models.MessageTypeTextDelivered,
+		Data: map[string]interface{}{
+			"id":         payload.ID,
+			"recipients": recipients,
+			"online":     online,
+		},
+	}); err != nil {
+		log.Printf("发送文本消息回执失败: %v", err)
+	}
+}
+
+// sendTextHistory 发送当前设备最近收发的文本消息
+func (s *Server) sendTextHistory(conn *websocket.Conn) {
+	deviceID := s.connDeviceID(conn)
+	if deviceID == "" {
+		s.sendError(conn, "未知的设备身份")
+		return
+	}
+
+	if err := s.writeJSON(conn, models.WebSocketMessage{
+		Type: models.MessageTypeTextHistory,
+		Data: s.textHistory.list(deviceID),
+	}); err != nil {
+		log.Printf("发送文本消息历史失败: %v", err)
+	}
+}
+
+// textRecipients 确定文本消息的接收设备
+// 房间中未指定目标时发给其他所有成员，房间外必须指定已配对的目标设备
+func (s *Server) textRecipients(binding *roomBinding, sender, target string) ([]string, error) {
+	if binding == nil {
+		if target == "" {
+			return nil, errors.New("缺少目标设备")
+		}
+		if sender == "" {
+			return nil, errors.New("未知的设备身份")
+		}
+		if !s.encryption.IsTrusted(target) {
+			return nil, errors.New("目标设备未配对")
+		}
+		return []string{target}, nil
+	}
+
+	if !s.rooms.IsMember(binding.roomID, sender) {
+		return nil, room.ErrNotMember
+	}
+	if target != "" {
+		if !s.rooms.IsMember(binding.roomID, target) {
+			return nil, errors.New("目标设备不在房间中")
+		}
+		return []string{target}, nil
+	}
+
+	info, err := s.rooms.Get(binding.roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	var recipients []string
+	for _, device := range info.Devices {
+		if device.ID != sender {
+			recipients = append(recipients, device.ID)
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("房间中没有其他设备")
+	}
+	return recipients, nil
+}
+
+// sealTextFor 生成发给指定设备的消息，要求服务器到设备加密时用该设备的公钥加密
+func (s *Server) sealTextFor(payload models.TextPayload, recipient string) (models.TextPayload, error) {
+	payload.To = recipient
+	if !payload.ServerEncrypt {
+		return payload, nil
+	}
+
+	encrypted, err := s.encryption.EncryptForDevice(recipient, []byte(payload.Content))
+	if err != nil {
+		return payload, err
+	}
+	data, err := json.Marshal(encrypted)
+	if err != nil {
+		return payload, fmt.Errorf("序列化加密内容失败: %v", err)
+	}
+
+	payload.ServerEncrypt = false
+	payload.Content = ""
+	payload.Encrypted = data
+	return payload, nil
+}
+
+// validateTextPayload 检查MIME类型、内容格式和大小
+func validateTextPayload(payload *models.TextPayload) error {
+	if payload.MIME == "" {
+		payload.MIME = models.MIMETextPlain
+	}
+
+	// 客户端自行加密的内容只检查信封格式
+	if len(payload.Encrypted) > 0 {
+		if payload.Content != "" || payload.ServerEncrypt {
+			return errors.New("加密消息不能同时携带明文")
+		}
+		var envelope security.EncryptedMessage
+		if err := json.Unmarshal(payload.Encrypted, &envelope); err != nil || envelope.Data == "" || envelope.Key == "" || envelope.Signature == "" {
+			return errors.New("无效的加密内容")
+		}
+		if base64.StdEncoding.DecodedLen(len(envelope.Data)) > maxImageSize {
+			return errors.New("内容超过大小限制")
+		}
+		return nil
+	}
+
+	switch payload.MIME {
+	case models.MIMETextPlain, models.MIMEURIList:
+		if len(payload.Content) > maxTextSize {
+			return fmt.Errorf("文本超过大小限制（%d字节）", maxTextSize)
+		}
+		if !utf8.ValidString(payload.Content) {
+			return errors.New("文本不是有效的UTF-8")
+		}
+		if payload.MIME == models.MIMEURIList {
+			if err := validateURIList(payload.Content); err != nil {
+				return err
+			}
+		}
+		payload.Size = len(payload.Content)
+	case models.MIMEImagePNG:
+		if base64.StdEncoding.DecodedLen(len(payload.Content)) > maxImageSize+2 {
+			return fmt.Errorf("图片超过大小限制（%d字节）", maxImageSize)
+		}
+		image, err := base64.StdEncoding.DecodeString(payload.Content)
+		if err != nil || !bytes.HasPrefix(image, pngSignature) {
+			return errors.New("无效的PNG图片")
+		}
+		if len(image) > maxImageSize {
+			return fmt.Errorf("图片超过大小限制（%d字节）", maxImageSize)
+		}
+		payload.Size = len(image)
+	default:
+		return fmt.Errorf("不支持的MIME类型: %s", payload.MIME)
+	}
+
+	if payload.Size == 0 {
+		return errors.New("内容为空")
+	}
+	return nil
+}
+
+// validateURIList 检查 text/uri-list（RFC 2483）：每行一个绝对URI，#开头为注释
+func validateURIList(content string) error {
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if uri, err := url.Parse(line); err != nil || !uri.IsAbs() {
+			return fmt.Errorf("无效的URI: %s", line)
+		}
+	}
+	return nil
+}
+
+// connDeviceID 获取连接代表的设备ID：房间中的设备ID或令牌绑定的设备ID
+func (s *Server) connDeviceID(conn *websocket.Conn) string {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	if binding := s.roomBindings[conn]; binding != nil {
+		return binding.deviceID
+	}
+	if token := s.clients[conn]; token != nil {
+		return token.DeviceID
+	}
+	return ""
+}
+
+// deviceConns 获取令牌绑定到指定设备的所有连接
+func (s *Server) deviceConns(deviceID string) []*websocket.Conn {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	var conns []*websocket.Conn
+	for conn, token := range s.clients {
+		if token != nil && token.DeviceID == deviceID {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+// newTextID 生成文本消息ID
+func newTextID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("生成消息ID失败: %v", err)
+	}
+	return hex.EncodeToString(id), nil
+}
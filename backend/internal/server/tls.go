@@ -0,0 +1,127 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"airshare-backend/internal/security"
+)
+
+// tlsReadHeaderTimeout HTTPS服务器读取请求头的超时时间
+const tlsReadHeaderTimeout = 15 * time.Second
+
+// newHTTPSServer 根据安全配置创建HTTPS服务器
+// 配置了证书文件时使用该证书，否则由CertificateService自动签发设备证书
+func (s *Server) newHTTPSServer(handler http.Handler) (*http.Server, error) {
+	certService, err := s.newCertificateService()
+	if err != nil {
+		return nil, err
+	}
+
+	deviceID, err := os.Hostname()
+	if err != nil || deviceID == "" {
+		deviceID = "airshare"
+	}
+
+	if s.securityConfig.CertFile != "" && s.securityConfig.KeyFile != "" {
+		certPEM, err := os.ReadFile(s.securityConfig.CertFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取证书文件失败: %v", err)
+		}
+
+		keyPEM, err := os.ReadFile(s.securityConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取私钥文件失败: %v", err)
+		}
+
+		if err := certService.ImportCertificate(deviceID, string(certPEM), string(keyPEM)); err != nil {
+			return nil, fmt.Errorf("导入证书失败: %v", err)
+		}
+		log.Printf("使用证书文件: %s", s.securityConfig.CertFile)
+	} else {
+		if _, _, err := certService.GenerateDeviceCertificate(deviceID, s.certificateHosts(deviceID)...); err != nil {
+			return nil, fmt.Errorf("签发服务器证书失败: %v", err)
+		}
+		log.Printf("已为 %s 自动签发服务器证书", deviceID)
+	}
+
+	tlsService, err := security.NewTLSService(certService)
+	if err != nil {
+		return nil, err
+	}
+
+	httpServer, err := tlsService.CreateHTTPSServer(deviceID, handler)
+	if err != nil {
+		return nil, err
+	}
+	// 上传和下载大文件可能持续很久，不限制整个请求的读写时间，与HTTP模式一致
+	// 只限制读取请求头的时间，防止连接一直不发送请求头
+	httpServer.ReadTimeout = 0
+	httpServer.WriteTimeout = 0
+	httpServer.ReadHeaderTimeout = tlsReadHeaderTimeout
+
+	if s.securityConfig.RequireClientCert {
+		// 克隆配置，避免修改TLSService缓存的配置
+		tlsConfig := httpServer.TLSConfig.Clone()
+		// 证书链由VerifyPeerCertificate根据AirShare CA校验
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+		tlsConfig.VerifyPeerCertificate = tlsService.VerifyPeerCertificate
+		httpServer.TLSConfig = tlsConfig
+		log.Println("已启用双向TLS认证")
+	}
+
+	return httpServer, nil
+}
+
+// newCertificateService 创建证书服务，配置了CA目录时使用持久化CA
+func (s *Server) newCertificateService() (*security.CertificateService, error) {
+	algorithm, err := security.ParseKeyAlgorithm(s.securityConfig.KeyAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.securityConfig.CADir != "" {
+		return security.NewPersistentCertificateService(s.securityConfig.CADir, algorithm)
+	}
+
+	if s.securityConfig.RequireClientCert {
+		log.Println("警告: 未配置ca_dir，CA将在重启后变化，已签发的客户端证书会失效")
+	}
+	return security.NewCertificateService(algorithm)
+}
+
+// certificateHosts 收集自动签发证书时使用的主机名和IP地址
+func (s *Server) certificateHosts(deviceID string) []string {
+	hosts := []string{deviceID, "localhost", "127.0.0.1", "::1"}
+
+	if s.config.Host != "" && s.config.Host != "0.0.0.0" && s.config.Host != "::" {
+		hosts = append(hosts, s.config.Host)
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return hosts
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			hosts = append(hosts, ipNet.IP.String())
+		}
+	}
+
+	return hosts
+}
+
+// localHosts 收集本节点可被访问的主机名和IP地址，包括mDNS使用的 .local 名称
+func (s *Server) localHosts() []string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return s.certificateHosts("localhost")
+	}
+	return append(s.certificateHosts(hostname), hostname+".local")
+}
@@ -0,0 +1,344 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// blobsDirName 存储目录下按内容寻址保存文件的目录
+const blobsDirName = ".blobs"
+
+// blobRefsFile 内容存储目录下保存引用计数和持有设备的文件
+const blobRefsFile = "refs.json"
+
+// ErrInvalidChecksum 校验和不是SHA-256的十六进制形式
+var ErrInvalidChecksum = errors.New("无效的校验和")
+
+// BlobStore 按SHA-256校验和保存文件内容的存储，相同内容只保存一份
+// 每个引用该内容的传输文件计一次引用，引用归零时删除内容
+// 引用计数和持有设备持久化在 refs.json 中，重启后保留；先写 refs.json 再放入或删除内容，
+// 因此 refs.json 中没有记录的内容一定没有引用
+type BlobStore struct {
+	mu      sync.Mutex
+	dir     string
+	refs    map[string]int
+	holders map[string]map[string]bool // 发送或接收过该内容的设备，只有这些设备可以去重
+}
+
+// blobRecord refs.json 中一份内容的引用计数和持有设备
+type blobRecord struct {
+	Refs    int      `json:"refs"`
+	Holders []string `json:"holders,omitempty"`
+}
+
+// OpenBlobStore 打开存储目录下的内容存储，不存在时创建
+// 读取 refs.json 中的引用计数，清理中断留下的临时文件和没有引用的内容
+func OpenBlobStore(storageDir string) (*BlobStore, error) {
+	store := &BlobStore{
+		dir:     filepath.Join(storageDir, blobsDirName),
+		refs:    make(map[string]int),
+		holders: make(map[string]map[string]bool),
+	}
+
+	if err := os.MkdirAll(store.dir, 0700); err != nil {
+		return nil, fmt.Errorf("创建内容存储目录失败: %v", err)
+	}
+
+	indexed, err := store.load()
+	if err != nil {
+		return nil, err
+	}
+	store.collectGarbage(indexed)
+
+	if err := store.save(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// ValidChecksum 检查校验和是否为小写十六进制的SHA-256
+func ValidChecksum(checksum string) bool {
+	if len(checksum) != sha256.Size*2 || strings.ToLower(checksum) != checksum {
+		return false
+	}
+	_, err := hex.DecodeString(checksum)
+	return err == nil
+}
+
+// Path 内容的存储位置，按校验和前两位分目录
+func (b *BlobStore) Path(checksum string) string {
+	return filepath.Join(b.dir, checksum[:2], checksum)
+}
+
+// Missing 返回 deviceID 不能去重的校验和，顺序与输入一致
+// 存储中没有的内容和该设备没有发送或接收过的内容都视为缺少，避免探测其他设备的文件
+func (b *BlobStore) Missing(deviceID string, checksums []string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	missing := []string{}
+	for _, checksum := range checksums {
+		if !b.has(checksum) || !b.holders[checksum][deviceID] {
+			missing = append(missing, checksum)
+		}
+	}
+	return missing
+}
+
+// Acquire 内容已存在且 sender 发送或接收过该内容时增加一次引用并返回true，receiver 记为持有该内容
+func (b *BlobStore) Acquire(checksum, sender, receiver string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.has(checksum) || !b.holders[checksum][sender] {
+		return false
+	}
+	b.refs[checksum]++
+	b.hold(checksum, receiver)
+	if err := b.save(); err != nil {
+		log.Printf("保存内容引用失败: %v", err)
+	}
+	return true
+}
+
+// Put 将已校验的临时文件存入内容存储并增加一次引用，holders 记为持有该内容
+// 相同内容已存在时删除临时文件，临时文件必须与存储目录在同一文件系统上
+func (b *BlobStore) Put(tempPath, checksum string, holders ...string) error {
+	if !ValidChecksum(checksum) {
+		os.Remove(tempPath)
+		return ErrInvalidChecksum
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	exists := b.has(checksum)
+	target := b.Path(checksum)
+	if exists {
+		os.Remove(tempPath)
+	} else if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("创建内容存储目录失败: %v", err)
+	}
+
+	b.refs[checksum]++
+	for _, holder := range holders {
+		b.hold(checksum, holder)
+	}
+
+	// 先持久化引用再放入内容，崩溃后 refs.json 中没有记录的内容可以安全清理
+	if err := b.save(); err != nil {
+		if exists {
+			log.Printf("保存内容引用失败: %v", err)
+			return nil
+		}
+		b.unref(checksum)
+		os.Remove(tempPath)
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	if err := os.Rename(tempPath, target); err != nil {
+		os.Remove(tempPath)
+		b.unref(checksum)
+		if err := b.save(); err != nil {
+			log.Printf("保存内容引用失败: %v", err)
+		}
+		return fmt.Errorf("保存文件内容失败: %v", err)
+	}
+	return nil
+}
+
+// Release 减少一次引用，引用归零时删除内容
+func (b *BlobStore) Release(checksum string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.refs[checksum] <= 0 {
+		return
+	}
+
+	removed := b.unref(checksum)
+	// 先持久化引用再删除内容，保存失败时下次启动会丢弃内容已不存在的记录
+	if err := b.save(); err != nil {
+		log.Printf("保存内容引用失败: %v", err)
+	}
+	if removed {
+		os.Remove(b.Path(checksum))
+		os.Remove(filepath.Dir(b.Path(checksum)))
+	}
+}
+
+// TempPath 上传中的文件在内容存储中的临时位置
+func (b *BlobStore) TempPath(name string) string {
+	return filepath.Join(b.dir, name+".tmp")
+}
+
+// unref 减少一次引用，引用归零时删除记录并返回true，调用者需持有锁
+func (b *BlobStore) unref(checksum string) bool {
+	b.refs[checksum]--
+	if b.refs[checksum] > 0 {
+		return false
+	}
+	delete(b.refs, checksum)
+	delete(b.holders, checksum)
+	return true
+}
+
+// hold 记录设备持有该内容，调用者需持有锁
+func (b *BlobStore) hold(checksum, deviceID string) {
+	if deviceID == "" {
+		return
+	}
+	if b.holders[checksum] == nil {
+		b.holders[checksum] = make(map[string]bool)
+	}
+	b.holders[checksum][deviceID] = true
+}
+
+// has 内容是否存在，调用者需持有锁
+func (b *BlobStore) has(checksum string) bool {
+	if !ValidChecksum(checksum) || b.refs[checksum] <= 0 {
+		return false
+	}
+	_, err := os.Stat(b.Path(checksum))
+	return err == nil
+}
+
+// collectGarbage 删除中断留下的临时文件和没有引用的内容
+// indexed 为false时没有 refs.json，无法证明内容没有引用，保留已有内容并各计一次引用
+func (b *BlobStore) collectGarbage(indexed bool) {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			if strings.HasSuffix(entry.Name(), ".tmp") {
+				os.Remove(filepath.Join(b.dir, entry.Name()))
+			}
+			continue
+		}
+
+		subDir := filepath.Join(b.dir, entry.Name())
+		blobs, err := os.ReadDir(subDir)
+		if err != nil {
+			continue
+		}
+		for _, blob := range blobs {
+			checksum := blob.Name()
+			// 不是内容文件的文件不属于内容存储，不做处理
+			if blob.IsDir() || !ValidChecksum(checksum) || checksum[:2] != entry.Name() || b.refs[checksum] > 0 {
+				continue
+			}
+			if !indexed {
+				b.refs[checksum] = 1
+				log.Printf("内容 %s 没有引用记录，保留", checksum)
+				continue
+			}
+			os.Remove(filepath.Join(subDir, checksum))
+		}
+		os.Remove(subDir) // 只有空目录会被删除
+	}
+}
+
+// load 读取 refs.json，丢弃内容已不存在的记录；文件不存在时返回false
+func (b *BlobStore) load() (bool, error) {
+	data, err := os.ReadFile(b.refsPath())
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("读取内容引用失败: %v", err)
+	}
+
+	records := make(map[string]blobRecord)
+	if err := json.Unmarshal(data, &records); err != nil {
+		// 早期版本只保存引用计数
+		counts := make(map[string]int)
+		if json.Unmarshal(data, &counts) != nil {
+			return false, fmt.Errorf("解析内容引用失败: %v", err)
+		}
+		for checksum, refs := range counts {
+			records[checksum] = blobRecord{Refs: refs}
+		}
+	}
+
+	for checksum, record := range records {
+		if !ValidChecksum(checksum) || record.Refs <= 0 {
+			continue
+		}
+		if _, err := os.Stat(b.Path(checksum)); err != nil {
+			continue
+		}
+		b.refs[checksum] = record.Refs
+		for _, holder := range record.Holders {
+			b.hold(checksum, holder)
+		}
+	}
+	return true, nil
+}
+
+// save 原子地写入 refs.json：先写临时文件并同步到磁盘再替换，调用者需持有锁
+func (b *BlobStore) save() error {
+	records := make(map[string]blobRecord, len(b.refs))
+	for checksum, refs := range b.refs {
+		record := blobRecord{Refs: refs}
+		for holder := range b.holders[checksum] {
+			record.Holders = append(record.Holders, holder)
+		}
+		sort.Strings(record.Holders)
+		records[checksum] = record
+	}
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("序列化内容引用失败: %v", err)
+	}
+
+	tempPath := b.refsPath() + ".tmp"
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("写入内容引用失败: %v", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("写入内容引用失败: %v", err)
+	}
+
+	if err := os.Rename(tempPath, b.refsPath()); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("写入内容引用失败: %v", err)
+	}
+
+	// 同步目录，保证替换后的文件名在断电后仍然有效
+	if dir, err := os.Open(b.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// refsPath refs.json 的位置
+func (b *BlobStore) refsPath() string {
+	return filepath.Join(b.dir, blobRefsFile)
+}
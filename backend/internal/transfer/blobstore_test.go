@@ -0,0 +1,90 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// putBlob 将 content 作为临时文件存入内容存储，返回校验和
+func putBlob(t *testing.T, store *BlobStore, content string, holders ...string) string {
+	t.Helper()
+
+	sum := sha256.Sum256([]byte(content))
+	checksum := hex.EncodeToString(sum[:])
+	tempPath := store.TempPath(checksum[:8])
+	if err := os.WriteFile(tempPath, []byte(content), 0600); err != nil {
+		t.Fatalf("写入临时文件失败: %v", err)
+	}
+	if err := store.Put(tempPath, checksum, holders...); err != nil {
+		t.Fatalf("保存内容失败: %v", err)
+	}
+	return checksum
+}
+
+func TestBlobStoreKeepsReferencedBlobsAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenBlobStore(dir)
+	if err != nil {
+		t.Fatalf("打开内容存储失败: %v", err)
+	}
+
+	kept := putBlob(t, store, "kept", "sender", "receiver")
+	released := putBlob(t, store, "released", "sender")
+	store.Release(released)
+
+	// 中断的上传和没有记录的内容
+	partial := store.TempPath("upload")
+	os.WriteFile(partial, []byte("partial"), 0600)
+	orphanSum := sha256.Sum256([]byte("orphan"))
+	orphan := hex.EncodeToString(orphanSum[:])
+	os.MkdirAll(filepath.Dir(store.Path(orphan)), 0700)
+	os.WriteFile(store.Path(orphan), []byte("orphan"), 0600)
+
+	reopened, err := OpenBlobStore(dir)
+	if err != nil {
+		t.Fatalf("重新打开内容存储失败: %v", err)
+	}
+
+	if _, err := os.Stat(reopened.Path(kept)); err != nil {
+		t.Fatalf("有引用的内容在重启后被删除: %v", err)
+	}
+	if missing := reopened.Missing("receiver", []string{kept}); len(missing) != 0 {
+		t.Fatalf("持有设备在重启后丢失: %v", missing)
+	}
+	if missing := reopened.Missing("other", []string{kept}); len(missing) != 1 {
+		t.Fatalf("其他设备可以去重: %v", missing)
+	}
+	for name, path := range map[string]string{"已释放的内容": reopened.Path(released), "没有记录的内容": reopened.Path(orphan), "临时文件": partial} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s未被清理: %v", name, err)
+		}
+	}
+}
+
+func TestBlobStoreWithoutIndexKeepsBlobs(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenBlobStore(dir)
+	if err != nil {
+		t.Fatalf("打开内容存储失败: %v", err)
+	}
+	checksum := putBlob(t, store, "content", "sender")
+
+	// 没有 refs.json 时无法证明内容没有引用
+	if err := os.Remove(store.refsPath()); err != nil {
+		t.Fatalf("删除引用文件失败: %v", err)
+	}
+
+	reopened, err := OpenBlobStore(dir)
+	if err != nil {
+		t.Fatalf("重新打开内容存储失败: %v", err)
+	}
+	if _, err := os.Stat(reopened.Path(checksum)); err != nil {
+		t.Fatalf("没有引用记录的内容被删除: %v", err)
+	}
+	if reopened.refs[checksum] != 1 {
+		t.Fatalf("引用计数 = %d，期望 1", reopened.refs[checksum])
+	}
+}
@@ -2,6 +2,7 @@ package transfer
 
 import (
 	"crypto/sha256"
+	"errors"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -10,6 +11,8 @@ import (
 	"path/filepath"
 	"sync"
 	"time"
+
+	"airshare-backend/pkg/models"
 )
 
 // ChunkTransferService 实现文件分片传输和断点续传功能
@@ -19,6 +22,7 @@ type ChunkTransferService struct {
 	maxRetries    int
 	retryInterval time.Duration
 	storageDir    string
+	conflictPolicy ConflictPolicy
 }
 
 // ChunkTransfer 表示分片传输任务
@@ -35,6 +39,21 @@ type ChunkTransfer struct {
 	EndTime     time.Time
 	Error       string
 	FileHash    string
+
+	// 文件夹传输中的文件，FolderID 为文件夹传输ID，RelPath 为文件在清单中的相对路径
+	FolderID string
+	Folder   *models.FolderManifest
+	RelPath  string
+
+	// 差异传输：只传输接收方旧版本中没有的数据，LiteralBytes 为实际传输的字节数，CopiedBytes 为引用旧版本的字节数
+	Delta        bool
+	LiteralBytes int64
+	CopiedBytes  int64
+
+	// 分片压缩：Compression 为协商的算法，RawBytes 为原始字节数，WireBytes 为实际传输的字节数
+	Compression Compression
+	RawBytes    int64
+	WireBytes   int64
 }
 
 // Chunk 表示文件分片
@@ -68,6 +87,7 @@ func NewChunkTransferService(chunkSize int64, maxRetries int, storageDir string)
 		maxRetries:    maxRetries,
 		retryInterval: 5 * time.Second,
 		storageDir:    storageDir,
+		conflictPolicy: ConflictRename,
 	}
 }
 
@@ -179,7 +199,24 @@ func (s *ChunkTransferService) WriteChunkData(transferID string, chunk *Chunk, d
 	return nil
 }
 
+// ReadReceivedChunk 读取已接收但尚未组装的分片，并按读取的数据设置校验和
+func (s *ChunkTransferService) ReadReceivedChunk(transferID string, chunk *Chunk) ([]byte, error) {
+	chunkPath := filepath.Join(s.storageDir, "temp", transferID, fmt.Sprintf("chunk_%d.tmp", chunk.Index))
+	data, err := os.ReadFile(chunkPath)
+	if err != nil {
+		return nil, fmt.Errorf("读取分片文件失败: %v", err)
+	}
+	if int64(len(data)) != chunk.Size {
+		return nil, fmt.Errorf("读取数据大小不匹配: 期望 %d, 实际 %d", chunk.Size, len(data))
+	}
+
+	chunk.Checksum = s.calculateChunkChecksum(data)
+	return data, nil
+}
+
 // ReassembleFile 重新组装文件
+// 单个文件的名称经过 SanitizeFileName 处理，先在临时目录中组装并校验，再按冲突策略移动到存储目录；
+// 策略为 skip 且文件已存在时返回已有文件的路径和 ErrConflictSkipped
 func (s *ChunkTransferService) ReassembleFile(transfer *ChunkTransfer) (string, error) {
 	// 检查所有分片是否都已接收
 	for _, chunk := range transfer.Chunks {
@@ -188,16 +225,22 @@ func (s *ChunkTransferService) ReassembleFile(transfer *ChunkTransfer) (string,
 		}
 	}
 
+	name, assemblyPath, err := s.assemblyPath(transfer)
+	if err != nil {
+		return "", err
+	}
+
 	// 创建目标文件
-	targetPath := filepath.Join(s.storageDir, transfer.FileName)
-	targetFile, err := os.Create(targetPath)
+	targetFile, err := os.Create(assemblyPath)
 	if err != nil {
 		return "", fmt.Errorf("创建目标文件失败: %v", err)
 	}
 	defer targetFile.Close()
 
-	// 按顺序合并分片
+	// 按顺序合并分片，同时计算文件哈希
 	tempDir := filepath.Join(s.storageDir, "temp", transfer.ID)
+	hash := sha256.New()
+	writer := io.MultiWriter(targetFile, hash)
 	for i := 0; i < transfer.TotalChunks; i++ {
 		chunkPath := filepath.Join(tempDir, fmt.Sprintf("chunk_%d.tmp", i))
 		
@@ -207,7 +250,7 @@ func (s *ChunkTransferService) ReassembleFile(transfer *ChunkTransfer) (string,
 		}
 
 		// 写入目标文件
-		_, err = targetFile.Write(chunkData)
+		_, err = writer.Write(chunkData)
 		if err != nil {
 			return "", fmt.Errorf("写入分片 %d 失败: %v", i, err)
 		}
@@ -215,17 +258,66 @@ func (s *ChunkTransferService) ReassembleFile(transfer *ChunkTransfer) (string,
 		// 标记分片为已验证
 		transfer.Chunks[i].Status = ChunkVerified
 	}
+	if err := targetFile.Close(); err != nil {
+		return "", fmt.Errorf("写入目标文件失败: %v", err)
+	}
 
-	// 验证文件完整性
-	finalHash, err := s.calculateFileHash(targetPath)
+	return s.finishAssembly(transfer, name, assemblyPath, hex.EncodeToString(hash.Sum(nil)))
+}
+
+// assemblyPath 组装文件的位置：文件夹中的文件直接写入该文件夹的暂存目录，单个文件先写入临时目录
+// 单个文件同时返回处理后的文件名
+func (s *ChunkTransferService) assemblyPath(transfer *ChunkTransfer) (string, string, error) {
+	if transfer.Folder != nil {
+		relPath, err := SanitizeRelPath(transfer.RelPath)
+		if err != nil {
+			return "", "", err
+		}
+		assemblyPath := stagedPath(s.storageDir, transfer.FolderID, transfer.Folder, relPath)
+		if err := os.MkdirAll(filepath.Dir(assemblyPath), 0700); err != nil {
+			return "", "", fmt.Errorf("创建目录失败: %v", err)
+		}
+		return "", assemblyPath, nil
+	}
+
+	name, err := SanitizeFileName(transfer.FileName)
 	if err != nil {
-		return "", fmt.Errorf("验证文件完整性失败: %v", err)
+		return "", "", fmt.Errorf("%w: %q", err, transfer.FileName)
 	}
+	tempDir := filepath.Join(s.storageDir, "temp", transfer.ID)
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return "", "", fmt.Errorf("创建临时目录失败: %v", err)
+	}
+	return name, filepath.Join(tempDir, "assembled.tmp"), nil
+}
 
+// finishAssembly 校验组装好的文件，单个文件按冲突策略移动到存储目录，返回文件的最终路径
+func (s *ChunkTransferService) finishAssembly(transfer *ChunkTransfer, name, assemblyPath, finalHash string) (string, error) {
+	// 验证文件完整性
 	if finalHash != transfer.FileHash {
+		os.Remove(assemblyPath)
 		return "", fmt.Errorf("文件完整性验证失败")
 	}
 
+	targetPath := assemblyPath
+	if transfer.Folder == nil {
+		s.mu.RLock()
+		policy := s.conflictPolicy
+		s.mu.RUnlock()
+
+		var err error
+		targetPath, err = placeFile(assemblyPath, s.storageDir, name, policy)
+		if errors.Is(err, ErrConflictSkipped) {
+			transfer.Status = TransferSkipped
+			transfer.EndTime = time.Now()
+			s.cleanupTempFiles(transfer.ID)
+			return targetPath, err
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
 	transfer.Status = TransferCompleted
 	transfer.EndTime = time.Now()
 
@@ -235,6 +327,69 @@ func (s *ChunkTransferService) ReassembleFile(transfer *ChunkTransfer) (string,
 	return targetPath, nil
 }
 
+// SetConflictPolicy 设置接收的文件与已有文件同名时的处理方式
+func (s *ChunkTransferService) SetConflictPolicy(policy ConflictPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conflictPolicy = policy
+}
+
+// PrepareFolderForSending 生成文件夹清单，并为其中的每个文件准备分片传输任务
+func (s *ChunkTransferService) PrepareFolderForSending(root string, policy models.SymlinkPolicy) (*models.FolderManifest, []*ChunkTransfer, error) {
+	manifest, err := BuildManifest(root, policy)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	folderID := generateTransferID()
+	var transfers []*ChunkTransfer
+	for _, entry := range manifest.Entries {
+		if entry.Type != models.EntryFile {
+			continue
+		}
+
+		// 跟随链接时清单路径可能经过链接，读取时同样经过链接
+		transfer, err := s.PrepareFileForSending(filepath.Join(root, filepath.FromSlash(entry.Path)))
+		if err != nil {
+			return nil, nil, err
+		}
+		transfer.FolderID = folderID
+		transfer.Folder = manifest
+		transfer.RelPath = entry.Path
+		transfers = append(transfers, transfer)
+	}
+
+	return manifest, transfers, nil
+}
+
+// StageFolder 校验接收到的文件夹清单并创建暂存目录
+// 之后该文件夹中的文件由 ReassembleFile 写入暂存目录
+func (s *ChunkTransferService) StageFolder(folderID string, manifest *models.FolderManifest) error {
+	if err := ValidateManifest(manifest); err != nil {
+		return err
+	}
+	return prepareStaging(s.storageDir, folderID, manifest)
+}
+
+// CommitFolder 所有文件组装完成后，将暂存的文件夹整体移动到存储目录，返回文件夹的路径
+// 策略为 skip 且同名文件夹已存在时返回已有文件夹的路径和 ErrConflictSkipped
+func (s *ChunkTransferService) CommitFolder(folderID string, manifest *models.FolderManifest) (string, error) {
+	s.mu.RLock()
+	policy := s.conflictPolicy
+	s.mu.RUnlock()
+
+	name, err := commitFolder(s.storageDir, folderID, manifest, policy)
+	if name == "" {
+		return "", err
+	}
+	return filepath.Join(s.storageDir, name), err
+}
+
+// DiscardFolder 放弃未完成的文件夹传输，删除暂存目录
+func (s *ChunkTransferService) DiscardFolder(folderID string) {
+	discardStaging(s.storageDir, folderID)
+}
+
 // ResumeTransfer 恢复传输任务
 func (s *ChunkTransferService) ResumeTransfer(transfer *ChunkTransfer) []*Chunk {
 	var pendingChunks []*Chunk
@@ -265,9 +420,13 @@ func (s *ChunkTransferService) MarkChunkFailed(chunk *Chunk, err error) {
 }
 
 // GetTransferProgress 获取传输进度
+// 差异传输没有分片，只返回已写入的字节数
 func (s *ChunkTransferService) GetTransferProgress(transfer *ChunkTransfer) (int, int64) {
 	completedChunks := 0
 	transferredBytes := int64(0)
+	if transfer.Delta {
+		return 0, transfer.LiteralBytes + transfer.CopiedBytes
+	}
 
 	for _, chunk := range transfer.Chunks {
 		if chunk.Status == ChunkReceived || chunk.Status == ChunkVerified || chunk.Status == ChunkSent {
@@ -279,6 +438,35 @@ func (s *ChunkTransferService) GetTransferProgress(transfer *ChunkTransfer) (int
 	return completedChunks, transferredBytes
 }
 
+// ProgressEvent 生成传输进度事件，包含压缩率
+// 差异传输中引用旧版本的数据不需要传输，同样计入压缩率
+func (s *ChunkTransferService) ProgressEvent(transfer *ChunkTransfer) *TransferProgress {
+	completedChunks, bytes := s.GetTransferProgress(transfer)
+
+	s.mu.RLock()
+	rawBytes, wireBytes := transfer.RawBytes, transfer.WireBytes
+	s.mu.RUnlock()
+	if transfer.Delta {
+		rawBytes, wireBytes = transfer.LiteralBytes+transfer.CopiedBytes, transfer.LiteralBytes
+	}
+
+	compression := transfer.Compression
+	if compression == "" {
+		compression = CompressionNone
+	}
+
+	return &TransferProgress{
+		TransferID:       transfer.ID,
+		CompletedChunks:  completedChunks,
+		TotalChunks:      transfer.TotalChunks,
+		Bytes:            bytes,
+		TotalBytes:       transfer.FileSize,
+		WireBytes:        wireBytes,
+		Compression:      compression,
+		CompressionRatio: compressionRatio(rawBytes, wireBytes),
+	}
+}
+
 // 计算文件哈希
 func (s *ChunkTransferService) calculateFileHash(filePath string) (string, error) {
 	file, err := os.Open(filePath)
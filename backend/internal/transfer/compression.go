@@ -0,0 +1,266 @@
+package transfer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression 分片数据的压缩算法
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionZstd Compression = "zstd"
+	CompressionGzip Compression = "gzip"
+)
+
+// supportedCompressions 本端支持的压缩算法，按优先级排列
+var supportedCompressions = []Compression{CompressionZstd, CompressionGzip}
+
+const (
+	// minCompressionSaving 压缩后至少节省的比例，达不到时发送原始数据
+	minCompressionSaving = 0.1
+	// compressionSampleSize 试压缩时读取的文件开头部分
+	compressionSampleSize = 64 * 1024
+	// maxDecodedChunkSize 解压单个分片的大小上限，防止压缩炸弹
+	maxDecodedChunkSize = 64 * 1024 * 1024
+)
+
+// incompressibleTypes 本身已经压缩过的文件类型
+var incompressibleTypes = map[string]bool{
+	"application/zip":                         true,
+	"application/gzip":                        true,
+	"application/x-gzip":                      true,
+	"application/x-bzip2":                     true,
+	"application/x-xz":                        true,
+	"application/zstd":                        true,
+	"application/x-7z-compressed":             true,
+	"application/x-rar-compressed":            true,
+	"application/vnd.rar":                     true,
+	"application/java-archive":                true,
+	"application/epub+zip":                    true,
+	"application/vnd.android.package-archive": true,
+
+	// Office文档是zip格式
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   true,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         true,
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": true,
+}
+
+// compressibleMedia 图片、音频、视频中未压缩的格式
+var compressibleMedia = map[string]bool{
+	"image/bmp":      true,
+	"image/x-ms-bmp": true,
+	"image/tiff":     true,
+	"image/svg+xml":  true,
+	"audio/wav":      true,
+	"audio/x-wav":    true,
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// zstdCodec 共享的zstd编码器和解码器，EncodeAll 和 DecodeAll 可以并发使用
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxDecodedChunkSize))
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// CompressionOffer 发送方根据文件类型和试压缩结果决定在文件元数据中提供哪些压缩算法
+// 已压缩的格式或试压缩节省不足时返回nil，表示不压缩；mimeType 为空时根据扩展名推断
+func CompressionOffer(filePath, mimeType string) []Compression {
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(filepath.Ext(filePath))
+	}
+	if !compressibleType(mimeType) {
+		return nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	sample := make([]byte, compressionSampleSize)
+	n, err := io.ReadFull(file, sample)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil
+	}
+
+	compressed, err := compressChunk(CompressionZstd, sample[:n])
+	if err != nil || !worthCompressing(n, len(compressed)) {
+		return nil
+	}
+	return append([]Compression(nil), supportedCompressions...)
+}
+
+// NegotiateCompression 接收方从发送方提供的算法中选择第一个本端支持的算法，都不支持时不压缩
+func NegotiateCompression(offered []Compression) Compression {
+	for _, candidate := range offered {
+		for _, supported := range supportedCompressions {
+			if candidate == supported {
+				return candidate
+			}
+		}
+	}
+	return CompressionNone
+}
+
+// compressibleType 按MIME类型判断文件是否值得压缩
+func compressibleType(mimeType string) bool {
+	if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+		mimeType = mediaType
+	}
+	mimeType = strings.ToLower(mimeType)
+
+	if incompressibleTypes[mimeType] {
+		return false
+	}
+	for _, prefix := range []string{"image/", "audio/", "video/"} {
+		if strings.HasPrefix(mimeType, prefix) {
+			return compressibleMedia[mimeType]
+		}
+	}
+	return true
+}
+
+// worthCompressing 压缩后是否至少节省 minCompressionSaving
+func worthCompressing(rawSize, compressedSize int) bool {
+	return rawSize > 0 && float64(compressedSize) <= float64(rawSize)*(1-minCompressionSaving)
+}
+
+// compressChunk 使用指定算法压缩一个分片
+func compressChunk(compression Compression, data []byte) ([]byte, error) {
+	switch compression {
+	case CompressionZstd:
+		encoder, _, err := zstdCodec()
+		if err != nil {
+			return nil, fmt.Errorf("初始化zstd失败: %v", err)
+		}
+		return encoder.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+	case CompressionGzip:
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(data); err != nil {
+			return nil, fmt.Errorf("gzip压缩失败: %v", err)
+		}
+		if err := writer.Close(); err != nil {
+			return nil, fmt.Errorf("gzip压缩失败: %v", err)
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("不支持的压缩算法: %s", compression)
+	}
+}
+
+// decompressChunk 解压一个分片，解压后的大小必须等于 size
+func decompressChunk(compression Compression, data []byte, size int64) ([]byte, error) {
+	if size < 0 || size > maxDecodedChunkSize {
+		return nil, fmt.Errorf("分片大小超出限制: %d", size)
+	}
+
+	var decoded []byte
+	switch compression {
+	case CompressionZstd:
+		_, decoder, err := zstdCodec()
+		if err != nil {
+			return nil, fmt.Errorf("初始化zstd失败: %v", err)
+		}
+		decoded, err = decoder.DecodeAll(data, make([]byte, 0, size))
+		if err != nil {
+			return nil, fmt.Errorf("zstd解压失败: %v", err)
+		}
+	case CompressionGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("gzip解压失败: %v", err)
+		}
+		defer reader.Close()
+		// 多读一个字节以发现超出声明大小的数据
+		decoded, err = io.ReadAll(io.LimitReader(reader, size+1))
+		if err != nil {
+			return nil, fmt.Errorf("gzip解压失败: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("不支持的压缩算法: %s", compression)
+	}
+
+	if int64(len(decoded)) != size {
+		return nil, fmt.Errorf("解压后大小不匹配: 期望 %d, 实际 %d", size, len(decoded))
+	}
+	return decoded, nil
+}
+
+// EncodeChunk 发送方按传输协商的算法压缩分片数据，返回要发送的数据和实际使用的算法
+// 分片压缩后节省不足时（如已压缩的内容）发送原始数据
+func (s *ChunkTransferService) EncodeChunk(transfer *ChunkTransfer, data []byte) ([]byte, Compression, error) {
+	out, used := data, CompressionNone
+	if transfer.Compression != "" && transfer.Compression != CompressionNone {
+		compressed, err := compressChunk(transfer.Compression, data)
+		if err != nil {
+			return nil, "", err
+		}
+		if worthCompressing(len(data), len(compressed)) {
+			out, used = compressed, transfer.Compression
+		}
+	}
+
+	s.mu.Lock()
+	transfer.RawBytes += int64(len(data))
+	transfer.WireBytes += int64(len(out))
+	s.mu.Unlock()
+	return out, used, nil
+}
+
+// DecodeChunk 接收方还原分片数据，只接受未压缩或使用协商算法压缩的分片
+func (s *ChunkTransferService) DecodeChunk(transfer *ChunkTransfer, chunk *FileChunk) ([]byte, error) {
+	data := chunk.Data
+	switch chunk.Compression {
+	case "", CompressionNone:
+		if int64(len(data)) != chunk.Size {
+			return nil, fmt.Errorf("分片大小不匹配: 期望 %d, 实际 %d", chunk.Size, len(data))
+		}
+	case transfer.Compression:
+		decoded, err := decompressChunk(chunk.Compression, data, chunk.Size)
+		if err != nil {
+			return nil, err
+		}
+		data = decoded
+	default:
+		return nil, fmt.Errorf("分片使用了未协商的压缩算法: %s", chunk.Compression)
+	}
+
+	s.mu.Lock()
+	transfer.RawBytes += int64(len(data))
+	transfer.WireBytes += int64(len(chunk.Data))
+	s.mu.Unlock()
+	return data, nil
+}
+
+// compressionRatio 实际传输字节数与原始字节数之比，1表示没有压缩
+func compressionRatio(rawBytes, wireBytes int64) float64 {
+	if rawBytes == 0 {
+		return 1
+	}
+	return float64(wireBytes) / float64(rawBytes)
+}
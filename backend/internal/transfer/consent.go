@@ -0,0 +1,322 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"airshare-backend/internal/config"
+	"airshare-backend/pkg/models"
+)
+
+// defaultConsentTimeout 未配置时等待接收方确认的时间
+const defaultConsentTimeout = 2 * time.Minute
+
+var (
+	ErrNoReceiver      = errors.New("缺少接收设备")
+	ErrNotReceiver     = errors.New("只有接收设备可以确认传输")
+	ErrNotAwaiting     = errors.New("传输不在等待确认状态")
+	ErrNotAccepted     = errors.New("接收方尚未同意该传输")
+	ErrInvalidDecision = errors.New("无效的确认操作")
+)
+
+// OfferCallback 有新的传输请求需要接收方确认
+type OfferCallback func(offer models.TransferRequest)
+
+// DecisionCallback 传输请求被接收、拒绝或确认超时
+type DecisionCallback func(transfer models.TransferRequest, decision models.TransferDecision)
+
+// OnOffer 注册传输请求回调，用于通知接收设备
+func (s *Service) OnOffer(callback OfferCallback) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.offerCallbacks = append(s.offerCallbacks, callback)
+}
+
+// OnDecision 注册接收方决定回调，用于通知发送设备
+func (s *Service) OnDecision(callback DecisionCallback) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.decisionCallbacks = append(s.decisionCallbacks, callback)
+}
+
+// SetTrustCheck 设置判断发送设备是否已信任的函数，用于自动接收规则
+func (s *Service) SetTrustCheck(isTrusted func(deviceID string) bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.isTrusted = isTrusted
+}
+
+// Decide 接收方接收全部或部分文件，或拒绝传输
+// deviceID 为空时不检查操作者身份（未启用认证）
+func (s *Service) Decide(transferID, deviceID string, decision models.TransferDecision) (*models.TransferRequest, error) {
+	s.mutex.Lock()
+
+	transfer, exists := s.transfers[transferID]
+	if !exists {
+		s.mutex.Unlock()
+		return nil, fmt.Errorf("传输不存在: %s", transferID)
+	}
+	if deviceID != "" && deviceID != transfer.ReceiverID {
+		s.mutex.Unlock()
+		return nil, ErrNotReceiver
+	}
+	if transfer.Status != models.TransferPending {
+		s.mutex.Unlock()
+		return nil, ErrNotAwaiting
+	}
+
+	decision.TransferID = transferID
+	decision.Auto = false
+	switch decision.Action {
+	case models.DecisionAccept:
+		if err := acceptFiles(transfer, decision.FileIDs); err != nil {
+			s.mutex.Unlock()
+			return nil, err
+		}
+	case models.DecisionReject:
+		decision.FileIDs = nil
+	default:
+		s.mutex.Unlock()
+		return nil, ErrInvalidDecision
+	}
+
+	s.applyDecision(transfer, decision)
+	snapshot := snapshotTransfer(transfer)
+	callbacks := s.decisionCallbacks
+	s.mutex.Unlock()
+
+	log.Printf("传输 %s 已%s", transferID, decisionText(decision))
+	notifyDecision(callbacks, snapshot, *snapshot.Decision)
+	return &snapshot, nil
+}
+
+// PendingOffers 获取等待指定设备确认的传输请求
+func (s *Service) PendingOffers(deviceID string) []models.TransferRequest {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var offers []models.TransferRequest
+	for _, transfer := range s.transfers {
+		if transfer.ReceiverID == deviceID && transfer.Status == models.TransferPending {
+			offers = append(offers, snapshotTransfer(transfer))
+		}
+	}
+	return offers
+}
+
+// offer 新传输请求：满足自动接收规则时直接接收，否则等待接收方确认，调用者需持有锁
+// 返回需要在释放锁之后执行的通知
+func (s *Service) offer(transfer *models.TransferRequest) func() {
+	if s.autoAccept(transfer) {
+		s.applyDecision(transfer, models.TransferDecision{
+			TransferID: transfer.ID,
+			Action:     models.DecisionAccept,
+			Reason:     models.DecisionReasonAutoAccept,
+			Auto:       true,
+		})
+		snapshot := snapshotTransfer(transfer)
+		callbacks := s.decisionCallbacks
+		log.Printf("传输 %s 满足自动接收规则，已自动接收", transfer.ID)
+		return func() { notifyDecision(callbacks, snapshot, *snapshot.Decision) }
+	}
+
+	timeout := time.Duration(s.config.ConsentTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultConsentTimeout
+	}
+	expiresAt := time.Now().Add(timeout)
+	transfer.ExpiresAt = &expiresAt
+
+	transferID := transfer.ID
+	s.offerTimers[transferID] = time.AfterFunc(timeout, func() { s.expireOffer(transferID) })
+
+	snapshot := snapshotTransfer(transfer)
+	callbacks := s.offerCallbacks
+	return func() {
+		for _, callback := range callbacks {
+			go func(cb OfferCallback) {
+				defer func() {
+					if r := recover(); r != nil {
+						log.Printf("Transfer offer callback panic: %v", r)
+					}
+				}()
+				cb(snapshot)
+			}(callback)
+		}
+	}
+}
+
+// expireOffer 接收方未及时确认，视为拒绝
+func (s *Service) expireOffer(transferID string) {
+	s.mutex.Lock()
+	transfer, exists := s.transfers[transferID]
+	if !exists || transfer.Status != models.TransferPending {
+		s.mutex.Unlock()
+		return
+	}
+
+	s.applyDecision(transfer, models.TransferDecision{
+		TransferID: transferID,
+		Action:     models.DecisionReject,
+		Reason:     models.DecisionReasonTimeout,
+		Auto:       true,
+	})
+	snapshot := snapshotTransfer(transfer)
+	callbacks := s.decisionCallbacks
+	s.mutex.Unlock()
+
+	log.Printf("传输 %s 等待确认超时", transferID)
+	notifyDecision(callbacks, snapshot, *snapshot.Decision)
+}
+
+// applyDecision 记录决定并更新传输状态，调用者需持有锁
+func (s *Service) applyDecision(transfer *models.TransferRequest, decision models.TransferDecision) {
+	if timer, ok := s.offerTimers[transfer.ID]; ok {
+		timer.Stop()
+		delete(s.offerTimers, transfer.ID)
+	}
+
+	decision.DecidedAt = time.Now()
+	transfer.Decision = &decision
+	transfer.ExpiresAt = nil
+
+	if decision.Action == models.DecisionAccept {
+		// 接收后排队，有空闲名额时立即开始；已有全部内容时直接完成
+		s.enqueue(transfer)
+		s.deduplicate(transfer)
+		s.reschedule()
+		return
+	}
+
+	transfer.Status = models.TransferRejected
+	transfer.Error = "接收方拒绝了传输"
+	if decision.Reason == models.DecisionReasonTimeout {
+		transfer.Error = "等待接收方确认超时"
+	}
+	s.removeStoredFiles(transfer)
+}
+
+// autoAccept 检查传输是否满足自动接收规则，调用者需持有锁
+func (s *Service) autoAccept(transfer *models.TransferRequest) bool {
+	rules := s.config.AutoAccept
+	if !rules.Enabled {
+		return false
+	}
+
+	if rules.TrustedOnly && (s.isTrusted == nil || !s.isTrusted(transfer.SenderID)) {
+		return false
+	}
+
+	total := int64(0)
+	for _, file := range transfer.Files {
+		total += file.Size
+		if !mimeAllowed(rules, file) {
+			return false
+		}
+	}
+	return rules.MaxSize <= 0 || total <= rules.MaxSize
+}
+
+// mimeAllowed 检查文件类型是否在自动接收的类型列表中
+// 发送方声明的类型不可信，类型由清理后的文件名的扩展名推断，无法推断时不自动接收
+func mimeAllowed(rules config.AutoAcceptConfig, file models.FileInfo) bool {
+	if len(rules.MIMETypes) == 0 {
+		return true
+	}
+
+	name, err := SanitizeFileName(file.Name)
+	if err != nil {
+		return false
+	}
+	fileType := mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	if mediaType, _, err := mime.ParseMediaType(fileType); err == nil {
+		fileType = mediaType
+	}
+	if fileType == "" {
+		return false
+	}
+
+	for _, allowed := range rules.MIMETypes {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == fileType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(fileType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptFiles 只保留接收方同意的文件，文件夹传输同时从清单中移除其他文件，调用者需持有锁
+func acceptFiles(transfer *models.TransferRequest, fileIDs []string) error {
+	if len(fileIDs) == 0 {
+		return nil
+	}
+
+	accepted := make(map[string]bool, len(fileIDs))
+	for _, id := range fileIDs {
+		if findFile(transfer, id) == nil {
+			return fmt.Errorf("%w: 文件不属于该传输: %s", ErrInvalidDecision, id)
+		}
+		accepted[id] = true
+	}
+
+	var files []models.FileInfo
+	for _, file := range transfer.Files {
+		if accepted[file.ID] {
+			files = append(files, file)
+		}
+	}
+	transfer.Files = files
+	updateByteCounters(transfer)
+
+	if transfer.Manifest != nil {
+		manifest := *transfer.Manifest
+		manifest.Entries = nil
+		for _, entry := range transfer.Manifest.Entries {
+			if entry.Type != models.EntryFile || accepted[entry.FileID] {
+				manifest.Entries = append(manifest.Entries, entry)
+			}
+		}
+		transfer.Manifest = &manifest
+	}
+	return nil
+}
+
+// snapshotTransfer 复制传输信息供回调使用，文件列表单独复制，避免与进度更新竞争
+func snapshotTransfer(transfer *models.TransferRequest) models.TransferRequest {
+	snapshot := *transfer
+	snapshot.Files = append([]models.FileInfo(nil), transfer.Files...)
+	return snapshot
+}
+
+// notifyDecision 通知所有注册的决定回调
+func notifyDecision(callbacks []DecisionCallback, transfer models.TransferRequest, decision models.TransferDecision) {
+	for _, callback := range callbacks {
+		go func(cb DecisionCallback) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Transfer decision callback panic: %v", r)
+				}
+			}()
+			cb(transfer, decision)
+		}(callback)
+	}
+}
+
+// decisionText 日志中的决定描述
+func decisionText(decision models.TransferDecision) string {
+	if decision.Action == models.DecisionReject {
+		return "被拒绝"
+	}
+	if len(decision.FileIDs) > 0 {
+		return fmt.Sprintf("部分接收（%d个文件）", len(decision.FileIDs))
+	}
+	return "接收"
+}
@@ -0,0 +1,551 @@
+package transfer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+const (
+	minDeltaBlockSize = 2 * 1024
+	maxDeltaBlockSize = 128 * 1024
+	// maxDeltaOps 一条差异消息中的最大操作数
+	maxDeltaOps = 1024
+)
+
+// ErrInvalidSignature 块签名与其描述的文件不一致
+var ErrInvalidSignature = errors.New("无效的块签名")
+
+// BlockSignature 旧版本中一个数据块的签名
+type BlockSignature struct {
+	Index  int    `json:"index"`
+	Weak   uint32 `json:"weak"`   // 滚动校验和，用于快速筛选
+	Strong string `json:"strong"` // SHA-256，用于确认匹配
+}
+
+// FileSignature 接收方已有版本的分块签名，最后一块可能小于 BlockSize
+type FileSignature struct {
+	FileHash  string           `json:"file_hash"`
+	FileSize  int64            `json:"file_size"`
+	BlockSize int64            `json:"block_size"`
+	Blocks    []BlockSignature `json:"blocks"`
+}
+
+// DeltaOpType 差异操作类型
+type DeltaOpType string
+
+const (
+	DeltaCopy    DeltaOpType = "copy"    // 引用旧版本中从 Block 开始的 Count 个连续块
+	DeltaLiteral DeltaOpType = "literal" // 旧版本中没有的数据
+)
+
+// DeltaOp 差异操作
+type DeltaOp struct {
+	Type  DeltaOpType `json:"type"`
+	Block int         `json:"block"`
+	Count int         `json:"count,omitempty"`
+	Data  []byte      `json:"data,omitempty"`
+}
+
+// FileDelta 一批按顺序应用的差异操作
+type FileDelta struct {
+	Sequence int       `json:"sequence"`
+	Ops      []DeltaOp `json:"ops"`
+	IsLast   bool      `json:"is_last"`
+}
+
+// rollingChecksum rsync使用的弱校验和，窗口滑动一个字节时可以O(1)更新
+type rollingChecksum struct {
+	a, b   uint32
+	length uint32
+}
+
+func newRollingChecksum(block []byte) rollingChecksum {
+	r := rollingChecksum{length: uint32(len(block))}
+	for i, c := range block {
+		r.a += uint32(c)
+		r.b += uint32(len(block)-i) * uint32(c)
+	}
+	return r
+}
+
+// roll 移出窗口的第一个字节，移入新字节
+func (r *rollingChecksum) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.length*uint32(out)
+}
+
+func (r rollingChecksum) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+// deltaBlockSize 按文件大小选择块大小：约为文件大小的平方根，按1KB对齐
+func deltaBlockSize(fileSize int64) int64 {
+	size := int64(math.Sqrt(float64(fileSize)))
+	size = (size + 1023) / 1024 * 1024
+	if size < minDeltaBlockSize {
+		return minDeltaBlockSize
+	}
+	if size > maxDeltaBlockSize {
+		return maxDeltaBlockSize
+	}
+	return size
+}
+
+// FindPreviousVersion 在存储目录中查找与接收的文件同名的旧版本
+func (s *ChunkTransferService) FindPreviousVersion(fileName string) (string, bool) {
+	name, err := SanitizeFileName(fileName)
+	if err != nil {
+		return "", false
+	}
+
+	path := filepath.Join(s.storageDir, name)
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", false
+	}
+	return path, true
+}
+
+// ComputeSignature 接收方计算已有版本的块签名，发送给发送方用于生成差异
+func (s *ChunkTransferService) ComputeSignature(basePath string) (*FileSignature, error) {
+	file, err := os.Open(basePath)
+	if err != nil {
+		return nil, fmt.Errorf("打开文件失败: %v", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("获取文件信息失败: %v", err)
+	}
+
+	sig := &FileSignature{
+		FileSize:  info.Size(),
+		BlockSize: deltaBlockSize(info.Size()),
+	}
+
+	fileHash := sha256.New()
+	reader := io.TeeReader(bufio.NewReader(file), fileHash)
+	block := make([]byte, sig.BlockSize)
+	read := int64(0)
+	for index := 0; ; index++ {
+		n, err := io.ReadFull(reader, block)
+		if n > 0 {
+			strong := sha256.Sum256(block[:n])
+			sig.Blocks = append(sig.Blocks, BlockSignature{
+				Index:  index,
+				Weak:   newRollingChecksum(block[:n]).sum(),
+				Strong: hex.EncodeToString(strong[:]),
+			})
+			read += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("读取文件失败: %v", err)
+		}
+	}
+
+	if read != sig.FileSize {
+		return nil, fmt.Errorf("文件在计算签名时发生变化")
+	}
+	sig.FileHash = hex.EncodeToString(fileHash.Sum(nil))
+	return sig, nil
+}
+
+// validate 检查块签名是否与其描述的文件大小一致
+func (sig *FileSignature) validate() error {
+	if sig.BlockSize < minDeltaBlockSize || sig.BlockSize > maxDeltaBlockSize || sig.FileSize < 0 {
+		return fmt.Errorf("%w: 块大小 %d", ErrInvalidSignature, sig.BlockSize)
+	}
+
+	expected := (sig.FileSize + sig.BlockSize - 1) / sig.BlockSize
+	if int64(len(sig.Blocks)) != expected {
+		return fmt.Errorf("%w: 块数量 %d，期望 %d", ErrInvalidSignature, len(sig.Blocks), expected)
+	}
+	for i, block := range sig.Blocks {
+		if block.Index != i || len(block.Strong) != sha256.Size*2 {
+			return fmt.Errorf("%w: 块 %d", ErrInvalidSignature, i)
+		}
+	}
+	return nil
+}
+
+// blockLength 旧版本中第 index 块的长度
+func (sig *FileSignature) blockLength(index int) int64 {
+	offset := int64(index) * sig.BlockSize
+	if remaining := sig.FileSize - offset; remaining < sig.BlockSize {
+		return remaining
+	}
+	return sig.BlockSize
+}
+
+// deltaEncoder 发送方生成差异操作，合并连续的块引用和字面数据，按批次发出
+type deltaEncoder struct {
+	transfer *ChunkTransfer
+	emit     func(*FileDelta) error
+	batch    *FileDelta
+	literal  int64
+	limit    int64
+}
+
+// copyBlock 记录对旧版本第 index 块的引用，与上一个引用连续时合并
+func (e *deltaEncoder) copyBlock(index int, length int64) error {
+	e.transfer.CopiedBytes += length
+	if n := len(e.batch.Ops); n > 0 {
+		last := &e.batch.Ops[n-1]
+		if last.Type == DeltaCopy && last.Block+last.Count == index {
+			last.Count++
+			return nil
+		}
+	}
+	e.batch.Ops = append(e.batch.Ops, DeltaOp{Type: DeltaCopy, Block: index, Count: 1})
+	return e.flushIfFull()
+}
+
+// addLiteral 记录旧版本中没有的数据，与上一段字面数据合并
+func (e *deltaEncoder) addLiteral(data ...byte) error {
+	e.transfer.LiteralBytes += int64(len(data))
+	e.literal += int64(len(data))
+	if n := len(e.batch.Ops); n > 0 && e.batch.Ops[n-1].Type == DeltaLiteral {
+		e.batch.Ops[n-1].Data = append(e.batch.Ops[n-1].Data, data...)
+	} else {
+		e.batch.Ops = append(e.batch.Ops, DeltaOp{Type: DeltaLiteral, Data: append([]byte(nil), data...)})
+	}
+	return e.flushIfFull()
+}
+
+// flushIfFull 字面数据达到分片大小或操作数达到上限时发出当前批次
+func (e *deltaEncoder) flushIfFull() error {
+	if e.literal < e.limit && len(e.batch.Ops) < maxDeltaOps {
+		return nil
+	}
+	return e.flush(false)
+}
+
+func (e *deltaEncoder) flush(last bool) error {
+	if len(e.batch.Ops) == 0 && !last {
+		return nil
+	}
+
+	batch := e.batch
+	batch.IsLast = last
+	e.batch = &FileDelta{Sequence: batch.Sequence + 1}
+	e.literal = 0
+	return e.emit(batch)
+}
+
+// ComputeDelta 发送方根据接收方旧版本的块签名生成差异，依次通过 emit 发出，最后一批的 IsLast 为true
+// 使用滚动校验和在新文件的每个字节位置查找旧版本中相同的块，只有找不到的数据作为字面数据发送
+func (s *ChunkTransferService) ComputeDelta(transfer *ChunkTransfer, filePath string, sig *FileSignature, emit func(*FileDelta) error) error {
+	if err := sig.validate(); err != nil {
+		return err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("打开文件失败: %v", err)
+	}
+	defer file.Close()
+
+	// 按弱校验和索引旧版本的块
+	index := make(map[uint32][]int, len(sig.Blocks))
+	for _, block := range sig.Blocks {
+		index[block.Weak] = append(index[block.Weak], block.Index)
+	}
+
+	transfer.Delta = true
+	transfer.LiteralBytes = 0
+	transfer.CopiedBytes = 0
+	transfer.Status = TransferInProgress
+
+	encoder := &deltaEncoder{
+		transfer: transfer,
+		emit:     emit,
+		batch:    &FileDelta{},
+		limit:    s.chunkSize,
+	}
+	if encoder.limit <= 0 {
+		encoder.limit = maxDeltaBlockSize
+	}
+
+	// 窗口是长度为块大小的环形缓冲区，start 为窗口的第一个字节
+	reader := bufio.NewReaderSize(file, 256*1024)
+	blockSize := int(sig.BlockSize)
+	window := make([]byte, blockSize)
+	contiguous := make([]byte, 0, blockSize)
+	start, filled := 0, 0
+	nextBlock := -1
+
+	// fill 读取一个完整的窗口，文件剩余数据不足时窗口不满
+	fill := func() error {
+		n, err := io.ReadFull(reader, window)
+		start, filled = 0, n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("读取文件失败: %v", err)
+		}
+		return nil
+	}
+
+	// match 在候选块中确认强校验和，优先选择紧接上一次引用的块以便合并
+	match := func(weak uint32, data []byte) int {
+		candidates := index[weak]
+		if len(candidates) == 0 {
+			return -1
+		}
+		strong := sha256.Sum256(data)
+		found := -1
+		for _, candidate := range candidates {
+			block := sig.Blocks[candidate]
+			if sig.blockLength(candidate) != int64(len(data)) || block.Strong != hex.EncodeToString(strong[:]) {
+				continue
+			}
+			if candidate == nextBlock {
+				return candidate
+			}
+			if found < 0 {
+				found = candidate
+			}
+		}
+		return found
+	}
+
+	if err := fill(); err != nil {
+		return err
+	}
+
+	var rolling rollingChecksum
+	if filled == blockSize {
+		rolling = newRollingChecksum(window)
+	}
+	for filled == blockSize {
+		// 弱校验和命中时才拼接窗口计算强校验和
+		block := -1
+		if weak := rolling.sum(); len(index[weak]) > 0 {
+			contiguous = append(append(contiguous[:0], window[start:]...), window[:start]...)
+			block = match(weak, contiguous)
+		}
+		if block >= 0 {
+			if err := encoder.copyBlock(block, int64(blockSize)); err != nil {
+				return err
+			}
+			nextBlock = block + 1
+			if err := fill(); err != nil {
+				return err
+			}
+			if filled == blockSize {
+				rolling = newRollingChecksum(window)
+			}
+			continue
+		}
+
+		// 没有匹配时窗口后移一个字节，移出的字节作为字面数据
+		in, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("读取文件失败: %v", err)
+		}
+
+		out := window[start]
+		window[start] = in
+		start = (start + 1) % blockSize
+		rolling.roll(out, in)
+		nextBlock = -1
+		if err := encoder.addLiteral(out); err != nil {
+			return err
+		}
+	}
+
+	// 剩余的数据可能与旧版本较短的最后一块相同
+	// 窗口不满时 start 为0
+	tail := append(append(contiguous[:0], window[start:filled]...), window[:start]...)
+	if len(tail) > 0 {
+		last := len(sig.Blocks) - 1
+		if filled < blockSize && last >= 0 && match(newRollingChecksum(tail).sum(), tail) == last {
+			if err := encoder.copyBlock(last, int64(len(tail))); err != nil {
+				return err
+			}
+		} else if err := encoder.addLiteral(tail...); err != nil {
+			return err
+		}
+	}
+
+	return encoder.flush(true)
+}
+
+// DeltaApplier 接收方依次应用差异操作，用旧版本中的块和收到的字面数据重建新文件
+type DeltaApplier struct {
+	service      *ChunkTransferService
+	transfer     *ChunkTransfer
+	sig          *FileSignature
+	base         *os.File
+	out          *os.File
+	name         string
+	assemblyPath string
+	hash         hash.Hash
+	written      int64
+	sequence     int
+	done         bool
+}
+
+// NewDeltaApplier 基于旧版本 basePath 和发送给发送方的块签名创建差异应用器
+// 新文件与 ReassembleFile 一样写入临时目录或文件夹的暂存目录，完成后由 Finish 校验并保存
+func (s *ChunkTransferService) NewDeltaApplier(transfer *ChunkTransfer, basePath string, sig *FileSignature) (*DeltaApplier, error) {
+	if err := sig.validate(); err != nil {
+		return nil, err
+	}
+
+	base, err := os.Open(basePath)
+	if err != nil {
+		return nil, fmt.Errorf("打开旧版本失败: %v", err)
+	}
+
+	name, assemblyPath, err := s.assemblyPath(transfer)
+	if err != nil {
+		base.Close()
+		return nil, err
+	}
+
+	out, err := os.Create(assemblyPath)
+	if err != nil {
+		base.Close()
+		return nil, fmt.Errorf("创建目标文件失败: %v", err)
+	}
+
+	transfer.Delta = true
+	transfer.LiteralBytes = 0
+	transfer.CopiedBytes = 0
+	transfer.Status = TransferInProgress
+
+	return &DeltaApplier{
+		service:      s,
+		transfer:     transfer,
+		sig:          sig,
+		base:         base,
+		out:          out,
+		name:         name,
+		assemblyPath: assemblyPath,
+		hash:         sha256.New(),
+	}, nil
+}
+
+// Apply 按顺序应用一批差异操作，IsLast 为true时校验并保存新文件，返回其最终路径
+func (a *DeltaApplier) Apply(delta *FileDelta) (string, error) {
+	if a.done {
+		return "", fmt.Errorf("差异传输已结束")
+	}
+	if delta.Sequence != a.sequence {
+		a.Abort()
+		return "", fmt.Errorf("差异消息顺序错误: 期望 %d, 实际 %d", a.sequence, delta.Sequence)
+	}
+	a.sequence++
+
+	for _, op := range delta.Ops {
+		var err error
+		switch op.Type {
+		case DeltaCopy:
+			err = a.copyBlocks(op.Block, op.Count)
+		case DeltaLiteral:
+			err = a.write(op.Data)
+			a.transfer.LiteralBytes += int64(len(op.Data))
+		default:
+			err = fmt.Errorf("未知的差异操作: %s", op.Type)
+		}
+		if err != nil {
+			a.Abort()
+			return "", err
+		}
+	}
+
+	if !delta.IsLast {
+		return "", nil
+	}
+	return a.finish()
+}
+
+// Abort 放弃差异传输，删除未完成的文件
+func (a *DeltaApplier) Abort() {
+	if a.done {
+		return
+	}
+	a.done = true
+	a.base.Close()
+	a.out.Close()
+	os.Remove(a.assemblyPath)
+	a.service.cleanupTempFiles(a.transfer.ID)
+	a.transfer.Status = TransferFailed
+}
+
+// copyBlocks 从旧版本复制连续的块，复制前确认块内容与签名一致，防止旧版本在此期间被修改
+func (a *DeltaApplier) copyBlocks(first, count int) error {
+	if count <= 0 || first < 0 || first+count > len(a.sig.Blocks) {
+		return fmt.Errorf("块引用超出范围: %d+%d", first, count)
+	}
+
+	buf := make([]byte, a.sig.BlockSize)
+	for index := first; index < first+count; index++ {
+		data := buf[:a.sig.blockLength(index)]
+		if _, err := a.base.ReadAt(data, int64(index)*a.sig.BlockSize); err != nil && err != io.EOF {
+			return fmt.Errorf("读取旧版本失败: %v", err)
+		}
+
+		strong := sha256.Sum256(data)
+		if hex.EncodeToString(strong[:]) != a.sig.Blocks[index].Strong {
+			return fmt.Errorf("旧版本的块 %d 已改变", index)
+		}
+		if err := a.write(data); err != nil {
+			return err
+		}
+		a.transfer.CopiedBytes += int64(len(data))
+	}
+	return nil
+}
+
+// write 写入新文件，超过声明的文件大小时报错
+func (a *DeltaApplier) write(data []byte) error {
+	if a.written+int64(len(data)) > a.transfer.FileSize {
+		return fmt.Errorf("数据超过文件大小: %d", a.transfer.FileSize)
+	}
+	if _, err := a.out.Write(data); err != nil {
+		return fmt.Errorf("写入目标文件失败: %v", err)
+	}
+	a.hash.Write(data)
+	a.written += int64(len(data))
+	return nil
+}
+
+// finish 校验新文件的大小和哈希，与分片传输一样保存到存储目录
+func (a *DeltaApplier) finish() (string, error) {
+	a.done = true
+	a.base.Close()
+	if err := a.out.Close(); err != nil {
+		os.Remove(a.assemblyPath)
+		return "", fmt.Errorf("写入目标文件失败: %v", err)
+	}
+
+	if a.written != a.transfer.FileSize {
+		os.Remove(a.assemblyPath)
+		a.transfer.Status = TransferFailed
+		return "", fmt.Errorf("文件大小不匹配: 期望 %d, 实际 %d", a.transfer.FileSize, a.written)
+	}
+
+	path, err := a.service.finishAssembly(a.transfer, a.name, a.assemblyPath, hex.EncodeToString(a.hash.Sum(nil)))
+	if err != nil && !errors.Is(err, ErrConflictSkipped) {
+		a.transfer.Status = TransferFailed
+	}
+	return path, err
+}
@@ -0,0 +1,214 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// deltaTestRandom 生成 n 字节随机数据
+func deltaTestRandom(t *testing.T, n int) []byte {
+	t.Helper()
+
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("生成随机数据失败: %v", err)
+	}
+	return data
+}
+
+// splice 返回 data 中 [from, to) 替换为 insert 后的新切片
+func splice(data []byte, from, to int, insert []byte) []byte {
+	out := append([]byte(nil), data[:from]...)
+	out = append(out, insert...)
+	return append(out, data[to:]...)
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	old := deltaTestRandom(t, 200*1024)
+	blockSize := int(deltaBlockSize(int64(len(old))))
+
+	tests := []struct {
+		name       string
+		edit       func(old []byte) []byte
+		maxLiteral int // 允许作为字面数据发送的最大字节数
+	}{
+		{
+			name:       "identical",
+			edit:       func(old []byte) []byte { return old },
+			maxLiteral: 0,
+		},
+		{
+			name:       "insert",
+			edit:       func(old []byte) []byte { return splice(old, 50000, 50000, deltaTestRandom(t, 100)) },
+			maxLiteral: 100 + blockSize,
+		},
+		{
+			name:       "delete",
+			edit:       func(old []byte) []byte { return splice(old, 30000, 30500, nil) },
+			maxLiteral: 2 * blockSize,
+		},
+		{
+			name:       "shift",
+			edit:       func(old []byte) []byte { return splice(old, 0, 0, []byte("shifted")) },
+			maxLiteral: 7 + blockSize,
+		},
+		{
+			name:       "replace",
+			edit:       func(old []byte) []byte { return splice(old, 70000, 70500, deltaTestRandom(t, 500)) },
+			maxLiteral: 2 * blockSize,
+		},
+		{
+			name:       "append",
+			edit:       func(old []byte) []byte { return splice(old, len(old), len(old), deltaTestRandom(t, 3000)) },
+			maxLiteral: 3000 + blockSize,
+		},
+		{
+			name:       "truncate",
+			edit:       func(old []byte) []byte { return old[:len(old)-1000] },
+			maxLiteral: blockSize,
+		},
+		{
+			name:       "empty",
+			edit:       func([]byte) []byte { return nil },
+			maxLiteral: 0,
+		},
+		{
+			name:       "unrelated",
+			edit:       func(old []byte) []byte { return deltaTestRandom(t, len(old)) },
+			maxLiteral: len(old),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiveDir, sendDir := t.TempDir(), t.TempDir()
+			receiver := NewChunkTransferService(64*1024, 3, receiveDir)
+			sender := NewChunkTransferService(64*1024, 3, sendDir)
+
+			basePath := filepath.Join(receiveDir, "doc.bin")
+			if err := os.WriteFile(basePath, old, 0644); err != nil {
+				t.Fatalf("写入旧版本失败: %v", err)
+			}
+			updated := tt.edit(old)
+			newPath := filepath.Join(sendDir, "doc.bin")
+			if err := os.WriteFile(newPath, updated, 0644); err != nil {
+				t.Fatalf("写入新版本失败: %v", err)
+			}
+
+			sig, err := receiver.ComputeSignature(basePath)
+			if err != nil {
+				t.Fatalf("计算块签名失败: %v", err)
+			}
+
+			var deltas []*FileDelta
+			sending := &ChunkTransfer{ID: "send"}
+			err = sender.ComputeDelta(sending, newPath, sig, func(delta *FileDelta) error {
+				deltas = append(deltas, delta)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("计算差异失败: %v", err)
+			}
+			if len(deltas) == 0 || !deltas[len(deltas)-1].IsLast {
+				t.Fatal("最后一批差异没有标记 IsLast")
+			}
+			if sending.LiteralBytes > int64(tt.maxLiteral) {
+				t.Fatalf("字面数据 %d 字节，期望不超过 %d", sending.LiteralBytes, tt.maxLiteral)
+			}
+			if sending.LiteralBytes+sending.CopiedBytes != int64(len(updated)) {
+				t.Fatalf("字面数据 %d + 引用 %d 字节，期望共 %d", sending.LiteralBytes, sending.CopiedBytes, len(updated))
+			}
+
+			hash := sha256.Sum256(updated)
+			receiving := &ChunkTransfer{
+				ID:       "receive",
+				FileName: "doc.bin",
+				FileSize: int64(len(updated)),
+				FileHash: hex.EncodeToString(hash[:]),
+			}
+			applier, err := receiver.NewDeltaApplier(receiving, basePath, sig)
+			if err != nil {
+				t.Fatalf("创建差异应用器失败: %v", err)
+			}
+
+			var path string
+			for _, delta := range deltas {
+				if path, err = applier.Apply(delta); err != nil {
+					t.Fatalf("应用差异失败: %v", err)
+				}
+			}
+
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("读取重建的文件失败: %v", err)
+			}
+			if !bytes.Equal(got, updated) {
+				t.Fatal("重建的文件与新版本不一致")
+			}
+			if receiving.Status != TransferCompleted {
+				t.Fatalf("传输状态 = %s，期望 %s", receiving.Status, TransferCompleted)
+			}
+		})
+	}
+}
+
+func TestFileSignatureValidate(t *testing.T) {
+	dir := t.TempDir()
+	service := NewChunkTransferService(64*1024, 3, dir)
+	basePath := filepath.Join(dir, "base.bin")
+	if err := os.WriteFile(basePath, deltaTestRandom(t, 10*1024+5), 0644); err != nil {
+		t.Fatalf("写入文件失败: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		mutate  func(sig *FileSignature)
+		wantErr bool
+	}{
+		{name: "valid", mutate: func(*FileSignature) {}, wantErr: false},
+		{name: "block size too small", mutate: func(sig *FileSignature) { sig.BlockSize = minDeltaBlockSize - 1 }, wantErr: true},
+		{name: "block size too large", mutate: func(sig *FileSignature) { sig.BlockSize = maxDeltaBlockSize + 1 }, wantErr: true},
+		{name: "negative file size", mutate: func(sig *FileSignature) { sig.FileSize = -1 }, wantErr: true},
+		{name: "missing block", mutate: func(sig *FileSignature) { sig.Blocks = sig.Blocks[:len(sig.Blocks)-1] }, wantErr: true},
+		{name: "extra block", mutate: func(sig *FileSignature) { sig.Blocks = append(sig.Blocks, sig.Blocks[0]) }, wantErr: true},
+		{name: "file size larger than blocks", mutate: func(sig *FileSignature) { sig.FileSize += sig.BlockSize }, wantErr: true},
+		{name: "out of order index", mutate: func(sig *FileSignature) { sig.Blocks[0].Index, sig.Blocks[1].Index = 1, 0 }, wantErr: true},
+		{name: "short strong hash", mutate: func(sig *FileSignature) { sig.Blocks[2].Strong = sig.Blocks[2].Strong[:10] }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig, err := service.ComputeSignature(basePath)
+			if err != nil {
+				t.Fatalf("计算块签名失败: %v", err)
+			}
+			tt.mutate(sig)
+
+			err = sig.validate()
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("有效的签名被拒绝: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("错误 = %v，期望 ErrInvalidSignature", err)
+			}
+
+			// 发送方和接收方都在使用前校验签名
+			emit := func(*FileDelta) error { return nil }
+			if err := service.ComputeDelta(&ChunkTransfer{ID: "send"}, basePath, sig, emit); !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("ComputeDelta 的错误 = %v，期望 ErrInvalidSignature", err)
+			}
+			if _, err := service.NewDeltaApplier(&ChunkTransfer{ID: "receive", FileName: "new.bin"}, basePath, sig); !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("NewDeltaApplier 的错误 = %v，期望 ErrInvalidSignature", err)
+			}
+		})
+	}
+}
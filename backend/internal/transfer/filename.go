@@ -0,0 +1,192 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// ConflictPolicy 接收的文件与已有文件同名时的处理方式
+type ConflictPolicy string
+
+const (
+	ConflictRename    ConflictPolicy = "rename"    // 新文件名称追加序号，如 a (1).txt（默认）
+	ConflictOverwrite ConflictPolicy = "overwrite" // 新文件替换已有文件
+	ConflictSkip      ConflictPolicy = "skip"      // 保留已有文件，丢弃新文件
+	ConflictVersion   ConflictPolicy = "version"   // 已有文件移到 .versions 目录，新文件使用原名称
+)
+
+// versionsDirName 冲突策略为 version 时保存旧版本的目录
+const versionsDirName = ".versions"
+
+var (
+	ErrInvalidFileName = errors.New("无效的文件名")
+	// ErrConflictSkipped 目标已存在，按冲突策略跳过
+	ErrConflictSkipped = errors.New("目标已存在，已跳过")
+)
+
+// windowsReserved Windows保留的设备名，带扩展名时同样无法使用
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// ParseConflictPolicy 解析配置中的冲突策略，为空时使用 rename
+func ParseConflictPolicy(value string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(strings.ToLower(strings.TrimSpace(value))); policy {
+	case "":
+		return ConflictRename, nil
+	case ConflictRename, ConflictOverwrite, ConflictSkip, ConflictVersion:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("未知的冲突策略: %s", value)
+	}
+}
+
+// SanitizeFileName 将发送方提供的文件名转换为可以安全保存在任何平台上的名称
+// 只保留最后一级名称，统一为NFC，去掉控制字符和双向文本控制符，
+// 替换Windows不允许的字符，避开保留设备名，并把长度限制在255字节以内
+func SanitizeFileName(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = norm.NFC.String(name)
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == utf8.RuneError, unicode.IsControl(r), isBidiControl(r):
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+
+	// Windows会去掉结尾的点和空格，导致名称与预期不一致
+	name = strings.TrimRight(strings.TrimSpace(name), ". ")
+	if name == "" || name == "." || name == ".." {
+		return "", ErrInvalidFileName
+	}
+
+	base := name
+	if i := strings.IndexByte(base, '.'); i > 0 {
+		base = base[:i]
+	}
+	if windowsReserved[strings.ToUpper(strings.TrimSpace(base))] {
+		name = "_" + name
+	}
+
+	return truncateFileName(name, maxNameLength), nil
+}
+
+// isBidiControl 双向文本控制符可以让 "exe.txt" 显示成 "txt.exe"
+func isBidiControl(r rune) bool {
+	return r >= 0x202A && r <= 0x202E || r >= 0x2066 && r <= 0x2069 || r == 0x200E || r == 0x200F
+}
+
+// truncateFileName 截断过长的文件名，尽量保留扩展名，不截断多字节字符
+func truncateFileName(name string, limit int) string {
+	if len(name) <= limit {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	if len(ext) > limit/2 {
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	cut := limit - len(ext)
+	for cut > 0 && !utf8.RuneStart(base[cut]) {
+		cut--
+	}
+	return base[:cut] + ext
+}
+
+// resolveConflict 按冲突策略确定 dir 中名为 name 的目标，返回最终使用的名称，isDir 表示新接收的是文件夹
+// overwrite 时删除已有的目录（文件由调用者通过重命名原子替换），version 时将已有的文件或目录移到 .versions
+// skip 且目标已存在时返回 ErrConflictSkipped
+func resolveConflict(dir, name string, isDir bool, policy ConflictPolicy) (string, error) {
+	target := filepath.Join(dir, name)
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return name, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("检查目标失败: %v", err)
+	}
+
+	switch policy {
+	case ConflictOverwrite:
+		if info.IsDir() {
+			if err := os.RemoveAll(target); err != nil {
+				return "", fmt.Errorf("删除已有目录失败: %v", err)
+			}
+		}
+		return name, nil
+	case ConflictSkip:
+		return name, ErrConflictSkipped
+	case ConflictVersion:
+		if err := keepVersion(dir, name); err != nil {
+			return "", err
+		}
+		return name, nil
+	default:
+		return uniqueName(dir, name, !isDir)
+	}
+}
+
+// keepVersion 将已有的文件或目录移到 .versions 目录，名称中加入修改时间
+func keepVersion(dir, name string) error {
+	versionsDir := filepath.Join(dir, versionsDirName)
+	if err := os.MkdirAll(versionsDir, 0755); err != nil {
+		return fmt.Errorf("创建版本目录失败: %v", err)
+	}
+
+	source := filepath.Join(dir, name)
+	info, err := os.Lstat(source)
+	if err != nil {
+		return fmt.Errorf("检查目标失败: %v", err)
+	}
+
+	ext := filepath.Ext(name)
+	if info.IsDir() {
+		ext = ""
+	}
+	versioned := fmt.Sprintf("%s~%s%s", strings.TrimSuffix(name, ext), info.ModTime().Format("20060102-150405"), ext)
+	versioned, err = uniqueName(versionsDir, truncateFileName(versioned, maxNameLength), !info.IsDir())
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(source, filepath.Join(versionsDir, versioned)); err != nil {
+		return fmt.Errorf("保存旧版本失败: %v", err)
+	}
+	return nil
+}
+
+// placeFile 将临时文件按冲突策略移动到 dir/name，返回最终路径
+// 临时文件必须与 dir 在同一文件系统上，跳过时删除临时文件并返回已有文件的路径
+func placeFile(tempPath, dir, name string, policy ConflictPolicy) (string, error) {
+	name, err := resolveConflict(dir, name, false, policy)
+	if errors.Is(err, ErrConflictSkipped) {
+		os.Remove(tempPath)
+		return filepath.Join(dir, name), err
+	}
+	if err != nil {
+		return "", err
+	}
+
+	target := filepath.Join(dir, name)
+	if err := os.Rename(tempPath, target); err != nil {
+		return "", fmt.Errorf("移动文件失败: %v", err)
+	}
+	return target, nil
+}
@@ -0,0 +1,394 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"airshare-backend/pkg/models"
+)
+
+const (
+	stagingDirName     = ".staging" // 存储目录下的暂存目录，文件夹接收完成前都写在这里
+	maxManifestEntries = 100000
+	maxRelPathLength   = 4096
+	maxNameLength      = 255
+)
+
+// ErrInvalidManifest 清单格式错误或包含不安全的路径
+var ErrInvalidManifest = errors.New("无效的文件夹清单")
+
+// SanitizeRelPath 检查并规范化清单中的相对路径
+// 拒绝绝对路径、盘符、反斜杠、.. 和空字节，每一级名称按 SanitizeFileName 处理，返回以 / 分隔的规范路径
+func SanitizeRelPath(p string) (string, error) {
+	if p == "" || len(p) > maxRelPathLength {
+		return "", fmt.Errorf("%w: 路径为空或过长", ErrInvalidManifest)
+	}
+	if strings.ContainsAny(p, "\x00\\") {
+		return "", fmt.Errorf("%w: 路径包含非法字符: %q", ErrInvalidManifest, p)
+	}
+	if strings.HasPrefix(p, "/") || len(p) >= 2 && p[1] == ':' {
+		return "", fmt.Errorf("%w: 不允许绝对路径: %s", ErrInvalidManifest, p)
+	}
+
+	var parts []string
+	for _, part := range strings.Split(p, "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			return "", fmt.Errorf("%w: 路径不能包含 ..: %s", ErrInvalidManifest, p)
+		}
+		name, err := SanitizeFileName(part)
+		if err != nil {
+			return "", fmt.Errorf("%w: 无效的名称: %q", ErrInvalidManifest, part)
+		}
+		parts = append(parts, name)
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("%w: 路径为空: %s", ErrInvalidManifest, p)
+	}
+
+	return strings.Join(parts, "/"), nil
+}
+
+// ValidateManifest 校验接收到的清单并规范化其中的路径
+// 条目的上级路径只能是目录，符号链接只能指向文件夹内部
+func ValidateManifest(m *models.FolderManifest) error {
+	if m == nil {
+		return fmt.Errorf("%w: 缺少清单", ErrInvalidManifest)
+	}
+
+	root, err := SanitizeRelPath(m.Root)
+	if err != nil || strings.Contains(root, "/") {
+		return fmt.Errorf("%w: 无效的文件夹名称: %s", ErrInvalidManifest, m.Root)
+	}
+	m.Root = root
+
+	switch m.SymlinkPolicy {
+	case "":
+		m.SymlinkPolicy = models.SymlinkSkip
+	case models.SymlinkSkip, models.SymlinkFollow, models.SymlinkPreserve:
+	default:
+		return fmt.Errorf("%w: 未知的符号链接策略: %s", ErrInvalidManifest, m.SymlinkPolicy)
+	}
+
+	if len(m.Entries) > maxManifestEntries {
+		return fmt.Errorf("%w: 条目过多", ErrInvalidManifest)
+	}
+
+	types := make(map[string]models.ManifestEntryType, len(m.Entries))
+	fileIDs := make(map[string]bool)
+	for i := range m.Entries {
+		entry := &m.Entries[i]
+
+		entry.Path, err = SanitizeRelPath(entry.Path)
+		if err != nil {
+			return err
+		}
+		if _, exists := types[entry.Path]; exists {
+			return fmt.Errorf("%w: 重复的路径: %s", ErrInvalidManifest, entry.Path)
+		}
+		types[entry.Path] = entry.Type
+
+		switch entry.Type {
+		case models.EntryFile:
+			if entry.Size < 0 {
+				return fmt.Errorf("%w: 无效的文件大小: %s", ErrInvalidManifest, entry.Path)
+			}
+			if entry.FileID == "" || fileIDs[entry.FileID] {
+				return fmt.Errorf("%w: 文件ID为空或重复: %s", ErrInvalidManifest, entry.Path)
+			}
+			fileIDs[entry.FileID] = true
+			if len(entry.Checksum) != sha256.Size*2 {
+				return fmt.Errorf("%w: 缺少文件校验和: %s", ErrInvalidManifest, entry.Path)
+			}
+		case models.EntryDir:
+			entry.Size = 0
+		case models.EntrySymlink:
+			// 跟随链接时发送方已经展开了链接，清单中不应再有链接
+			if m.SymlinkPolicy != models.SymlinkPreserve {
+				return fmt.Errorf("%w: 当前策略不允许符号链接: %s", ErrInvalidManifest, entry.Path)
+			}
+			if !linkStaysInside(entry.Path, entry.Target) {
+				return fmt.Errorf("%w: 符号链接指向文件夹外部: %s", ErrInvalidManifest, entry.Path)
+			}
+			entry.Size = 0
+		default:
+			return fmt.Errorf("%w: 未知的条目类型: %s", ErrInvalidManifest, entry.Type)
+		}
+		entry.Mode &= 0777
+	}
+
+	// 文件和链接下面不能再有条目，否则写入时可能经过链接逃出暂存目录
+	for p := range types {
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			if t, exists := types[dir]; exists && t != models.EntryDir {
+				return fmt.Errorf("%w: %s 的上级不是目录", ErrInvalidManifest, p)
+			}
+		}
+	}
+
+	return nil
+}
+
+// linkStaysInside 检查相对链接目标解析后是否仍在文件夹内
+func linkStaysInside(linkPath, target string) bool {
+	if target == "" || strings.ContainsAny(target, "\x00\\") || strings.HasPrefix(target, "/") || len(target) >= 2 && target[1] == ':' {
+		return false
+	}
+	resolved := path.Join(path.Dir(linkPath), target)
+	return resolved != ".." && !strings.HasPrefix(resolved, "../")
+}
+
+// BuildManifest 遍历本地文件夹生成清单，文件ID按顺序分配
+// 设备文件、管道等特殊文件被忽略
+func BuildManifest(root string, policy models.SymlinkPolicy) (*models.FolderManifest, error) {
+	if policy == "" {
+		policy = models.SymlinkSkip
+	}
+
+	root = filepath.Clean(root)
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("获取文件夹信息失败: %v", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("不是文件夹: %s", root)
+	}
+
+	m := &models.FolderManifest{
+		Root:          filepath.Base(root),
+		SymlinkPolicy: policy,
+	}
+
+	// 跟随链接时记录已访问的目录，防止链接成环
+	visited := make(map[string]bool)
+	if real, err := filepath.EvalSymlinks(root); err == nil {
+		visited[real] = true
+	}
+
+	if err := walkFolder(m, root, "", visited); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// walkFolder 递归添加目录中的条目
+func walkFolder(m *models.FolderManifest, dir, rel string, visited map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("读取目录失败: %v", err)
+	}
+
+	for _, de := range entries {
+		fullPath := filepath.Join(dir, de.Name())
+		relPath := path.Join(rel, de.Name())
+
+		info, err := os.Lstat(fullPath)
+		if err != nil {
+			return fmt.Errorf("获取文件信息失败: %v", err)
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			switch m.SymlinkPolicy {
+			case models.SymlinkPreserve:
+				target, err := os.Readlink(fullPath)
+				if err != nil {
+					return fmt.Errorf("读取符号链接失败: %v", err)
+				}
+				target = filepath.ToSlash(target)
+				if !linkStaysInside(relPath, target) {
+					log.Printf("忽略指向文件夹外部的符号链接: %s -> %s", relPath, target)
+					continue
+				}
+				m.Entries = append(m.Entries, models.ManifestEntry{
+					Path:    relPath,
+					Type:    models.EntrySymlink,
+					ModTime: info.ModTime(),
+					Target:  target,
+				})
+				continue
+			case models.SymlinkFollow:
+				info, err = os.Stat(fullPath)
+				if err != nil {
+					log.Printf("忽略失效的符号链接: %s", relPath)
+					continue
+				}
+			default:
+				continue
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			real, err := filepath.EvalSymlinks(fullPath)
+			if err != nil {
+				return fmt.Errorf("解析目录失败: %v", err)
+			}
+			if visited[real] {
+				log.Printf("忽略已包含的目录（链接成环或重复）: %s", relPath)
+				continue
+			}
+			visited[real] = true
+
+			m.Entries = append(m.Entries, models.ManifestEntry{
+				Path:    relPath,
+				Type:    models.EntryDir,
+				Mode:    uint32(info.Mode().Perm()),
+				ModTime: info.ModTime(),
+			})
+			if err := walkFolder(m, fullPath, relPath, visited); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if len(m.Entries) >= maxManifestEntries {
+				return fmt.Errorf("文件夹中的条目过多")
+			}
+			checksum, err := calculateFileChecksum(fullPath)
+			if err != nil {
+				return fmt.Errorf("计算文件校验和失败: %v", err)
+			}
+			m.Entries = append(m.Entries, models.ManifestEntry{
+				Path:     relPath,
+				Type:     models.EntryFile,
+				Size:     info.Size(),
+				Mode:     uint32(info.Mode().Perm()),
+				ModTime:  info.ModTime(),
+				Checksum: checksum,
+				FileID:   fmt.Sprintf("f%d", len(m.Entries)),
+			})
+		}
+	}
+
+	return nil
+}
+
+// stagingDir 文件夹传输的暂存目录，与存储目录在同一文件系统上以便原子移动
+func stagingDir(storageDir, transferID string) string {
+	return filepath.Join(storageDir, stagingDirName, transferID)
+}
+
+// stagedPath 文件在暂存目录中的位置，路径必须已经过 ValidateManifest 规范化
+func stagedPath(storageDir, transferID string, m *models.FolderManifest, relPath string) string {
+	return filepath.Join(stagingDir(storageDir, transferID), m.Root, filepath.FromSlash(relPath))
+}
+
+// prepareStaging 创建暂存目录和清单中的所有目录
+func prepareStaging(storageDir, transferID string, m *models.FolderManifest) error {
+	root := filepath.Join(stagingDir(storageDir, transferID), m.Root)
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return fmt.Errorf("创建暂存目录失败: %v", err)
+	}
+
+	for _, entry := range m.Entries {
+		if entry.Type != models.EntryDir {
+			continue
+		}
+		if err := os.MkdirAll(stagedPath(storageDir, transferID, m, entry.Path), 0700); err != nil {
+			return fmt.Errorf("创建目录失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// commitFolder 检查暂存的文件夹是否完整，恢复链接、权限和修改时间后移动到存储目录
+// 存储目录中已有同名文件或文件夹时按冲突策略处理，返回最终的文件夹名称
+// 策略为 skip 时丢弃暂存的文件夹并返回 ErrConflictSkipped
+func commitFolder(storageDir, transferID string, m *models.FolderManifest, policy ConflictPolicy) (string, error) {
+	for _, entry := range m.Entries {
+		if entry.Type != models.EntryFile {
+			continue
+		}
+		info, err := os.Lstat(stagedPath(storageDir, transferID, m, entry.Path))
+		if err != nil || !info.Mode().IsRegular() {
+			return "", fmt.Errorf("文件尚未接收: %s", entry.Path)
+		}
+	}
+
+	for _, entry := range m.Entries {
+		if entry.Type != models.EntrySymlink {
+			continue
+		}
+		if err := os.Symlink(filepath.FromSlash(entry.Target), stagedPath(storageDir, transferID, m, entry.Path)); err != nil {
+			return "", fmt.Errorf("创建符号链接失败: %v", err)
+		}
+	}
+
+	// 先处理文件，再从最深的目录开始处理目录，避免修改时间被后续操作覆盖
+	entries := append([]models.ManifestEntry{}, m.Entries...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		if (entries[i].Type == models.EntryDir) != (entries[j].Type == models.EntryDir) {
+			return entries[j].Type == models.EntryDir
+		}
+		return strings.Count(entries[i].Path, "/") > strings.Count(entries[j].Path, "/")
+	})
+	for _, entry := range entries {
+		if entry.Type == models.EntrySymlink {
+			continue
+		}
+		target := stagedPath(storageDir, transferID, m, entry.Path)
+		if entry.Mode != 0 {
+			mode := os.FileMode(entry.Mode)
+			if entry.Type == models.EntryDir {
+				// 保证接收方自己仍然可以进入和清理目录
+				mode |= 0700
+			}
+			if err := os.Chmod(target, mode); err != nil {
+				return "", fmt.Errorf("设置权限失败: %v", err)
+			}
+		}
+		if !entry.ModTime.IsZero() {
+			if err := os.Chtimes(target, entry.ModTime, entry.ModTime); err != nil {
+				return "", fmt.Errorf("设置修改时间失败: %v", err)
+			}
+		}
+	}
+
+	name, err := resolveConflict(storageDir, m.Root, true, policy)
+	if errors.Is(err, ErrConflictSkipped) {
+		discardStaging(storageDir, transferID)
+		return name, err
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(filepath.Join(stagingDir(storageDir, transferID), m.Root), filepath.Join(storageDir, name)); err != nil {
+		return "", fmt.Errorf("移动文件夹失败: %v", err)
+	}
+
+	discardStaging(storageDir, transferID)
+	return name, nil
+}
+
+// discardStaging 删除暂存目录
+func discardStaging(storageDir, transferID string) {
+	if err := os.RemoveAll(stagingDir(storageDir, transferID)); err != nil {
+		log.Printf("清理暂存目录失败: %v", err)
+	}
+}
+
+// uniqueName 在目录中找一个未被占用的名称，如 photos、photos (1)
+// keepExt 为true时序号加在扩展名之前，如 a (1).txt
+func uniqueName(dir, name string, keepExt bool) (string, error) {
+	ext := ""
+	if keepExt {
+		ext = filepath.Ext(name)
+	}
+	base := strings.TrimSuffix(name, ext)
+
+	candidate := name
+	for i := 1; i <= 1000; i++ {
+		if _, err := os.Lstat(filepath.Join(dir, candidate)); os.IsNotExist(err) {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	return "", fmt.Errorf("同名文件过多: %s", name)
+}
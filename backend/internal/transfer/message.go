@@ -1,9 +1,14 @@
 package transfer
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
+
+	"airshare-backend/internal/security"
 )
 
 // 消息类型枚举
@@ -15,6 +20,12 @@ const (
 	MessageTypeError           = "error"
 	MessageTypePing            = "ping"
 	MessageTypePong            = "pong"
+	MessageTypeBlockSignatures = "block_signatures" // 接收方已有旧版本的块签名
+	MessageTypeFileDelta       = "file_delta"       // 差异传输的块引用和字面数据
+	MessageTypeTransferProgress = "transfer_progress" // 传输进度和压缩率
+	MessageTypeSwarmManifest    = "swarm_manifest"    // 分发清单，包含每个分片的校验和
+	MessageTypeChunkAvailability = "chunk_availability" // 本端可以提供的分片
+	MessageTypeChunkRequest     = "chunk_request"     // 向对等端请求分片
 )
 
 // TransferMessage 传输消息结构
@@ -25,6 +36,8 @@ type TransferMessage struct {
 	Timestamp   int64           `json:"timestamp"`   // 时间戳
 	Sequence    int             `json:"sequence"`     // 序列号
 	Checksum    string          `json:"checksum"`     // 校验和
+	SenderID    string          `json:"sender_id,omitempty"` // 发送者ID，仅供参考，未经认证
+	Nonce       string          `json:"nonce"`        // 随机数，用于重放检测
 }
 
 // FileMetadata 文件元数据
@@ -35,6 +48,10 @@ type FileMetadata struct {
 	Checksum string `json:"checksum"` // 文件校验和
 	Chunks   int    `json:"chunks"`   // 分片数量
 	ChunkSize int64 `json:"chunk_size"` // 分片大小
+	// 压缩协商：发送方在 Compressions 中按优先级列出可用的算法，
+	// 接收方回复的元数据中 Compression 为选定的算法
+	Compressions []Compression `json:"compressions,omitempty"`
+	Compression  Compression   `json:"compression,omitempty"`
 }
 
 // FileChunk 文件分片数据
@@ -45,6 +62,20 @@ type FileChunk struct {
 	Data     []byte `json:"data"`     // 分片数据
 	Checksum string `json:"checksum"` // 分片校验和
 	IsLast   bool   `json:"is_last"`  // 是否为最后一个分片
+	// Compression Data 使用的压缩算法，为空或 none 时是原始数据；Size 和 Checksum 始终针对原始数据
+	Compression Compression `json:"compression,omitempty"`
+}
+
+// TransferProgress 传输进度事件
+type TransferProgress struct {
+	TransferID       string      `json:"transfer_id"`
+	CompletedChunks  int         `json:"completed_chunks"`
+	TotalChunks      int         `json:"total_chunks"`
+	Bytes            int64       `json:"bytes"`       // 已完成的原始字节数
+	TotalBytes       int64       `json:"total_bytes"` // 文件大小
+	WireBytes        int64       `json:"wire_bytes"`  // 实际传输的字节数
+	Compression      Compression `json:"compression"`
+	CompressionRatio float64     `json:"compression_ratio"` // 实际传输字节数与原始字节数之比，1表示没有压缩
 }
 
 // TransferComplete 传输完成消息
@@ -81,15 +112,56 @@ func NewTransferMessage(msgType, transferID string, data interface{}) (*Transfer
 	// 计算校验和
 	checksum := calculateChecksum(jsonData)
 
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("生成消息随机数失败: %v", err)
+	}
+
 	return &TransferMessage{
 		Type:       msgType,
 		TransferID: transferID,
 		Data:       jsonData,
 		Timestamp:  time.Now().UnixMilli(),
 		Checksum:   checksum,
+		Nonce:      hex.EncodeToString(nonce),
 	}, nil
 }
 
+// MessageSequencer 为发往同一对等端的消息分配单调递增的序列号
+type MessageSequencer struct {
+	mu       sync.Mutex
+	senderID string
+	last     int
+}
+
+// NewMessageSequencer 创建消息序列号分配器
+// 序列号以纳秒时间戳为起点，进程重启后仍然大于之前发送的序列号
+func NewMessageSequencer(senderID string) *MessageSequencer {
+	return &MessageSequencer{
+		senderID: senderID,
+		last:     int(time.Now().UnixNano()),
+	}
+}
+
+// Stamp 在发送前为消息设置发送者ID、下一个序列号、当前时间戳和新的随机数
+// 重发的消息也需要重新调用，否则会被接收方当作重放拒绝
+func (s *MessageSequencer) Stamp(msg *TransferMessage) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("生成消息随机数失败: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.last++
+	msg.SenderID = s.senderID
+	msg.Sequence = s.last
+	msg.Timestamp = time.Now().UnixMilli()
+	msg.Nonce = hex.EncodeToString(nonce)
+	return nil
+}
+
 // ParseMessageData 解析消息数据
 func (msg *TransferMessage) ParseMessageData(target interface{}) error {
 	if err := json.Unmarshal(msg.Data, target); err != nil {
@@ -128,6 +200,36 @@ func CreateFileChunkMessage(transferID string, chunk *FileChunk) (*TransferMessa
 	return NewTransferMessage(MessageTypeFileChunk, transferID, chunk)
 }
 
+// CreateBlockSignaturesMessage 创建块签名消息，接收方已有旧版本时回复文件元数据
+func CreateBlockSignaturesMessage(transferID string, sig *FileSignature) (*TransferMessage, error) {
+	return NewTransferMessage(MessageTypeBlockSignatures, transferID, sig)
+}
+
+// CreateFileDeltaMessage 创建差异消息
+func CreateFileDeltaMessage(transferID string, delta *FileDelta) (*TransferMessage, error) {
+	return NewTransferMessage(MessageTypeFileDelta, transferID, delta)
+}
+
+// CreateTransferProgressMessage 创建传输进度消息
+func CreateTransferProgressMessage(transferID string, progress *TransferProgress) (*TransferMessage, error) {
+	return NewTransferMessage(MessageTypeTransferProgress, transferID, progress)
+}
+
+// CreateSwarmManifestMessage 创建分发清单消息
+func CreateSwarmManifestMessage(transferID string, manifest *SwarmManifest) (*TransferMessage, error) {
+	return NewTransferMessage(MessageTypeSwarmManifest, transferID, manifest)
+}
+
+// CreateChunkAvailabilityMessage 创建分片可用性消息
+func CreateChunkAvailabilityMessage(transferID string, availability *ChunkAvailability) (*TransferMessage, error) {
+	return NewTransferMessage(MessageTypeChunkAvailability, transferID, availability)
+}
+
+// CreateChunkRequestMessage 创建分片请求消息
+func CreateChunkRequestMessage(transferID string, request *ChunkRequest) (*TransferMessage, error) {
+	return NewTransferMessage(MessageTypeChunkRequest, transferID, request)
+}
+
 // CreateTransferCompleteMessage 创建传输完成消息
 func CreateTransferCompleteMessage(transferID string, complete *TransferComplete) (*TransferMessage, error) {
 	return NewTransferMessage(MessageTypeTransferComplete, transferID, complete)
@@ -168,20 +270,30 @@ func calculateChecksum(data []byte) string {
 	return fmt.Sprintf("%08x", sum)
 }
 
-// MessageHandler 消息处理器接口
+// MessageHandler 消息处理器接口，peerID 为传输层认证的对等端
 type MessageHandler interface {
-	HandleMessage(msg *TransferMessage) error
+	HandleMessage(peerID string, msg *TransferMessage) error
+}
+
+// MessageHandlerFunc 函数形式的消息处理器
+type MessageHandlerFunc func(peerID string, msg *TransferMessage) error
+
+// HandleMessage 调用处理函数
+func (f MessageHandlerFunc) HandleMessage(peerID string, msg *TransferMessage) error {
+	return f(peerID, msg)
 }
 
 // MessageRouter 消息路由器
 type MessageRouter struct {
-	handlers map[string]MessageHandler
+	handlers    map[string]MessageHandler
+	replayGuard *security.ReplayGuard
 }
 
 // NewMessageRouter 创建新的消息路由器
 func NewMessageRouter() *MessageRouter {
 	return &MessageRouter{
-		handlers: make(map[string]MessageHandler),
+		handlers:    make(map[string]MessageHandler),
+		replayGuard: security.NewReplayGuard(security.DefaultReplaySkew, security.DefaultNonceCacheSize),
 	}
 }
 
@@ -190,8 +302,10 @@ func (r *MessageRouter) RegisterHandler(msgType string, handler MessageHandler)
 	r.handlers[msgType] = handler
 }
 
-// RouteMessage 路由消息
-func (r *MessageRouter) RouteMessage(msg *TransferMessage) error {
+// RouteMessage 路由来自对等端的消息
+// peerID 必须是传输层认证的身份（例如消息到达的WebRTC数据通道所属的对等连接），
+// 消息中的 SenderID 由对方自行填写，不能用于重放检测
+func (r *MessageRouter) RouteMessage(peerID string, msg *TransferMessage) error {
 	handler, exists := r.handlers[msg.Type]
 	if !exists {
 		return fmt.Errorf("未知的消息类型: %s", msg.Type)
@@ -202,7 +316,31 @@ func (r *MessageRouter) RouteMessage(msg *TransferMessage) error {
 		return fmt.Errorf("消息校验和验证失败")
 	}
 
-	return handler.HandleMessage(msg)
+	// 重放检测，拒绝时返回 *security.ReplayError
+	if err := r.checkReplay(peerID, msg); err != nil {
+		return err
+	}
+
+	return handler.HandleMessage(peerID, msg)
+}
+
+// ForgetPeer 清除对等端的序列号状态，对等连接关闭后调用
+func (r *MessageRouter) ForgetPeer(peerID string) {
+	r.replayGuard.Forget(peerID)
+}
+
+// checkReplay 按对等端检查消息的时间戳、序列号和随机数
+func (r *MessageRouter) checkReplay(peerID string, msg *TransferMessage) error {
+	if msg.Sequence < 0 {
+		return &security.ReplayError{PeerID: peerID, Err: security.ErrReplaySequence}
+	}
+
+	var timestamp time.Time
+	if msg.Timestamp > 0 {
+		timestamp = time.UnixMilli(msg.Timestamp)
+	}
+
+	return r.replayGuard.Check(peerID, uint64(msg.Sequence), timestamp, msg.Nonce)
 }
 
 // BroadcastMessage 广播消息（用于多播传输）
@@ -211,6 +349,8 @@ type BroadcastMessage struct {
 	Targets   []string         `json:"targets"`  // 目标设备列表
 	Priority  int              `json:"priority"` // 优先级
 	RetryCount int             `json:"retry_count"` // 重试次数
+	// OnResult 每个目标设备发送成功、失败待重试或放弃时由调度器调用
+	OnResult  func(result DeliveryResult) `json:"-"`
 }
 
 // CreateBroadcastMessage 创建广播消息
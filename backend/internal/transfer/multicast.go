@@ -0,0 +1,474 @@
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// multicastWindow 多播传输同时在发送队列中的最大分片数，超过时暂停读取源文件
+	multicastWindow = 16
+	// multicastChunkSize 元数据未指定分片大小时使用的分片大小
+	multicastChunkSize = 64 * 1024
+	// multicastControlPriority 元数据和完成消息的优先级，先于同一传输的分片发送
+	multicastControlPriority = 2
+)
+
+// MulticastTransfer 一对多传输：源文件只读取一次，每个分片通过 BroadcastMessage 发给所有仍在接收的设备
+// 每个接收设备对应一个 FileTransfer，分别记录进度、重试次数和状态
+type MulticastTransfer struct {
+	ID          string
+	FileName    string
+	FileSize    int64
+	TotalChunks int
+	StartTime   time.Time
+	EndTime     time.Time
+
+	mu         sync.Mutex
+	recipients map[string]*multicastRecipient
+	order      []string
+	ctx        context.Context
+	cancel     context.CancelFunc
+	window     chan struct{}
+	inflight   sync.WaitGroup
+	done       chan struct{}
+}
+
+// multicastRecipient 多播传输的一个接收设备
+type multicastRecipient struct {
+	peer     *WebRTCPeer // 对等连接不存在时为nil
+	transfer *FileTransfer
+	chunks   int // 已送达的分片数
+}
+
+// MulticastStatus 多播传输的汇总状态
+// 有接收设备仍在接收时为 in_progress；全部完成为 completed；部分完成为 partial；
+// 全部取消为 cancelled；其余情况为 failed
+type MulticastStatus struct {
+	TransferID  string            `json:"transfer_id"`
+	FileName    string            `json:"file_name"`
+	FileSize    int64             `json:"file_size"`
+	TotalChunks int               `json:"total_chunks"`
+	Status      TransferStatus    `json:"status"`
+	BytesDone   int64             `json:"bytes_done"`  // 所有接收设备已送达的字节数之和
+	BytesTotal  int64             `json:"bytes_total"` // 文件大小乘以接收设备数
+	InProgress  int               `json:"in_progress"`
+	Completed   int               `json:"completed"`
+	Failed      int               `json:"failed"`
+	Cancelled   int               `json:"cancelled"`
+	Recipients  []RecipientStatus `json:"recipients"`
+}
+
+// RecipientStatus 多播传输中一个接收设备的状态
+type RecipientStatus struct {
+	PeerID     string         `json:"peer_id"`
+	Status     TransferStatus `json:"status"`
+	BytesDone  int64          `json:"bytes_done"`
+	ChunksDone int            `json:"chunks_done"`
+	Retries    int            `json:"retries"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// SendFileToPeers 将文件发送给多个对等端，源文件只读取一次
+// 每个分片作为一条 BroadcastMessage 加入发送队列，由调度器分别发送给每个设备并重试失败的设备；
+// 某个设备的重试次数达到上限后，后续分片不再发给它，其他设备不受影响
+// 不存在的对等端直接记为失败，没有可用的对等端时返回错误
+func (s *WebRTCTransferService) SendFileToPeers(peerIDs []string, filePath string, metadata FileMetadata) (*MulticastTransfer, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("打开文件失败: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("获取文件信息失败: %v", err)
+	}
+
+	metadata.Size = info.Size()
+	if metadata.ChunkSize <= 0 {
+		metadata.ChunkSize = multicastChunkSize
+	}
+	metadata.Chunks = int((metadata.Size + metadata.ChunkSize - 1) / metadata.ChunkSize)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &MulticastTransfer{
+		ID:          generateTransferID(),
+		FileName:    metadata.Name,
+		FileSize:    metadata.Size,
+		TotalChunks: metadata.Chunks,
+		StartTime:   time.Now(),
+		recipients:  make(map[string]*multicastRecipient),
+		ctx:         ctx,
+		cancel:      cancel,
+		window:      make(chan struct{}, multicastWindow),
+		done:        make(chan struct{}),
+	}
+
+	var targets []string
+	for _, peerID := range peerIDs {
+		if _, dup := m.recipients[peerID]; dup {
+			continue
+		}
+
+		transfer := &FileTransfer{
+			ID:        m.ID,
+			FileName:  metadata.Name,
+			FileSize:  metadata.Size,
+			Status:    TransferInProgress,
+			Direction: DirectionSend,
+			PeerID:    peerID,
+			StartTime: m.StartTime,
+		}
+		s.mu.RLock()
+		peer, exists := s.peers[peerID]
+		s.mu.RUnlock()
+		if exists {
+			peer.mu.Lock()
+			peer.transfers[m.ID] = transfer
+			peer.mu.Unlock()
+			targets = append(targets, peerID)
+		} else {
+			transfer.Status = TransferFailed
+			transfer.Error = fmt.Sprintf("对等连接不存在: %s", peerID)
+			transfer.EndTime = m.StartTime
+		}
+
+		m.recipients[peerID] = &multicastRecipient{peer: peer, transfer: transfer}
+		m.order = append(m.order, peerID)
+	}
+
+	if len(targets) == 0 {
+		file.Close()
+		cancel()
+		return nil, fmt.Errorf("没有可用的接收设备")
+	}
+
+	msg, err := CreateFileMetadataMessage(m.ID, &metadata)
+	if err != nil {
+		file.Close()
+		cancel()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.multicasts[m.ID] = m
+	s.mu.Unlock()
+
+	broadcast := CreateBroadcastMessage(msg, targets)
+	broadcast.Priority = multicastControlPriority
+	m.track(broadcast, nil, nil)
+	s.scheduler.Enqueue(broadcast)
+
+	go s.runMulticast(m, file, metadata)
+	return m, nil
+}
+
+// MulticastStatus 获取多播传输的汇总状态
+func (s *WebRTCTransferService) MulticastStatus(transferID string) (*MulticastStatus, error) {
+	s.mu.RLock()
+	m, exists := s.multicasts[transferID]
+	s.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("传输任务不存在: %s", transferID)
+	}
+	status := m.Status()
+	return &status, nil
+}
+
+// CancelMulticast 取消多播传输，通知所有仍在接收的设备
+// 取消单个接收设备使用 CancelTransfer，其他设备继续接收
+func (s *WebRTCTransferService) CancelMulticast(transferID string) error {
+	s.mu.RLock()
+	m, exists := s.multicasts[transferID]
+	s.mu.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("传输任务不存在: %s", transferID)
+	}
+
+	m.cancel()
+	for _, peerID := range m.order {
+		if err := s.CancelTransfer(peerID, transferID); err != nil {
+			log.Printf("取消 %s 的多播传输失败: %v", peerID, err)
+		}
+	}
+	return nil
+}
+
+// Status 汇总每个接收设备的状态
+func (m *MulticastTransfer) Status() MulticastStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := MulticastStatus{
+		TransferID:  m.ID,
+		FileName:    m.FileName,
+		FileSize:    m.FileSize,
+		TotalChunks: m.TotalChunks,
+		BytesTotal:  m.FileSize * int64(len(m.order)),
+		Recipients:  make([]RecipientStatus, 0, len(m.order)),
+	}
+	for _, peerID := range m.order {
+		r := m.recipients[peerID]
+		recipient := RecipientStatus{PeerID: peerID, ChunksDone: r.chunks}
+		r.update(func(t *FileTransfer) {
+			recipient.Status = t.Status
+			recipient.BytesDone = t.Progress
+			recipient.Retries = t.Retries
+			recipient.Error = t.Error
+		})
+		status.Recipients = append(status.Recipients, recipient)
+		status.BytesDone += recipient.BytesDone
+
+		switch recipient.Status {
+		case TransferCompleted:
+			status.Completed++
+		case TransferCancelled:
+			status.Cancelled++
+		case TransferFailed:
+			status.Failed++
+		default:
+			status.InProgress++
+		}
+	}
+
+	switch {
+	case status.InProgress > 0:
+		status.Status = TransferInProgress
+	case status.Completed == len(m.order):
+		status.Status = TransferCompleted
+	case status.Completed > 0:
+		status.Status = TransferPartial
+	case status.Cancelled == len(m.order):
+		status.Status = TransferCancelled
+	default:
+		status.Status = TransferFailed
+	}
+	return status
+}
+
+// Done 所有接收设备都有结果后关闭
+func (m *MulticastTransfer) Done() <-chan struct{} {
+	return m.done
+}
+
+// runMulticast 依次读取分片并加入发送队列，所有分片送达后发送完成消息
+func (s *WebRTCTransferService) runMulticast(m *MulticastTransfer, file *os.File, metadata FileMetadata) {
+	defer file.Close()
+	defer m.finish()
+
+	for index := 0; index < metadata.Chunks; index++ {
+		// 等待发送窗口，限制读取后尚未送达的分片数
+		select {
+		case m.window <- struct{}{}:
+		case <-m.ctx.Done():
+			m.inflight.Wait()
+			return
+		}
+
+		targets := m.activeTargets()
+		if len(targets) == 0 || m.ctx.Err() != nil {
+			<-m.window
+			break
+		}
+
+		offset := int64(index) * metadata.ChunkSize
+		data := make([]byte, min(metadata.ChunkSize, metadata.Size-offset))
+		if _, err := io.ReadFull(file, data); err != nil {
+			<-m.window
+			m.failAll(fmt.Errorf("读取文件失败: %v", err))
+			break
+		}
+
+		msg, err := multicastChunkMessage(m.ID, metadata, index, offset, data)
+		if err != nil {
+			<-m.window
+			m.failAll(err)
+			break
+		}
+
+		size := int64(len(data))
+		broadcast := CreateBroadcastMessage(msg, targets)
+		m.track(broadcast, func(r *multicastRecipient) {
+			r.chunks++
+			r.update(func(t *FileTransfer) { t.Progress += size })
+		}, func() { <-m.window })
+		s.scheduler.Enqueue(broadcast)
+	}
+	m.inflight.Wait()
+
+	// 收到全部分片的设备发送完成消息，送达后记为完成
+	targets := m.activeTargets()
+	if len(targets) == 0 {
+		return
+	}
+	elapsed := time.Since(m.StartTime)
+	complete := &TransferComplete{
+		Success:   true,
+		TotalTime: elapsed.Milliseconds(),
+	}
+	if elapsed > 0 {
+		complete.AverageSpeed = float64(m.FileSize) / elapsed.Seconds()
+	}
+	msg, err := CreateTransferCompleteMessage(m.ID, complete)
+	if err != nil {
+		m.failAll(err)
+		return
+	}
+
+	broadcast := CreateBroadcastMessage(msg, targets)
+	broadcast.Priority = multicastControlPriority
+	m.track(broadcast, func(r *multicastRecipient) {
+		if r.chunks < m.TotalChunks {
+			return
+		}
+		r.update(func(t *FileTransfer) {
+			t.Status = TransferCompleted
+			t.EndTime = time.Now()
+		})
+		transferCounter.WithLabelValues(string(TransferCompleted), string(DirectionSend)).Inc()
+		transferBytes.WithLabelValues(string(DirectionSend)).Add(float64(m.FileSize))
+	}, nil)
+	s.scheduler.Enqueue(broadcast)
+	m.inflight.Wait()
+}
+
+// track 设置消息的结果回调：送达时调用 delivered，失败待重试时累计设备的重试次数，
+// 放弃时将设备记为失败；所有目标都有最终结果后调用 settled
+func (m *MulticastTransfer) track(msg *BroadcastMessage, delivered func(r *multicastRecipient), settled func()) {
+	remaining := len(msg.Targets)
+	m.inflight.Add(1)
+
+	msg.OnResult = func(result DeliveryResult) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if r, ok := m.recipients[result.Target]; ok && r.active() {
+			switch {
+			case result.Err == nil:
+				if delivered != nil {
+					delivered(r)
+				}
+			case !result.Final:
+				r.update(func(t *FileTransfer) { t.Retries++ })
+			default:
+				r.fail(result.Err)
+			}
+		}
+
+		if !result.Final {
+			return
+		}
+		remaining--
+		if remaining == 0 {
+			if settled != nil {
+				settled()
+			}
+			m.inflight.Done()
+		}
+	}
+}
+
+// activeTargets 仍在接收的设备
+func (m *MulticastTransfer) activeTargets() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var targets []string
+	for _, peerID := range m.order {
+		if m.recipients[peerID].active() {
+			targets = append(targets, peerID)
+		}
+	}
+	return targets
+}
+
+// failAll 将所有仍在接收的设备记为失败
+func (m *MulticastTransfer) failAll(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Printf("多播传输 %s 失败: %v", m.ID, err)
+	for _, r := range m.recipients {
+		if r.active() {
+			r.fail(err)
+		}
+	}
+}
+
+// finish 结束多播传输，未收到完成消息的设备记为失败
+func (m *MulticastTransfer) finish() {
+	m.mu.Lock()
+	for _, r := range m.recipients {
+		if r.active() {
+			r.fail(fmt.Errorf("传输未完成"))
+		}
+	}
+	m.EndTime = time.Now()
+	m.mu.Unlock()
+
+	m.cancel()
+	close(m.done)
+
+	status := m.Status()
+	log.Printf("多播传输 %s 结束: %s，完成 %d，失败 %d，取消 %d", m.ID, status.Status, status.Completed, status.Failed, status.Cancelled)
+}
+
+// active 设备是否仍在接收，调用者需持有 MulticastTransfer 的锁
+func (r *multicastRecipient) active() bool {
+	active := false
+	r.update(func(t *FileTransfer) { active = t.Status == TransferInProgress })
+	return active
+}
+
+// fail 将设备记为失败，调用者需持有 MulticastTransfer 的锁
+func (r *multicastRecipient) fail(err error) {
+	r.update(func(t *FileTransfer) {
+		t.Status = TransferFailed
+		t.Error = err.Error()
+		t.EndTime = time.Now()
+	})
+	transferCounter.WithLabelValues(string(TransferFailed), string(DirectionSend)).Inc()
+}
+
+// update 在对等端的锁内读写设备的 FileTransfer，CancelTransfer 也在该锁内修改状态
+func (r *multicastRecipient) update(fn func(t *FileTransfer)) {
+	if r.peer != nil {
+		r.peer.mu.Lock()
+		defer r.peer.mu.Unlock()
+	}
+	fn(r.transfer)
+}
+
+// multicastChunkMessage 创建分片消息，元数据指定了压缩算法且压缩有效时发送压缩后的数据
+func multicastChunkMessage(transferID string, metadata FileMetadata, index int, offset int64, data []byte) (*TransferMessage, error) {
+	hash := sha256.Sum256(data)
+	chunk := &FileChunk{
+		Index:       index,
+		Offset:      offset,
+		Size:        int64(len(data)),
+		Data:        data,
+		Checksum:    hex.EncodeToString(hash[:]),
+		IsLast:      index == metadata.Chunks-1,
+		Compression: CompressionNone,
+	}
+
+	if metadata.Compression != "" && metadata.Compression != CompressionNone {
+		compressed, err := compressChunk(metadata.Compression, data)
+		if err != nil {
+			return nil, err
+		}
+		if worthCompressing(len(data), len(compressed)) {
+			chunk.Data, chunk.Compression = compressed, metadata.Compression
+		}
+	}
+	return CreateFileChunkMessage(transferID, chunk)
+}
@@ -0,0 +1,277 @@
+package transfer
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"airshare-backend/pkg/models"
+)
+
+// speedSmoothing 速度指数平滑的时间常数，越大速度变化越平缓
+const speedSmoothing = 3 * time.Second
+
+// ProgressCallback 进行中的传输的进度事件，在定时任务的协程中调用，不应阻塞
+type ProgressCallback func(event models.TransferProgressEvent)
+
+// progressTracker 计算传输的平滑速度
+type progressTracker struct {
+	lastBytes   int64
+	lastTime    time.Time
+	speed       float64
+	sampled     bool
+	currentFile string
+	writers     map[*progressWriter]struct{} // 进行中的上传
+}
+
+// progressWriter 记录上传中写入的字节数
+// 写入时只累加计数，不获取服务的锁，计数在发送进度事件或查询进度时计入传输
+type progressWriter struct {
+	transfer  *models.TransferRequest
+	fileID    string
+	fileIndex int
+	pending   atomic.Int64 // 尚未计入传输的字节数
+}
+
+// OnProgress 注册进度事件回调，用于推送给客户端
+func (s *Service) OnProgress(callback ProgressCallback) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.progressCallbacks = append(s.progressCallbacks, callback)
+}
+
+// Progress 获取传输当前的进度，速度按最近一次进度事件计算
+func (s *Service) Progress(transferID string) (*models.TransferProgressEvent, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	transfer, exists := s.transfers[transferID]
+	if !exists {
+		return nil, fmt.Errorf("传输不存在: %s", transferID)
+	}
+	if tracker := s.trackers[transferID]; tracker != nil {
+		tracker.flush()
+	}
+	event := s.progressEvent(transfer, s.trackers[transferID], time.Now())
+	return &event, nil
+}
+
+// startProgressTask 定期为进行中的传输发送进度事件
+// 传输暂停或结束后再发送一次最终的进度
+func (s *Service) startProgressTask() {
+	if s.config.ProgressInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(s.config.ProgressInterval) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.emitProgress(now)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// emitProgress 更新速度并通知所有进度回调
+func (s *Service) emitProgress(now time.Time) {
+	s.mutex.Lock()
+	var events []models.TransferProgressEvent
+	for id, tracker := range s.trackers {
+		transfer, exists := s.transfers[id]
+		if !exists {
+			delete(s.trackers, id)
+			continue
+		}
+
+		tracker.flush()
+		tracker.sample(transfer.BytesDone, now)
+		events = append(events, s.progressEvent(transfer, tracker, now))
+		if transfer.Status != models.TransferAccepted {
+			delete(s.trackers, id)
+		}
+	}
+	callbacks := s.progressCallbacks
+	s.mutex.Unlock()
+
+	// 回调在定时任务的协程中依次执行，不应阻塞
+	for _, event := range events {
+		for _, callback := range callbacks {
+			notifyProgress(callback, event)
+		}
+	}
+}
+
+// notifyProgress 调用进度回调，回调的panic不影响定时任务
+func notifyProgress(callback ProgressCallback, event models.TransferProgressEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Transfer progress callback panic: %v", r)
+		}
+	}()
+	callback(event)
+}
+
+// trackProgress 开始计算传输的速度并记录上传写入的字节数，调用者需持有锁
+func (s *Service) trackProgress(transferID string, writer *progressWriter) {
+	tracker, ok := s.trackers[transferID]
+	if !ok {
+		tracker = &progressTracker{writers: make(map[*progressWriter]struct{})}
+		s.trackers[transferID] = tracker
+	}
+	tracker.currentFile = writer.fileID
+	tracker.writers[writer] = struct{}{}
+}
+
+// untrackProgress 上传结束后计入剩余的字节数并停止记录，调用者需持有锁
+func (s *Service) untrackProgress(transferID string, writer *progressWriter) {
+	writer.flush()
+	if tracker, ok := s.trackers[transferID]; ok {
+		delete(tracker.writers, writer)
+	}
+}
+
+// flush 将进行中的上传写入的字节数计入传输，调用者需持有锁
+func (t *progressTracker) flush() {
+	for writer := range t.writers {
+		writer.flush()
+	}
+}
+
+// progressEvent 生成传输的进度事件，调用者需持有锁
+func (s *Service) progressEvent(transfer *models.TransferRequest, tracker *progressTracker, now time.Time) models.TransferProgressEvent {
+	chunkSize := int64(s.config.ChunkSize)
+	if chunkSize <= 0 {
+		chunkSize = math.MaxInt64
+	}
+
+	event := models.TransferProgressEvent{
+		TransferID: transfer.ID,
+		SenderID:   transfer.SenderID,
+		ReceiverID: transfer.ReceiverID,
+		Status:     transfer.Status,
+		BytesDone:  transfer.BytesDone,
+		BytesTotal: transfer.BytesTotal,
+		ETA:        -1,
+		Files:      make([]models.FileProgress, 0, len(transfer.Files)),
+		Timestamp:  now,
+	}
+
+	for _, file := range transfer.Files {
+		totalChunks := int((file.Size + chunkSize - 1) / chunkSize)
+		chunksDone := int(file.BytesDone / chunkSize)
+		if file.BytesDone >= file.Size {
+			chunksDone = totalChunks
+		}
+		event.Files = append(event.Files, models.FileProgress{
+			FileID:      file.ID,
+			Name:        file.Name,
+			BytesDone:   file.BytesDone,
+			BytesTotal:  file.Size,
+			ChunksDone:  chunksDone,
+			TotalChunks: totalChunks,
+		})
+
+		if tracker != nil && file.ID == tracker.currentFile {
+			event.CurrentFile = file.ID
+			event.CurrentChunk = int(file.BytesDone / chunkSize)
+		}
+	}
+
+	if tracker != nil && transfer.Status == models.TransferAccepted {
+		event.Speed = tracker.speed
+		if tracker.speed > 0 {
+			event.ETA = float64(transfer.BytesTotal-transfer.BytesDone) / tracker.speed
+		}
+	}
+	return event
+}
+
+// sample 按距上次采样的时间对速度做指数平滑
+func (t *progressTracker) sample(bytes int64, now time.Time) {
+	if t.lastTime.IsZero() {
+		t.lastBytes, t.lastTime = bytes, now
+		return
+	}
+
+	elapsed := now.Sub(t.lastTime)
+	if elapsed <= 0 {
+		return
+	}
+	delta := bytes - t.lastBytes
+	if delta < 0 {
+		// 上传失败后丢弃了部分数据
+		delta = 0
+	}
+	current := float64(delta) / elapsed.Seconds()
+
+	if !t.sampled {
+		t.speed = current
+		t.sampled = true
+	} else {
+		alpha := 1 - math.Exp(-elapsed.Seconds()/speedSmoothing.Seconds())
+		t.speed += alpha * (current - t.speed)
+	}
+	t.lastBytes, t.lastTime = bytes, now
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.pending.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// flush 将写入的字节数计入文件和传输的进度，调用者需持有锁
+func (w *progressWriter) flush() {
+	n := w.pending.Swap(0)
+	if n == 0 {
+		return
+	}
+
+	// 文件列表在接收后不再变化，索引只在找不到时重新查找
+	if w.fileIndex >= len(w.transfer.Files) || w.transfer.Files[w.fileIndex].ID != w.fileID {
+		w.fileIndex = fileIndex(w.transfer, w.fileID)
+		if w.fileIndex < 0 {
+			return
+		}
+	}
+
+	file := &w.transfer.Files[w.fileIndex]
+	file.BytesDone += n
+	if file.Size > 0 && file.Progress < 100 {
+		// 校验通过之前进度最多为99
+		file.Progress = int(min(file.BytesDone*100/file.Size, 99))
+	}
+	w.transfer.BytesDone += n
+}
+
+// setFileBytes 设置文件已接收的字节数并重新计算传输的总数，调用者需持有锁
+func setFileBytes(transfer *models.TransferRequest, fileID string, bytes int64) {
+	if i := fileIndex(transfer, fileID); i >= 0 {
+		transfer.Files[i].BytesDone = bytes
+	}
+	updateByteCounters(transfer)
+}
+
+// updateByteCounters 按文件重新计算传输的已接收字节数和总字节数，调用者需持有锁
+func updateByteCounters(transfer *models.TransferRequest) {
+	transfer.BytesDone, transfer.BytesTotal = 0, 0
+	for _, file := range transfer.Files {
+		transfer.BytesDone += file.BytesDone
+		transfer.BytesTotal += file.Size
+	}
+}
+
+// fileIndex 按ID查找文件在传输中的位置，找不到时返回-1
+func fileIndex(transfer *models.TransferRequest, fileID string) int {
+	for i := range transfer.Files {
+		if transfer.Files[i].ID == fileID {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,262 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"airshare-backend/pkg/models"
+)
+
+var (
+	ErrInvalidControl    = errors.New("无效的传输操作")
+	ErrInvalidTransition = errors.New("传输当前的状态不支持该操作")
+	ErrNotParticipant    = errors.New("只有发送设备和接收设备可以操作传输")
+	ErrInvalidOffset     = errors.New("续传位置不匹配")
+)
+
+// StatusCallback 传输开始、排队、暂停、失败或完成
+type StatusCallback func(transfer models.TransferRequest)
+
+// runningTransfer 正在进行的传输，暂停或取消时中断进行中的上传
+type runningTransfer struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// OnStatusChange 注册传输状态变化回调，用于通知发送设备和接收设备
+func (s *Service) OnStatusChange(callback StatusCallback) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.statusCallbacks = append(s.statusCallbacks, callback)
+}
+
+// Queue 获取 deviceID 参与的进行中、排队中和已暂停的传输
+// deviceID 为空时返回所有传输（未启用认证）
+func (s *Service) Queue(deviceID string) models.TransferQueue {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	queue := models.TransferQueue{
+		MaxConcurrent: s.config.MaxConcurrent,
+		Active:        []models.TransferRequest{},
+		Queued:        []models.TransferRequest{},
+		Paused:        []models.TransferRequest{},
+	}
+	for _, transfer := range s.transfers {
+		if !isParticipant(transfer, deviceID) {
+			continue
+		}
+		switch transfer.Status {
+		case models.TransferAccepted:
+			queue.Active = append(queue.Active, snapshotTransfer(transfer))
+		case models.TransferPaused:
+			queue.Paused = append(queue.Paused, snapshotTransfer(transfer))
+		}
+	}
+	for _, id := range s.queue {
+		if transfer := s.transfers[id]; isParticipant(transfer, deviceID) {
+			queue.Queued = append(queue.Queued, snapshotTransfer(transfer))
+		}
+	}
+	return queue
+}
+
+// isParticipant deviceID 是否为传输的发送设备或接收设备，deviceID 为空时不检查
+func isParticipant(transfer *models.TransferRequest, deviceID string) bool {
+	return deviceID == "" || deviceID == transfer.SenderID || deviceID == transfer.ReceiverID
+}
+
+// Control 执行暂停、恢复、重试或调整队列位置
+// deviceID 为空时不检查操作者身份（未启用认证）
+func (s *Service) Control(deviceID string, control models.TransferControl) (*models.TransferRequest, error) {
+	switch control.Action {
+	case models.QueueActionPause:
+		return s.Pause(control.TransferID, deviceID)
+	case models.QueueActionResume:
+		return s.Resume(control.TransferID, deviceID)
+	case models.QueueActionRetry:
+		return s.Retry(control.TransferID, deviceID)
+	case models.QueueActionMove:
+		return s.Move(control.TransferID, deviceID, control.Position)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrInvalidControl, control.Action)
+	}
+}
+
+// Pause 暂停进行中或排队中的传输，进行中的上传被中断，已写入的完整分片保留
+func (s *Service) Pause(transferID, deviceID string) (*models.TransferRequest, error) {
+	return s.control(transferID, deviceID, func(transfer *models.TransferRequest) error {
+		if transfer.Status != models.TransferAccepted && transfer.Status != models.TransferQueued {
+			return fmt.Errorf("%w: %s", ErrInvalidTransition, transfer.Status)
+		}
+		transfer.Status = models.TransferPaused
+		transfer.QueuePosition = 0
+		log.Printf("传输已暂停: %s", transferID)
+		return nil
+	})
+}
+
+// Resume 恢复已暂停的传输，重新排到队列末尾
+func (s *Service) Resume(transferID, deviceID string) (*models.TransferRequest, error) {
+	return s.control(transferID, deviceID, func(transfer *models.TransferRequest) error {
+		if transfer.Status != models.TransferPaused {
+			return fmt.Errorf("%w: %s", ErrInvalidTransition, transfer.Status)
+		}
+		s.enqueue(transfer)
+		log.Printf("传输已恢复: %s", transferID)
+		return nil
+	})
+}
+
+// Retry 重新排队失败的传输，已接收的文件和中断文件已写入的完整分片无需重新上传
+func (s *Service) Retry(transferID, deviceID string) (*models.TransferRequest, error) {
+	return s.control(transferID, deviceID, func(transfer *models.TransferRequest) error {
+		if transfer.Status != models.TransferFailed {
+			return fmt.Errorf("%w: %s", ErrInvalidTransition, transfer.Status)
+		}
+		transfer.Error = ""
+		transfer.CompletedAt = nil
+		s.enqueue(transfer)
+		log.Printf("重试传输: %s", transferID)
+		return nil
+	})
+}
+
+// Move 调整排队中的传输在队列中的位置，position 从1开始，超出队列长度时排到末尾
+func (s *Service) Move(transferID, deviceID string, position int) (*models.TransferRequest, error) {
+	return s.control(transferID, deviceID, func(transfer *models.TransferRequest) error {
+		if position < 1 {
+			return fmt.Errorf("%w: 队列位置必须大于0", ErrInvalidControl)
+		}
+		if transfer.Status != models.TransferQueued {
+			return fmt.Errorf("%w: %s", ErrInvalidTransition, transfer.Status)
+		}
+
+		queue := make([]string, 0, len(s.queue))
+		for _, id := range s.queue {
+			if id != transferID {
+				queue = append(queue, id)
+			}
+		}
+		if position > len(queue)+1 {
+			position = len(queue) + 1
+		}
+		queue = append(queue[:position-1], append([]string{transferID}, queue[position-1:]...)...)
+		s.queue = queue
+		return nil
+	})
+}
+
+// control 检查操作者后修改传输，重新调度队列并通知状态变化
+func (s *Service) control(transferID, deviceID string, apply func(*models.TransferRequest) error) (*models.TransferRequest, error) {
+	s.mutex.Lock()
+
+	transfer, exists := s.transfers[transferID]
+	if !exists {
+		s.mutex.Unlock()
+		return nil, fmt.Errorf("传输不存在: %s", transferID)
+	}
+	if !isParticipant(transfer, deviceID) {
+		s.mutex.Unlock()
+		return nil, ErrNotParticipant
+	}
+	if err := apply(transfer); err != nil {
+		s.mutex.Unlock()
+		return nil, err
+	}
+
+	changed := s.reschedule()
+	snapshot := snapshotTransfer(transfer)
+	if !containsTransfer(changed, transferID) {
+		changed = append(changed, snapshot)
+	}
+	callbacks := s.statusCallbacks
+	s.mutex.Unlock()
+
+	notifyStatus(callbacks, changed)
+	return &snapshot, nil
+}
+
+// enqueue 将传输排到队列末尾，调用者需持有锁
+func (s *Service) enqueue(transfer *models.TransferRequest) {
+	transfer.Status = models.TransferQueued
+	s.queue = append(s.queue, transfer.ID)
+}
+
+// reschedule 按队列顺序开始排队的传输直到达到并发上限，调用者需持有锁
+// 不再进行中的传输释放名额，其进行中的上传被中断；返回被开始的传输
+func (s *Service) reschedule() []models.TransferRequest {
+	for id, run := range s.running {
+		if transfer, ok := s.transfers[id]; !ok || transfer.Status != models.TransferAccepted {
+			run.cancel()
+			delete(s.running, id)
+		}
+	}
+
+	// 移除已不在排队状态的传输（被暂停、取消或去重后直接完成）
+	queue := make([]string, 0, len(s.queue))
+	for _, id := range s.queue {
+		if transfer, ok := s.transfers[id]; ok && transfer.Status == models.TransferQueued {
+			queue = append(queue, id)
+		}
+	}
+
+	var started []models.TransferRequest
+	for len(queue) > 0 && (s.config.MaxConcurrent <= 0 || len(s.running) < s.config.MaxConcurrent) {
+		transfer := s.transfers[queue[0]]
+		queue = queue[1:]
+
+		ctx, cancel := context.WithCancel(context.Background())
+		s.running[transfer.ID] = &runningTransfer{ctx: ctx, cancel: cancel}
+		transfer.Status = models.TransferAccepted
+		transfer.QueuePosition = 0
+		if transfer.StartedAt == nil {
+			now := time.Now()
+			transfer.StartedAt = &now
+		}
+		started = append(started, snapshotTransfer(transfer))
+	}
+
+	s.queue = queue
+	for i, id := range s.queue {
+		s.transfers[id].QueuePosition = i + 1
+	}
+	return started
+}
+
+// uploadContext 进行中的传输的上下文，传输暂停或结束时取消，调用者需持有锁
+func (s *Service) uploadContext(transferID string) context.Context {
+	if run, ok := s.running[transferID]; ok {
+		return run.ctx
+	}
+	return context.Background()
+}
+
+// containsTransfer 检查列表中是否有指定的传输
+func containsTransfer(transfers []models.TransferRequest, transferID string) bool {
+	for _, transfer := range transfers {
+		if transfer.ID == transferID {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyStatus 通知所有注册的状态回调
+func notifyStatus(callbacks []StatusCallback, transfers []models.TransferRequest) {
+	for _, transfer := range transfers {
+		for _, callback := range callbacks {
+			go func(cb StatusCallback, t models.TransferRequest) {
+				defer func() {
+					if r := recover(); r != nil {
+						log.Printf("Transfer status callback panic: %v", r)
+					}
+				}()
+				cb(t)
+			}(callback, transfer)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package transfer
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"airshare-backend/internal/config"
+)
+
+// rateLimitReadSize 限速读取时每次读取的最大字节数，使等待更平滑
+const rateLimitReadSize = 32 * 1024
+
+// peerBucketSweepInterval 清理空闲设备令牌桶的最小间隔
+const peerBucketSweepInterval = time.Minute
+
+// TokenBucket 令牌桶限速器，令牌单位为字节
+// 令牌可以透支，透支后的请求需要等待透支部分按速率恢复，因此大于桶容量的请求也能通过
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // 每秒字节数，0表示不限制
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket 创建令牌桶，rate 为每秒字节数，0表示不限制，桶容量为一秒的流量
+func NewTokenBucket(rate int64) *TokenBucket {
+	b := &TokenBucket{last: time.Now()}
+	b.SetRate(rate)
+	b.tokens = b.burst
+	return b
+}
+
+// SetRate 运行时调整速率，已透支的令牌保留
+func (b *TokenBucket) SetRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if rate < 0 {
+		rate = 0
+	}
+	b.rate = float64(rate)
+	b.burst = float64(rate)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Rate 当前速率，0表示不限制
+func (b *TokenBucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(b.rate)
+}
+
+// reserve 取走 n 个令牌，返回令牌恢复到非负所需的等待时间
+func (b *TokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	return b.debt()
+}
+
+// delay 令牌恢复到非负所需的等待时间，不取走令牌
+func (b *TokenBucket) delay() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	return b.debt()
+}
+
+// idle 令牌已经恢复满，与新建的令牌桶等价，可以丢弃
+func (b *TokenBucket) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// debt 透支部分恢复所需的时间，调用者需持有锁
+func (b *TokenBucket) debt() time.Duration {
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refill 按经过的时间补充令牌，调用者需持有锁
+func (b *TokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	if b.rate <= 0 {
+		b.tokens = 0
+		return
+	}
+
+	b.tokens += elapsed * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// BandwidthLimits 带宽限制设置，单位为字节/秒，0表示不限制
+type BandwidthLimits struct {
+	GlobalLimit int64            `json:"global_limit"`
+	PeerLimit   int64            `json:"peer_limit"`            // 未单独设置的设备使用的限制
+	PeerLimits  map[string]int64 `json:"peer_limits,omitempty"` // 按设备ID单独设置的限制
+}
+
+// BandwidthLimiter 全局和按设备的带宽限制，发送或接收数据前先取得两者的令牌
+type BandwidthLimiter struct {
+	mu        sync.Mutex
+	global    *TokenBucket
+	peerLimit int64
+	overrides map[string]int64
+	peers     map[string]*TokenBucket
+	lastSweep time.Time // 上次清理空闲令牌桶的时间
+}
+
+// NewBandwidthLimiter 根据配置创建带宽限制器
+func NewBandwidthLimiter(cfg config.BandwidthConfig) *BandwidthLimiter {
+	l := &BandwidthLimiter{
+		global:    NewTokenBucket(cfg.GlobalLimit),
+		peerLimit: cfg.PeerLimit,
+		overrides: make(map[string]int64),
+		peers:     make(map[string]*TokenBucket),
+	}
+	for peerID, limit := range cfg.PeerLimits {
+		l.overrides[peerID] = limit
+	}
+	return l
+}
+
+// Wait 等待 peerID 和全局的令牌都足够传输 n 个字节
+func (l *BandwidthLimiter) Wait(ctx context.Context, peerID string, n int) error {
+	return l.wait(ctx, peerID, n, true)
+}
+
+// wait 取走设备和全局的令牌并等待，waitPeer 为false时只等待全局令牌，
+// 设备的透支由调用者通过 PeerDelay 跳过该设备来消化
+func (l *BandwidthLimiter) wait(ctx context.Context, peerID string, n int, waitPeer bool) error {
+	if n <= 0 {
+		return nil
+	}
+
+	delay := l.global.reserve(n)
+	if peerID != "" {
+		if peerDelay := l.peerBucket(peerID).reserve(n); waitPeer && peerDelay > delay {
+			delay = peerDelay
+		}
+	}
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PeerDelay 设备当前需要等待的时间，用于调度时跳过暂时无法发送的设备
+func (l *BandwidthLimiter) PeerDelay(peerID string) time.Duration {
+	return l.peerBucket(peerID).delay()
+}
+
+// Reader 返回按限制速率读取的 Reader，用于接收上传的数据
+func (l *BandwidthLimiter) Reader(ctx context.Context, peerID string, r io.Reader) io.Reader {
+	return &limitedReader{ctx: ctx, limiter: l, peerID: peerID, reader: r}
+}
+
+// Limits 当前的带宽限制
+func (l *BandwidthLimiter) Limits() BandwidthLimits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limits := BandwidthLimits{
+		GlobalLimit: l.global.Rate(),
+		PeerLimit:   l.peerLimit,
+		PeerLimits:  make(map[string]int64, len(l.overrides)),
+	}
+	for peerID, limit := range l.overrides {
+		limits.PeerLimits[peerID] = limit
+	}
+	return limits
+}
+
+// SetGlobalLimit 运行时调整全局限制
+func (l *BandwidthLimiter) SetGlobalLimit(limit int64) {
+	l.global.SetRate(limit)
+}
+
+// SetPeerLimit 运行时调整未单独设置的设备使用的限制
+func (l *BandwidthLimiter) SetPeerLimit(limit int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.peerLimit = limit
+	for peerID, bucket := range l.peers {
+		if _, ok := l.overrides[peerID]; !ok {
+			bucket.SetRate(limit)
+		}
+	}
+}
+
+// SetPeerOverride 单独设置指定设备的限制，limit 为负数时取消单独设置
+func (l *BandwidthLimiter) SetPeerOverride(peerID string, limit int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if limit < 0 {
+		delete(l.overrides, peerID)
+		limit = l.peerLimit
+	} else {
+		l.overrides[peerID] = limit
+	}
+	if bucket, ok := l.peers[peerID]; ok {
+		bucket.SetRate(limit)
+	}
+}
+
+// peerBucket 获取设备的令牌桶，首次使用时创建
+func (l *BandwidthLimiter) peerBucket(peerID string) *TokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(time.Now())
+
+	bucket, ok := l.peers[peerID]
+	if !ok {
+		limit, overridden := l.overrides[peerID]
+		if !overridden {
+			limit = l.peerLimit
+		}
+		bucket = NewTokenBucket(limit)
+		l.peers[peerID] = bucket
+	}
+	return bucket
+}
+
+// sweep 定期删除令牌已恢复满的设备令牌桶，避免断开的设备一直占用内存
+// 删除后再次使用时按当前限制重新创建，不会放宽限制，调用者需持有锁
+func (l *BandwidthLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < peerBucketSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for peerID, bucket := range l.peers {
+		if bucket.idle(now) {
+			delete(l.peers, peerID)
+		}
+	}
+}
+
+// limitedReader 每次读取后等待对应字节数的令牌
+type limitedReader struct {
+	ctx     context.Context
+	limiter *BandwidthLimiter
+	peerID  string
+	reader  io.Reader
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(p) > rateLimitReadSize {
+		p = p[:rateLimitReadSize]
+	}
+
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.Wait(r.ctx, r.peerID, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
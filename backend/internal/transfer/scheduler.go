@@ -0,0 +1,253 @@
+package transfer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// schedulerPollInterval 所有待发送消息的目标设备都受限时，调度器重新检查的间隔
+const schedulerPollInterval = 10 * time.Millisecond
+
+// schedulerRetryDelay 发送失败后重新排队前等待的时间，按重试次数递增
+const schedulerRetryDelay = time.Second
+
+// errSchedulerStopped 调度器已停止，队列中和之后加入的消息不再发送
+var errSchedulerStopped = errors.New("发送调度器已停止")
+
+// DeliveryResult 消息发送到一个目标设备的结果
+type DeliveryResult struct {
+	Target string
+	Err    error // 为nil表示发送成功
+	Final  bool  // 发送成功或重试次数已达上限，不会再重试
+}
+
+// SendQueue 按 BroadcastMessage.Priority 排列的待发送消息，优先级高的先发送，同一优先级按加入顺序
+type SendQueue struct {
+	mu     sync.Mutex
+	items  []*BroadcastMessage
+	notify chan struct{}
+}
+
+// NewSendQueue 创建发送队列
+func NewSendQueue() *SendQueue {
+	return &SendQueue{notify: make(chan struct{}, 1)}
+}
+
+// Push 加入一条消息，排在同一优先级的已有消息之后
+func (q *SendQueue) Push(msg *BroadcastMessage) {
+	q.mu.Lock()
+	i := sort.Search(len(q.items), func(i int) bool {
+		return q.items[i].Priority < msg.Priority
+	})
+	q.items = append(q.items, nil)
+	copy(q.items[i+1:], q.items[i:])
+	q.items[i] = msg
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Len 待发送的消息数
+func (q *SendQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// drain 取出所有待发送的消息
+func (q *SendQueue) drain() []*BroadcastMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	items := q.items
+	q.items = nil
+	return items
+}
+
+// popReady 取出优先级最高的可以立即发送的消息，没有时返回nil
+func (q *SendQueue) popReady(ready func(*BroadcastMessage) bool) *BroadcastMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, msg := range q.items {
+		if ready(msg) {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			return msg
+		}
+	}
+	return nil
+}
+
+// ChunkScheduler 按优先级发送分片消息，发送前取得带宽令牌
+// 目标设备受单独限制而暂时无法发送的消息会被跳过，不阻塞其他设备的消息
+type ChunkScheduler struct {
+	queue      *SendQueue
+	limiter    *BandwidthLimiter
+	send       func(peerID string, msg *TransferMessage) error
+	maxRetries int
+
+	mu      sync.Mutex
+	stopped bool // Run 已退出
+}
+
+// NewChunkScheduler 创建分片发送调度器，limiter 为nil时不限速；发送失败的目标最多重试 maxRetries 次
+func NewChunkScheduler(limiter *BandwidthLimiter, maxRetries int, send func(peerID string, msg *TransferMessage) error) *ChunkScheduler {
+	return &ChunkScheduler{
+		queue:      NewSendQueue(),
+		limiter:    limiter,
+		send:       send,
+		maxRetries: maxRetries,
+	}
+}
+
+// Enqueue 加入待发送的消息，调度器已停止时所有目标立即报告为最终失败
+func (c *ChunkScheduler) Enqueue(msg *BroadcastMessage) {
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		reportFailure(msg, msg.Targets, errSchedulerStopped)
+		return
+	}
+	c.queue.Push(msg)
+	c.mu.Unlock()
+}
+
+// Pending 待发送的消息数
+func (c *ChunkScheduler) Pending() int {
+	return c.queue.Len()
+}
+
+// Run 持续发送队列中的消息，直到 ctx 结束
+// 结束时队列中的消息和之后加入的消息都报告为最终失败，等待结果的发送方不会一直阻塞
+func (c *ChunkScheduler) Run(ctx context.Context) {
+	defer c.stop()
+
+	timer := time.NewTimer(schedulerPollInterval)
+	defer timer.Stop()
+
+	for {
+		msg := c.queue.popReady(c.ready)
+		if msg == nil {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(schedulerPollInterval)
+
+			// 队列为空时等待新消息，有受限的消息时定期重新检查
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.queue.notify:
+			case <-timer.C:
+			}
+			continue
+		}
+
+		if err := c.dispatch(ctx, msg); err != nil {
+			return
+		}
+	}
+}
+
+// stop 停止接受新消息，队列中的消息报告为最终失败
+func (c *ChunkScheduler) stop() {
+	c.mu.Lock()
+	c.stopped = true
+	c.mu.Unlock()
+
+	for _, msg := range c.queue.drain() {
+		reportFailure(msg, msg.Targets, errSchedulerStopped)
+	}
+}
+
+// ready 消息的所有目标设备当前都不需要等待
+func (c *ChunkScheduler) ready(msg *BroadcastMessage) bool {
+	if c.limiter == nil {
+		return true
+	}
+	for _, target := range msg.Targets {
+		if c.limiter.PeerDelay(target) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// dispatch 将消息发送给每个目标设备，失败的目标按 RetryCount 重新排队，ctx 结束时返回错误
+// 每个目标的结果通过 OnResult 回调报告，ctx 结束时未发送的目标报告为最终失败
+func (c *ChunkScheduler) dispatch(ctx context.Context, msg *BroadcastMessage) error {
+	size := 0
+	if c.limiter != nil {
+		if data, err := json.Marshal(msg.Message); err == nil {
+			size = len(data)
+		}
+	}
+
+	giveUp := msg.RetryCount >= c.maxRetries
+	var failed []string
+	for i, target := range msg.Targets {
+		if c.limiter != nil {
+			// 目标设备的限制已由 ready 检查，这里只等待全局令牌
+			if err := c.limiter.wait(ctx, target, size, false); err != nil {
+				// 已失败但等待重试的目标也不会再重试
+				if !giveUp {
+					reportFailure(msg, failed, err)
+				}
+				reportFailure(msg, msg.Targets[i:], err)
+				return err
+			}
+		}
+		if err := c.send(target, msg.Message); err != nil {
+			log.Printf("发送消息到 %s 失败: %v", target, err)
+			failed = append(failed, target)
+			reportDelivery(msg, DeliveryResult{Target: target, Err: err, Final: giveUp})
+			continue
+		}
+		reportDelivery(msg, DeliveryResult{Target: target, Final: true})
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+	if giveUp {
+		log.Printf("消息 %s 重试次数已达上限，放弃发送到 %d 个设备", msg.Message.Type, len(failed))
+		return nil
+	}
+
+	retry := *msg
+	retry.Targets = failed
+	retry.RetryCount++
+	time.AfterFunc(time.Duration(retry.RetryCount)*schedulerRetryDelay, func() { c.Enqueue(&retry) })
+	return nil
+}
+
+// reportFailure 将消息的 targets 报告为最终失败
+func reportFailure(msg *BroadcastMessage, targets []string, err error) {
+	for _, target := range targets {
+		reportDelivery(msg, DeliveryResult{Target: target, Err: err, Final: true})
+	}
+}
+
+// reportDelivery 调用消息的结果回调，回调在调度器的协程中执行，不应阻塞
+func reportDelivery(msg *BroadcastMessage, result DeliveryResult) {
+	if msg.OnResult == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Delivery result callback panic: %v", r)
+		}
+	}()
+	msg.OnResult(result)
+}
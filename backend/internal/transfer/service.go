@@ -3,32 +3,67 @@ package transfer
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"airshare-backend/internal/config"
+	"airshare-backend/internal/security"
 	"airshare-backend/pkg/models"
 )
 
 // Service 文件传输服务
 type Service struct {
 	config        *config.TransferConfig
+	vault          *security.StorageVault // 静态加密，为nil时明文存储
 	transfers      map[string]*models.TransferRequest
 	mutex          sync.RWMutex
 	stopChan       chan struct{}
+	conflictPolicy ConflictPolicy // 接收的文件夹与已有文件同名时的处理方式
+	blobs          *BlobStore     // 普通文件按内容保存，相同内容只保存一份
+	bandwidth      *BandwidthLimiter
+
+	// 接收方确认
+	offerTimers       map[string]*time.Timer
+	offerCallbacks    []OfferCallback
+	decisionCallbacks []DecisionCallback
+	isTrusted         func(deviceID string) bool
+
+	// 传输队列
+	queue           []string // 排队中的传输ID，按开始的顺序
+	running         map[string]*runningTransfer
+	statusCallbacks []StatusCallback
+
+	// 进度事件
+	trackers          map[string]*progressTracker
+	progressCallbacks []ProgressCallback
 }
 
 // NewService 创建新的文件传输服务
-func NewService(cfg *config.TransferConfig) (*Service, error) {
+// vault 不为nil时接收的文件加密存储，下载时透明解密
+func NewService(cfg *config.TransferConfig, vault *security.StorageVault) (*Service, error) {
+	policy, err := ParseConflictPolicy(cfg.ConflictPolicy)
+	if err != nil {
+		return nil, err
+	}
+
 	service := &Service{
-		config:   cfg,
+		config:    cfg,
+		vault:     vault,
 		transfers: make(map[string]*models.TransferRequest),
 		stopChan:  make(chan struct{}),
+		conflictPolicy: policy,
+		bandwidth:      NewBandwidthLimiter(cfg.Bandwidth),
+		offerTimers: make(map[string]*time.Timer),
+		running:     make(map[string]*runningTransfer),
+		trackers:    make(map[string]*progressTracker),
 	}
 
 	// 确保存储目录存在
@@ -36,20 +71,51 @@ func NewService(cfg *config.TransferConfig) (*Service, error) {
 		return nil, fmt.Errorf("创建存储目录失败: %v", err)
 	}
 
+	blobs, err := OpenBlobStore(cfg.StoragePath)
+	if err != nil {
+		return nil, err
+	}
+	service.blobs = blobs
+
 	// 启动清理任务
 	go service.startCleanupTask()
+	go service.startProgressTask()
 
 	return service, nil
 }
 
 // StartTransfer 开始传输
+// 传输请求发送给接收设备确认，满足自动接收规则时直接接收
 func (s *Service) StartTransfer(req *models.TransferRequest) (*models.TransferRequest, error) {
+	if req.ReceiverID == "" {
+		return nil, ErrNoReceiver
+	}
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	// 验证文件大小
+	// 文件夹传输的文件列表以清单为准
+	if req.Manifest != nil {
+		if err := ValidateManifest(req.Manifest); err != nil {
+			return nil, err
+		}
+		req.Files = manifestFiles(req.Manifest)
+	}
+
+	// 验证文件ID、校验和和大小，文件ID用作存储的文件名
 	totalSize := int64(0)
-	for _, file := range req.Files {
+	for i := range req.Files {
+		req.Files[i].Checksum = strings.ToLower(req.Files[i].Checksum)
+		req.Files[i].Deduplicated = false
+		req.Files[i].Received = 0
+		req.Files[i].BytesDone = 0
+		file := req.Files[i]
+		if !validFileID(file.ID) {
+			return nil, fmt.Errorf("%w: 文件ID %q", ErrInvalidFileName, file.ID)
+		}
+		if !ValidChecksum(file.Checksum) {
+			return nil, fmt.Errorf("%w: 文件 %s", ErrInvalidChecksum, file.Name)
+		}
 		totalSize += file.Size
 		if file.Size > s.config.MaxFileSize {
 			return nil, fmt.Errorf("文件 %s 超过最大大小限制", file.Name)
@@ -57,20 +123,33 @@ func (s *Service) StartTransfer(req *models.TransferRequest) (*models.TransferRe
 	}
 
 	// 设置传输信息
+	updateByteCounters(req)
 	req.ID = generateID()
 	req.Status = models.TransferPending
 	req.CreatedAt = time.Now()
 
+	// 文件夹传输先在暂存目录中重建目录结构
+	if req.Manifest != nil {
+		if err := prepareStaging(s.config.StoragePath, req.ID, req.Manifest); err != nil {
+			return nil, err
+		}
+	}
+
 	// 存储传输请求
 	s.transfers[req.ID] = req
 
 	log.Printf("开始传输: %s, 文件数: %d, 总大小: %d", req.ID, len(req.Files), totalSize)
 
+	// 通知在释放锁之后执行
+	notify := s.offer(req)
+	defer notify()
+
 	return req, nil
 }
 
 // GetTransferStatus 获取传输状态
-func (s *Service) GetTransferStatus(transferID string) (*models.TransferRequest, error) {
+// deviceID 为空时不检查查询者身份（未启用认证）
+func (s *Service) GetTransferStatus(transferID, deviceID string) (*models.TransferRequest, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
@@ -78,97 +157,321 @@ func (s *Service) GetTransferStatus(transferID string) (*models.TransferRequest,
 	if !exists {
 		return nil, fmt.Errorf("传输不存在: %s", transferID)
 	}
+	if !isParticipant(transfer, deviceID) {
+		return nil, ErrNotParticipant
+	}
+
+	snapshot := snapshotTransfer(transfer)
+	return &snapshot, nil
+}
 
-	return transfer, nil
+// Bandwidth 带宽限制器，可以在运行时调整限制
+func (s *Service) Bandwidth() *BandwidthLimiter {
+	return s.bandwidth
 }
 
-// UploadFile 上传文件
+// UploadFile 上传文件，reader 提供完整的文件内容
+// 上传中断时保留已写入的完整分片，之后可以通过 ResumeUpload 继续
 func (s *Service) UploadFile(transferID string, fileInfo *models.FileInfo, reader io.Reader) error {
-	s.mutex.Lock()
+	return s.upload(transferID, fileInfo, 0, reader)
+}
+
+// ResumeUpload 从 offset 继续上传中断的文件，offset 必须等于 UploadOffset 返回的值，reader 提供 offset 之后的内容
+func (s *Service) ResumeUpload(transferID string, fileInfo *models.FileInfo, offset int64, reader io.Reader) error {
+	return s.upload(transferID, fileInfo, offset, reader)
+}
+
+// UploadOffset 文件已写入的完整分片的字节数，继续上传时从这里开始
+func (s *Service) UploadOffset(transferID, fileID string) (int64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
 	transfer, exists := s.transfers[transferID]
-	s.mutex.Unlock()
+	if !exists {
+		return 0, fmt.Errorf("传输不存在: %s", transferID)
+	}
+	file := findFile(transfer, fileID)
+	if file == nil {
+		return 0, fmt.Errorf("文件不属于该传输")
+	}
+	return file.Received, nil
+}
 
+// upload 从 offset 开始写入文件，offset 为0时重新上传整个文件
+func (s *Service) upload(transferID string, fileInfo *models.FileInfo, offset int64, reader io.Reader) error {
+	s.mutex.Lock()
+	transfer, exists := s.transfers[transferID]
 	if !exists {
+		s.mutex.Unlock()
 		return fmt.Errorf("传输不存在: %s", transferID)
 	}
+	// 文件的路径、大小和校验和以传输请求中登记的为准
+	fileInfo = findFile(transfer, fileInfo.ID)
+	if fileInfo == nil {
+		s.mutex.Unlock()
+		return fmt.Errorf("文件不属于该传输")
+	}
+	status := transfer.Status
+	ctx := s.uploadContext(transferID)
+	filePath := s.storedPath(transfer, fileInfo)
+	if transfer.Manifest == nil {
+		// 普通文件先写入临时文件，校验通过后存入内容存储
+		filePath = s.blobs.TempPath(transferID + "-" + fileInfo.ID)
+	}
+	s.mutex.Unlock()
 
-	// 创建文件路径
-	filePath := filepath.Join(s.config.StoragePath, fileInfo.ID)
+	if status != models.TransferAccepted && status != models.TransferCompleted {
+		return fmt.Errorf("%w: %s", ErrNotAccepted, status)
+	}
+	if fileInfo.Progress >= 100 {
+		// 接收方已有相同内容或文件已上传过
+		log.Printf("文件 %s 已接收，跳过上传", fileInfo.Name)
+		return nil
+	}
+	if offset != 0 && offset != fileInfo.Received {
+		return fmt.Errorf("%w: 期望 %d, 实际 %d", ErrInvalidOffset, fileInfo.Received, offset)
+	}
+	if transfer.Manifest != nil {
+		if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+			return fmt.Errorf("创建目录失败: %v", err)
+		}
+	}
 
-	// 创建文件
-	file, err := os.Create(filePath)
+	// 创建文件，继续上传时保留已写入的部分
+	flags := os.O_RDWR | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(filePath, flags, 0600)
 	if err != nil {
 		return fmt.Errorf("创建文件失败: %v", err)
 	}
 	defer file.Close()
 
-	// 写入文件
+	// 已写入的部分重新计算校验和，新数据从 offset 开始写入
 	hash := sha256.New()
-	writer := io.MultiWriter(file, hash)
+	if offset > 0 {
+		if _, err := io.CopyN(hash, file, offset); err != nil {
+			file.Close()
+			s.abortUpload(transfer, fileInfo.ID, filePath, 0, nil)
+			return fmt.Errorf("读取已上传的部分失败: %v", err)
+		}
+		if err := file.Truncate(offset); err != nil {
+			return fmt.Errorf("写入文件失败: %v", err)
+		}
+	}
 
-	written, err := io.Copy(writer, reader)
+	// 启用静态加密时写入加密数据，校验和仍然基于明文计算
+	var storageWriter io.WriteCloser = nopWriteCloser{file}
+	if s.vault != nil {
+		storageWriter, err = s.vault.NewWriter(file)
+		if err != nil {
+			os.Remove(filePath)
+			return err
+		}
+	}
+
+	// 写入文件，同时记录进度
+	progress := &progressWriter{transfer: transfer, fileID: fileInfo.ID}
+	s.mutex.Lock()
+	setFileBytes(transfer, fileInfo.ID, offset)
+	s.trackProgress(transferID, progress)
+	s.mutex.Unlock()
+	writer := io.MultiWriter(storageWriter, hash, progress)
+
+	// 按发送设备和全局带宽限制接收，传输暂停或取消时中断
+	written, err := io.Copy(writer, s.bandwidth.Reader(ctx, transfer.SenderID, reader))
+	s.mutex.Lock()
+	s.untrackProgress(transferID, progress)
+	s.mutex.Unlock()
+	if err == nil {
+		err = storageWriter.Close()
+	}
+	received := offset + written
+	if err == nil && received < fileInfo.Size {
+		err = io.ErrUnexpectedEOF
+	}
 	if err != nil {
+		file.Close()
+		// 暂停或取消导致的中断不算失败
+		reason := fmt.Errorf("写入文件失败: %v", err)
+		if ctx.Err() != nil {
+			reason = nil
+		}
+		s.abortUpload(transfer, fileInfo.ID, filePath, received, reason)
 		return fmt.Errorf("写入文件失败: %v", err)
 	}
 
 	// 验证文件大小
-	if written != fileInfo.Size {
-		os.Remove(filePath)
-		return fmt.Errorf("文件大小不匹配: 期望 %d, 实际 %d", fileInfo.Size, written)
+	if received != fileInfo.Size {
+		file.Close()
+		err := fmt.Errorf("文件大小不匹配: 期望 %d, 实际 %d", fileInfo.Size, received)
+		s.abortUpload(transfer, fileInfo.ID, filePath, 0, err)
+		return err
 	}
 
 	// 验证校验和
 	checksum := hex.EncodeToString(hash.Sum(nil))
 	if checksum != fileInfo.Checksum {
-		os.Remove(filePath)
-		return fmt.Errorf("文件校验和不匹配")
+		file.Close()
+		err := fmt.Errorf("文件校验和不匹配")
+		s.abortUpload(transfer, fileInfo.ID, filePath, 0, err)
+		return err
 	}
+	file.Close()
 
 	// 更新传输进度
 	s.mutex.Lock()
+	if transfer.Manifest == nil {
+		if transfer.Status != models.TransferAccepted {
+			s.mutex.Unlock()
+			os.Remove(filePath)
+			return fmt.Errorf("%w: %s", ErrNotAccepted, transfer.Status)
+		}
+		if err := s.blobs.Put(filePath, checksum, transfer.SenderID, transfer.ReceiverID); err != nil {
+			s.mutex.Unlock()
+			return err
+		}
+	}
+	completedBefore := allFilesCompleted(transfer)
+	completedIndex := 0
 	for i, f := range transfer.Files {
 		if f.ID == fileInfo.ID {
 			transfer.Files[i].Progress = 100
+			transfer.Files[i].Received = fileInfo.Size
+			transfer.Files[i].BytesDone = fileInfo.Size
+			completedIndex = i
 			break
 		}
 	}
+	updateByteCounters(transfer)
 
 	// 检查是否所有文件都完成
-	allCompleted := true
-	for _, f := range transfer.Files {
-		if f.Progress < 100 {
-			allCompleted = false
-			break
+	allCompleted := allFilesCompleted(transfer)
+
+	// 只由完成最后一个文件的上传提交文件夹
+	if allCompleted && !completedBefore && transfer.Manifest != nil {
+		// 所有文件接收完成后再整体移动到存储目录，其他设备看不到不完整的文件夹
+		s.mutex.Unlock()
+		savedAs, err := commitFolder(s.config.StoragePath, transfer.ID, transfer.Manifest, s.conflictPolicy)
+		s.mutex.Lock()
+
+		if errors.Is(err, ErrConflictSkipped) {
+			transfer.Status = models.TransferSkipped
+			transfer.Error = fmt.Sprintf("%s 已存在，按冲突策略跳过", savedAs)
+			completed := time.Now()
+			transfer.CompletedAt = &completed
+			s.finishUpload(transfer)
+			log.Printf("文件夹 %s 已存在，跳过接收", savedAs)
+			return nil
 		}
+		if err != nil {
+			transfer.Status = models.TransferFailed
+			transfer.Error = err.Error()
+			// 重试时重新上传最后一个文件以再次提交文件夹
+			transfer.Files[completedIndex].Progress = 0
+			transfer.Files[completedIndex].Received = 0
+			setFileBytes(transfer, fileInfo.ID, 0)
+			s.finishUpload(transfer)
+			return err
+		}
+		transfer.SavedAs = savedAs
+		log.Printf("文件夹接收完成: %s", savedAs)
 	}
 
-	if allCompleted {
+	if !allCompleted {
+		s.mutex.Unlock()
+	} else {
 		transfer.Status = models.TransferCompleted
 		completed := time.Now()
 		transfer.CompletedAt = &completed
+		s.finishUpload(transfer)
 	}
 
+	log.Printf("文件上传完成: %s, 大小: %d", fileInfo.Name, fileInfo.Size)
+	return nil
+}
+
+// finishUpload 传输结束后释放名额并开始排队的传输，调用者需持有锁，返回前释放锁
+func (s *Service) finishUpload(transfer *models.TransferRequest) {
+	changed := append(s.reschedule(), snapshotTransfer(transfer))
+	callbacks := s.statusCallbacks
 	s.mutex.Unlock()
 
-	log.Printf("文件上传完成: %s, 大小: %d", fileInfo.Name, written)
-	return nil
+	notifyStatus(callbacks, changed)
+}
+
+// abortUpload 处理中断或校验失败的上传，保留前 keep 字节中的完整分片，其余数据丢弃
+// reason 不为nil时传输标记为失败，可以通过 Retry 重新排队
+func (s *Service) abortUpload(transfer *models.TransferRequest, fileID, filePath string, keep int64, reason error) {
+	s.mutex.Lock()
+
+	// 静态加密的文件无法从中间继续写入
+	chunkSize := int64(s.config.ChunkSize)
+	if !s.config.EnableResume || s.vault != nil || chunkSize <= 0 {
+		keep = 0
+	} else {
+		keep -= keep % chunkSize
+	}
+	switch transfer.Status {
+	case models.TransferAccepted, models.TransferQueued, models.TransferPaused, models.TransferFailed:
+	default:
+		// 传输已取消或结束
+		keep = 0
+	}
+	if keep > 0 && os.Truncate(filePath, keep) != nil {
+		keep = 0
+	}
+	if keep == 0 {
+		os.Remove(filePath)
+	}
+
+	for i := range transfer.Files {
+		file := &transfer.Files[i]
+		if file.ID == fileID && file.Progress < 100 {
+			file.Received = keep
+			file.Progress = 0
+			if file.Size > 0 {
+				file.Progress = int(keep * 100 / file.Size)
+			}
+			setFileBytes(transfer, fileID, keep)
+		}
+	}
+
+	if reason == nil || transfer.Status != models.TransferAccepted {
+		s.mutex.Unlock()
+		return
+	}
+	transfer.Status = models.TransferFailed
+	transfer.Error = reason.Error()
+	log.Printf("传输 %s 失败，已保留 %d 字节: %v", transfer.ID, keep, reason)
+	s.finishUpload(transfer)
 }
 
-// DownloadFile 下载文件
-func (s *Service) DownloadFile(transferID, fileID string) (io.ReadCloser, *models.FileInfo, error) {
+// ErrFileIncomplete 文件还没有接收完成，不能下载
+var ErrFileIncomplete = errors.New("文件尚未接收完成")
+
+// DownloadFile 下载接收完成的文件
+// deviceID 为请求下载的设备，不为空时只有接收设备可以下载
+func (s *Service) DownloadFile(deviceID, transferID, fileID string) (io.ReadCloser, *models.FileInfo, error) {
 	s.mutex.RLock()
-	transfer, exists := s.transfers[transferID]
-	s.mutex.RUnlock()
+	defer s.mutex.RUnlock()
 
+	transfer, exists := s.transfers[transferID]
 	if !exists {
 		return nil, nil, fmt.Errorf("传输不存在: %s", transferID)
 	}
 
-	// 查找文件信息
+	if deviceID != "" && deviceID != transfer.ReceiverID {
+		return nil, nil, ErrNotParticipant
+	}
+
+	// 查找文件信息，复制一份避免调用方在锁外读取传输记录
 	var fileInfo *models.FileInfo
-	for _, f := range transfer.Files {
-		if f.ID == fileID {
-			fileInfo = &f
+	for i := range transfer.Files {
+		if transfer.Files[i].ID == fileID {
+			file := transfer.Files[i]
+			fileInfo = &file
 			break
 		}
 	}
@@ -177,18 +480,48 @@ func (s *Service) DownloadFile(transferID, fileID string) (io.ReadCloser, *model
 		return nil, nil, fmt.Errorf("文件不存在: %s", fileID)
 	}
 
-	// 打开文件
-	filePath := filepath.Join(s.config.StoragePath, fileID)
-	file, err := os.Open(filePath)
+	if fileInfo.Progress < 100 {
+		return nil, nil, ErrFileIncomplete
+	}
+
+	// 持有锁打开文件，避免与删除传输同时进行
+	file, err := s.openStoredFile(s.storedPath(transfer, fileInfo))
 	if err != nil {
-		return nil, nil, fmt.Errorf("打开文件失败: %v", err)
+		return nil, nil, err
 	}
 
 	return file, fileInfo, nil
 }
 
-// CancelTransfer 取消传输
-func (s *Service) CancelTransfer(transferID string) error {
+// openStoredFile 打开存储的文件，加密文件透明解密
+// 启用静态加密之前接收的明文文件按原样返回
+func (s *Service) openStoredFile(filePath string) (io.ReadCloser, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("打开文件失败: %v", err)
+	}
+
+	if !security.IsEncryptedFile(filePath) {
+		return file, nil
+	}
+
+	if s.vault == nil {
+		file.Close()
+		return nil, security.ErrVaultLocked
+	}
+
+	reader, err := s.vault.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return decryptingReadCloser{Reader: reader, Closer: file}, nil
+}
+
+// CancelTransfer 取消传输，已完成或已取消的传输不能取消
+// deviceID 为空时不检查操作者身份（未启用认证）
+func (s *Service) CancelTransfer(transferID, deviceID string) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -196,14 +529,26 @@ func (s *Service) CancelTransfer(transferID string) error {
 	if !exists {
 		return fmt.Errorf("传输不存在: %s", transferID)
 	}
+	if !isParticipant(transfer, deviceID) {
+		return ErrNotParticipant
+	}
+	if transfer.Status == models.TransferCompleted || transfer.Status == models.TransferCancelled {
+		return fmt.Errorf("%w: %s", ErrInvalidTransition, transfer.Status)
+	}
 
+	if timer, ok := s.offerTimers[transferID]; ok {
+		timer.Stop()
+		delete(s.offerTimers, transferID)
+	}
 	transfer.Status = models.TransferCancelled
 	
 	// 清理文件
-	for _, file := range transfer.Files {
-		filePath := filepath.Join(s.config.StoragePath, file.ID)
-		os.Remove(filePath)
-	}
+	s.removeStoredFiles(transfer)
+
+	// 中断进行中的上传并开始排队的传输
+	changed := s.reschedule()
+	callbacks := s.statusCallbacks
+	defer notifyStatus(callbacks, append(changed, snapshotTransfer(transfer)))
 
 	log.Printf("传输已取消: %s", transferID)
 	return nil
@@ -236,21 +581,157 @@ func (s *Service) cleanupOldTransfers() {
 			delete(s.transfers, id)
 			
 			// 清理文件
-			for _, file := range transfer.Files {
-				filePath := filepath.Join(s.config.StoragePath, file.ID)
-				os.Remove(filePath)
-			}
+			s.removeStoredFiles(transfer)
 			
 			log.Printf("清理传输记录: %s", id)
 		}
 	}
 }
 
+// storedPath 文件的存储位置，调用者需持有锁
+// 普通文件位于内容存储中，以校验和命名；文件夹中的文件接收完成前位于暂存目录，之后位于接收到的文件夹中
+func (s *Service) storedPath(transfer *models.TransferRequest, file *models.FileInfo) string {
+	if transfer.Manifest == nil {
+		return s.blobs.Path(file.Checksum)
+	}
+	if transfer.SavedAs != "" {
+		return filepath.Join(s.config.StoragePath, transfer.SavedAs, filepath.FromSlash(file.Path))
+	}
+	return stagedPath(s.config.StoragePath, transfer.ID, transfer.Manifest, file.Path)
+}
+
+// removeStoredFiles 删除传输接收的文件，调用者需持有锁
+// 普通文件只释放已接收文件的引用，内容没有其他引用时才会删除；中断上传留下的部分数据直接删除
+func (s *Service) removeStoredFiles(transfer *models.TransferRequest) {
+	if transfer.Manifest == nil {
+		for i := range transfer.Files {
+			if transfer.Files[i].Progress < 100 {
+				if transfer.Files[i].Received > 0 {
+					os.Remove(s.blobs.TempPath(transfer.ID + "-" + transfer.Files[i].ID))
+				}
+				transfer.Files[i].Progress = 0
+				transfer.Files[i].Received = 0
+				transfer.Files[i].BytesDone = 0
+				continue
+			}
+			s.blobs.Release(transfer.Files[i].Checksum)
+			transfer.Files[i].Progress = 0
+			transfer.Files[i].Received = 0
+			transfer.Files[i].BytesDone = 0
+			transfer.Files[i].Deduplicated = false
+		}
+		updateByteCounters(transfer)
+		return
+	}
+
+	discardStaging(s.config.StoragePath, transfer.ID)
+	if transfer.SavedAs != "" {
+		os.RemoveAll(filepath.Join(s.config.StoragePath, transfer.SavedAs))
+	}
+}
+
+// allFilesCompleted 检查传输中的文件是否都已接收，调用者需持有锁
+func allFilesCompleted(transfer *models.TransferRequest) bool {
+	for _, f := range transfer.Files {
+		if f.Progress < 100 {
+			return false
+		}
+	}
+	return true
+}
+
+// findFile 按ID查找传输中的文件，调用者需持有锁
+func findFile(transfer *models.TransferRequest, fileID string) *models.FileInfo {
+	for i := range transfer.Files {
+		if transfer.Files[i].ID == fileID {
+			file := transfer.Files[i]
+			return &file
+		}
+	}
+	return nil
+}
+
+// MissingContent 返回 deviceID 作为发送方需要上传的校验和
+// 只有该设备发送或接收过的内容可以去重，其他内容即使接收方已有也返回，不泄露接收方有哪些文件
+func (s *Service) MissingContent(deviceID string, checksums []string) []string {
+	normalized := make([]string, len(checksums))
+	for i, checksum := range checksums {
+		normalized[i] = strings.ToLower(checksum)
+	}
+	return s.blobs.Missing(deviceID, normalized)
+}
+
+// deduplicate 接收方已有相同内容的普通文件直接引用已有内容并标记为已接收，调用者需持有锁
+// 只有发送方发送或接收过的内容才会去重，发送方不能借此探测接收方有哪些文件；所有文件都已存在时传输直接完成
+func (s *Service) deduplicate(transfer *models.TransferRequest) {
+	if transfer.Manifest != nil {
+		return
+	}
+
+	saved := int64(0)
+	for i := range transfer.Files {
+		file := &transfer.Files[i]
+		if !s.blobs.Acquire(file.Checksum, transfer.SenderID, transfer.ReceiverID) {
+			continue
+		}
+		file.Progress = 100
+		file.BytesDone = file.Size
+		file.Deduplicated = true
+		saved += file.Size
+	}
+	updateByteCounters(transfer)
+
+	if saved > 0 {
+		log.Printf("传输 %s 中已有相同内容的文件无需上传，节省 %d 字节", transfer.ID, saved)
+	}
+	if len(transfer.Files) > 0 && allFilesCompleted(transfer) {
+		transfer.Status = models.TransferCompleted
+		completed := time.Now()
+		transfer.CompletedAt = &completed
+	}
+}
+
+// validFileID 检查文件ID能否直接作为存储目录中的文件名
+func validFileID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\`) && len(id) <= maxNameLength
+}
+
+// manifestFiles 根据清单生成文件列表，Path 为文件在文件夹中的相对路径
+func manifestFiles(m *models.FolderManifest) []models.FileInfo {
+	var files []models.FileInfo
+	for _, entry := range m.Entries {
+		if entry.Type != models.EntryFile {
+			continue
+		}
+		files = append(files, models.FileInfo{
+			ID:       entry.FileID,
+			Name:     path.Base(entry.Path),
+			Size:     entry.Size,
+			Path:     entry.Path,
+			Checksum: entry.Checksum,
+		})
+	}
+	return files
+}
+
 // Stop 停止服务
 func (s *Service) Stop() {
 	close(s.stopChan)
 }
 
+// nopWriteCloser 为未加密的文件提供空的Close，文件本身由调用方关闭
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// decryptingReadCloser 读取解密后的数据，关闭时关闭底层文件
+type decryptingReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
 // generateID 生成唯一ID
 func generateID() string {
 	return fmt.Sprintf("%d", time.Now().UnixNano())
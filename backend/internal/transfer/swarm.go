@@ -0,0 +1,821 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// swarmPeerRequests 向每个对等端同时请求的最大分片数
+	swarmPeerRequests = 4
+	// swarmRequestTimeout 请求的分片在该时间内没有送达时改向其他对等端请求
+	swarmRequestTimeout = 10 * time.Second
+	// swarmCheckInterval 检查超时请求的间隔
+	swarmCheckInterval = time.Second
+	// swarmMaxBadChunks 对等端发送的分片校验失败达到该次数后不再向其请求
+	swarmMaxBadChunks = 3
+	// swarmControlPriority 清单、可用性和请求消息的优先级，先于分片发送
+	swarmControlPriority = 2
+)
+
+// SwarmManifest 做种方发给所有接收设备的分发清单
+// 接收设备用清单中每个分片的校验和验证从任何对等端收到的分片
+type SwarmManifest struct {
+	TransferID     string   `json:"transfer_id"`
+	FileName       string   `json:"file_name"`
+	FileSize       int64    `json:"file_size"`
+	ChunkSize      int64    `json:"chunk_size"`
+	FileHash       string   `json:"file_hash"`
+	ChunkChecksums []string `json:"chunk_checksums"` // 每个分片的 SHA-256
+	Peers          []string `json:"peers"`           // 参与分发的接收设备
+}
+
+// ChunkAvailability 本端可以提供的分片
+// Bitfield 为完整的位图（第i位对应分片i，高位在前），Have 为新增的分片，两者都与之前的记录合并，
+// 因此消息的到达顺序不影响结果；Stopped 表示不再提供任何分片
+type ChunkAvailability struct {
+	Bitfield []byte `json:"bitfield,omitempty"`
+	Have     []int  `json:"have,omitempty"`
+	Stopped  bool   `json:"stopped,omitempty"`
+}
+
+// ChunkRequest 向对等端请求分片，对方以 file_chunk 消息回复持有的分片
+type ChunkRequest struct {
+	Indexes []int `json:"indexes"`
+}
+
+// Swarm 多个接收设备之间的分片分发：发送方做种，接收设备把已校验的分片再提供给其他设备，
+// 各设备通过 chunk_availability 交换持有的分片，按最稀有优先向对等端请求缺少的分片
+type Swarm struct {
+	mu       sync.Mutex
+	service  *WebRTCTransferService
+	chunks   *ChunkTransferService
+	manifest SwarmManifest
+	transfer *ChunkTransfer
+	seedID   string // 做种设备ID，做种方为空
+	filePath string // 完整文件的位置：做种方的源文件或接收设备组装完成后的文件
+	serving  bool   // 是否向其他设备提供分片
+	peers    map[string]*swarmPeer
+	requests map[int]*swarmRequest
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+	finished bool
+}
+
+// swarmPeer 对等端持有的分片和对其的请求
+type swarmPeer struct {
+	have    []bool
+	count   int
+	pending int
+	bad     int
+}
+
+// swarmRequest 等待送达的分片请求
+type swarmRequest struct {
+	peerID string
+	at     time.Time
+}
+
+// SwarmStatus 分发的状态
+type SwarmStatus struct {
+	TransferID  string            `json:"transfer_id"`
+	Seeding     bool              `json:"seeding"` // 本端拥有完整文件
+	TotalChunks int               `json:"total_chunks"`
+	ChunksDone  int               `json:"chunks_done"` // 本端已校验的分片数
+	Requests    int               `json:"requests"`    // 等待送达的请求数
+	Peers       []SwarmPeerStatus `json:"peers"`
+}
+
+// SwarmPeerStatus 对等端在分发中的状态
+type SwarmPeerStatus struct {
+	PeerID  string `json:"peer_id"`
+	Seed    bool   `json:"seed"`
+	Chunks  int    `json:"chunks"`  // 对等端持有的分片数
+	Pending int    `json:"pending"` // 向其请求尚未送达的分片数
+}
+
+// SeedSwarm 以本端为种子向多个接收设备分发文件
+// 向每个设备发送分发清单和完整的可用性位图，接收设备之间再互相交换分片
+func (s *WebRTCTransferService) SeedSwarm(peerIDs []string, filePath string) (*Swarm, error) {
+	chunks := s.config.Chunks
+	if chunks == nil {
+		return nil, fmt.Errorf("未配置分片传输服务")
+	}
+
+	transfer, err := chunks.PrepareFileForSending(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := SwarmManifest{
+		TransferID:     transfer.ID,
+		FileName:       transfer.FileName,
+		FileSize:       transfer.FileSize,
+		ChunkSize:      transfer.ChunkSize,
+		FileHash:       transfer.FileHash,
+		ChunkChecksums: make([]string, transfer.TotalChunks),
+		Peers:          uniquePeers(peerIDs),
+	}
+	for i, chunk := range transfer.Chunks {
+		if _, err := chunks.ReadChunkData(filePath, chunk); err != nil {
+			return nil, err
+		}
+		chunk.Status = ChunkVerified
+		manifest.ChunkChecksums[i] = chunk.Checksum
+	}
+	transfer.Status = TransferInProgress
+
+	targets := s.connectedPeers(manifest.Peers)
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("没有可用的接收设备")
+	}
+	msg, err := CreateSwarmManifestMessage(transfer.ID, &manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	sw := s.newSwarm(manifest, transfer, "")
+	sw.filePath = filePath
+	sw.serving = true
+
+	s.mu.Lock()
+	s.swarms[transfer.ID] = sw
+	s.mu.Unlock()
+
+	s.sendSwarmMessage(sw, msg, targets)
+	sw.announce(targets)
+
+	log.Printf("开始分发 %s 到 %d 个设备", transfer.FileName, len(targets))
+	return sw, nil
+}
+
+// SwarmStatus 获取分发的状态
+func (s *WebRTCTransferService) SwarmStatus(transferID string) (*SwarmStatus, error) {
+	sw := s.swarm(transferID)
+	if sw == nil {
+		return nil, fmt.Errorf("传输任务不存在: %s", transferID)
+	}
+	status := sw.Status()
+	return &status, nil
+}
+
+// LeaveSwarm 退出分发，通知对等端不再提供分片
+func (s *WebRTCTransferService) LeaveSwarm(transferID string) error {
+	s.mu.Lock()
+	sw, exists := s.swarms[transferID]
+	delete(s.swarms, transferID)
+	s.mu.Unlock()
+
+	if !exists {
+		return fmt.Errorf("传输任务不存在: %s", transferID)
+	}
+
+	sw.mu.Lock()
+	sw.serving = false
+	sw.mu.Unlock()
+	sw.cancel()
+	sw.announce(s.connectedPeers(sw.members()))
+	return nil
+}
+
+// Status 本端和对等端持有的分片
+func (sw *Swarm) Status() SwarmStatus {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	status := SwarmStatus{
+		TransferID:  sw.manifest.TransferID,
+		Seeding:     sw.filePath != "" && sw.serving,
+		TotalChunks: sw.transfer.TotalChunks,
+		Requests:    len(sw.requests),
+		Peers:       make([]SwarmPeerStatus, 0, len(sw.peers)),
+	}
+	for _, chunk := range sw.transfer.Chunks {
+		if chunk.Status == ChunkVerified {
+			status.ChunksDone++
+		}
+	}
+	for _, peerID := range sw.peerOrder() {
+		peer := sw.peers[peerID]
+		status.Peers = append(status.Peers, SwarmPeerStatus{
+			PeerID:  peerID,
+			Seed:    peerID == sw.seedID,
+			Chunks:  peer.count,
+			Pending: peer.pending,
+		})
+	}
+	return status
+}
+
+// Done 接收设备收到并组装完整个文件后关闭；做种方在所有接收设备都持有全部分片后关闭
+func (sw *Swarm) Done() <-chan struct{} {
+	return sw.done
+}
+
+// newSwarm 创建分发状态
+func (s *WebRTCTransferService) newSwarm(manifest SwarmManifest, transfer *ChunkTransfer, seedID string) *Swarm {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Swarm{
+		service:  s,
+		chunks:   s.config.Chunks,
+		manifest: manifest,
+		transfer: transfer,
+		seedID:   seedID,
+		peers:    make(map[string]*swarmPeer),
+		requests: make(map[int]*swarmRequest),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+}
+
+// swarm 按传输ID查找分发
+func (s *WebRTCTransferService) swarm(transferID string) *Swarm {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.swarms[transferID]
+}
+
+// connectedPeers 已建立连接的对等端
+func (s *WebRTCTransferService) connectedPeers(peerIDs []string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var connected []string
+	for _, peerID := range peerIDs {
+		if _, exists := s.peers[peerID]; exists {
+			connected = append(connected, peerID)
+		}
+	}
+	return connected
+}
+
+// sendSwarmMessage 通过发送队列向对等端发送分发消息，重试后仍无法送达的对等端移出分发
+func (s *WebRTCTransferService) sendSwarmMessage(sw *Swarm, msg *TransferMessage, targets []string) {
+	if len(targets) == 0 {
+		return
+	}
+	broadcast := CreateBroadcastMessage(msg, targets)
+	if msg.Type != MessageTypeFileChunk {
+		broadcast.Priority = swarmControlPriority
+	}
+	broadcast.OnResult = func(result DeliveryResult) {
+		if result.Err != nil && result.Final {
+			sw.removePeer(result.Target)
+		}
+	}
+	s.scheduler.Enqueue(broadcast)
+}
+
+// handleSwarmManifest 接收设备收到分发清单后经 WebRTCConfig.Accept 同意加入分发，
+// 向其他设备通告持有的分片并开始请求
+func (s *WebRTCTransferService) handleSwarmManifest(peerID string, msg TransferMessage) {
+	if s.config.Chunks == nil {
+		log.Printf("未配置分片传输服务，忽略 %s 的分发清单", peerID)
+		return
+	}
+
+	var manifest SwarmManifest
+	if err := msg.ParseMessageData(&manifest); err != nil {
+		log.Printf("解析分发清单失败: %v", err)
+		return
+	}
+	transfer, err := manifestTransfer(&manifest, peerID)
+	if err != nil {
+		log.Printf("无效的分发清单: %v", err)
+		return
+	}
+	if s.swarm(manifest.TransferID) != nil {
+		return
+	}
+
+	offer := IncomingFile{
+		PeerID:     peerID,
+		TransferID: manifest.TransferID,
+		Name:       manifest.FileName,
+		Size:       manifest.FileSize,
+		Swarm:      true,
+	}
+	if s.config.Accept == nil || !s.config.Accept(offer) {
+		log.Printf("拒绝加入 %s 发起的分发: %s", peerID, manifest.FileName)
+		return
+	}
+
+	s.mu.Lock()
+	if _, exists := s.swarms[manifest.TransferID]; exists {
+		s.mu.Unlock()
+		return
+	}
+	sw := s.newSwarm(manifest, transfer, peerID)
+	sw.serving = true
+	s.swarms[manifest.TransferID] = sw
+	s.mu.Unlock()
+
+	sw.mu.Lock()
+	sw.peer(peerID)
+	sw.mu.Unlock()
+
+	log.Printf("加入分发: %s，来自 %s，%d 个分片", manifest.FileName, peerID, transfer.TotalChunks)
+	sw.announce(s.connectedPeers(sw.members()))
+	if transfer.TotalChunks == 0 {
+		go sw.assemble()
+		return
+	}
+	go sw.run()
+}
+
+// handleChunkAvailability 记录对等端持有的分片，并向其请求缺少的分片
+func (s *WebRTCTransferService) handleChunkAvailability(peerID string, msg TransferMessage) {
+	sw := s.swarm(msg.TransferID)
+	if sw == nil || !sw.member(peerID) {
+		return
+	}
+
+	var availability ChunkAvailability
+	if err := msg.ParseMessageData(&availability); err != nil {
+		log.Printf("解析分片可用性失败: %v", err)
+		return
+	}
+
+	sw.mu.Lock()
+	_, known := sw.peers[peerID]
+	peer := sw.peer(peerID)
+	total := sw.transfer.TotalChunks
+	if availability.Stopped {
+		peer.have = make([]bool, total)
+		peer.count = 0
+	}
+	have := availability.Have
+	for i, has := range decodeBitfield(availability.Bitfield, total) {
+		if has {
+			have = append(have, i)
+		}
+	}
+	for _, index := range have {
+		if index >= 0 && index < total && !peer.have[index] {
+			peer.have[index] = true
+			peer.count++
+		}
+	}
+	sw.checkSeeded()
+	sw.mu.Unlock()
+
+	// 新加入的对等端还不知道本端已有的分片
+	if !known {
+		sw.announce([]string{peerID})
+	}
+	sw.requestChunks()
+}
+
+// handleChunkRequest 向请求方发送本端持有的分片，没有的分片忽略，由请求方超时后改向其他设备请求
+func (s *WebRTCTransferService) handleChunkRequest(peerID string, msg TransferMessage) {
+	sw := s.swarm(msg.TransferID)
+	if sw == nil || !sw.member(peerID) {
+		return
+	}
+
+	var request ChunkRequest
+	if err := msg.ParseMessageData(&request); err != nil {
+		log.Printf("解析分片请求失败: %v", err)
+		return
+	}
+
+	for _, index := range request.Indexes {
+		chunk, err := sw.readChunk(index)
+		if err != nil {
+			log.Printf("无法向 %s 提供分片 %d: %v", peerID, index, err)
+			continue
+		}
+		reply, err := CreateFileChunkMessage(msg.TransferID, chunk)
+		if err != nil {
+			log.Printf("创建分片消息失败: %v", err)
+			continue
+		}
+		s.sendSwarmMessage(sw, reply, []string{peerID})
+	}
+}
+
+// run 定期改向其他对等端请求超时的分片，直到收到全部分片
+func (sw *Swarm) run() {
+	ticker := time.NewTicker(swarmCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sw.ctx.Done():
+			return
+		case <-sw.done:
+			return
+		case now := <-ticker.C:
+			sw.mu.Lock()
+			for index, request := range sw.requests {
+				if now.Sub(request.at) >= swarmRequestTimeout {
+					sw.releaseRequest(index)
+				}
+			}
+			sw.mu.Unlock()
+			sw.requestChunks()
+		}
+	}
+}
+
+// handleChunk 校验对等端发来的分片，通过后保存并通告其他设备
+func (sw *Swarm) handleChunk(peerID string, msg TransferMessage) {
+	var data FileChunk
+	if err := msg.ParseMessageData(&data); err != nil {
+		log.Printf("解析分片失败: %v", err)
+		return
+	}
+
+	sw.mu.Lock()
+	if sw.filePath != "" || data.Index < 0 || data.Index >= sw.transfer.TotalChunks {
+		sw.mu.Unlock()
+		return
+	}
+	chunk := sw.transfer.Chunks[data.Index]
+	if chunk.Status == ChunkVerified {
+		sw.releaseRequest(data.Index)
+		sw.mu.Unlock()
+		return
+	}
+	expected := *chunk
+	sw.mu.Unlock()
+
+	// 分发中不协商压缩，分片按清单中的校验和验证
+	var err error
+	if data.Compression != "" && data.Compression != CompressionNone {
+		err = fmt.Errorf("分发中的分片不能压缩")
+	} else {
+		err = sw.chunks.WriteChunkData(sw.transfer.ID, &expected, data.Data)
+	}
+
+	sw.mu.Lock()
+	sw.releaseRequest(data.Index)
+	if err != nil {
+		sw.chunks.MarkChunkFailed(chunk, err)
+		peer := sw.peer(peerID)
+		peer.bad++
+		log.Printf("来自 %s 的分片 %d 无效: %v", peerID, data.Index, err)
+		sw.mu.Unlock()
+		sw.requestChunks()
+		return
+	}
+
+	chunk.Status = ChunkVerified
+	chunk.LastError = ""
+	complete := true
+	for _, c := range sw.transfer.Chunks {
+		if c.Status != ChunkVerified {
+			complete = false
+			break
+		}
+	}
+	sw.mu.Unlock()
+
+	if msg, err := CreateChunkAvailabilityMessage(sw.transfer.ID, &ChunkAvailability{Have: []int{data.Index}}); err == nil {
+		sw.service.sendSwarmMessage(sw, msg, sw.service.connectedPeers(sw.members()))
+	}
+
+	if complete {
+		sw.assemble()
+		return
+	}
+	sw.requestChunks()
+}
+
+// assemble 收到全部分片后组装文件，之后从组装好的文件提供分片
+// 组装失败或按冲突策略跳过时不再提供分片
+func (sw *Swarm) assemble() {
+	sw.mu.Lock()
+	if sw.filePath != "" || sw.finished {
+		sw.mu.Unlock()
+		return
+	}
+	sw.finished = true
+	// 组装时会修改分片状态，使用副本以免与其他设备的请求竞争
+	assembly := *sw.transfer
+	assembly.Chunks = make([]*Chunk, len(sw.transfer.Chunks))
+	for i, chunk := range sw.transfer.Chunks {
+		c := *chunk
+		assembly.Chunks[i] = &c
+	}
+	sw.mu.Unlock()
+
+	path, err := sw.chunks.ReassembleFile(&assembly)
+
+	sw.mu.Lock()
+	sw.transfer.Status = assembly.Status
+	sw.transfer.EndTime = assembly.EndTime
+	if err != nil {
+		if !errors.Is(err, ErrConflictSkipped) {
+			sw.transfer.Status = TransferFailed
+			sw.transfer.Error = err.Error()
+		}
+		sw.serving = false
+		log.Printf("分发 %s 组装文件失败: %v", sw.transfer.ID, err)
+	} else {
+		sw.filePath = path
+		log.Printf("分发 %s 接收完成: %s", sw.transfer.ID, path)
+	}
+	serving := sw.serving
+	sw.mu.Unlock()
+	close(sw.done)
+
+	// 不再提供分片时通知对等端
+	if !serving {
+		sw.announce(sw.service.connectedPeers(sw.members()))
+	}
+}
+
+// requestChunks 按最稀有优先向各对等端请求缺少的分片
+func (sw *Swarm) requestChunks() {
+	sw.mu.Lock()
+	if sw.filePath != "" || sw.finished || sw.ctx.Err() != nil {
+		sw.mu.Unlock()
+		return
+	}
+	plan := sw.schedule(time.Now())
+	sw.mu.Unlock()
+
+	for peerID, indexes := range plan {
+		msg, err := CreateChunkRequestMessage(sw.transfer.ID, &ChunkRequest{Indexes: indexes})
+		if err != nil {
+			log.Printf("创建分片请求失败: %v", err)
+			continue
+		}
+		sw.service.sendSwarmMessage(sw, msg, []string{peerID})
+	}
+}
+
+// schedule 为每个对等端选择要请求的分片，调用者需持有锁
+// 分片按持有的对等端数从少到多选择，数量相同时随机，使各设备优先取得不同的分片后互相交换；
+// 其他接收设备排在种子之前，种子只需提供其他设备都没有的分片
+func (sw *Swarm) schedule(now time.Time) map[string][]int {
+	rarity := make([]int, sw.transfer.TotalChunks)
+	for _, peer := range sw.peers {
+		for i, has := range peer.have {
+			if has {
+				rarity[i]++
+			}
+		}
+	}
+
+	plan := make(map[string][]int)
+	for _, peerID := range sw.peerOrder() {
+		peer := sw.peers[peerID]
+		free := swarmPeerRequests - peer.pending
+		if free <= 0 || peer.bad >= swarmMaxBadChunks {
+			continue
+		}
+
+		var candidates []int
+		for i, chunk := range sw.transfer.Chunks {
+			if peer.have[i] && chunk.Status != ChunkVerified && sw.requests[i] == nil {
+				candidates = append(candidates, i)
+			}
+		}
+		rand.Shuffle(len(candidates), func(a, b int) {
+			candidates[a], candidates[b] = candidates[b], candidates[a]
+		})
+		sort.SliceStable(candidates, func(a, b int) bool {
+			return rarity[candidates[a]] < rarity[candidates[b]]
+		})
+
+		for _, index := range candidates[:min(free, len(candidates))] {
+			sw.requests[index] = &swarmRequest{peerID: peerID, at: now}
+			sw.transfer.Chunks[index].Status = ChunkSending
+			peer.pending++
+			plan[peerID] = append(plan[peerID], index)
+		}
+	}
+	return plan
+}
+
+// peerOrder 其他接收设备按ID排列在前，种子在最后，调用者需持有锁
+func (sw *Swarm) peerOrder() []string {
+	order := make([]string, 0, len(sw.peers))
+	for peerID := range sw.peers {
+		if peerID != sw.seedID {
+			order = append(order, peerID)
+		}
+	}
+	sort.Strings(order)
+	if _, ok := sw.peers[sw.seedID]; ok && sw.seedID != "" {
+		order = append(order, sw.seedID)
+	}
+	return order
+}
+
+// peer 获取对等端的记录，不存在时创建，调用者需持有锁
+func (sw *Swarm) peer(peerID string) *swarmPeer {
+	peer, ok := sw.peers[peerID]
+	if !ok {
+		peer = &swarmPeer{have: make([]bool, sw.transfer.TotalChunks)}
+		sw.peers[peerID] = peer
+	}
+	return peer
+}
+
+// releaseRequest 清除分片的请求，未收到的分片重新等待请求，调用者需持有锁
+func (sw *Swarm) releaseRequest(index int) {
+	request, ok := sw.requests[index]
+	if !ok {
+		return
+	}
+	delete(sw.requests, index)
+	if peer, ok := sw.peers[request.peerID]; ok && peer.pending > 0 {
+		peer.pending--
+	}
+	if chunk := sw.transfer.Chunks[index]; chunk.Status == ChunkSending {
+		chunk.Status = ChunkPending
+	}
+}
+
+// removePeer 对等端无法送达时移出分发，向其请求的分片改向其他设备请求
+func (sw *Swarm) removePeer(peerID string) {
+	sw.mu.Lock()
+	if _, ok := sw.peers[peerID]; !ok {
+		sw.mu.Unlock()
+		return
+	}
+	for index, request := range sw.requests {
+		if request.peerID == peerID {
+			sw.releaseRequest(index)
+		}
+	}
+	delete(sw.peers, peerID)
+	sw.mu.Unlock()
+
+	log.Printf("分发 %s 移除无法送达的设备 %s", sw.transfer.ID, peerID)
+	sw.requestChunks()
+}
+
+// checkSeeded 做种方在所有接收设备都持有全部分片后结束，调用者需持有锁
+func (sw *Swarm) checkSeeded() {
+	if sw.seedID != "" || sw.finished {
+		return
+	}
+	for _, peerID := range sw.manifest.Peers {
+		peer, ok := sw.peers[peerID]
+		if !ok || peer.count < sw.transfer.TotalChunks {
+			return
+		}
+	}
+	sw.finished = true
+	sw.transfer.Status = TransferCompleted
+	sw.transfer.EndTime = time.Now()
+	close(sw.done)
+	log.Printf("分发 %s 完成，%d 个设备已收到全部分片", sw.transfer.ID, len(sw.manifest.Peers))
+}
+
+// announce 向对等端发送本端可以提供的分片的完整位图，不再提供分片时发送 stopped
+func (sw *Swarm) announce(targets []string) {
+	sw.mu.Lock()
+	availability := &ChunkAvailability{Stopped: !sw.serving}
+	if sw.serving {
+		availability.Bitfield = make([]byte, (sw.transfer.TotalChunks+7)/8)
+		for i, chunk := range sw.transfer.Chunks {
+			if chunk.Status == ChunkVerified {
+				availability.Bitfield[i/8] |= 0x80 >> (i % 8)
+			}
+		}
+	}
+	sw.mu.Unlock()
+
+	msg, err := CreateChunkAvailabilityMessage(sw.manifest.TransferID, availability)
+	if err != nil {
+		log.Printf("创建分片可用性消息失败: %v", err)
+		return
+	}
+	sw.service.sendSwarmMessage(sw, msg, targets)
+}
+
+// members 除本端外参与分发的设备：种子和清单中的接收设备
+func (sw *Swarm) members() []string {
+	members := make([]string, 0, len(sw.manifest.Peers)+1)
+	if sw.seedID != "" {
+		members = append(members, sw.seedID)
+	}
+	return append(members, sw.manifest.Peers...)
+}
+
+// member 设备是否参与分发，只接受种子和清单中的接收设备发来的分发消息
+func (sw *Swarm) member(peerID string) bool {
+	for _, id := range sw.members() {
+		if id == peerID {
+			return true
+		}
+	}
+	return false
+}
+
+// readChunk 读取本端持有的已校验分片，组装前从临时分片文件读取，之后从完整文件读取
+func (sw *Swarm) readChunk(index int) (*FileChunk, error) {
+	sw.mu.Lock()
+	if !sw.serving {
+		sw.mu.Unlock()
+		return nil, fmt.Errorf("不再提供分片")
+	}
+	if index < 0 || index >= sw.transfer.TotalChunks || sw.transfer.Chunks[index].Status != ChunkVerified {
+		sw.mu.Unlock()
+		return nil, fmt.Errorf("分片 %d 不可用", index)
+	}
+	chunk := *sw.transfer.Chunks[index]
+	filePath := sw.filePath
+	sw.mu.Unlock()
+
+	var data []byte
+	var err error
+	if filePath != "" {
+		data, err = sw.chunks.ReadChunkData(filePath, &chunk)
+	} else {
+		data, err = sw.chunks.ReadReceivedChunk(sw.transfer.ID, &chunk)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if chunk.Checksum != sw.manifest.ChunkChecksums[index] {
+		return nil, fmt.Errorf("分片 %d 校验失败", index)
+	}
+
+	return &FileChunk{
+		Index:       index,
+		Offset:      chunk.Offset,
+		Size:        chunk.Size,
+		Data:        data,
+		Checksum:    chunk.Checksum,
+		IsLast:      index == sw.transfer.TotalChunks-1,
+		Compression: CompressionNone,
+	}, nil
+}
+
+// manifestTransfer 按分发清单创建接收任务，分片的校验和来自清单
+// 传输ID由种子指定并用作临时目录名，必须是合法的文件名
+func manifestTransfer(manifest *SwarmManifest, seedID string) (*ChunkTransfer, error) {
+	if !validFileID(manifest.TransferID) {
+		return nil, fmt.Errorf("%w: 传输ID %q", ErrInvalidFileName, manifest.TransferID)
+	}
+	if manifest.FileSize < 0 || manifest.ChunkSize <= 0 || manifest.ChunkSize > maxDecodedChunkSize {
+		return nil, fmt.Errorf("无效的文件大小或分片大小")
+	}
+	if !ValidChecksum(manifest.FileHash) {
+		return nil, ErrInvalidChecksum
+	}
+	totalChunks := int((manifest.FileSize + manifest.ChunkSize - 1) / manifest.ChunkSize)
+	if len(manifest.ChunkChecksums) != totalChunks {
+		return nil, fmt.Errorf("分片校验和数量不匹配: 期望 %d, 实际 %d", totalChunks, len(manifest.ChunkChecksums))
+	}
+
+	transfer := &ChunkTransfer{
+		ID:          manifest.TransferID,
+		FileName:    manifest.FileName,
+		FileSize:    manifest.FileSize,
+		ChunkSize:   manifest.ChunkSize,
+		TotalChunks: totalChunks,
+		Chunks:      make([]*Chunk, totalChunks),
+		Status:      TransferInProgress,
+		PeerID:      seedID,
+		StartTime:   time.Now(),
+		FileHash:    manifest.FileHash,
+	}
+	for i := range transfer.Chunks {
+		offset := int64(i) * manifest.ChunkSize
+		transfer.Chunks[i] = &Chunk{
+			Index:    i,
+			Offset:   offset,
+			Size:     min(manifest.ChunkSize, manifest.FileSize-offset),
+			Checksum: manifest.ChunkChecksums[i],
+			Status:   ChunkPending,
+		}
+	}
+	return transfer, nil
+}
+
+// decodeBitfield 将位图解码为每个分片是否可用，位图过短时缺少的部分视为不可用
+func decodeBitfield(bitfield []byte, n int) []bool {
+	have := make([]bool, n)
+	for i := 0; i < n && i/8 < len(bitfield); i++ {
+		have[i] = bitfield[i/8]&(0x80>>(i%8)) != 0
+	}
+	return have
+}
+
+// uniquePeers 去掉重复的设备ID，保持原有顺序
+func uniquePeers(peerIDs []string) []string {
+	seen := make(map[string]bool, len(peerIDs))
+	unique := make([]string, 0, len(peerIDs))
+	for _, peerID := range peerIDs {
+		if !seen[peerID] {
+			seen[peerID] = true
+			unique = append(unique, peerID)
+		}
+	}
+	return unique
+}
@@ -19,6 +19,11 @@ type WebRTCTransferService struct {
 	peers      map[string]*WebRTCPeer
 	signalChan chan SignalMessage
 	config     *WebRTCConfig
+	scheduler  *ChunkScheduler
+	multicasts map[string]*MulticastTransfer
+	swarms     map[string]*Swarm
+	incoming   map[string]*incomingFile // 正在从对等端接收的单个文件
+	router     *MessageRouter // 按对等连接做重放检测后分发消息
 }
 
 // WebRTCPeer 表示一个WebRTC对等连接
@@ -30,6 +35,8 @@ type WebRTCPeer struct {
 	onMessage   func(TransferMessage)
 	onClose     func()
 	mu          sync.RWMutex
+	sequencer   *MessageSequencer // 发往该对等端的消息序列号
+	sendMu      sync.Mutex        // 分配序列号和发送保持同一顺序，避免接收方判为重放
 }
 
 // FileTransfer 表示文件传输任务
@@ -44,6 +51,10 @@ type FileTransfer struct {
 	StartTime    time.Time
 	EndTime      time.Time
 	Error        string
+	Retries      int // 发送失败后重试的次数
+
+	filePath     string         // 发送的源文件，接收方回复后从这里读取差异或分片
+	chunks       *ChunkTransfer // 源文件的分片信息，多播传输中为nil
 }
 
 // TransferStatus 传输状态
@@ -55,6 +66,8 @@ const (
 	TransferCompleted  TransferStatus = "completed"
 	TransferFailed     TransferStatus = "failed"
 	TransferCancelled  TransferStatus = "cancelled"
+	TransferSkipped    TransferStatus = "skipped" // 同名文件已存在，按冲突策略跳过
+	TransferPartial    TransferStatus = "partial" // 多播传输中部分接收设备完成
 )
 
 // TransferDirection 传输方向
@@ -71,6 +84,14 @@ type WebRTCConfig struct {
 	STUNServers []string
 	TURNServers []string
 	DataChannelConfig webrtc.DataChannelInit
+	// Bandwidth 分片发送的带宽限制，为nil时不限速
+	Bandwidth *BandwidthLimiter
+	// MaxRetries 分片发送失败的最大重试次数
+	MaxRetries int
+	// Chunks 收发文件和分发中接收、提供分片使用的服务，为nil时不能接收文件，也不参与分发
+	Chunks *ChunkTransferService
+	// Accept 对等端发来文件元数据或分发清单时决定是否接收，在消息处理协程中调用，不应阻塞；为nil时拒绝所有传入的文件
+	Accept func(file IncomingFile) bool
 }
 
 // 监控指标
@@ -93,16 +114,26 @@ var (
 
 // NewWebRTCTransferService 创建新的WebRTC传输服务
 func NewWebRTCTransferService(config *WebRTCConfig) *WebRTCTransferService {
-	return &WebRTCTransferService{
+	s := &WebRTCTransferService{
 		peers:      make(map[string]*WebRTCPeer),
 		signalChan: make(chan SignalMessage, 100),
 		config:     config,
+		multicasts: make(map[string]*MulticastTransfer),
+		swarms:     make(map[string]*Swarm),
+		incoming:   make(map[string]*incomingFile),
+		router:     NewMessageRouter(),
 	}
+	s.registerHandlers()
+	s.scheduler = NewChunkScheduler(config.Bandwidth, config.MaxRetries, func(peerID string, msg *TransferMessage) error {
+		return s.sendMessage(peerID, *msg)
+	})
+	return s
 }
 
 // Start 启动WebRTC传输服务
 func (s *WebRTCTransferService) Start(ctx context.Context) error {
 	go s.signalProcessor(ctx)
+	go s.scheduler.Run(ctx)
 	log.Println("WebRTC传输服务已启动")
 	return nil
 }
@@ -150,6 +181,7 @@ func (s *WebRTCTransferService) CreateOffer(peerID string) (*webrtc.SessionDescr
 		connection:  peerConnection,
 		datachannel: datachannel,
 		transfers:   make(map[string]*FileTransfer),
+		sequencer:   NewMessageSequencer(""),
 	}
 
 	s.mu.Lock()
@@ -188,6 +220,8 @@ func (s *WebRTCTransferService) AddICECandidate(peerID string, candidate webrtc.
 }
 
 // SendFile 发送文件到指定的对等端
+// 先发送文件元数据，接收方有同名旧版本时回复块签名，本端只发送差异；
+// 否则接收方回复选定的压缩算法，本端发送全部分片
 func (s *WebRTCTransferService) SendFile(peerID string, filePath string, metadata FileMetadata) error {
 	s.mu.RLock()
 	peer, exists := s.peers[peerID]
@@ -196,9 +230,31 @@ func (s *WebRTCTransferService) SendFile(peerID string, filePath string, metadat
 	if !exists {
 		return fmt.Errorf("对等连接不存在: %s", peerID)
 	}
+	if s.config.Chunks == nil {
+		return fmt.Errorf("未配置分片传输服务")
+	}
+
+	chunks, err := s.config.Chunks.PrepareFileForSending(filePath)
+	if err != nil {
+		return err
+	}
 
-	// 创建传输任务
+	// 创建传输任务，元数据中的大小、哈希和分片信息以源文件为准
 	transferID := generateTransferID()
+	chunks.ID = transferID
+	chunks.PeerID = peerID
+	if metadata.Name == "" {
+		metadata.Name = chunks.FileName
+	}
+	metadata.Size = chunks.FileSize
+	metadata.Checksum = chunks.FileHash
+	metadata.Chunks = chunks.TotalChunks
+	metadata.ChunkSize = chunks.ChunkSize
+	if len(metadata.Compressions) == 0 {
+		metadata.Compressions = CompressionOffer(filePath, metadata.Type)
+	}
+	metadata.Compression = ""
+
 	transfer := &FileTransfer{
 		ID:        transferID,
 		FileName:  metadata.Name,
@@ -207,6 +263,8 @@ func (s *WebRTCTransferService) SendFile(peerID string, filePath string, metadat
 		Direction: DirectionSend,
 		PeerID:    peerID,
 		StartTime: time.Now(),
+		filePath:  filePath,
+		chunks:    chunks,
 	}
 
 	peer.mu.Lock()
@@ -214,18 +272,18 @@ func (s *WebRTCTransferService) SendFile(peerID string, filePath string, metadat
 	peer.mu.Unlock()
 
 	// 发送文件元数据
-	metadataBytes, err := json.Marshal(metadata)
+	msg, err := CreateFileMetadataMessage(transferID, &metadata)
 	if err != nil {
-		return fmt.Errorf("序列化metadata失败: %v", err)
-	}
-	msg := TransferMessage{
-		Type:        MessageTypeFileMetadata,
-		TransferID:  transferID,
-		Data:        metadataBytes,
-		Timestamp:   time.Now().Unix(),
+		return err
 	}
 
-	return s.sendMessage(peerID, msg)
+	return s.sendMessage(peerID, *msg)
+}
+
+// QueueChunk 将分片消息加入发送队列，按优先级和带宽限制发送给目标设备
+// 优先级高的消息先发送，未设置时使用 CreateBroadcastMessage 的默认优先级
+func (s *WebRTCTransferService) QueueChunk(msg *BroadcastMessage) {
+	s.scheduler.Enqueue(msg)
 }
 
 // CancelTransfer 取消传输
@@ -246,16 +304,16 @@ func (s *WebRTCTransferService) CancelTransfer(peerID, transferID string) error
 		return fmt.Errorf("传输任务不存在: %s", transferID)
 	}
 
-	if transfer.Status == TransferInProgress {
+	if transfer.Status == TransferPending || transfer.Status == TransferInProgress {
 		transfer.Status = TransferCancelled
 		transfer.EndTime = time.Now()
 	
 		// 发送取消消息
-		msg := TransferMessage{
-			Type:       MessageTypeCancelTransfer,
-			TransferID: transferID,
+		msg, err := CreateCancelTransferMessage(transferID)
+		if err != nil {
+			return err
 		}
-		return s.sendMessage(peerID, msg)
+		return s.sendMessage(peerID, *msg)
 	}
 
 	return nil
@@ -283,23 +341,37 @@ func (s *WebRTCTransferService) setupDataChannelHandlers(dc *webrtc.DataChannel,
 	})
 }
 
+// registerHandlers 注册各类消息的处理函数
+func (s *WebRTCTransferService) registerHandlers() {
+	handlers := map[string]func(peerID string, msg TransferMessage){
+		MessageTypeFileMetadata:      s.handleFileMetadata,
+		MessageTypeFileChunk:         s.handleFileChunk,
+		MessageTypeTransferComplete:  s.handleTransferComplete,
+		MessageTypeCancelTransfer:    s.handleCancelTransfer,
+		MessageTypeBlockSignatures:   s.handleBlockSignatures,
+		MessageTypeFileDelta:         s.handleFileDelta,
+		MessageTypeSwarmManifest:     s.handleSwarmManifest,
+		MessageTypeChunkAvailability: s.handleChunkAvailability,
+		MessageTypeChunkRequest:      s.handleChunkRequest,
+	}
+	for msgType, handler := range handlers {
+		handler := handler
+		s.router.RegisterHandler(msgType, MessageHandlerFunc(func(peerID string, msg *TransferMessage) error {
+			handler(peerID, *msg)
+			return nil
+		}))
+	}
+}
+
 // 处理接收到的消息
+// 数据通道经过DTLS认证且只属于一个对等连接，因此按 peerID 而不是消息中的 SenderID 做重放检测
 func (s *WebRTCTransferService) handleMessage(peerID string, msg TransferMessage) {
-	switch msg.Type {
-	case MessageTypeFileMetadata:
-		s.handleFileMetadata(peerID, msg)
-	case MessageTypeFileChunk:
-		s.handleFileChunk(peerID, msg)
-	case MessageTypeTransferComplete:
-		s.handleTransferComplete(peerID, msg)
-	case MessageTypeCancelTransfer:
-		s.handleCancelTransfer(peerID, msg)
-	default:
-		log.Printf("未知消息类型: %s", msg.Type)
+	if err := s.router.RouteMessage(peerID, &msg); err != nil {
+		log.Printf("丢弃来自 %s 的消息: %v", peerID, err)
 	}
 }
 
-// 发送消息
+// 发送消息，每次发送（包括重发）都分配新的序列号和随机数
 func (s *WebRTCTransferService) sendMessage(peerID string, msg TransferMessage) error {
 	s.mu.RLock()
 	peer, exists := s.peers[peerID]
@@ -309,6 +381,13 @@ func (s *WebRTCTransferService) sendMessage(peerID string, msg TransferMessage)
 		return fmt.Errorf("对等连接不存在: %s", peerID)
 	}
 
+	peer.sendMu.Lock()
+	defer peer.sendMu.Unlock()
+
+	if err := peer.sequencer.Stamp(&msg); err != nil {
+		return err
+	}
+
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return err
@@ -335,19 +414,29 @@ func (s *WebRTCTransferService) logConnectionState(peerID string, state webrtc.P
 	}
 }
 
-// 关闭对等连接
+// 关闭对等连接，放弃从该对等端接收的文件
 func (s *WebRTCTransferService) closePeer(peerID string) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
+	var dropped []*incomingFile
+	for _, in := range s.incoming {
+		if in.peerID == peerID {
+			dropped = append(dropped, in)
+		}
+	}
 	if peer, exists := s.peers[peerID]; exists {
 		if peer.connection != nil {
 			peer.connection.Close()
 		}
 		delete(s.peers, peerID)
+		s.router.ForgetPeer(peerID)
 		activeConnections.Dec()
 		log.Printf("已关闭对等连接: %s", peerID)
 	}
+	s.mu.Unlock()
+
+	for _, in := range dropped {
+		s.closeIncoming(in, TransferFailed)
+	}
 }
 
 // 信号处理器
@@ -373,19 +462,91 @@ func generateTransferID() string {
 	return fmt.Sprintf("transfer_%d", time.Now().UnixNano())
 }
 
-// 辅助方法：处理文件元数据、文件分片等（具体实现略）
+// handleFileMetadata 本端发出的传输收到的是接收方的回复，否则是对等端要发来的文件
 func (s *WebRTCTransferService) handleFileMetadata(peerID string, msg TransferMessage) {
-	// 实现文件元数据处理逻辑
+	var metadata FileMetadata
+	if err := msg.ParseMessageData(&metadata); err != nil {
+		log.Printf("解析文件元数据失败: %v", err)
+		return
+	}
+
+	// 接收方没有旧版本，按其选定的压缩算法发送完整的分片；多播传输不等待回复，忽略
+	if peer, transfer := s.outgoingTransfer(peerID, msg.TransferID); transfer != nil {
+		if transfer.chunks != nil && startOutgoing(peer, transfer) {
+			compression := NegotiateCompression([]Compression{metadata.Compression})
+			go s.sendChunks(peer, transfer, compression)
+		}
+		return
+	}
+	s.receiveFile(peerID, msg.TransferID, metadata)
 }
 
 func (s *WebRTCTransferService) handleFileChunk(peerID string, msg TransferMessage) {
-	// 实现文件分片处理逻辑
+	// 分发中的分片由对应的 Swarm 校验和保存，不参与分发的设备发来的分片忽略
+	if sw := s.swarm(msg.TransferID); sw != nil {
+		if sw.member(peerID) {
+			sw.handleChunk(peerID, msg)
+		}
+		return
+	}
+	if in := s.incomingFrom(peerID, msg.TransferID); in != nil {
+		s.receiveChunk(in, msg)
+	}
 }
 
+// handleTransferComplete 接收方报告的接收结果
+// 发送方发来的完成消息只是通知，接收方收齐数据时已经结束接收
 func (s *WebRTCTransferService) handleTransferComplete(peerID string, msg TransferMessage) {
-	// 实现传输完成处理逻辑
+	peer, transfer := s.outgoingTransfer(peerID, msg.TransferID)
+	if transfer == nil {
+		return
+	}
+
+	var complete TransferComplete
+	if err := msg.ParseMessageData(&complete); err != nil {
+		log.Printf("解析传输完成消息失败: %v", err)
+		return
+	}
+
+	peer.mu.Lock()
+	if transfer.Status != TransferInProgress {
+		peer.mu.Unlock()
+		return
+	}
+	transfer.EndTime = time.Now()
+	if complete.Success {
+		transfer.Status = TransferCompleted
+		transfer.Progress = transfer.FileSize
+	} else {
+		transfer.Status = TransferFailed
+		transfer.Error = complete.Error
+	}
+	status := transfer.Status
+	peer.mu.Unlock()
+
+	transferCounter.WithLabelValues(string(status), string(DirectionSend)).Inc()
+	log.Printf("%s 接收 %s 结束: %s", peerID, transfer.FileName, status)
 }
 
+// handleCancelTransfer 发送方取消时放弃接收，接收方拒绝或取消时停止发送
 func (s *WebRTCTransferService) handleCancelTransfer(peerID string, msg TransferMessage) {
-	// 实现取消传输处理逻辑
+	if in := s.incomingFrom(peerID, msg.TransferID); in != nil {
+		if s.closeIncoming(in, TransferCancelled) {
+			log.Printf("%s 取消了传输 %s", peerID, msg.TransferID)
+		}
+		return
+	}
+
+	peer, transfer := s.outgoingTransfer(peerID, msg.TransferID)
+	if transfer == nil {
+		return
+	}
+
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if transfer.Status == TransferPending || transfer.Status == TransferInProgress {
+		transfer.Status = TransferCancelled
+		transfer.Error = "接收方取消了传输"
+		transfer.EndTime = time.Now()
+	}
 }
\ No newline at end of file
@@ -0,0 +1,523 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// sendWindow 单个文件同时在发送队列中的最大分片数，超过时暂停读取源文件
+const sendWindow = 16
+
+// errTransferStopped 发送过程中传输被取消或已结束
+var errTransferStopped = errors.New("传输已停止")
+
+// IncomingFile 对等端要发给本端的文件，由 WebRTCConfig.Accept 决定是否接收
+type IncomingFile struct {
+	PeerID     string
+	TransferID string
+	Name       string
+	Size       int64
+	Type       string
+	Swarm      bool // 多接收方分发的清单，分片也会来自清单中的其他接收设备
+}
+
+// incomingFile 正在从对等端接收的单个文件
+// 本端有同名旧版本时先回复块签名，发送方可以只发送差异
+type incomingFile struct {
+	mu       sync.Mutex
+	peerID   string
+	transfer *ChunkTransfer
+	delta    *DeltaApplier // 已回复块签名时不为nil
+	chunked  bool          // 已收到分片，不再使用差异
+	done     bool
+}
+
+// receiveFile 校验文件元数据，征得同意后开始接收
+// 计算旧版本的块签名需要读取整个文件，在单独的协程中完成，不阻塞数据通道
+func (s *WebRTCTransferService) receiveFile(peerID, transferID string, metadata FileMetadata) {
+	if s.config.Chunks == nil {
+		log.Printf("未配置分片传输服务，忽略 %s 发来的文件", peerID)
+		return
+	}
+
+	transfer, err := metadataTransfer(transferID, peerID, &metadata)
+	if err != nil {
+		log.Printf("来自 %s 的文件元数据无效: %v", peerID, err)
+		s.rejectFile(peerID, transferID)
+		return
+	}
+
+	offer := IncomingFile{
+		PeerID:     peerID,
+		TransferID: transferID,
+		Name:       metadata.Name,
+		Size:       metadata.Size,
+		Type:       metadata.Type,
+	}
+	if s.config.Accept == nil || !s.config.Accept(offer) {
+		log.Printf("拒绝接收 %s 发来的文件 %s", peerID, metadata.Name)
+		s.rejectFile(peerID, transferID)
+		return
+	}
+
+	in := &incomingFile{peerID: peerID, transfer: transfer}
+	s.mu.Lock()
+	if _, exists := s.incoming[transferID]; exists {
+		s.mu.Unlock()
+		log.Printf("忽略 %s 重复的文件元数据: %s", peerID, transferID)
+		return
+	}
+	s.incoming[transferID] = in
+	s.mu.Unlock()
+
+	log.Printf("开始接收 %s 发来的文件 %s", peerID, metadata.Name)
+	go s.replyMetadata(in, metadata)
+}
+
+// replyMetadata 本端有同名旧版本时回复块签名，否则回复带有选定压缩算法的元数据，由发送方发送全部分片
+func (s *WebRTCTransferService) replyMetadata(in *incomingFile, metadata FileMetadata) {
+	sig, err := s.prepareDelta(in, metadata.Name)
+	if err != nil {
+		log.Printf("不使用 %s 的旧版本: %v", metadata.Name, err)
+	}
+
+	var msg *TransferMessage
+	if sig != nil {
+		msg, err = CreateBlockSignaturesMessage(in.transfer.ID, sig)
+	} else {
+		reply := metadata
+		reply.Compressions = nil
+		reply.Compression = in.transfer.Compression
+		msg, err = CreateFileMetadataMessage(in.transfer.ID, &reply)
+	}
+	if err == nil {
+		err = s.sendMessage(in.peerID, *msg)
+	}
+	if err != nil {
+		s.finishIncoming(in, "", err)
+		return
+	}
+
+	// 空文件没有分片，回复后直接完成
+	if sig == nil && in.transfer.TotalChunks == 0 {
+		in.mu.Lock()
+		path, err := s.config.Chunks.ReassembleFile(in.transfer)
+		in.mu.Unlock()
+		s.finishIncoming(in, path, err)
+	}
+}
+
+// prepareDelta 本端有同名旧版本时计算块签名并准备差异应用器，没有旧版本时返回nil
+func (s *WebRTCTransferService) prepareDelta(in *incomingFile, fileName string) (*FileSignature, error) {
+	chunks := s.config.Chunks
+	basePath, ok := chunks.FindPreviousVersion(fileName)
+	if !ok {
+		return nil, nil
+	}
+	sig, err := chunks.ComputeSignature(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.done || in.chunked {
+		return nil, errTransferStopped
+	}
+	applier, err := chunks.NewDeltaApplier(in.transfer, basePath, sig)
+	if err != nil {
+		return nil, err
+	}
+	in.delta = applier
+	return sig, nil
+}
+
+// handleBlockSignatures 接收方已有旧版本，按其块签名只发送差异
+func (s *WebRTCTransferService) handleBlockSignatures(peerID string, msg TransferMessage) {
+	peer, transfer := s.outgoingTransfer(peerID, msg.TransferID)
+	if transfer == nil || transfer.chunks == nil {
+		return
+	}
+
+	var sig FileSignature
+	if err := msg.ParseMessageData(&sig); err != nil {
+		log.Printf("解析块签名失败: %v", err)
+		return
+	}
+	if !startOutgoing(peer, transfer) {
+		return
+	}
+	go s.sendDelta(peer, transfer, &sig)
+}
+
+// sendDelta 生成并按顺序发送差异，差异消息不经过发送队列，以免重试打乱顺序
+func (s *WebRTCTransferService) sendDelta(peer *WebRTCPeer, transfer *FileTransfer, sig *FileSignature) {
+	chunks := transfer.chunks
+	err := s.config.Chunks.ComputeDelta(chunks, transfer.filePath, sig, func(delta *FileDelta) error {
+		if !outgoingActive(peer, transfer) {
+			return errTransferStopped
+		}
+		msg, err := CreateFileDeltaMessage(transfer.ID, delta)
+		if err != nil {
+			return err
+		}
+		if err := s.sendMessage(peer.ID, *msg); err != nil {
+			return err
+		}
+
+		peer.mu.Lock()
+		transfer.Progress = chunks.LiteralBytes + chunks.CopiedBytes
+		peer.mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		s.failOutgoing(peer, transfer, err)
+		return
+	}
+	log.Printf("差异发送 %s: 字面数据 %d 字节，引用旧版本 %d 字节", transfer.FileName, chunks.LiteralBytes, chunks.CopiedBytes)
+}
+
+// sendChunks 按接收方选定的压缩算法发送全部分片
+// 分片经发送队列按带宽限制发送并重试，重试后仍失败时传输失败；完成由接收方的 transfer_complete 确认
+func (s *WebRTCTransferService) sendChunks(peer *WebRTCPeer, transfer *FileTransfer, compression Compression) {
+	chunks := transfer.chunks
+	chunks.Compression = compression
+	chunks.Status = TransferInProgress
+
+	window := make(chan struct{}, sendWindow)
+	for _, chunk := range chunks.Chunks {
+		window <- struct{}{}
+		if !outgoingActive(peer, transfer) {
+			return
+		}
+
+		data, err := s.config.Chunks.ReadChunkData(transfer.filePath, chunk)
+		if err != nil {
+			s.failOutgoing(peer, transfer, err)
+			return
+		}
+		wire, used, err := s.config.Chunks.EncodeChunk(chunks, data)
+		if err != nil {
+			s.failOutgoing(peer, transfer, err)
+			return
+		}
+		msg, err := CreateFileChunkMessage(transfer.ID, &FileChunk{
+			Index:       chunk.Index,
+			Offset:      chunk.Offset,
+			Size:        chunk.Size,
+			Data:        wire,
+			Checksum:    chunk.Checksum,
+			IsLast:      chunk.Index == chunks.TotalChunks-1,
+			Compression: used,
+		})
+		if err != nil {
+			s.failOutgoing(peer, transfer, err)
+			return
+		}
+
+		size := chunk.Size
+		broadcast := CreateBroadcastMessage(msg, []string{peer.ID})
+		broadcast.OnResult = func(result DeliveryResult) {
+			switch {
+			case result.Err == nil:
+				peer.mu.Lock()
+				transfer.Progress += size
+				peer.mu.Unlock()
+			case result.Final:
+				s.failOutgoing(peer, transfer, result.Err)
+			default:
+				peer.mu.Lock()
+				transfer.Retries++
+				peer.mu.Unlock()
+			}
+			if result.Final {
+				<-window
+			}
+		}
+		s.scheduler.Enqueue(broadcast)
+	}
+}
+
+// receiveChunk 按协商的压缩算法还原分片，校验后保存，收齐后组装文件
+func (s *WebRTCTransferService) receiveChunk(in *incomingFile, msg TransferMessage) {
+	var data FileChunk
+	if err := msg.ParseMessageData(&data); err != nil {
+		s.finishIncoming(in, "", err)
+		return
+	}
+
+	chunks := s.config.Chunks
+	in.mu.Lock()
+	transfer := in.transfer
+	if in.done || data.Index < 0 || data.Index >= transfer.TotalChunks {
+		in.mu.Unlock()
+		return
+	}
+	// 发送方没有使用差异，放弃为差异准备的文件；此时还没有保存任何分片
+	in.chunked = true
+	if in.delta != nil {
+		in.delta.Abort()
+		in.delta = nil
+		transfer.Delta = false
+		transfer.Status = TransferInProgress
+	}
+	chunk := transfer.Chunks[data.Index]
+	if chunk.Status == ChunkReceived {
+		in.mu.Unlock()
+		return
+	}
+
+	var err error
+	if data.Size != chunk.Size || data.Offset != chunk.Offset {
+		err = fmt.Errorf("分片位置不匹配")
+	} else {
+		var raw []byte
+		raw, err = chunks.DecodeChunk(transfer, &data)
+		if err == nil {
+			chunk.Checksum = data.Checksum
+			err = chunks.WriteChunkData(transfer.ID, chunk, raw)
+		}
+	}
+	if err != nil {
+		in.mu.Unlock()
+		s.finishIncoming(in, "", fmt.Errorf("分片 %d 无效: %w", data.Index, err))
+		return
+	}
+
+	for _, c := range transfer.Chunks {
+		if c.Status != ChunkReceived {
+			in.mu.Unlock()
+			return
+		}
+	}
+	path, err := chunks.ReassembleFile(transfer)
+	in.mu.Unlock()
+	s.finishIncoming(in, path, err)
+}
+
+// handleFileDelta 应用发送方发来的差异，最后一批应用后校验并保存新文件
+func (s *WebRTCTransferService) handleFileDelta(peerID string, msg TransferMessage) {
+	in := s.incomingFrom(peerID, msg.TransferID)
+	if in == nil {
+		return
+	}
+
+	var delta FileDelta
+	if err := msg.ParseMessageData(&delta); err != nil {
+		s.finishIncoming(in, "", err)
+		return
+	}
+
+	in.mu.Lock()
+	if in.done || in.delta == nil {
+		in.mu.Unlock()
+		return
+	}
+	path, err := in.delta.Apply(&delta)
+	in.mu.Unlock()
+
+	if err != nil || delta.IsLast {
+		s.finishIncoming(in, path, err)
+	}
+}
+
+// finishIncoming 结束接收并向发送方报告结果，失败时删除已收到的数据
+func (s *WebRTCTransferService) finishIncoming(in *incomingFile, path string, err error) {
+	status := TransferCompleted
+	switch {
+	case errors.Is(err, ErrConflictSkipped):
+		status = TransferSkipped
+	case err != nil:
+		status = TransferFailed
+	}
+	if !s.closeIncoming(in, status) {
+		return
+	}
+
+	transfer := in.transfer
+	elapsed := transfer.EndTime.Sub(transfer.StartTime)
+	complete := &TransferComplete{
+		Success:   status != TransferFailed,
+		TotalTime: elapsed.Milliseconds(),
+	}
+	if elapsed > 0 {
+		complete.AverageSpeed = float64(transfer.FileSize) / elapsed.Seconds()
+	}
+	if err != nil {
+		complete.Error = err.Error()
+		log.Printf("接收 %s 未完成: %v", transfer.FileName, err)
+	} else {
+		log.Printf("接收完成: %s", path)
+	}
+
+	msg, err := CreateTransferCompleteMessage(transfer.ID, complete)
+	if err == nil {
+		err = s.sendMessage(in.peerID, *msg)
+	}
+	if err != nil {
+		log.Printf("向 %s 报告接收结果失败: %v", in.peerID, err)
+	}
+}
+
+// closeIncoming 结束接收并移出接收列表，未成功时删除已收到的数据；已结束时返回false
+func (s *WebRTCTransferService) closeIncoming(in *incomingFile, status TransferStatus) bool {
+	in.mu.Lock()
+	if in.done {
+		in.mu.Unlock()
+		return false
+	}
+	in.done = true
+	if status != TransferCompleted && status != TransferSkipped {
+		if in.delta != nil {
+			in.delta.Abort()
+		}
+		s.config.Chunks.cleanupTempFiles(in.transfer.ID)
+	}
+	in.transfer.Status = status
+	in.transfer.EndTime = time.Now()
+	in.mu.Unlock()
+
+	s.mu.Lock()
+	if s.incoming[in.transfer.ID] == in {
+		delete(s.incoming, in.transfer.ID)
+	}
+	s.mu.Unlock()
+
+	transferCounter.WithLabelValues(string(status), string(DirectionRecv)).Inc()
+	return true
+}
+
+// rejectFile 拒绝对等端发来的文件
+func (s *WebRTCTransferService) rejectFile(peerID, transferID string) {
+	msg, err := CreateCancelTransferMessage(transferID)
+	if err == nil {
+		err = s.sendMessage(peerID, *msg)
+	}
+	if err != nil {
+		log.Printf("通知 %s 拒绝接收失败: %v", peerID, err)
+	}
+}
+
+// incomingFrom 对等端正在发给本端的文件，其他对等端不能操作该传输
+func (s *WebRTCTransferService) incomingFrom(peerID, transferID string) *incomingFile {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	in := s.incoming[transferID]
+	if in == nil || in.peerID != peerID {
+		return nil
+	}
+	return in
+}
+
+// outgoingTransfer 本端发给对等端的传输
+func (s *WebRTCTransferService) outgoingTransfer(peerID, transferID string) (*WebRTCPeer, *FileTransfer) {
+	s.mu.RLock()
+	peer, exists := s.peers[peerID]
+	s.mu.RUnlock()
+	if !exists {
+		return nil, nil
+	}
+
+	peer.mu.RLock()
+	defer peer.mu.RUnlock()
+
+	transfer := peer.transfers[transferID]
+	if transfer == nil || transfer.Direction != DirectionSend {
+		return nil, nil
+	}
+	return peer, transfer
+}
+
+// startOutgoing 接收方回复后开始发送，只有等待回复的传输可以开始
+func startOutgoing(peer *WebRTCPeer, transfer *FileTransfer) bool {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	if transfer.Status != TransferPending {
+		return false
+	}
+	transfer.Status = TransferInProgress
+	return true
+}
+
+// outgoingActive 传输是否仍在发送
+func outgoingActive(peer *WebRTCPeer, transfer *FileTransfer) bool {
+	peer.mu.RLock()
+	defer peer.mu.RUnlock()
+	return transfer.Status == TransferInProgress
+}
+
+// failOutgoing 发送失败，通知接收方放弃已收到的数据；传输已被取消时不做处理
+func (s *WebRTCTransferService) failOutgoing(peer *WebRTCPeer, transfer *FileTransfer, err error) {
+	peer.mu.Lock()
+	if transfer.Status != TransferInProgress {
+		peer.mu.Unlock()
+		return
+	}
+	transfer.Status = TransferFailed
+	transfer.Error = err.Error()
+	transfer.EndTime = time.Now()
+	peer.mu.Unlock()
+
+	transferCounter.WithLabelValues(string(TransferFailed), string(DirectionSend)).Inc()
+	log.Printf("发送 %s 到 %s 失败: %v", transfer.FileName, peer.ID, err)
+
+	if msg, err := CreateCancelTransferMessage(transfer.ID); err == nil {
+		s.sendMessage(peer.ID, *msg)
+	}
+}
+
+// metadataTransfer 按文件元数据创建接收任务
+// 传输ID由对方指定并用作临时目录名，必须是合法的文件名；文件哈希用于校验组装后的文件
+func metadataTransfer(transferID, peerID string, metadata *FileMetadata) (*ChunkTransfer, error) {
+	if !validFileID(transferID) {
+		return nil, fmt.Errorf("%w: 传输ID %q", ErrInvalidFileName, transferID)
+	}
+	if metadata.Size < 0 || metadata.ChunkSize <= 0 || metadata.ChunkSize > maxDecodedChunkSize {
+		return nil, fmt.Errorf("无效的文件大小或分片大小")
+	}
+	totalChunks := int((metadata.Size + metadata.ChunkSize - 1) / metadata.ChunkSize)
+	if metadata.Chunks != totalChunks {
+		return nil, fmt.Errorf("分片数量不匹配: 期望 %d, 实际 %d", totalChunks, metadata.Chunks)
+	}
+	if !ValidChecksum(metadata.Checksum) {
+		return nil, ErrInvalidChecksum
+	}
+
+	// 发送方已选定算法时（如多播传输）必须是本端支持的算法，否则从发送方提供的算法中选择
+	compression := NegotiateCompression(metadata.Compressions)
+	if metadata.Compression != "" {
+		compression = NegotiateCompression([]Compression{metadata.Compression})
+		if compression != metadata.Compression && metadata.Compression != CompressionNone {
+			return nil, fmt.Errorf("不支持的压缩算法: %s", metadata.Compression)
+		}
+	}
+
+	transfer := &ChunkTransfer{
+		ID:          transferID,
+		FileName:    metadata.Name,
+		FileSize:    metadata.Size,
+		ChunkSize:   metadata.ChunkSize,
+		TotalChunks: totalChunks,
+		Chunks:      make([]*Chunk, totalChunks),
+		Status:      TransferInProgress,
+		PeerID:      peerID,
+		StartTime:   time.Now(),
+		FileHash:    metadata.Checksum,
+		Compression: compression,
+	}
+	for i := range transfer.Chunks {
+		offset := int64(i) * metadata.ChunkSize
+		transfer.Chunks[i] = &Chunk{
+			Index:  i,
+			Offset: offset,
+			Size:   min(metadata.ChunkSize, metadata.Size-offset),
+			Status: ChunkPending,
+		}
+	}
+	return transfer, nil
+}
@@ -1,31 +1,158 @@
 package transfer
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"airshare-backend/internal/security"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+// 心跳与超时参数，server.Server 的 /ws 连接使用同样的取值
+const (
+	WSWriteTimeout   = 10 * time.Second // 单次写入的超时
+	WSPongTimeout    = 60 * time.Second // 未收到任何数据（包括pong）的读超时
+	WSPingInterval   = 25 * time.Second // 发送ping的间隔，必须小于WSPongTimeout
+	WSIdleTimeout    = 10 * time.Minute // 没有任何业务消息时断开连接
+	wsSendQueueSize  = 100              // 每个客户端的发送队列长度
+	wsMaxDroppedMsgs = 10               // 连续丢弃的消息超过该数量时断开慢客户端
+)
+
+// 断开原因，用于监控指标，server.Server 的 /ws 连接使用同样的取值
+const (
+	WSEvictIdle         = "idle"
+	WSEvictPongTimeout  = "pong_timeout"
+	WSEvictWriteTimeout = "write_timeout"
+	WSEvictSlowConsumer = "slow_consumer"
+)
+
+// WebSocket监控指标
+var (
+	wsClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "airshare_ws_clients",
+		Help: "Number of connected WebSocket clients",
+	})
+
+	wsEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "airshare_ws_evictions_total",
+		Help: "WebSocket clients disconnected by the server",
+	}, []string{"reason"})
+
+	wsDroppedMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "airshare_ws_dropped_messages_total",
+		Help: "Messages dropped because a client's send queue was full",
+	})
+
+	wsPingRTT = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "airshare_ws_ping_rtt_seconds",
+		Help:    "Round-trip time of WebSocket ping/pong",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+)
+
+// RecordWSConnected 记录WebSocket客户端连接（delta为1）或断开（delta为-1）
+// 其他WebSocket入口通过以下函数与 WebSocketServer 共用同一组监控指标
+func RecordWSConnected(delta float64) {
+	wsClients.Add(delta)
+}
+
+// RecordWSEviction 记录服务端断开客户端的原因
+func RecordWSEviction(reason string) {
+	wsEvictions.WithLabelValues(reason).Inc()
+}
+
+// ObserveWSPingRTT 记录ping/pong的往返时间
+func ObserveWSPingRTT(rtt time.Duration) {
+	wsPingRTT.Observe(rtt.Seconds())
+}
+
+// WSOutbox 连接的有界发送队列，由连接唯一的写协程取出并写入
+// 队列已满时丢弃消息，连续丢弃过多的慢客户端会被断开，发送方从不阻塞
+type WSOutbox struct {
+	queue   chan []byte
+	done    <-chan struct{} // 连接关闭后不再入队
+	evict   func()          // 断开慢客户端
+	dropped atomic.Int32    // 连续丢弃的消息数量
+}
+
+// NewWSOutbox 创建发送队列，done 在连接关闭时关闭，evict 断开连接且可以多次调用
+func NewWSOutbox(done <-chan struct{}, evict func()) *WSOutbox {
+	return &WSOutbox{
+		queue: make(chan []byte, wsSendQueueSize),
+		done:  done,
+		evict: evict,
+	}
+}
+
+// Messages 待写入的消息，只由写协程读取
+func (o *WSOutbox) Messages() <-chan []byte {
+	return o.queue
+}
+
+// Enqueue 非阻塞地将消息放入发送队列
+// 队列已满时丢弃消息，连续丢弃超过 wsMaxDroppedMsgs 条时断开连接
+func (o *WSOutbox) Enqueue(data []byte) {
+	select {
+	case <-o.done:
+		return
+	default:
+	}
+
+	select {
+	case o.queue <- data:
+		o.dropped.Store(0)
+		return
+	default:
+	}
+
+	wsDroppedMessages.Inc()
+	if o.dropped.Add(1) != wsMaxDroppedMsgs+1 {
+		return
+	}
+
+	wsEvictions.WithLabelValues(WSEvictSlowConsumer).Inc()
+	log.Printf("WebSocket连接的发送队列持续阻塞，断开连接")
+	o.evict()
+}
+
 // WebSocketServer 实现WebSocket通信服务
 type WebSocketServer struct {
 	upgrader websocket.Upgrader
-	clients  map[string]*WebSocketClient
+	clients  map[string]*WebSocketClient // 在线的连接
+	sessions *WSSessionStore             // 所有会话，包括断线宽限期内的
 	mu       sync.RWMutex
 	handlers map[string]WSMessageHandler
+	ctx      context.Context    // 服务关闭时取消，所有客户端的上下文都派生自它
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup     // 等待所有客户端协程退出
 }
 
 // WebSocketClient 表示WebSocket客户端连接
+// 读协程负责注销客户端，写协程是连接上唯一的数据写入者；
+// 发送队列从不关闭，连接关闭通过取消 ctx 通知所有协程
 type WebSocketClient struct {
 	ID         string
 	conn       *websocket.Conn
-	sendChan   chan []byte
-	closeChan  chan bool
-	lastActive time.Time
+	outbox     *WSOutbox
+	ctx        context.Context
+	cancel     context.CancelFunc
+	closeOnce  sync.Once
+	writerDone chan struct{} // 写协程退出时关闭
+	session    *WSSession
+	lastActive atomic.Int64  // 最后一次收到业务消息的时间（UnixNano）
+	lastPing   atomic.Int64 // 最后一次发送ping的时间（UnixNano）
 }
 
 // WSMessageHandler WebSocket消息处理器
@@ -37,6 +164,8 @@ type WebSocketMessage struct {
 	Data      map[string]interface{} `json:"data"`
 	Timestamp int64                  `json:"timestamp"`
 	SessionID string                 `json:"session_id,omitempty"`
+	Seq       uint64                 `json:"seq,omitempty"` // 服务端消息的序列号，用于断线重发
+	Ack       uint64                 `json:"ack,omitempty"` // 客户端已收到的最大序列号
 }
 
 // 消息类型常量
@@ -51,22 +180,40 @@ const (
 	WSMessageTypeError       = "error"
 	WSMessageTypeDiscovery   = "discovery"
 	WSMessageTypeDeviceInfo  = "device_info"
+	WSMessageTypeAck         = "ack"
 )
 
 // NewWebSocketServer 创建新的WebSocket服务器
-func NewWebSocketServer() *WebSocketServer {
-	return &WebSocketServer{
+// originPolicy 为允许发起WebSocket握手的来源白名单
+func NewWebSocketServer(originPolicy *security.OriginPolicy) *WebSocketServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &WebSocketServer{
 		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				// 允许所有来源的连接（生产环境应更严格）
-				return true
-			},
+			CheckOrigin:     originPolicy.CheckRequest,
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
 		},
 		clients:  make(map[string]*WebSocketClient),
 		handlers: make(map[string]WSMessageHandler),
+		ctx:      ctx,
+		cancel:   cancel,
 	}
+	s.sessions = NewWSSessionStore(s.sessionExpired)
+	return s
+}
+
+// Close 断开所有客户端并等待其协程退出，之后的连接请求会被拒绝
+func (s *WebSocketServer) Close() {
+	s.cancel()
+
+	s.mu.RLock()
+	for _, client := range s.clients {
+		client.close()
+	}
+	s.mu.RUnlock()
+
+	s.wg.Wait()
+	s.sessions.Close()
 }
 
 // RegisterHandler 注册消息处理器
@@ -78,83 +225,223 @@ func (s *WebSocketServer) RegisterHandler(messageType string, handler WSMessageH
 
 // HandleWebSocket WebSocket连接处理入口
 func (s *WebSocketServer) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if s.ctx.Err() != nil {
+		http.Error(w, "服务已关闭", http.StatusServiceUnavailable)
+		return
+	}
+
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket升级失败: %v", err)
 		return
 	}
 
-	clientID := generateClientID()
+	ctx, cancel := context.WithCancel(s.ctx)
 	client := &WebSocketClient{
-		ID:         clientID,
 		conn:       conn,
-		sendChan:   make(chan []byte, 100),
-		closeChan:  make(chan bool),
-		lastActive: time.Now(),
+		ctx:        ctx,
+		cancel:     cancel,
+		writerDone: make(chan struct{}),
 	}
+	// 读协程随之退出并清理客户端
+	client.outbox = NewWSOutbox(ctx.Done(), client.close)
+	client.touch()
 
-	// 注册客户端
-	s.mu.Lock()
-	s.clients[clientID] = client
-	s.mu.Unlock()
+	// 创建或恢复会话并注册客户端，欢迎消息已在其中入队
+	resumed, err := s.openSession(client, r.URL.Query())
+	if err != nil {
+		log.Printf("建立会话失败: %v", err)
+		client.close()
+		return
+	}
 
-	log.Printf("客户端 %s 已连接", clientID)
+	if !resumed {
+		log.Printf("客户端 %s 已连接", client.ID)
+	}
 
 	// 启动消息处理协程
 	go s.handleClientMessages(client)
 	go s.handleClientSend(client)
+}
+
+// registerClient 注册在线连接，服务已关闭时返回false
+func (s *WebSocketServer) registerClient(client *WebSocketClient) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx.Err() != nil {
+		return false
+	}
+
+	// 恢复会话时新连接替换旧连接
+	if _, exists := s.clients[client.ID]; !exists {
+		wsClients.Inc()
+	}
+	s.clients[client.ID] = client
+	s.wg.Add(2)
+	return true
+}
+
+// openSession 为新连接创建会话，提供有效的恢复令牌时恢复原会话并注册客户端
+// 查询参数：session_id、resume_token、last_seq（客户端收到的最大序列号）
+func (s *WebSocketServer) openSession(client *WebSocketClient, query url.Values) (bool, error) {
+	if id, token := query.Get("session_id"), query.Get("resume_token"); id != "" && token != "" {
+		lastSeq, _ := strconv.ParseUint(query.Get("last_seq"), 10, 64)
+
+		resumed, err := s.sessions.Resume(id, token, "", lastSeq, client, welcomeMessage)
+		if err == nil {
+			RecordWSResume("resumed")
+			client.ID = resumed.Session.ID()
+			client.session = resumed.Session
+			if !s.registerClient(client) {
+				return false, errServerClosed
+			}
 
-	// 发送连接成功消息
-	s.sendWelcomeMessage(client)
+			// 旧连接可能是尚未超时的半开连接
+			if old, ok := resumed.Previous.(*WebSocketClient); ok {
+				old.close()
+			}
+			log.Printf("客户端 %s 已恢复会话，重发 %d 条消息", client.ID, resumed.Replayed)
+			return true, nil
+		}
+		if errors.Is(err, errServerClosed) {
+			return false, err
+		}
+
+		RecordWSResume("rejected")
+		log.Printf("恢复会话 %s 失败: %v，创建新会话", id, err)
+	}
+
+	session, err := s.sessions.Open(generateClientID(), "", client, welcomeMessage)
+	if err != nil {
+		return false, err
+	}
+	client.ID = session.ID()
+	client.session = session
+
+	if !s.registerClient(client) {
+		return false, errServerClosed
+	}
+	return false, nil
 }
 
-// 处理客户端消息
+// 处理客户端消息，读协程退出时负责清理客户端
 func (s *WebSocketServer) handleClientMessages(client *WebSocketClient) {
+	defer s.wg.Done()
 	defer s.cleanupClient(client)
 
+	// 任何数据（包括pong）都会延长读超时，超时未收到数据视为连接已失效
+	client.conn.SetReadDeadline(time.Now().Add(WSPongTimeout))
+	client.conn.SetPongHandler(func(string) error {
+		if sent := client.lastPing.Load(); sent > 0 {
+			wsPingRTT.Observe(time.Since(time.Unix(0, sent)).Seconds())
+		}
+		return client.conn.SetReadDeadline(time.Now().Add(WSPongTimeout))
+	})
+
+	// 连接关闭后ReadJSON立即返回错误，因此无需在循环中检查上下文
 	for {
-		select {
-		case <-client.closeChan:
-			return
-		default:
-			var msg WebSocketMessage
-			err := client.conn.ReadJSON(&msg)
-			if err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					log.Printf("客户端 %s 读取消息错误: %v", client.ID, err)
-				}
-				return
+		var msg WebSocketMessage
+		err := client.conn.ReadJSON(&msg)
+		if err != nil {
+			var netErr net.Error
+			if client.ctx.Err() != nil {
+				// 由服务端主动关闭，原因已在关闭处记录
+			} else if errors.As(err, &netErr) && netErr.Timeout() {
+				wsEvictions.WithLabelValues(WSEvictPongTimeout).Inc()
+				log.Printf("客户端 %s 心跳超时", client.ID)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("客户端 %s 读取消息错误: %v", client.ID, err)
 			}
+			return
+		}
 
-			// 更新最后活跃时间
-			client.lastActive = time.Now()
+		// 更新最后活跃时间和读超时
+		client.touch()
+		client.conn.SetReadDeadline(time.Now().Add(WSPongTimeout))
 
-			// 处理消息
-			s.processMessage(client, msg)
-		}
+		// 处理消息
+		s.processMessage(client, msg)
 	}
 }
 
-// 处理客户端发送消息
+// 处理客户端发送消息，写协程退出时关闭连接以唤醒读协程
 func (s *WebSocketServer) handleClientSend(client *WebSocketClient) {
-	defer s.cleanupClient(client)
+	defer s.wg.Done()
+	defer close(client.writerDone)
+	defer client.close()
+
+	ticker := time.NewTicker(WSPingInterval)
+	defer ticker.Stop()
 
 	for {
 		select {
-		case <-client.closeChan:
+		case <-client.ctx.Done():
 			return
-		case msg := <-client.sendChan:
+		case msg := <-client.outbox.Messages():
+			client.conn.SetWriteDeadline(time.Now().Add(WSWriteTimeout))
 			err := client.conn.WriteMessage(websocket.TextMessage, msg)
 			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					wsEvictions.WithLabelValues(WSEvictWriteTimeout).Inc()
+				}
 				log.Printf("客户端 %s 发送消息错误: %v", client.ID, err)
 				return
 			}
+		case now := <-ticker.C:
+			// 长时间没有业务消息的客户端被断开，心跳本身不算活跃
+			if idle := now.Sub(client.LastActive()); idle > WSIdleTimeout {
+				wsEvictions.WithLabelValues(WSEvictIdle).Inc()
+				log.Printf("客户端 %s 空闲 %v，断开连接", client.ID, idle.Round(time.Second))
+				client.conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, "idle timeout"),
+					time.Now().Add(WSWriteTimeout))
+				return
+			}
+
+			client.lastPing.Store(now.UnixNano())
+			if err := client.conn.WriteControl(websocket.PingMessage, nil, now.Add(WSWriteTimeout)); err != nil {
+				log.Printf("客户端 %s 发送心跳失败: %v", client.ID, err)
+				return
+			}
 		}
 	}
 }
 
+// close 关闭客户端连接，可以从任意协程多次调用
+func (c *WebSocketClient) close() {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.conn.Close()
+	})
+}
+
+// touch 更新客户端最后活跃时间
+func (c *WebSocketClient) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// LastActive 获取客户端最后一次发送业务消息的时间
+func (c *WebSocketClient) LastActive() time.Time {
+	return time.Unix(0, c.lastActive.Load())
+}
+
+// Enqueue 将消息放入客户端的发送队列，实现 WSConn
+func (c *WebSocketClient) Enqueue(data []byte) {
+	c.outbox.Enqueue(data)
+}
+
 // 处理消息
 func (s *WebSocketServer) processMessage(client *WebSocketClient, msg WebSocketMessage) {
+	// 任何消息都可以携带确认，ack 消息只用于确认
+	if msg.Ack > 0 {
+		client.session.Ack(msg.Ack)
+	}
+	if msg.Type == WSMessageTypeAck {
+		return
+	}
+
 	s.mu.RLock()
 	handler, exists := s.handlers[msg.Type]
 	s.mu.RUnlock()
@@ -171,19 +458,21 @@ func (s *WebSocketServer) processMessage(client *WebSocketClient, msg WebSocketM
 	}
 }
 
-// 发送欢迎消息
-func (s *WebSocketServer) sendWelcomeMessage(client *WebSocketClient) {
-	msg := WebSocketMessage{
+// 欢迎消息，携带会话恢复信息
+func welcomeMessage(info WSSessionInfo) ([]byte, error) {
+	return json.Marshal(WebSocketMessage{
 		Type:      "welcome",
 		Timestamp: time.Now().Unix(),
+		SessionID: info.ID,
 		Data: map[string]interface{}{
-			"client_id": client.ID,
-			"message":   "欢迎连接到AirShare文件传输服务",
-			"version":   "1.0.0",
+			"client_id":    info.ID,
+			"resume_token": info.Token,
+			"resumed":      info.Resumed,
+			"last_seq":     info.LastSeq,
+			"message":      "欢迎连接到AirShare文件传输服务",
+			"version":      "1.0.0",
 		},
-	}
-
-	s.sendMessage(client, msg)
+	})
 }
 
 // 发送错误消息
@@ -202,84 +491,77 @@ func (s *WebSocketServer) sendError(client *WebSocketClient, errorCode, message
 
 // 发送消息到客户端
 func (s *WebSocketServer) sendMessage(client *WebSocketClient, msg WebSocketMessage) {
-	data, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("序列化消息失败: %v", err)
-		return
-	}
-
-	select {
-	case client.sendChan <- data:
-		// 消息已排队
-	case <-time.After(5 * time.Second):
-		log.Printf("发送消息到客户端 %s 超时", client.ID)
-	}
+	s.deliver(client.session, msg)
 }
 
-// 广播消息到所有客户端
+// 广播消息到所有会话，断线宽限期内的会话在恢复后收到，不会因为慢客户端阻塞
 func (s *WebSocketServer) Broadcast(msg WebSocketMessage) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	data, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("序列化广播消息失败: %v", err)
-		return
-	}
-
-	for _, client := range s.clients {
-		select {
-		case client.sendChan <- data:
-			// 消息已排队
-		case <-time.After(1 * time.Second):
-			log.Printf("广播消息到客户端 %s 超时", client.ID)
-		}
+	for _, session := range s.sessions.Snapshot() {
+		s.deliver(session, msg)
 	}
 }
 
-// 发送消息到特定客户端
+// 发送消息到特定客户端，客户端断线重连期间消息被缓存
 func (s *WebSocketServer) SendToClient(clientID string, msg WebSocketMessage) error {
-	s.mu.RLock()
-	client, exists := s.clients[clientID]
-	s.mu.RUnlock()
-
-	if !exists {
+	session := s.sessions.Get(clientID)
+	if session == nil {
 		return fmt.Errorf("客户端不存在: %s", clientID)
 	}
 
-	s.sendMessage(client, msg)
+	s.deliver(session, msg)
 	return nil
 }
 
-// 清理客户端资源
-func (s *WebSocketServer) cleanupClient(client *WebSocketClient) {
-	// 关闭连接
-	if client.conn != nil {
-		client.conn.Close()
+// deliver 为消息分配序列号并缓存，会话在线时立即投递
+func (s *WebSocketServer) deliver(session *WSSession, msg WebSocketMessage) {
+	err := session.Send(func(seq uint64) ([]byte, error) {
+		msg.Seq = seq
+		return json.Marshal(msg)
+	})
+	if err != nil && !errors.Is(err, errSessionExpired) {
+		log.Printf("序列化消息失败: %v", err)
 	}
+}
 
-	// 从客户端列表中移除
-	s.mu.Lock()
-	delete(s.clients, client.ID)
-	s.mu.Unlock()
-
-	// 关闭通道
-	close(client.closeChan)
-	close(client.sendChan)
-
-	log.Printf("客户端 %s 已断开连接", client.ID)
+// sessionExpired 会话宽限期内未恢复，广播设备离线
+func (s *WebSocketServer) sessionExpired(session *WSSession) {
+	if s.ctx.Err() != nil {
+		return
+	}
 
-	// 广播设备离线消息
 	s.Broadcast(WebSocketMessage{
 		Type:      WSMessageTypeDisconnect,
 		Timestamp: time.Now().Unix(),
 		Data: map[string]interface{}{
-			"client_id": client.ID,
+			"client_id": session.ID(),
 			"message":   "设备已离线",
 		},
 	})
 }
 
+// 清理客户端资源，只由读协程调用一次
+// 会话在宽限期内保留，过期后才广播设备离线
+func (s *WebSocketServer) cleanupClient(client *WebSocketClient) {
+	client.close()
+	<-client.writerDone
+
+	// 从客户端列表中移除，已恢复会话的新连接不受影响
+	s.mu.Lock()
+	if current, exists := s.clients[client.ID]; exists && current == client {
+		delete(s.clients, client.ID)
+		wsClients.Dec()
+	}
+	s.mu.Unlock()
+
+	log.Printf("客户端 %s 已断开连接", client.ID)
+
+	// 服务关闭时会话随之丢弃
+	if s.ctx.Err() != nil {
+		return
+	}
+	s.sessions.Detach(client.session, client, nil)
+}
+
 // 获取活动客户端列表
 func (s *WebSocketServer) GetActiveClients() []string {
 	s.mu.RLock()
@@ -302,9 +584,12 @@ func (s *WebSocketServer) GetClientInfo(clientID string) (*WebSocketClient, bool
 	return client, exists
 }
 
+// clientSeq 客户端序号，避免同一纳秒内连接的客户端ID冲突
+var clientSeq atomic.Uint64
+
 // 生成客户端ID
 func generateClientID() string {
-	return fmt.Sprintf("client_%d", time.Now().UnixNano())
+	return fmt.Sprintf("client_%d_%d", time.Now().UnixNano(), clientSeq.Add(1))
 }
 
 // 默认消息处理器
@@ -374,15 +659,19 @@ func (s *WebSocketServer) handleDeviceInfo(client *WebSocketClient, msg WebSocke
 
 // 获取在线设备列表
 func (s *WebSocketServer) getOnlineDevices() []map[string]interface{} {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
 	var devices []map[string]interface{}
-	for _, client := range s.clients {
+	for _, session := range s.sessions.Snapshot() {
+		// 断线宽限期内的设备显示为重连中
+		status := "reconnecting"
+		conn, lastActive := session.Status()
+		if client, ok := conn.(*WebSocketClient); ok {
+			status, lastActive = "online", client.LastActive()
+		}
+
 		devices = append(devices, map[string]interface{}{
-			"client_id":   client.ID,
-			"last_active": client.lastActive.Unix(),
-			"status":      "online",
+			"client_id":   session.ID(),
+			"last_active": lastActive.Unix(),
+			"status":      status,
 		})
 	}
 
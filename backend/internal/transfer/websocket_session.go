@@ -0,0 +1,354 @@
+package transfer
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// 会话恢复参数
+const (
+	wsResumeGrace      = 2 * time.Minute // 断线后保留会话的时间
+	wsReplayBufferSize = 64              // 每个会话缓存的未确认消息数量，必须小于发送队列长度
+)
+
+// 会话恢复错误
+var (
+	errSessionExpired = errors.New("会话已过期")
+	errResumeToken    = errors.New("恢复令牌无效")
+	errResumeGap      = errors.New("缓存中缺少需要重发的消息")
+	errSessionOwner   = errors.New("会话不属于当前设备")
+	errServerClosed   = errors.New("WebSocket服务已关闭")
+)
+
+// ErrWSSessionDetached 消息指定的连接已不是会话当前的连接
+var ErrWSSessionDetached = errors.New("连接已不属于该会话")
+
+var wsResumes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "airshare_ws_session_resumes_total",
+	Help: "WebSocket session resume attempts",
+}, []string{"result"})
+
+// RecordWSResume 记录会话恢复的结果：resumed 或 rejected
+func RecordWSResume(result string) {
+	wsResumes.WithLabelValues(result).Inc()
+}
+
+// WSConn 会话当前绑定的连接，消息非阻塞地放入连接的发送队列
+type WSConn interface {
+	Enqueue(data []byte)
+}
+
+// WSSessionInfo 会话信息，连接建立或恢复时最先发给客户端
+type WSSessionInfo struct {
+	ID      string
+	Token   string
+	LastSeq uint64
+	Resumed bool
+}
+
+// WSHello 生成会话信息消息，会话信息不分配序列号也不缓存
+type WSHello func(info WSSessionInfo) ([]byte, error)
+
+// bufferedMessage 已发送但未被确认的消息
+type bufferedMessage struct {
+	seq  uint64
+	data []byte
+}
+
+// WSSession 客户端会话，断线后在宽限期内可以用恢复令牌找回同一身份
+// 已发送但未确认的消息在恢复时重发
+type WSSession struct {
+	id    string
+	token string
+	owner string // 建立会话的设备，恢复时必须一致，未认证时为空
+
+	mu         sync.Mutex
+	conn       WSConn            // 当前连接，断线期间为nil
+	state      any               // 断线时调用者保存的状态，恢复时交还
+	lastSeq    uint64            // 最后分配的序列号
+	buffer     []bufferedMessage // 未确认的消息，序列号连续递增
+	detachedAt time.Time
+	generation uint64 // 每次断线递增，用于识别过时的过期定时器
+	expiry     *time.Timer
+	expired    bool
+}
+
+// WSResumed 恢复会话的结果
+type WSResumed struct {
+	Session  *WSSession
+	Previous WSConn // 被替换的连接，可能是尚未超时的半开连接
+	State    any    // 断线时保存的状态
+	Replayed int    // 重发的消息数
+}
+
+// WSSessionStore 会话和重发缓存，transfer.WebSocketServer 和 server.Server 的 /ws 共用
+type WSSessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*WSSession // 所有会话，包括断线宽限期内的
+	closed   bool
+	onExpire func(session *WSSession)
+}
+
+// NewWSSessionStore 创建会话存储，onExpire 在会话宽限期内未恢复而过期时调用，可以为nil
+func NewWSSessionStore(onExpire func(session *WSSession)) *WSSessionStore {
+	return &WSSessionStore{
+		sessions: make(map[string]*WSSession),
+		onExpire: onExpire,
+	}
+}
+
+// ID 会话ID
+func (session *WSSession) ID() string {
+	return session.id
+}
+
+// Status 会话当前的连接，断线期间连接为nil，detachedAt 为断线的时间
+func (session *WSSession) Status() (conn WSConn, detachedAt time.Time) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.conn, session.detachedAt
+}
+
+// Open 创建会话并绑定连接，会话信息先于其他消息放入连接的发送队列
+// id 为空时随机生成，owner 为建立会话的设备
+func (st *WSSessionStore) Open(id, owner string, conn WSConn, hello WSHello) (*WSSession, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("生成恢复令牌失败: %v", err)
+	}
+	if id == "" {
+		raw := make([]byte, 8)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, fmt.Errorf("生成会话ID失败: %v", err)
+		}
+		id = hex.EncodeToString(raw)
+	}
+
+	session := &WSSession{
+		id:    id,
+		token: hex.EncodeToString(token),
+		owner: owner,
+		conn:  conn,
+	}
+	data, err := hello(WSSessionInfo{ID: session.id, Token: session.token})
+	if err != nil {
+		return nil, err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return nil, errServerClosed
+	}
+	st.sessions[session.id] = session
+	conn.Enqueue(data)
+	return session, nil
+}
+
+// Resume 将连接绑定到已有会话，会话信息和客户端未收到的消息依次放入连接的发送队列
+// 令牌无效、设备不一致、会话已过期或缓存中缺少需要重发的消息时返回错误
+func (st *WSSessionStore) Resume(id, token, owner string, lastSeq uint64, conn WSConn, hello WSHello) (*WSResumed, error) {
+	session := st.Get(id)
+	if session == nil {
+		return nil, errSessionExpired
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.expired {
+		return nil, errSessionExpired
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(session.token)) != 1 {
+		return nil, errResumeToken
+	}
+	// 令牌换了设备时不能接管原设备的会话
+	if session.owner != owner {
+		return nil, errSessionOwner
+	}
+
+	// 缓存中最早的序列号，客户端缺少更早的消息时无法恢复
+	first := session.lastSeq + 1 - uint64(len(session.buffer))
+	if lastSeq > session.lastSeq || lastSeq+1 < first {
+		return nil, errResumeGap
+	}
+
+	data, err := hello(WSSessionInfo{ID: session.id, Token: session.token, LastSeq: session.lastSeq, Resumed: true})
+	if err != nil {
+		return nil, err
+	}
+
+	if session.expiry != nil {
+		session.expiry.Stop()
+	}
+	session.trim(lastSeq)
+
+	resumed := &WSResumed{
+		Session:  session,
+		Previous: session.conn,
+		State:    session.state,
+		Replayed: len(session.buffer),
+	}
+	session.conn = conn
+	session.state = nil
+
+	// 会话信息先于重发的消息入队，写协程按序发送
+	conn.Enqueue(data)
+	for _, msg := range session.buffer {
+		conn.Enqueue(msg.data)
+	}
+	return resumed, nil
+}
+
+// Send 为消息分配序列号并缓存，会话在线时立即放入连接的发送队列
+// 断线期间的消息在恢复后重发；encode 按序列号序列化消息
+func (session *WSSession) Send(encode func(seq uint64) ([]byte, error)) error {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.send(encode)
+}
+
+// SendTo 只在 conn 仍是会话当前的连接时发送，否则返回 ErrWSSessionDetached，
+// 发往旧连接的消息不进入缓存
+func (session *WSSession) SendTo(conn WSConn, encode func(seq uint64) ([]byte, error)) error {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.conn == nil || session.conn != conn {
+		return ErrWSSessionDetached
+	}
+	return session.send(encode)
+}
+
+// send 分配序列号、缓存并入队，持有会话锁入队保证消息按序列号顺序发送，调用者需持有锁
+func (session *WSSession) send(encode func(seq uint64) ([]byte, error)) error {
+	if session.expired {
+		return errSessionExpired
+	}
+
+	seq := session.lastSeq + 1
+	data, err := encode(seq)
+	if err != nil {
+		return err
+	}
+	session.lastSeq = seq
+
+	session.buffer = append(session.buffer, bufferedMessage{seq: seq, data: data})
+	if len(session.buffer) > wsReplayBufferSize {
+		session.buffer = session.buffer[1:]
+	}
+
+	if session.conn != nil {
+		session.conn.Enqueue(data)
+	}
+	return nil
+}
+
+// Ack 删除客户端已确认的缓存消息
+func (session *WSSession) Ack(seq uint64) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.trim(seq)
+}
+
+// trim 删除序列号不大于 seq 的缓存消息，调用者需持有锁
+func (session *WSSession) trim(seq uint64) {
+	i := 0
+	for i < len(session.buffer) && session.buffer[i].seq <= seq {
+		i++
+	}
+	session.buffer = session.buffer[i:]
+}
+
+// Detach 连接断开后保留会话和 state，宽限期内未恢复则过期
+// 会话已被新连接接管时不做任何事
+func (st *WSSessionStore) Detach(session *WSSession, conn WSConn, state any) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.conn != conn {
+		return
+	}
+
+	session.conn = nil
+	session.state = state
+	session.detachedAt = time.Now()
+	session.generation++
+	generation := session.generation
+	session.expiry = time.AfterFunc(wsResumeGrace, func() {
+		st.expire(session, generation)
+	})
+}
+
+// expire 删除宽限期内未恢复的会话
+func (st *WSSessionStore) expire(session *WSSession, generation uint64) {
+	session.mu.Lock()
+	if session.expired || session.conn != nil || session.generation != generation {
+		session.mu.Unlock()
+		return
+	}
+	session.expired = true
+	session.buffer = nil
+	session.state = nil
+	session.mu.Unlock()
+
+	st.mu.Lock()
+	if st.sessions[session.id] == session {
+		delete(st.sessions, session.id)
+	}
+	closed := st.closed
+	st.mu.Unlock()
+
+	log.Printf("会话 %s 已过期", session.id)
+	if !closed && st.onExpire != nil {
+		st.onExpire(session)
+	}
+}
+
+// Close 服务关闭时停止所有过期定时器并丢弃会话，之后不再创建会话
+func (st *WSSessionStore) Close() {
+	st.mu.Lock()
+	st.closed = true
+	sessions := st.sessions
+	st.sessions = make(map[string]*WSSession)
+	st.mu.Unlock()
+
+	for _, session := range sessions {
+		session.mu.Lock()
+		if session.expiry != nil {
+			session.expiry.Stop()
+		}
+		session.expired = true
+		session.buffer = nil
+		session.state = nil
+		session.mu.Unlock()
+	}
+}
+
+// Get 按ID查找会话，不存在或已过期时返回nil
+func (st *WSSessionStore) Get(id string) *WSSession {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.sessions[id]
+}
+
+// Snapshot 复制会话列表，避免投递期间持有存储的锁
+func (st *WSSessionStore) Snapshot() []*WSSession {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sessions := make([]*WSSession, 0, len(st.sessions))
+	for _, session := range st.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
@@ -0,0 +1,163 @@
+package transfer
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeWSConn 记录入队消息的测试连接
+type fakeWSConn struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (c *fakeWSConn) Enqueue(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, string(data))
+}
+
+func (c *fakeWSConn) received() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.messages...)
+}
+
+// testHello 以 hello:<最后序列号> 作为会话信息
+func testHello(info WSSessionInfo) ([]byte, error) {
+	return []byte("hello:" + strconv.FormatUint(info.LastSeq, 10)), nil
+}
+
+// sendN 在会话上发送 n 条以序列号为内容的消息
+func sendN(t *testing.T, session *WSSession, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		err := session.Send(func(seq uint64) ([]byte, error) {
+			return []byte(strconv.FormatUint(seq, 10)), nil
+		})
+		if err != nil {
+			t.Fatalf("发送消息失败: %v", err)
+		}
+	}
+}
+
+func TestWSSessionStoreResume(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   func(session *WSSession) string
+		owner   string
+		lastSeq uint64
+		wantErr error
+		want    []string
+	}{
+		{
+			name:    "replay unacked",
+			lastSeq: 1,
+			want:    []string{"hello:3", "2", "3"},
+		},
+		{
+			name:    "nothing to replay",
+			lastSeq: 3,
+			want:    []string{"hello:3"},
+		},
+		{
+			name:    "wrong token",
+			token:   func(*WSSession) string { return "bad" },
+			wantErr: errResumeToken,
+		},
+		{
+			name:    "other device",
+			owner:   "device-b",
+			wantErr: errSessionOwner,
+		},
+		{
+			name:    "ahead of server",
+			lastSeq: 4,
+			wantErr: errResumeGap,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewWSSessionStore(nil)
+			defer store.Close()
+
+			first := &fakeWSConn{}
+			session, err := store.Open("", "device-a", first, testHello)
+			if err != nil {
+				t.Fatalf("创建会话失败: %v", err)
+			}
+			sendN(t, session, 3)
+			store.Detach(session, first, "room")
+
+			token := session.token
+			if tt.token != nil {
+				token = tt.token(session)
+			}
+			owner := tt.owner
+			if owner == "" {
+				owner = "device-a"
+			}
+
+			second := &fakeWSConn{}
+			resumed, err := store.Resume(session.ID(), token, owner, tt.lastSeq, second, testHello)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("错误 = %v，期望 %v", err, tt.wantErr)
+				}
+				if got := second.received(); len(got) != 0 {
+					t.Fatalf("恢复失败时不应入队消息: %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("恢复会话失败: %v", err)
+			}
+
+			if resumed.Previous != nil || resumed.State != "room" {
+				t.Fatalf("恢复结果 = %+v", resumed)
+			}
+			got := second.received()
+			if len(got) != len(tt.want) {
+				t.Fatalf("入队消息 = %v，期望 %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("入队消息 = %v，期望 %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWSSessionSendToDetachedConn(t *testing.T) {
+	store := NewWSSessionStore(nil)
+	defer store.Close()
+
+	first := &fakeWSConn{}
+	session, err := store.Open("", "", first, testHello)
+	if err != nil {
+		t.Fatalf("创建会话失败: %v", err)
+	}
+
+	second := &fakeWSConn{}
+	if _, err := store.Resume(session.ID(), session.token, "", 0, second, testHello); err != nil {
+		t.Fatalf("恢复会话失败: %v", err)
+	}
+
+	// 被接管的旧连接上的消息不分配序列号也不缓存
+	encode := func(seq uint64) ([]byte, error) {
+		return []byte(strconv.FormatUint(seq, 10)), nil
+	}
+	if err := session.SendTo(first, encode); !errors.Is(err, ErrWSSessionDetached) {
+		t.Fatalf("向旧连接发送 = %v，期望 ErrWSSessionDetached", err)
+	}
+	if err := session.SendTo(second, encode); err != nil {
+		t.Fatalf("向当前连接发送失败: %v", err)
+	}
+	if got := second.received(); len(got) != 2 || got[1] != "1" {
+		t.Fatalf("当前连接收到 %v", got)
+	}
+}
@@ -0,0 +1,230 @@
+package transfer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"airshare-backend/internal/security"
+	"github.com/gorilla/websocket"
+)
+
+// newTestWebSocketServer 启动使用 WebSocketServer 的测试HTTP服务，返回ws地址
+func newTestWebSocketServer(t *testing.T) (*WebSocketServer, string) {
+	t.Helper()
+
+	ws := NewWebSocketServer(security.NewOriginPolicy([]string{"*"}))
+	ws.registerDefaultHandlers()
+
+	httpServer := httptest.NewServer(http.HandlerFunc(ws.HandleWebSocket))
+	t.Cleanup(func() {
+		ws.Close()
+		httpServer.Close()
+	})
+
+	return ws, "ws" + strings.TrimPrefix(httpServer.URL, "http")
+}
+
+// dialWelcome 连接服务并读取欢迎消息
+func dialWelcome(t *testing.T, wsURL string) (*websocket.Conn, WebSocketMessage) {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("连接失败: %v", err)
+	}
+
+	var welcome WebSocketMessage
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&welcome); err != nil {
+		conn.Close()
+		t.Fatalf("读取欢迎消息失败: %v", err)
+	}
+	if welcome.Type != "welcome" {
+		conn.Close()
+		t.Fatalf("第一条消息类型为 %q，期望 welcome", welcome.Type)
+	}
+	return conn, welcome
+}
+
+// waitFor 等待条件成立
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待超时: %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebSocketServerConcurrentDialClose(t *testing.T) {
+	ws, wsURL := newTestWebSocketServer(t)
+
+	const clients = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+
+			// 一半的客户端在收到消息前直接断开，另一半先交换消息
+			if i%2 == 0 {
+				return
+			}
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var msg WebSocketMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				errs <- err
+				return
+			}
+			if err := conn.WriteJSON(WebSocketMessage{Type: WSMessageTypePing}); err != nil {
+				errs <- err
+				return
+			}
+			for msg.Type != WSMessageTypePong {
+				if err := conn.ReadJSON(&msg); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	// 客户端连接和断开的同时广播，发送和清理不能互相干扰
+	stop := make(chan struct{})
+	broadcastDone := make(chan struct{})
+	go func() {
+		defer close(broadcastDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				ws.Broadcast(WebSocketMessage{Type: WSMessageTypeProgress, Timestamp: time.Now().Unix()})
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(stop)
+	<-broadcastDone
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("客户端出错: %v", err)
+	}
+
+	waitFor(t, "所有客户端断开", func() bool {
+		return len(ws.GetActiveClients()) == 0
+	})
+}
+
+func TestWebSocketServerCloseWithConnectedClients(t *testing.T) {
+	ws, wsURL := newTestWebSocketServer(t)
+
+	var conns []*websocket.Conn
+	for i := 0; i < 10; i++ {
+		conn, _ := dialWelcome(t, wsURL)
+		conns = append(conns, conn)
+	}
+	waitFor(t, "所有客户端注册", func() bool {
+		return len(ws.GetActiveClients()) == len(conns)
+	})
+
+	// Close 等待所有客户端协程退出，连续调用也不能panic
+	done := make(chan struct{})
+	go func() {
+		ws.Close()
+		ws.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("关闭服务超时")
+	}
+
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				break
+			}
+		}
+		conn.Close()
+	}
+
+	if _, _, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil {
+		t.Fatal("服务关闭后仍然接受连接")
+	}
+}
+
+func TestWebSocketServerResumeSession(t *testing.T) {
+	ws, wsURL := newTestWebSocketServer(t)
+
+	conn, welcome := dialWelcome(t, wsURL)
+	clientID, _ := welcome.Data["client_id"].(string)
+	token, _ := welcome.Data["resume_token"].(string)
+
+	if err := ws.SendToClient(clientID, WebSocketMessage{Type: WSMessageTypeProgress}); err != nil {
+		t.Fatalf("发送消息失败: %v", err)
+	}
+	var msg WebSocketMessage
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&msg); err != nil || msg.Seq != 1 {
+		t.Fatalf("读取消息失败: %v, seq=%d", err, msg.Seq)
+	}
+	conn.Close()
+
+	waitFor(t, "客户端断开", func() bool {
+		return len(ws.GetActiveClients()) == 0
+	})
+
+	// 断线期间发送的消息在恢复后重发
+	if err := ws.SendToClient(clientID, WebSocketMessage{Type: WSMessageTypeProgress}); err != nil {
+		t.Fatalf("断线期间发送消息失败: %v", err)
+	}
+
+	query := url.Values{
+		"session_id":   {clientID},
+		"resume_token": {token},
+		"last_seq":     {"1"},
+	}
+	resumed, welcome := dialWelcome(t, wsURL+"?"+query.Encode())
+	defer resumed.Close()
+
+	if welcome.Data["resumed"] != true || welcome.Data["client_id"] != clientID {
+		t.Fatalf("会话未恢复: %v", welcome.Data)
+	}
+	if err := resumed.ReadJSON(&msg); err != nil || msg.Seq != 2 {
+		t.Fatalf("未重发断线期间的消息: %v, seq=%d", err, msg.Seq)
+	}
+
+	// 错误的恢复令牌创建新会话
+	query.Set("resume_token", strings.Repeat("0", len(token)))
+	other, welcome := dialWelcome(t, wsURL+"?"+query.Encode())
+	defer other.Close()
+
+	if welcome.Data["resumed"] == true || welcome.Data["client_id"] == clientID {
+		t.Fatalf("无效的恢复令牌恢复了会话: %v", welcome.Data)
+	}
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -48,7 +49,14 @@ type TransferRequest struct {
 	SenderID    string        `json:"sender_id"`
 	ReceiverID  string        `json:"receiver_id"`
 	Files       []FileInfo    `json:"files"`
+	Manifest    *FolderManifest `json:"manifest,omitempty"` // 文件夹传输的清单，普通文件传输为nil
+	SavedAs     string        `json:"saved_as,omitempty"` // 文件夹接收完成后在存储目录中的名称
+	Decision    *TransferDecision `json:"decision,omitempty"` // 接收方的决定
+	ExpiresAt   *time.Time    `json:"expires_at,omitempty"` // 等待接收方确认的截止时间
 	Status      TransferStatus `json:"status"`
+	QueuePosition int         `json:"queue_position,omitempty"` // 排队中的传输在队列中的位置，从1开始
+	BytesDone   int64         `json:"bytes_done"`  // 已接收的字节数，包括上传中的部分
+	BytesTotal  int64         `json:"bytes_total"` // 所有文件的总字节数
 	CreatedAt   time.Time     `json:"created_at"`
 	StartedAt   *time.Time    `json:"started_at,omitempty"`
 	CompletedAt *time.Time    `json:"completed_at,omitempty"`
@@ -66,6 +74,49 @@ type FileInfo struct {
 	ChunkSize   int    `json:"chunk_size"`
 	TotalChunks int    `json:"total_chunks"`
 	Progress    int    `json:"progress"` // 0-100
+	// Deduplicated 接收方已有相同内容，无需上传
+	Deduplicated bool `json:"deduplicated,omitempty"`
+	// Received 已写入的完整分片的字节数，中断的上传从这里继续
+	Received int64 `json:"received,omitempty"`
+	// BytesDone 已接收的字节数，包括上传中的部分
+	BytesDone int64 `json:"bytes_done"`
+}
+
+// SymlinkPolicy 文件夹中符号链接的处理方式
+type SymlinkPolicy string
+
+const (
+	SymlinkSkip     SymlinkPolicy = "skip"     // 忽略符号链接（默认）
+	SymlinkFollow   SymlinkPolicy = "follow"   // 发送链接指向的内容
+	SymlinkPreserve SymlinkPolicy = "preserve" // 保留链接，只允许指向文件夹内部的相对链接
+)
+
+// ManifestEntryType 清单条目类型
+type ManifestEntryType string
+
+const (
+	EntryFile    ManifestEntryType = "file"
+	EntryDir     ManifestEntryType = "dir"
+	EntrySymlink ManifestEntryType = "symlink"
+)
+
+// FolderManifest 文件夹传输清单，描述完整的目录结构
+type FolderManifest struct {
+	Root          string          `json:"root"` // 文件夹名称，接收方在存储目录中以此名称创建
+	SymlinkPolicy SymlinkPolicy   `json:"symlink_policy"`
+	Entries       []ManifestEntry `json:"entries"`
+}
+
+// ManifestEntry 清单条目，路径相对于文件夹根目录，使用 / 分隔
+type ManifestEntry struct {
+	Path     string            `json:"path"`
+	Type     ManifestEntryType `json:"type"`
+	Size     int64             `json:"size,omitempty"`
+	Mode     uint32            `json:"mode,omitempty"` // 权限位，如 0644
+	ModTime  time.Time         `json:"mtime"`
+	Checksum string            `json:"checksum,omitempty"` // 文件的SHA-256
+	FileID   string            `json:"file_id,omitempty"`  // 对应 TransferRequest.Files 中的文件ID
+	Target   string            `json:"target,omitempty"`   // 符号链接的目标
 }
 
 // TransferStatus 传输状态
@@ -78,14 +129,100 @@ const (
 	TransferCompleted TransferStatus = "completed"
 	TransferFailed    TransferStatus = "failed"
 	TransferCancelled TransferStatus = "cancelled"
+	TransferAccepted  TransferStatus = "accepted" // 接收方已同意，可以上传文件
+	TransferRejected  TransferStatus = "rejected" // 接收方拒绝或确认超时
+	TransferSkipped   TransferStatus = "skipped"  // 同名文件夹已存在，按冲突策略跳过
+	TransferQueued    TransferStatus = "queued"   // 接收方已同意，等待空闲的传输名额
+	TransferPaused    TransferStatus = "paused"   // 已暂停，已接收的数据保留
+)
+
+// 接收方的决定
+const (
+	DecisionAccept = "accept"
+	DecisionReject = "reject"
+
+	// DecisionReasonTimeout 接收方未在规定时间内确认
+	DecisionReasonTimeout = "timeout"
+	// DecisionReasonAutoAccept 满足自动接收规则
+	DecisionReasonAutoAccept = "auto_accept"
 )
 
+// TransferDecision 接收方对传输请求的决定
+type TransferDecision struct {
+	TransferID string    `json:"transfer_id"`
+	Action     string    `json:"action"`             // accept 或 reject
+	FileIDs    []string  `json:"file_ids,omitempty"` // 只接收其中的文件，为空表示全部接收
+	Reason     string    `json:"reason,omitempty"`
+	Auto       bool      `json:"auto,omitempty"` // 由自动接收规则决定
+	DecidedAt  time.Time `json:"decided_at"`
+}
+
+// 传输队列操作
+const (
+	QueueActionPause  = "pause"
+	QueueActionResume = "resume"
+	QueueActionRetry  = "retry"
+	QueueActionMove   = "move"
+)
+
+// TransferControl 暂停、恢复、重试传输或调整其在队列中的位置
+type TransferControl struct {
+	TransferID string `json:"transfer_id"`
+	Action     string `json:"action"`             // pause、resume、retry 或 move
+	Position   int    `json:"position,omitempty"` // move 的目标位置，从1开始
+}
+
+// TransferQueue 传输队列，Queued 按将要开始的顺序排列
+type TransferQueue struct {
+	MaxConcurrent int               `json:"max_concurrent"`
+	Active        []TransferRequest `json:"active"`
+	Queued        []TransferRequest `json:"queued"`
+	Paused        []TransferRequest `json:"paused"`
+}
+
+// TransferProgressEvent 传输进度事件，传输进行中按 transfer.progress_interval 定期发送
+type TransferProgressEvent struct {
+	TransferID   string         `json:"transfer_id"`
+	SenderID     string         `json:"sender_id"`
+	ReceiverID   string         `json:"receiver_id"`
+	Status       TransferStatus `json:"status"`
+	BytesDone    int64          `json:"bytes_done"`
+	BytesTotal   int64          `json:"bytes_total"`
+	Speed        float64        `json:"speed"`                  // 平滑后的速度，字节/秒
+	ETA          float64        `json:"eta_seconds"`            // 预计剩余秒数，速度为0时为-1
+	CurrentFile  string         `json:"current_file,omitempty"` // 最近接收数据的文件ID
+	CurrentChunk int            `json:"current_chunk"`          // 该文件正在接收的分片序号，从0开始
+	Files        []FileProgress `json:"files"`
+	Timestamp    time.Time      `json:"timestamp"`
+}
+
+// FileProgress 单个文件的进度
+type FileProgress struct {
+	FileID      string `json:"file_id"`
+	Name        string `json:"name"`
+	BytesDone   int64  `json:"bytes_done"`
+	BytesTotal  int64  `json:"bytes_total"`
+	ChunksDone  int    `json:"chunks_done"`
+	TotalChunks int    `json:"total_chunks"`
+}
+
 // WebSocketMessage WebSocket消息
 type WebSocketMessage struct {
 	Type    string      `json:"type"`
 	Data    interface{} `json:"data,omitempty"`
 	Error   string      `json:"error,omitempty"`
 	Target  string      `json:"target,omitempty"` // 目标设备ID
+	Source  string      `json:"source,omitempty"` // 转发消息的来源设备ID
+	Seq     uint64      `json:"seq,omitempty"`    // 服务端消息的序列号，用于断线重发
+	Ack     uint64      `json:"ack,omitempty"`    // 客户端已收到的最大序列号
+}
+
+// WebSocketSession 连接建立时服务端发送的会话信息，断线后用于恢复会话
+type WebSocketSession struct {
+	SessionID   string `json:"session_id"`
+	ResumeToken string `json:"resume_token"`
+	Resumed     bool   `json:"resumed"`
+	LastSeq     uint64 `json:"last_seq"` // 会话中最后一条消息的序列号
 }
 
 // MessageType 消息类型
@@ -98,8 +235,79 @@ const (
 	MessageTypeProgress     = "progress"
 	MessageTypeError        = "error"
 	MessageTypeKeepAlive    = "keep_alive"
+	MessageTypeSession      = "session" // 会话信息，连接建立或恢复后首先发送
+	MessageTypeAck          = "ack"     // 客户端确认收到的消息，任何消息都可以携带 ack 字段
+
+	// 设备配对消息
+	MessageTypePairRequest  = "pair_request"
+	MessageTypePairResponse = "pair_response"
+	MessageTypePairConfirm  = "pair_confirm"
+	MessageTypePairComplete = "pair_complete"
+
+	// 设备身份和公钥变化消息
+	MessageTypeDeviceIdentity = "device_identity"
+	MessageTypeKeyChanged     = "key_changed"
+
+	// 房间消息
+	MessageTypeRoomCreate      = "room_create"
+	MessageTypeRoomJoin        = "room_join"
+	MessageTypeRoomJoinRequest = "room_join_request"
+	MessageTypeRoomApprove     = "room_approve"
+	MessageTypeRoomKick        = "room_kick"
+	MessageTypeRoomLeave       = "room_leave"
+	MessageTypeRoomUpdate      = "room_update"
+	MessageTypeRoomKicked      = "room_kicked"
+	MessageTypeRoomClosed      = "room_closed"
+	MessageTypeSignal          = "signal"
+
+	// 传输确认消息
+	MessageTypeTransferOffer    = "transfer_offer"
+	MessageTypeTransferDecision = "transfer_decision"
+
+	// 传输队列消息
+	MessageTypeTransferControl = "transfer_control"
+	MessageTypeTransferStatus  = "transfer_status"
+	MessageTypeTransferQueue   = "transfer_queue"
+
+	// 传输进度消息
+	MessageTypeTransferProgress = "transfer_progress"
+
+	// 文本片段和剪贴板消息
+	MessageTypeText          = "text"
+	MessageTypeClipboard     = "clipboard"
+	MessageTypeTextDelivered = "text_delivered"
+	MessageTypeTextHistory   = "text_history"
+)
+
+// 文本消息支持的MIME类型
+const (
+	MIMETextPlain = "text/plain"
+	MIMEURIList   = "text/uri-list"
+	MIMEImagePNG  = "image/png"
 )
 
+// TextPayload 文本片段或剪贴板内容
+type TextPayload struct {
+	ID            string          `json:"id,omitempty"`
+	Kind          string          `json:"kind,omitempty"`           // text 或 clipboard
+	MIME          string          `json:"mime"`                     // text/plain、text/uri-list 或 image/png
+	Content       string          `json:"content,omitempty"`        // 明文内容，image/png为base64编码
+	ServerEncrypt bool            `json:"server_encrypt,omitempty"` // 要求本节点用接收设备的公钥加密后转发，本节点可见明文，不是端到端加密
+	Encrypted     json.RawMessage `json:"encrypted,omitempty"`      // 加密后的内容（security.EncryptedMessage），客户端自行加密时为端到端加密
+	Size          int             `json:"size"`                     // 明文字节数
+	From          string          `json:"from,omitempty"`
+	To            string          `json:"to,omitempty"`
+	RoomID        string          `json:"room_id,omitempty"`
+	SentAt        time.Time       `json:"sent_at"`
+}
+
+// DeviceIdentity 设备身份声明，用于首次使用即信任的公钥固定
+type DeviceIdentity struct {
+	DeviceID   string `json:"device_id"`
+	DeviceName string `json:"device_name"`
+	PublicKey  string `json:"public_key"` // PEM格式公钥
+}
+
 // APIResponse API响应
 type APIResponse struct {
 	Success bool        `json:"success"`
@@ -114,11 +322,24 @@ type ConnectRequest struct {
 	Device DeviceInfo `json:"device"`
 }
 
-// RoomInfo 房间信息
+// RoomInfo 房间信息，ID即加入房间使用的短码
 type RoomInfo struct {
 	ID        string      `json:"id"`
 	HostID    string      `json:"host_id"`
 	Devices   []DeviceInfo `json:"devices"`
+	Pending   []DeviceInfo `json:"pending,omitempty"` // 等待房主批准的设备
 	CreatedAt time.Time   `json:"created_at"`
 	ExpiresAt time.Time   `json:"expires_at"`
+}
+
+// CreateRoomRequest 创建房间请求
+type CreateRoomRequest struct {
+	Device     DeviceInfo `json:"device"`
+	TTLSeconds int        `json:"ttl_seconds,omitempty"` // 有效期，不超过服务端配置
+}
+
+// RoomMemberAction 房主对成员的操作（批准或移出）
+type RoomMemberAction struct {
+	RoomID   string `json:"room_id"`
+	DeviceID string `json:"device_id"`
 }
\ No newline at end of file